@@ -99,6 +99,8 @@ function App() {
     logout: vaultLogout,
     loginToServer,
     registerOnServer,
+    deleteServerItem,
+    serverFetch,
     syncVault,
     connectionMode,
     serverUrl,
@@ -182,12 +184,9 @@ function App() {
     if (connectionMode !== "server" || !serverUrl || !authToken) return;
 
     try {
-      await fetch(`${serverUrl}/api/preferences`, {
+      await serverFetch("/api/preferences", {
         method: "PUT",
-        headers: {
-          "Content-Type": "application/json",
-          "Authorization": `Bearer ${authToken}`,
-        },
+        headers: { "Content-Type": "application/json" },
         body: JSON.stringify({
           theme: partial.theme ?? preferences.theme,
           accentColor: partial.accentColor ?? preferences.accentColor,
@@ -259,9 +258,7 @@ function App() {
         
     } else if (lastEvent.type === 'prefs_updated') {
       console.log('[SSE] Received prefs_updated. Fetching preferences...');
-      fetch(`${serverUrl}/api/preferences`, {
-        headers: { "Authorization": `Bearer ${authToken}` }
-      })
+      serverFetch("/api/preferences")
         .then(res => res.json())
         .then(data => loadFromVault(data))
         .catch(err => console.error('Failed to fetch preferences:', err));
@@ -696,18 +693,7 @@ function App() {
 
     try {
       if (connectionMode === "server" && serverUrl && authToken) {
-        const cleanUrl = (url: string) => url.replace(/\/$/, "");
-        const markerResp = await fetch(`${cleanUrl(serverUrl)}/vault/items`, {
-          method: "PUT",
-          headers: {
-            "Content-Type": "application/json",
-            Authorization: `Bearer ${authToken}`,
-          },
-          body: JSON.stringify([{ id: passwordId, encrypted_blob: "", revision: 0 }]),
-        });
-        if (!markerResp.ok) {
-          throw new Error(`Server delete marker failed (${markerResp.status})`);
-        }
+        await deleteServerItem(passwordId);
       }
 
       await deletePassword(passwordId);
@@ -2,6 +2,7 @@ import { useState, useCallback, useRef } from "react";
 import { readFile, writeFile } from "@tauri-apps/plugin-fs";
 import { VaultEntry, VaultData, VaultSettings, FolderNode, loadVault, createVault } from "@guardian/core/crypto/vault";
 import { deriveKey } from "@guardian/core/crypto/argon2";
+import { type PreloginResponse, deriveLoginSecrets, deriveRegistrationSecrets } from "@guardian/core/crypto/auth";
 import { encrypt, decrypt, generateNonce } from "@guardian/core/crypto/chacha20";
 
 interface UseVaultReturn {
@@ -27,6 +28,8 @@ interface UseVaultReturn {
   loginToServer: (url: string, username: string, password: string) => Promise<VaultData>;
   registerOnServer: (url: string, data: any) => Promise<void>;
   syncVault: () => Promise<VaultData>;
+  deleteServerItem: (id: string) => Promise<void>;
+  serverFetch: (path: string, init?: RequestInit) => Promise<Response>;
 }
 
 interface VaultItem {
@@ -67,6 +70,15 @@ export function useVault(): UseVaultReturn {
   const serverKeyRef = useRef<Uint8Array | null>(null);
   const serverUrlRef = useRef<string | null>(null);
   const authTokenRef = useRef<string | null>(null);
+  // Access tokens are short-lived; the refresh token renews them and is
+  // replaced by the server on every use, so only one refresh runs at a time.
+  const refreshTokenRef = useRef<string | null>(null);
+  const refreshingRef = useRef<Promise<string | null> | null>(null);
+  // The server only accepts a change made on top of an item's current
+  // revision: remember the last revision seen per item, and the plaintext
+  // it had, so saves send the right base and skip unchanged items.
+  const revisionsRef = useRef<Record<string, number>>({});
+  const syncedRef = useRef<Record<string, string>>({});
   const [username, setUsername] = useState<string | null>(null);
 
   const [isLoading, setIsLoading] = useState(false);
@@ -137,10 +149,11 @@ export function useVault(): UseVaultReturn {
   async function decryptItemsFromServer(
     items: VaultItem[],
     key: Uint8Array,
-  ): Promise<{ entries: VaultEntry[]; settings: VaultSettings | undefined; folders: FolderNode[] | undefined; successCount: number }> {
+  ): Promise<{ entries: VaultEntry[]; settings: VaultSettings | undefined; folders: FolderNode[] | undefined; plaintexts: Record<string, string>; successCount: number }> {
     const entries: VaultEntry[] = [];
     let settings: VaultSettings | undefined;
     let folders: FolderNode[] | undefined;
+    const plaintexts: Record<string, string> = {};
     let successCount = 0;
 
     for (const item of items) {
@@ -160,15 +173,64 @@ export function useVault(): UseVaultReturn {
         } else {
           entries.push(JSON.parse(jsonStr));
         }
+        plaintexts[item.id] = jsonStr;
         successCount++;
       } catch {
         // skip
       }
     }
 
-    return { entries, settings, folders, successCount };
+    return { entries, settings, folders, plaintexts, successCount };
   }
 
+  // Record what the server holds after a full fetch.
+  const rememberServerState = (items: VaultItem[], plaintexts: Record<string, string>) => {
+    const revisions: Record<string, number> = {};
+    for (const item of items) {
+      revisions[item.id] = item.revision;
+    }
+    revisionsRef.current = revisions;
+    syncedRef.current = { ...plaintexts };
+  };
+
+  const refreshAccessToken = async (): Promise<string | null> => {
+    const refreshToken = refreshTokenRef.current;
+    if (!serverUrlRef.current || !refreshToken) return null;
+    try {
+      const resp = await fetch(`${serverUrlRef.current}/auth/refresh`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refresh_token: refreshToken })
+      });
+      if (!resp.ok) return null;
+      const data = await resp.json();
+      refreshTokenRef.current = data.refresh_token;
+      authTokenRef.current = data.token;
+      setAuthToken(data.token);
+      return data.token;
+    } catch {
+      return null;
+    }
+  };
+
+  // Fetch an API path with the access token, renewing it once on a 401.
+  const serverFetch = async (path: string, init: RequestInit = {}): Promise<Response> => {
+    if (!serverUrlRef.current || !authTokenRef.current) throw new Error("Not connected to server");
+    const send = (token: string) => {
+      const headers = new Headers(init.headers);
+      headers.set("Authorization", `Bearer ${token}`);
+      return fetch(`${serverUrlRef.current}${path}`, { ...init, headers });
+    };
+
+    const resp = await send(authTokenRef.current);
+    if (resp.status !== 401) return resp;
+    if (!refreshingRef.current) {
+      refreshingRef.current = refreshAccessToken().finally(() => { refreshingRef.current = null; });
+    }
+    const token = await refreshingRef.current;
+    return token ? send(token) : resp;
+  };
+
   const loginToServer = useCallback(async (url: string, username: string, password: string): Promise<VaultData> => {
     setIsLoading(true);
     setError(null);
@@ -177,11 +239,23 @@ export function useVault(): UseVaultReturn {
     setConnectionMode("server");
 
     try {
-      // 1. Auth with Server
+      // 1. Derive the master key and auth hash; the password never leaves the device
+      const preResp = await fetch(`${url}/auth/prelogin`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ username })
+      });
+      if (!preResp.ok) {
+        throw new Error("Authentication failed");
+      }
+      const prelogin: PreloginResponse = await preResp.json();
+      const { masterKey, credentials } = await deriveLoginSecrets(password, prelogin);
+
+      // 2. Auth with Server
       const resp = await fetch(`${url}/auth/login`, {
         method: "POST",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ username, password })
+        body: JSON.stringify({ username, ...credentials })
       });
 
       if (!resp.ok) {
@@ -198,23 +272,15 @@ export function useVault(): UseVaultReturn {
         throw new Error("Invalid server response (not JSON)");
       }
       const token = data.token;
-      const saltBase64: string | undefined = data.salt;
       setAuthToken(token);
       authTokenRef.current = token;
+      refreshTokenRef.current = data.refresh_token ?? null;
       setServerUrl(url);
       serverUrlRef.current = url;
       setUsername(username);
 
-      // 2. Derive Key — use server-provided salt, fall back to legacy username hash
-      if (!saltBase64) {
-        throw new Error("Server did not return a salt. Update your server.");
-      }
-      const saltBytes = Uint8Array.from(atob(saltBase64), c => c.charCodeAt(0));
-
       // 3. Fetch Items
-      const itemsResp = await fetch(`${url}/vault/items`, {
-        headers: { "Authorization": `Bearer ${token}` }
-      });
+      const itemsResp = await serverFetch("/vault/items");
 
       if (!itemsResp.ok) throw new Error("Failed to fetch vault items");
 
@@ -225,8 +291,8 @@ export function useVault(): UseVaultReturn {
       loginDebug.itemsFetched = items.length;
       (window as any).__vaultDebug = loginDebug;
 
-      // 4. Try new salted key first
-      let key = await deriveKey(password, saltBytes);
+      // 4. Try the master key first
+      let key = masterKey;
       let decryptResult = await decryptItemsFromServer(items, key);
       let usedLegacyFallback = false;
 
@@ -256,28 +322,27 @@ export function useVault(): UseVaultReturn {
       di.chosenEntries = decryptResult.entries.length;
       di.step = di.step + '|before-return';
       serverKeyRef.current = key;
+      rememberServerState(items, decryptResult.plaintexts);
 
       // If legacy fallback was used, re-encrypt everything with the new salted key and save
       if (usedLegacyFallback) {
-        const newKey = await deriveKey(password, saltBytes);
-        serverKeyRef.current = newKey;
+        serverKeyRef.current = masterKey;
         // Re-encrypt and push all items back to server with new key
-        await saveToServer(decryptResult.entries, decryptResult.settings, decryptResult.folders);
+        await saveToServer(decryptResult.entries, decryptResult.settings, decryptResult.folders, true);
         console.log("[useVault] Migrated vault to per-user random salt key derivation");
       }
 
       // Clean up junk items with invalid encrypted blobs
-      const shortBlobIds = items
-        .filter(i => {
-          const raw = Uint8Array.from(atob(i.encrypted_blob), c => c.charCodeAt(0));
-          return raw.length < 28;
-        })
-        .map(i => i.id);
+      const shortBlobs = items.filter(i => {
+        const raw = Uint8Array.from(atob(i.encrypted_blob), c => c.charCodeAt(0));
+        return raw.length < 28;
+      });
+      const shortBlobIds = shortBlobs.map(i => i.id);
       if (shortBlobIds.length > 0) {
-        const cleanupResp = await fetch(`${url}/vault/items`, {
+        const cleanupResp = await serverFetch("/vault/items", {
           method: "PUT",
-          headers: { "Content-Type": "application/json", "Authorization": `Bearer ${token}` },
-          body: JSON.stringify(shortBlobIds.map(id => ({ id, encrypted_blob: "", revision: 0 }))),
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify(shortBlobs.map(i => ({ id: i.id, encrypted_blob: "", revision: i.revision }))),
         }).catch(() => null);
         console.log(`[useVault] Removed ${shortBlobIds.length} junk items from server`, cleanupResp?.ok ? "OK" : "FAILED", shortBlobIds);
       }
@@ -285,9 +350,7 @@ export function useVault(): UseVaultReturn {
       // 5. Fetch Preferences (Web Sync)
       let remotePrefs: Partial<VaultSettings> = {};
       try {
-        const prefResp = await fetch(`${url}/api/preferences`, {
-          headers: { "Authorization": `Bearer ${token}` }
-        });
+        const prefResp = await serverFetch("/api/preferences");
         if (prefResp.ok) {
           try {
             remotePrefs = await prefResp.json();
@@ -318,11 +381,14 @@ export function useVault(): UseVaultReturn {
     }
   }, []);
 
-  const saveToServer = async (entries: VaultEntry[], settings?: VaultSettings, folders?: FolderNode[]) => {
+  // Push entries, settings and folders that changed since the last sync.
+  // `force` re-sends everything, e.g. after re-encrypting with a new key.
+  const saveToServer = async (entries: VaultEntry[], settings?: VaultSettings, folders?: FolderNode[], force = false) => {
     if (!serverUrlRef.current || !authTokenRef.current || !serverKeyRef.current) throw new Error("Not connected to server");
     const key = serverKeyRef.current;
 
-    const itemsToSync: any[] = [];
+    const itemsToSync: VaultItem[] = [];
+    const pushed: Record<string, string> = {};
 
     // Encrypt Helper
     const encryptItem = async (data: any) => {
@@ -340,59 +406,66 @@ export function useVault(): UseVaultReturn {
       return bytesToBase64(finalObj);
     }
 
-    // 1. Process standard entries
-    for (const entry of entries) {
-      const b64 = await encryptItem(entry);
+    // Queue an item unless the server already has this content
+    const queueItem = async (id: string, data: any) => {
+      const json = JSON.stringify(data);
+      if (!force && syncedRef.current[id] === json) return;
       itemsToSync.push({
-        id: entry.id,
-        encrypted_blob: b64,
-        revision: 1
+        id,
+        encrypted_blob: await encryptItem(data),
+        revision: revisionsRef.current[id] ?? 0
       });
+      pushed[id] = json;
+    };
+
+    // 1. Process standard entries
+    for (const entry of entries) {
+      await queueItem(entry.id, entry);
     }
 
     // 2. Process Settings (Special ID 'settings')
     if (settings) {
-      const b64 = await encryptItem(settings);
-      itemsToSync.push({
-        id: "settings",
-        encrypted_blob: b64,
-        revision: 1
-      });
+      await queueItem("settings", settings);
     }
 
     // 3. Process Folders (Special ID 'folders')
     if (folders) {
-      const b64 = await encryptItem(folders);
-      itemsToSync.push({
-        id: "folders",
-        encrypted_blob: b64,
-        revision: 1
+      await queueItem("folders", folders);
+    }
+
+    if (itemsToSync.length > 0) {
+      const vaultResp = await serverFetch("/vault/items", {
+        method: "PUT",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(itemsToSync)
       });
-    }
+      if (vaultResp.status === 409) {
+        throw new Error("Some items were changed on another device. Sync the vault and try again.");
+      }
+      if (!vaultResp.ok) {
+        const errText = await vaultResp.text();
+        console.error(`[useVault] Vault push failed: ${vaultResp.status} ${errText}`);
+        throw new Error(`Vault push failed: ${vaultResp.status}`);
+      }
 
-    const vaultResp = await fetch(`${serverUrlRef.current}/vault/items`, {
-      method: "PUT",
-      headers: {
-        "Content-Type": "application/json",
-        "Authorization": `Bearer ${authTokenRef.current}`
-      },
-      body: JSON.stringify(itemsToSync)
-    });
-    if (!vaultResp.ok) {
-      const errText = await vaultResp.text();
-      console.error(`[useVault] Vault push failed: ${vaultResp.status} ${errText}`);
-      throw new Error(`Vault push failed: ${vaultResp.status}`);
+      const result = await vaultResp.json().catch(() => null);
+      for (const item of (result?.items ?? []) as { id: string; revision: number; deleted?: boolean }[]) {
+        if (item.deleted) {
+          delete revisionsRef.current[item.id];
+          delete syncedRef.current[item.id];
+        } else {
+          revisionsRef.current[item.id] = item.revision;
+          syncedRef.current[item.id] = pushed[item.id];
+        }
+      }
     }
 
     // Save preferences to API (Web Sync)
     if (settings) {
       try {
-        await fetch(`${serverUrlRef.current}/api/preferences`, {
+        await serverFetch("/api/preferences", {
           method: "PUT",
-          headers: {
-            "Content-Type": "application/json",
-            "Authorization": `Bearer ${authTokenRef.current}`
-          },
+          headers: { "Content-Type": "application/json" },
           body: JSON.stringify({ theme: settings.theme, accentColor: settings.accentColor })
         });
       } catch (e) {
@@ -438,9 +511,7 @@ export function useVault(): UseVaultReturn {
     setError(null);
 
     try {
-      const itemsResp = await fetch(`${serverUrlRef.current}/vault/items`, {
-        headers: { "Authorization": `Bearer ${authTokenRef.current}` }
-      });
+      const itemsResp = await serverFetch("/vault/items");
 
       if (!itemsResp.ok) throw new Error("Failed to fetch vault items");
 
@@ -449,19 +520,19 @@ export function useVault(): UseVaultReturn {
       const decryptResult = await decryptItemsFromServer(items, serverKeyRef.current);
       console.log(`[useVault] Sync decrypted ${decryptResult.successCount}/${items.length} items, returning ${decryptResult.entries.length} entries`);
       const { entries, folders, settings } = decryptResult;
+      rememberServerState(items, decryptResult.plaintexts);
 
       // Clean up junk items with invalid encrypted blobs
-      const shortBlobIds = items
-        .filter(i => {
-          const raw = Uint8Array.from(atob(i.encrypted_blob), c => c.charCodeAt(0));
-          return raw.length < 28;
-        })
-        .map(i => i.id);
+      const shortBlobs = items.filter(i => {
+        const raw = Uint8Array.from(atob(i.encrypted_blob), c => c.charCodeAt(0));
+        return raw.length < 28;
+      });
+      const shortBlobIds = shortBlobs.map(i => i.id);
       if (shortBlobIds.length > 0) {
-        const cleanupResp = await fetch(`${serverUrlRef.current}/vault/items`, {
+        const cleanupResp = await serverFetch("/vault/items", {
           method: "PUT",
-          headers: { "Content-Type": "application/json", "Authorization": `Bearer ${authTokenRef.current}` },
-          body: JSON.stringify(shortBlobIds.map(id => ({ id, encrypted_blob: "", revision: 0 }))),
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify(shortBlobs.map(i => ({ id: i.id, encrypted_blob: "", revision: i.revision }))),
         }).catch(() => null);
         console.log(`[useVault] Removed ${shortBlobIds.length} junk items from server`, cleanupResp?.ok ? "OK" : "FAILED", shortBlobIds);
       }
@@ -470,9 +541,7 @@ export function useVault(): UseVaultReturn {
       let remotePrefs: Partial<VaultSettings> = {};
       try {
         console.log("[useVault] Fetching preferences from:", `${serverUrlRef.current}/api/preferences`);
-        const prefResp = await fetch(`${serverUrlRef.current}/api/preferences`, {
-          headers: { "Authorization": `Bearer ${authTokenRef.current}` }
-        });
+        const prefResp = await serverFetch("/api/preferences");
         if (prefResp.ok) {
           try {
             remotePrefs = await prefResp.json();
@@ -504,15 +573,37 @@ export function useVault(): UseVaultReturn {
     }
   }, []);
 
+  // Delete an item on the server at the last revision seen for it, so a newer
+  // change from another device is reported instead of overwritten.
+  const deleteServerItem = async (id: string) => {
+    if (!serverUrlRef.current || !authTokenRef.current) throw new Error("Not connected to server");
+    const resp = await serverFetch("/vault/items", {
+      method: "PUT",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify([{ id, encrypted_blob: "", revision: revisionsRef.current[id] ?? 0 }]),
+    });
+    if (resp.status === 409) {
+      throw new Error("This item was changed on another device. Sync the vault and try again.");
+    }
+    if (!resp.ok) {
+      throw new Error(`Server delete marker failed (${resp.status})`);
+    }
+    delete revisionsRef.current[id];
+    delete syncedRef.current[id];
+  };
+
   const logout = useCallback(() => {
     setVaultPath(null);
     setMasterPassword("");
     setAuthToken(null);
     authTokenRef.current = null;
+    refreshTokenRef.current = null;
     setServerUrl(null);
     serverUrlRef.current = null;
     setUsername(null);
     setError(null);
+    revisionsRef.current = {};
+    syncedRef.current = {};
     if (serverKeyRef.current) {
       serverKeyRef.current.fill(0);
       serverKeyRef.current = null;
@@ -541,11 +632,16 @@ export function useVault(): UseVaultReturn {
     authToken,
     username,
     loginToServer,
+    deleteServerItem,
+    serverFetch,
     registerOnServer: async (url: string, data: any) => {
+      // Only the auth hash derived from the password is sent
+      const { password, ...rest } = data;
+      const { fields } = await deriveRegistrationSecrets(password);
       const resp = await fetch(`${url}/auth/register`, {
         method: "POST",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify(data)
+        body: JSON.stringify({ ...rest, ...fields })
       });
       if (!resp.ok) {
         throw new Error(await resp.text());
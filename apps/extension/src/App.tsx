@@ -24,7 +24,7 @@ import {
   loadFileHandle
 } from "./utils/fileSystem";
 import { useExtensionVault } from "./hooks/useExtensionVault";
-import { pushEntriesToServer, deleteEntryFromServer } from "./utils/serverSync";
+import { pushEntriesToServer, deleteEntryFromServer, clearServerRevisions } from "./utils/serverSync";
 
 // Helper function to convert VaultEntry to PasswordEntry
 function vaultEntryToPasswordEntry(vaultEntry: VaultEntry): PasswordEntry {
@@ -301,6 +301,7 @@ function App() {
     await clearSession();
     await clearFileHandle();
     await deleteVault();
+    await clearServerRevisions();
     await chrome.runtime.sendMessage({ action: 'clearPasswords' });
   };
 
@@ -438,6 +439,7 @@ function App() {
           .then(async (vaultData) => {
             const loadedPasswords = vaultData.entries.map(vaultEntryToPasswordEntry);
             setPasswords(loadedPasswords);
+            if (vaultData.authToken) setAuthToken(vaultData.authToken);
 
             const appKeyArray = new Uint8Array(localAppKey);
             await saveVault(appKeyArray, vaultData.entries);
@@ -448,7 +450,7 @@ function App() {
               lastModified: Date.now(),
               mode: 'server',
               serverUrl,
-              authToken,
+              authToken: vaultData.authToken ?? authToken,
               serverKey: undefined,
               derivedServerKey,
               localKey: localAppKey
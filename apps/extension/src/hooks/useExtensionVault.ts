@@ -6,7 +6,9 @@ export interface ExtensionVaultData extends VaultData {
     serverKey?: number[];
 }
 import { deriveKey } from "@guardian/core/crypto/argon2";
+import { type PreloginResponse, deriveLoginSecrets, deriveRegistrationSecrets } from "@guardian/core/crypto/auth";
 import { decrypt } from "@guardian/core/crypto/chacha20";
+import { rememberServerRevisions, rememberServerTokens, serverFetch, currentAuthToken } from "../utils/serverSync";
 
 interface UseExtensionVaultReturn {
     isLoading: boolean;
@@ -60,10 +62,22 @@ export function useExtensionVault(): UseExtensionVaultReturn {
             // Remove trailing slash if present
             const cleanUrl = url.replace(/\/$/, "");
 
+            // Only the auth hash derived from the password is sent
+            const preResp = await fetch(`${cleanUrl}/auth/prelogin`, {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify({ username })
+            });
+            if (!preResp.ok) {
+                throw new Error("Authentication failed");
+            }
+            const prelogin: PreloginResponse = await preResp.json();
+            const { masterKey, credentials } = await deriveLoginSecrets(password, prelogin);
+
             const resp = await fetch(`${cleanUrl}/auth/login`, {
                 method: "POST",
                 headers: { "Content-Type": "application/json" },
-                body: JSON.stringify({ username, password })
+                body: JSON.stringify({ username, ...credentials })
             });
 
             if (!resp.ok) {
@@ -72,22 +86,19 @@ export function useExtensionVault(): UseExtensionVaultReturn {
 
             const data = await resp.json();
             const token = data.token;
-            const saltBase64 = data.salt;
-            if (!saltBase64) throw new Error("Server did not return a salt. Update your server.");
+            await rememberServerTokens(token, data.refresh_token);
             setServerUrl(cleanUrl);
 
-            // 2. Derive Key — try server salt, fall back to legacy username hash
-            const saltBytes = Uint8Array.from(atob(saltBase64), c => c.charCodeAt(0));
-            let key = await deriveKey(password, saltBytes);
+            // 2. The master key decrypts the vault; legacy username hash as fallback
+            let key = masterKey;
 
             // 3. Fetch Items
-            const itemsResp = await fetch(`${cleanUrl}/vault/items`, {
-                headers: { "Authorization": `Bearer ${token}` }
-            });
+            const itemsResp = await serverFetch(cleanUrl, token, "/vault/items");
 
             if (!itemsResp.ok) throw new Error("Failed to fetch vault items");
 
             const items: VaultItem[] = await itemsResp.json();
+            await rememberServerRevisions(items);
 
             // 4. Try new salted key first
             let entries = await decryptEntries(items, key);
@@ -126,13 +137,12 @@ export function useExtensionVault(): UseExtensionVaultReturn {
             const cleanUrl = url.replace(/\/$/, "");
             const key = new Uint8Array(keyArray);
 
-            const itemsResp = await fetch(`${cleanUrl}/vault/items`, {
-                headers: { "Authorization": `Bearer ${token}` }
-            });
+            const itemsResp = await serverFetch(cleanUrl, token, "/vault/items");
 
             if (!itemsResp.ok) throw new Error("Failed to fetch vault items");
 
             const items: VaultItem[] = await itemsResp.json();
+            await rememberServerRevisions(items);
             const entries = await decryptEntries(items, key);
 
             return {
@@ -140,7 +150,7 @@ export function useExtensionVault(): UseExtensionVaultReturn {
                 createdAt: new Date().toISOString(),
                 lastModified: new Date().toISOString(),
                 settings: { theme: 'dark' },
-                authToken: token,
+                authToken: await currentAuthToken(token),
                 serverUrl: cleanUrl,
                 serverKey: keyArray
             };
@@ -159,10 +169,12 @@ export function useExtensionVault(): UseExtensionVaultReturn {
         setError(null);
         try {
             const cleanUrl = url.replace(/\/$/, "");
+            const { password, ...rest } = data;
+            const { fields } = await deriveRegistrationSecrets(password);
             const resp = await fetch(`${cleanUrl}/auth/register`, {
                 method: "POST",
                 headers: { "Content-Type": "application/json" },
-                body: JSON.stringify(data)
+                body: JSON.stringify({ ...rest, ...fields })
             });
             if (!resp.ok) {
                 const txt = await resp.text();
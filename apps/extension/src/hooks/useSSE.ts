@@ -1,4 +1,5 @@
 import { useEffect, useState, useRef } from 'react';
+import { currentAuthToken } from '../utils/serverSync';
 
 type SSEEvent = {
     type: string;
@@ -32,7 +33,9 @@ export function useSSE(serverUrl: string | null | undefined, authToken: string |
                     try {
                         const data = JSON.parse(event.data);
                         if (data.type === 'challenge') {
-                            ws.send(JSON.stringify({ type: 'auth', nonce: data.nonce, token: authToken }));
+                            currentAuthToken(authToken).then((token) => {
+                                ws.send(JSON.stringify({ type: 'auth', nonce: data.nonce, token }));
+                            });
                             return;
                         }
                         if (data.type === 'auth_ok') {
@@ -4,7 +4,7 @@
  */
 
 import { openVaultWithKey, createVaultWithKey, type VaultEntry } from "@guardian/core/crypto/vault";
-import { pushEntriesToServer } from "./utils/serverSync";
+import { pushEntriesToServer, clearServerTokens } from "./utils/serverSync";
 import { normalizeIcon } from "@guardian/core/icons";
 
 
@@ -241,6 +241,7 @@ async function clearSessionFromStorage() {
     if (storage.local) {
       removes.push(storage.local.remove([SESSION_STORAGE_KEY]));
     }
+    removes.push(clearServerTokens());
     await Promise.all(removes);
   } catch (error) {
     console.error('Failed to clear session from storage:', error);
@@ -4,9 +4,15 @@
  * Encrypts individual vault items with the user's server-side key and
  * PUTs or DELETEs them against the Guardian server.
  *
- * These are pure functions — no React state, no chrome.* APIs — so they
- * can be called from both the popup (`App.tsx`) and the background
- * service worker.
+ * The server only accepts a change made on top of the item's current
+ * revision, so the last revision seen for each item is kept in
+ * `chrome.storage.local`, where the popup (`App.tsx`) and the background
+ * service worker both see it. No React state, so both can call these.
+ *
+ * Access tokens are short-lived. The access and refresh tokens are kept in
+ * `chrome.storage.session` so both contexts renew them from the same
+ * place: the server replaces the refresh token on every use and revokes the
+ * session if an old one is presented again.
  */
 
 import type { VaultEntry } from "@guardian/core/crypto/vault";
@@ -32,9 +38,150 @@ function cleanUrl(url: string): string {
   return url.replace(/\/$/, "");
 }
 
+const REVISIONS_STORAGE_KEY = "guardian_server_revisions";
+
+interface ItemRevision {
+  id: string;
+  revision: number;
+  deleted?: boolean;
+}
+
+async function loadRevisions(): Promise<Record<string, number>> {
+  try {
+    const result = await chrome.storage.local.get(REVISIONS_STORAGE_KEY);
+    return result[REVISIONS_STORAGE_KEY] || {};
+  } catch {
+    return {};
+  }
+}
+
+async function storeRevisions(revisions: Record<string, number>): Promise<void> {
+  try {
+    await chrome.storage.local.set({ [REVISIONS_STORAGE_KEY]: revisions });
+  } catch (err) {
+    console.warn("Failed to store item revisions:", err);
+  }
+}
+
+const TOKENS_STORAGE_KEY = "guardian_server_tokens";
+
+interface ServerTokens {
+  token: string;
+  refreshToken: string;
+}
+
+function tokenStorage(): chrome.storage.StorageArea | null {
+  const storage = chrome.storage as any;
+  return storage.session ? (storage.session as chrome.storage.StorageArea) : null;
+}
+
+async function loadTokens(): Promise<ServerTokens | null> {
+  try {
+    const result = await tokenStorage()?.get(TOKENS_STORAGE_KEY);
+    return result?.[TOKENS_STORAGE_KEY] || null;
+  } catch {
+    return null;
+  }
+}
+
+/**
+ * Record the tokens from a login or refresh.
+ */
+export async function rememberServerTokens(token: string, refreshToken: string): Promise<void> {
+  try {
+    await tokenStorage()?.set({ [TOKENS_STORAGE_KEY]: { token, refreshToken } });
+  } catch (err) {
+    console.warn("Failed to store server tokens:", err);
+  }
+}
+
+/**
+ * Forget the stored tokens, e.g. on logout.
+ */
+export async function clearServerTokens(): Promise<void> {
+  try {
+    await tokenStorage()?.remove(TOKENS_STORAGE_KEY);
+  } catch { /* ignore */ }
+}
+
+/**
+ * The newest access token: the stored one if a refresh replaced `authToken`.
+ */
+export async function currentAuthToken(authToken: string): Promise<string> {
+  return (await loadTokens())?.token || authToken;
+}
+
+let refreshing: Promise<string | null> | null = null;
+
+async function refreshAuthToken(serverUrl: string, failedToken: string): Promise<string | null> {
+  const stored = await loadTokens();
+  if (!stored) return null;
+  // The other context already renewed it
+  if (stored.token !== failedToken) return stored.token;
+
+  try {
+    const resp = await fetch(`${cleanUrl(serverUrl)}/auth/refresh`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ refresh_token: stored.refreshToken }),
+    });
+    if (!resp.ok) return null;
+    const data = await resp.json();
+    await rememberServerTokens(data.token, data.refresh_token);
+    return data.token;
+  } catch {
+    return null;
+  }
+}
+
+/**
+ * Fetch an API path with the newest access token, renewing it once on a 401.
+ */
+export async function serverFetch(
+  serverUrl: string,
+  authToken: string,
+  path: string,
+  init: RequestInit = {},
+): Promise<Response> {
+  const send = (token: string) => {
+    const headers = new Headers(init.headers);
+    headers.set("Authorization", `Bearer ${token}`);
+    return fetch(`${cleanUrl(serverUrl)}${path}`, { ...init, headers });
+  };
+
+  const token = await currentAuthToken(authToken);
+  const resp = await send(token);
+  if (resp.status !== 401) return resp;
+  refreshing ??= refreshAuthToken(serverUrl, token).finally(() => { refreshing = null; });
+  const renewed = await refreshing;
+  return renewed ? send(renewed) : resp;
+}
+
+/**
+ * Record the revisions of a full item listing from the server, replacing
+ * whatever was known before.
+ */
+export async function rememberServerRevisions(items: ItemRevision[]): Promise<void> {
+  const revisions: Record<string, number> = {};
+  for (const item of items) {
+    revisions[item.id] = item.revision;
+  }
+  await storeRevisions(revisions);
+}
+
+/**
+ * Forget the recorded revisions, e.g. on logout.
+ */
+export async function clearServerRevisions(): Promise<void> {
+  try {
+    await chrome.storage.local.remove(REVISIONS_STORAGE_KEY);
+  } catch { /* ignore */ }
+}
+
 async function encryptEntry(
   key: Uint8Array,
   entry: VaultEntry,
+  revision: number,
 ): Promise<ServerItem> {
   const json = JSON.stringify(entry);
   const plaintext = new TextEncoder().encode(json);
@@ -49,13 +196,16 @@ async function encryptEntry(
   return {
     id: entry.id,
     encrypted_blob: bytesToBase64(packed),
-    revision: 1,
+    revision,
   };
 }
 
 /**
  * Encrypt and upsert the given entries on the server. Used for both
- * single-item updates (pass one entry) and bulk saves.
+ * single-item updates (pass one entry) and bulk saves. Each entry is sent
+ * with the last revision seen for it (0 for a new one); if another device
+ * changed it since, the server rejects the whole batch and nothing is
+ * written until the vault has been synced again.
  */
 export async function pushEntriesToServer(
   serverUrl: string,
@@ -65,24 +215,37 @@ export async function pushEntriesToServer(
 ): Promise<void> {
   if (entries.length === 0) return;
 
+  const revisions = await loadRevisions();
   const items: ServerItem[] = [];
   for (const entry of entries) {
-    items.push(await encryptEntry(serverKey, entry));
+    items.push(await encryptEntry(serverKey, entry, revisions[entry.id] ?? 0));
   }
 
-  const resp = await fetch(`${cleanUrl(serverUrl)}/vault/items`, {
+  const resp = await serverFetch(serverUrl, authToken, "/vault/items", {
     method: "PUT",
-    headers: {
-      "Content-Type": "application/json",
-      Authorization: `Bearer ${authToken}`,
-    },
+    headers: { "Content-Type": "application/json" },
     body: JSON.stringify(items),
   });
 
+  if (resp.status === 409) {
+    throw new Error("Some items were changed on another device. Sync the vault and try again.");
+  }
   if (!resp.ok) {
     const body = await resp.text().catch(() => "");
     throw new Error(`Server push failed (${resp.status}): ${body}`);
   }
+
+  const result = await resp.json().catch(() => null);
+  const saved: ItemRevision[] = result?.items || [];
+  const latest = await loadRevisions();
+  for (const item of saved) {
+    if (item.deleted) {
+      delete latest[item.id];
+    } else {
+      latest[item.id] = item.revision;
+    }
+  }
+  await storeRevisions(latest);
 }
 
 /**
@@ -94,16 +257,19 @@ export async function deleteEntryFromServer(
   authToken: string,
   id: string,
 ): Promise<void> {
-  const resp = await fetch(
-    `${cleanUrl(serverUrl)}/vault/items/${encodeURIComponent(id)}`,
-    {
-      method: "DELETE",
-      headers: { Authorization: `Bearer ${authToken}` },
-    },
+  const resp = await serverFetch(
+    serverUrl,
+    authToken,
+    `/vault/items/${encodeURIComponent(id)}`,
+    { method: "DELETE" },
   );
 
   if (!resp.ok && resp.status !== 404) {
     const body = await resp.text().catch(() => "");
     throw new Error(`Server delete failed (${resp.status}): ${body}`);
   }
+
+  const revisions = await loadRevisions();
+  delete revisions[id];
+  await storeRevisions(revisions);
 }
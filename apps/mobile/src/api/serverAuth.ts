@@ -1,11 +1,21 @@
 import type { VaultEntry, VaultData, VaultSettings } from "@guardian/core/crypto/vault";
 import { deriveKey } from "@guardian/core/crypto/argon2";
+import { deriveLoginSecrets, type PreloginResponse } from "@guardian/core/crypto/auth";
 import { decrypt } from "@guardian/core/crypto/chacha20";
 import { httpRequest } from "./http";
+import {
+  clearServerRevisions,
+  clearServerTokens,
+  currentAuthToken,
+  rememberServerRevisions,
+  rememberServerTokens,
+  serverRequest,
+} from "./serverSync";
 import { sha256 } from "./sha256";
 
 export interface ServerAuthResponse {
   token: string;
+  refresh_token: string;
   username: string;
   is_admin: boolean;
   salt?: string;
@@ -26,7 +36,6 @@ export type ServerSession = {
 
 const STORAGE_KEYS = {
   serverUrl: "guardian_server_url",
-  token: "guardian_token",
   user: "guardian_user",
   lastUsername: "guardian_server_username",
 } as const;
@@ -40,12 +49,13 @@ export function getStoredServerUsername(): string {
 }
 
 export function getStoredAuthToken(): string | null {
-  return localStorage.getItem(STORAGE_KEYS.token);
+  return currentAuthToken("") || null;
 }
 
 export function clearServerSession() {
-  localStorage.removeItem(STORAGE_KEYS.token);
+  clearServerTokens();
   localStorage.removeItem(STORAGE_KEYS.user);
+  clearServerRevisions();
 }
 
 function cleanUrl(url: string): string {
@@ -145,16 +155,14 @@ async function decryptVaultItems(
 }
 
 export async function fetchVaultFromServer(session: ServerSession): Promise<VaultData> {
-  const itemsResp = await httpRequest(`${cleanUrl(session.serverUrl)}/vault/items?ts=${Date.now()}`, {
-    method: "GET",
-    headers: { Authorization: `Bearer ${session.authToken}` },
-  });
+  const itemsResp = await serverRequest(session.serverUrl, session.authToken, `/vault/items?ts=${Date.now()}`);
 
   if (!itemsResp.ok) {
     throw new Error(itemsResp.text || "Failed to fetch vault items");
   }
 
   const items = (itemsResp.json ?? []) as VaultItem[];
+  rememberServerRevisions(items);
   const decrypted = await decryptVaultItems(items, session.serverKey);
   const prefs = await fetchPreferencesFromServer(session).catch(() => ({} as VaultSettings));
   const mergedSettings = { ...(decrypted.settings ?? {}), ...(prefs ?? {}) } as VaultSettings;
@@ -174,10 +182,7 @@ export async function fetchVaultFromServer(session: ServerSession): Promise<Vaul
 }
 
 export async function fetchVaultItemIdsFromServer(session: ServerSession): Promise<string[]> {
-  const itemsResp = await httpRequest(`${cleanUrl(session.serverUrl)}/vault/items?ts=${Date.now()}`, {
-    method: "GET",
-    headers: { Authorization: `Bearer ${session.authToken}` },
-  });
+  const itemsResp = await serverRequest(session.serverUrl, session.authToken, `/vault/items?ts=${Date.now()}`);
 
   if (!itemsResp.ok) {
     throw new Error(itemsResp.text || "Failed to fetch vault items");
@@ -190,10 +195,7 @@ export async function fetchVaultItemIdsFromServer(session: ServerSession): Promi
 }
 
 export async function fetchPreferencesFromServer(session: ServerSession): Promise<VaultSettings> {
-  const resp = await httpRequest(`${cleanUrl(session.serverUrl)}/api/preferences?ts=${Date.now()}`, {
-    method: "GET",
-    headers: { Authorization: `Bearer ${session.authToken}` },
-  });
+  const resp = await serverRequest(session.serverUrl, session.authToken, `/api/preferences?ts=${Date.now()}`);
 
   if (!resp.ok) {
     throw new Error(resp.text || `Failed to fetch preferences (${resp.status})`);
@@ -206,9 +208,8 @@ export async function savePreferencesToServer(
   session: ServerSession,
   prefs: Pick<VaultSettings, "theme" | "accentColor">,
 ): Promise<void> {
-  const resp = await httpRequest(`${cleanUrl(session.serverUrl)}/api/preferences`, {
+  const resp = await serverRequest(session.serverUrl, session.authToken, "/api/preferences", {
     method: "PUT",
-    headers: { Authorization: `Bearer ${session.authToken}` },
     json: prefs,
   });
 
@@ -227,12 +228,23 @@ export async function loginToServerAndFetchVault(
   if (!username.trim()) throw new Error("Username is required");
   if (password.length < 8) throw new Error("Password must be at least 8 characters.");
 
-  // 1) Auth
+  // 1) Auth, with the auth hash derived from the password; the password itself stays here
   let auth: ServerAuthResponse;
+  let key: Uint8Array;
   try {
+    const preResp = await httpRequest(`${base}/auth/prelogin`, {
+      method: "POST",
+      json: { username },
+    });
+    if (!preResp.ok) {
+      throw new Error(errorMessageFromHttpResult(preResp));
+    }
+    const secrets = await deriveLoginSecrets(password, preResp.json as PreloginResponse);
+    key = secrets.masterKey;
+
     const authResp = await httpRequest(`${base}/auth/login`, {
       method: "POST",
-      json: { username, password },
+      json: { username, ...secrets.credentials },
     });
 
     if (!authResp.ok) {
@@ -255,28 +267,19 @@ export async function loginToServerAndFetchVault(
   }
 
   const token = auth.token;
+  rememberServerTokens(token, auth.refresh_token);
 
-  // 2) Derive per-user server key using server-provided salt
-  const saltBase64: string | undefined = auth.salt;
-  if (!saltBase64) throw new Error("Server did not return a salt. Update your server.");
-  const saltBytes = decodeBase64ToBytes(saltBase64);
-  if (!saltBytes) throw new Error("Server returned an invalid salt.");
-
-  const key = await deriveKey(password, saltBytes);
-
-  // 3) Fetch items
-  const itemsResp = await httpRequest(`${base}/vault/items`, {
-    method: "GET",
-    headers: { Authorization: `Bearer ${token}` },
-  });
+  // 2) Fetch items
+  const itemsResp = await serverRequest(base, token, "/vault/items");
 
   if (!itemsResp.ok) {
     throw new Error(itemsResp.text || "Failed to fetch vault items");
   }
 
   const items = (itemsResp.json ?? []) as VaultItem[];
+  rememberServerRevisions(items);
 
-  // 4) Try new salted key first
+  // 3) Try the master key first
   let decrypted = await decryptVaultItems(items, key);
 
   // Try legacy username-based salt as fallback (migration for existing vaults)
@@ -297,7 +300,6 @@ export async function loginToServerAndFetchVault(
   // Persist minimal session info for later use.
   localStorage.setItem(STORAGE_KEYS.serverUrl, base);
   localStorage.setItem(STORAGE_KEYS.lastUsername, username);
-  localStorage.setItem(STORAGE_KEYS.token, token);
   localStorage.setItem(
     STORAGE_KEYS.user,
     JSON.stringify({ username: auth.username, is_admin: auth.is_admin }),
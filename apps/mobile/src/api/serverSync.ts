@@ -1,6 +1,6 @@
 import type { VaultEntry } from "@guardian/core/crypto/vault";
 import { encrypt, generateNonce } from "@guardian/core/crypto/chacha20";
-import { httpRequest } from "./http";
+import { httpRequest, type HttpRequestOptions, type HttpResult } from "./http";
 
 interface ServerItem {
   id: string;
@@ -24,7 +24,113 @@ function cleanUrl(url: string): string {
   return url.replace(/\/$/, "");
 }
 
-async function encryptEntry(key: Uint8Array, entry: VaultEntry): Promise<ServerItem> {
+// The server only accepts a change made on top of the item's current
+// revision, so the last revision seen for each item is kept here.
+const REVISIONS_STORAGE_KEY = "guardian_server_revisions";
+
+interface ItemRevision {
+  id: string;
+  revision: number;
+  deleted?: boolean;
+}
+
+function loadRevisions(): Record<string, number> {
+  try {
+    return JSON.parse(localStorage.getItem(REVISIONS_STORAGE_KEY) ?? "{}");
+  } catch {
+    return {};
+  }
+}
+
+function storeRevisions(revisions: Record<string, number>) {
+  localStorage.setItem(REVISIONS_STORAGE_KEY, JSON.stringify(revisions));
+}
+
+// Record the revisions of a full item listing from the server.
+export function rememberServerRevisions(items: ItemRevision[]) {
+  const revisions: Record<string, number> = {};
+  for (const item of items) {
+    revisions[item.id] = item.revision;
+  }
+  storeRevisions(revisions);
+}
+
+export function clearServerRevisions() {
+  localStorage.removeItem(REVISIONS_STORAGE_KEY);
+}
+
+// Access tokens are short-lived. The refresh token renews them and is
+// replaced by the server on every use, so only one refresh runs at a time.
+const TOKEN_STORAGE_KEY = "guardian_token";
+const REFRESH_TOKEN_STORAGE_KEY = "guardian_refresh_token";
+
+export function rememberServerTokens(token: string, refreshToken: string) {
+  localStorage.setItem(TOKEN_STORAGE_KEY, token);
+  localStorage.setItem(REFRESH_TOKEN_STORAGE_KEY, refreshToken);
+}
+
+export function clearServerTokens() {
+  localStorage.removeItem(TOKEN_STORAGE_KEY);
+  localStorage.removeItem(REFRESH_TOKEN_STORAGE_KEY);
+}
+
+// The newest access token: the stored one if a refresh replaced authToken.
+export function currentAuthToken(authToken: string): string {
+  return localStorage.getItem(TOKEN_STORAGE_KEY) || authToken;
+}
+
+let refreshing: Promise<string | null> | null = null;
+
+async function refreshAuthToken(serverUrl: string): Promise<string | null> {
+  const refreshToken = localStorage.getItem(REFRESH_TOKEN_STORAGE_KEY);
+  if (!refreshToken) return null;
+  try {
+    const resp = await httpRequest(`${cleanUrl(serverUrl)}/auth/refresh`, {
+      method: "POST",
+      json: { refresh_token: refreshToken },
+    });
+    const data = resp.json as { token?: string; refresh_token?: string } | null;
+    if (!resp.ok || !data?.token || !data.refresh_token) return null;
+    rememberServerTokens(data.token, data.refresh_token);
+    return data.token;
+  } catch {
+    return null;
+  }
+}
+
+// Send an API request with the newest access token, renewing it once on a 401.
+export async function serverRequest(
+  serverUrl: string,
+  authToken: string,
+  path: string,
+  options: HttpRequestOptions = {},
+): Promise<HttpResult> {
+  const send = (token: string) =>
+    httpRequest(`${cleanUrl(serverUrl)}${path}`, {
+      ...options,
+      headers: { ...options.headers, Authorization: `Bearer ${token}` },
+    });
+
+  const resp = await send(currentAuthToken(authToken));
+  if (resp.status !== 401) return resp;
+  refreshing ??= refreshAuthToken(serverUrl).finally(() => { refreshing = null; });
+  const token = await refreshing;
+  return token ? send(token) : resp;
+}
+
+function updateRevisions(items: ItemRevision[]) {
+  const revisions = loadRevisions();
+  for (const item of items) {
+    if (item.deleted) {
+      delete revisions[item.id];
+    } else {
+      revisions[item.id] = item.revision;
+    }
+  }
+  storeRevisions(revisions);
+}
+
+async function encryptEntry(key: Uint8Array, entry: VaultEntry, revision: number): Promise<ServerItem> {
   const json = JSON.stringify(entry);
   const plaintext = new TextEncoder().encode(json);
   const nonce = generateNonce();
@@ -37,7 +143,7 @@ async function encryptEntry(key: Uint8Array, entry: VaultEntry): Promise<ServerI
   return {
     id: entry.id,
     encrypted_blob: bytesToBase64(packed),
-    revision: 1,
+    revision,
   };
 }
 
@@ -49,20 +155,25 @@ export async function pushEntriesToServer(
 ): Promise<void> {
   if (entries.length === 0) return;
 
+  const revisions = loadRevisions();
   const items: ServerItem[] = [];
   for (const entry of entries) {
-    items.push(await encryptEntry(serverKey, entry));
+    items.push(await encryptEntry(serverKey, entry, revisions[entry.id] ?? 0));
   }
 
-  const resp = await httpRequest(`${cleanUrl(serverUrl)}/vault/items`, {
+  const resp = await serverRequest(serverUrl, authToken, "/vault/items", {
     method: "PUT",
-    headers: { Authorization: `Bearer ${authToken}` },
     json: items,
   });
 
+  if (resp.status === 409) {
+    throw new Error("Some items were changed on another device. Sync the vault and try again.");
+  }
   if (!resp.ok) {
     throw new Error(`Server push failed (${resp.status}): ${resp.text}`);
   }
+
+  updateRevisions(((resp.json as { items?: ItemRevision[] } | null)?.items) ?? []);
 }
 
 export async function deleteEntryViaUpsertToServer(
@@ -70,15 +181,19 @@ export async function deleteEntryViaUpsertToServer(
   authToken: string,
   id: string,
 ): Promise<void> {
-  const resp = await httpRequest(`${cleanUrl(serverUrl)}/vault/items`, {
+  const resp = await serverRequest(serverUrl, authToken, "/vault/items", {
     method: "PUT",
-    headers: { Authorization: `Bearer ${authToken}` },
-    json: [{ id, encrypted_blob: "", revision: 0 } satisfies ServerItem],
+    json: [{ id, encrypted_blob: "", revision: loadRevisions()[id] ?? 0 } satisfies ServerItem],
   });
 
+  if (resp.status === 409) {
+    throw new Error("This item was changed on another device. Sync the vault and try again.");
+  }
   if (!resp.ok) {
     throw new Error(`Server delete (via upsert) failed (${resp.status}): ${resp.text}`);
   }
+
+  updateRevisions([{ id, revision: 0, deleted: true }]);
 }
 
 export async function deleteEntryFromServer(
@@ -86,9 +201,8 @@ export async function deleteEntryFromServer(
   authToken: string,
   id: string,
 ): Promise<void> {
-  const resp = await httpRequest(`${cleanUrl(serverUrl)}/vault/items/${encodeURIComponent(id)}`, {
+  const resp = await serverRequest(serverUrl, authToken, `/vault/items/${encodeURIComponent(id)}`, {
     method: "DELETE",
-    headers: { Authorization: `Bearer ${authToken}` },
   });
 
   // The server delete endpoint is idempotent and returns 200 even if the item is missing.
@@ -96,4 +210,6 @@ export async function deleteEntryFromServer(
   if (!resp.ok) {
     throw new Error(`Server delete failed (${resp.status}): ${resp.text}`);
   }
+
+  updateRevisions([{ id, revision: 0, deleted: true }]);
 }
@@ -1,4 +1,5 @@
 import { useEffect, useRef, useState } from "react";
+import { currentAuthToken } from "../api/serverSync";
 
 export type SSEEvent = {
   type: string;
@@ -36,7 +37,7 @@ export function useSSE(serverUrl: string | null, authToken: string | null) {
           try {
             const data = JSON.parse(event.data);
             if (data.type === "challenge") {
-              ws.send(JSON.stringify({ type: "auth", nonce: data.nonce, token: authToken }));
+              ws.send(JSON.stringify({ type: "auth", nonce: data.nonce, token: currentAuthToken(authToken) }));
               return;
             }
             if (data.type === "auth_ok") {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// --- Audit Log ---
+//
+// Security-relevant account actions are recorded in audit_log. actor_id is
+// who did it (0 for an unauthenticated request), user_id whose account it
+// concerns. Rows are never updated or pruned by the server.
+
+const auditListLimit = 500
+
+// audit records an action. Failures are logged but never fail the request
+// that triggered them.
+func (s *Server) audit(r *http.Request, actorID, userID int, action, detail string) {
+	s.auditTx(s.systemDB, r, actorID, userID, action, detail)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// auditTx records an action through db, so it can be part of a transaction.
+func (s *Server) auditTx(db execer, r *http.Request, actorID, userID int, action, detail string) {
+	ip := ""
+	if r != nil {
+		ip = getClientIP(r)
+	}
+	_, err := db.Exec("INSERT INTO audit_log (actor_id, user_id, action, detail, ip) VALUES (NULLIF(?, 0), NULLIF(?, 0), ?, ?, ?)",
+		actorID, userID, action, detail, ip)
+	if err != nil {
+		s.logger.Printf("audit: %s (actor %d, user %d): %v", action, actorID, userID, err)
+	}
+}
+
+// handleListAuditLog returns the newest audit entries, optionally for one
+// user (?user_id=) and before a given id (?before=) for paging.
+func (s *Server) handleListAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT a.id, a.created_at, COALESCE(a.actor_id, 0), COALESCE(actor.username, ''),
+		       COALESCE(a.user_id, 0), COALESCE(u.username, ''), a.action, a.detail, a.ip
+		FROM audit_log a
+		LEFT JOIN users actor ON actor.id = a.actor_id
+		LEFT JOIN users u ON u.id = a.user_id
+		WHERE 1 = 1`
+	var args []any
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		query += " AND a.user_id = ?"
+		args = append(args, id)
+	}
+	if v := r.URL.Query().Get("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		query += " AND a.id < ?"
+		args = append(args, id)
+	}
+	query += " ORDER BY a.id DESC LIMIT " + strconv.Itoa(auditListLimit)
+
+	rows, err := s.systemDB.Query(query, args...)
+	if err != nil {
+		s.logger.Println("handleListAuditLog: query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Actor, &e.UserID, &e.Username, &e.Action, &e.Detail, &e.IP); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Snapshot Backups ---
+//
+// A backup is a gzipped tar of VACUUM INTO copies of system.db and every user
+// vault, plus finished attachment files, laid out like the data directory.
+// manifest.json at the root of the archive lists every file with its SHA-256.
+// Snapshots are taken on the live connections, so the server keeps serving;
+// each DB is copied in a single read transaction and is consistent on its own.
+
+const (
+	backupManifestName    = "manifest.json"
+	backupManifestFormat  = 1
+	backupArchiveSuffix   = ".tar.gz"
+	backupSchedulerTick   = time.Minute
+	backupRetryDelay      = 15 * time.Minute
+	defaultBackupInterval = 24 // hours
+	defaultBackupRetain   = 7  // successful archives kept
+)
+
+var (
+	errBackupRunning = errors.New("a backup is already running")
+	errVerifyRunning = errors.New("a restore drill is already running")
+)
+
+// backupSchedule returns the schedule stored in server_settings.
+func (s *Server) backupSchedule() BackupSchedule {
+	return BackupSchedule{
+		Enabled:             s.getSettingInt64("backup_schedule_enabled") == 1,
+		IntervalHours:       s.getSettingInt("backup_interval_hours", defaultBackupInterval),
+		RetentionCount:      s.getSettingInt("backup_retention_count", defaultBackupRetain),
+		VerifyIntervalHours: int(s.getSettingInt64("backup_verify_interval_hours")),
+		Directory:           s.config.BackupDir,
+	}
+}
+
+// startBackup records a new run and performs it in the background. It returns
+// errBackupRunning instead of queueing when another run is in progress.
+func (s *Server) startBackup(trigger string) (int64, error) {
+	if !s.backupMu.TryLock() {
+		return 0, errBackupRunning
+	}
+
+	res, err := s.systemDB.Exec("INSERT INTO backups (trigger, status) VALUES (?, 'running')", trigger)
+	if err != nil {
+		s.backupMu.Unlock()
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+
+	go func() {
+		defer s.backupMu.Unlock()
+		s.runBackup(id)
+	}()
+	return id, nil
+}
+
+// runBackup builds the archive for backup record id and stores the outcome.
+func (s *Server) runBackup(id int64) {
+	started := time.Now()
+	s.logger.Printf("runBackup: backup %d started", id)
+
+	result, err := s.writeBackupArchive(id, started.UTC())
+	if err != nil {
+		s.logger.Printf("runBackup: backup %d failed: %v", id, err)
+		s.systemDB.Exec(`
+			UPDATE backups SET status = 'failed', error = ?, completed_at = CURRENT_TIMESTAMP, duration_ms = ?
+			WHERE id = ?
+		`, err.Error(), time.Since(started).Milliseconds(), id)
+		return
+	}
+
+	s.systemDB.Exec(`
+		UPDATE backups SET status = 'success', filename = ?, size_bytes = ?, sha256 = ?, db_count = ?, file_count = ?,
+			completed_at = CURRENT_TIMESTAMP, duration_ms = ?
+		WHERE id = ?
+	`, result.filename, result.size, result.sha256, result.dbCount, result.fileCount, time.Since(started).Milliseconds(), id)
+	s.logger.Printf("runBackup: backup %d wrote %s (%s)", id, result.filename, formatBytes(result.size))
+
+	s.shipBackup(id, result.filename)
+	s.applyBackupRetention()
+}
+
+type backupResult struct {
+	filename  string
+	size      int64
+	sha256    string
+	dbCount   int
+	fileCount int
+}
+
+// writeBackupArchive snapshots everything into a staging directory next to
+// the archive, then packs it. The archive only appears under its final name
+// once it is complete.
+func (s *Server) writeBackupArchive(id int64, now time.Time) (backupResult, error) {
+	var result backupResult
+
+	if err := os.MkdirAll(s.config.BackupDir, 0700); err != nil {
+		return result, err
+	}
+	staging, err := os.MkdirTemp(s.config.BackupDir, ".staging-")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := s.snapshotDataDir(staging, now)
+	if err != nil {
+		return result, err
+	}
+	for _, f := range manifest.Files {
+		if f.Kind != "attachment" {
+			result.dbCount++
+		}
+	}
+	result.fileCount = len(manifest.Files)
+
+	result.filename = fmt.Sprintf("guardian-backup-%s-%d%s", now.Format("20060102T150405Z"), id, backupArchiveSuffix)
+	final := filepath.Join(s.config.BackupDir, result.filename)
+	tmp := final + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return result, err
+	}
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, h)}
+	err = packBackupArchive(counter, staging, manifest)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return result, err
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		os.Remove(tmp)
+		return result, err
+	}
+
+	result.size = counter.n
+	result.sha256 = hex.EncodeToString(h.Sum(nil))
+
+	// sha256sum-compatible sidecar so archives can be checked without the server
+	os.WriteFile(final+".sha256", []byte(result.sha256+"  "+result.filename+"\n"), 0600)
+
+	return result, nil
+}
+
+// snapshotDataDir writes consistent copies of all databases and attachment
+// files into dir and returns the manifest describing them. The user list is
+// read from the system.db snapshot so the archive never references a vault
+// whose users row it doesn't contain.
+func (s *Server) snapshotDataDir(dir string, now time.Time) (BackupManifest, error) {
+	manifest := BackupManifest{
+		Format:        backupManifestFormat,
+		CreatedAt:     now,
+		ServerVersion: Version,
+	}
+
+	systemCopy := filepath.Join(dir, "system.db")
+	if _, err := s.systemDB.Exec("VACUUM INTO ?", systemCopy); err != nil {
+		return manifest, fmt.Errorf("snapshot system.db: %w", err)
+	}
+	entry, err := manifestEntry(dir, "system.db", "system")
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Files = append(manifest.Files, entry)
+
+	users, err := readSnapshotUsers(systemCopy)
+	if err != nil {
+		return manifest, err
+	}
+
+	for _, u := range users {
+		db, err := s.openUserDB(u.DBPath)
+		if err == errVaultMissing {
+			// Back up everyone else; the archive's restore drill reports it
+			s.logger.Printf("snapshotDataDir: vault %s of user %d is missing, skipped", u.DBPath, u.ID)
+			continue
+		} else if err != nil {
+			return manifest, fmt.Errorf("open vault %s: %w", u.DBPath, err)
+		}
+		if _, err := db.Exec("VACUUM INTO ?", filepath.Join(dir, u.DBPath)); err != nil {
+			return manifest, fmt.Errorf("snapshot vault %s: %w", u.DBPath, err)
+		}
+		entry, err := manifestEntry(dir, u.DBPath, "vault")
+		if err != nil {
+			return manifest, err
+		}
+		entry.UserID, entry.Username = u.ID, u.Username
+		manifest.Files = append(manifest.Files, entry)
+
+		files, err := copyAttachmentFiles(s.config.DataDir, dir, u.DBPath)
+		if err != nil {
+			return manifest, fmt.Errorf("copy attachments of %s: %w", u.DBPath, err)
+		}
+		for _, rel := range files {
+			entry, err := manifestEntry(dir, rel, "attachment")
+			if err != nil {
+				return manifest, err
+			}
+			entry.UserID, entry.Username = u.ID, u.Username
+			manifest.Files = append(manifest.Files, entry)
+		}
+	}
+
+	return manifest, nil
+}
+
+type snapshotUser struct {
+	ID       int
+	Username string
+	DBPath   string
+}
+
+// readSnapshotUsers lists the users recorded in a (copied) system.db.
+func readSnapshotUsers(systemDBPath string) ([]snapshotUser, error) {
+	db, err := sql.Open("sqlite", "file:"+systemDBPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, username, db_path FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []snapshotUser
+	for rows.Next() {
+		var u snapshotUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.DBPath); err != nil {
+			return nil, err
+		}
+		if !isPlainFilename(u.DBPath) {
+			return nil, fmt.Errorf("user %d has invalid db_path %q", u.ID, u.DBPath)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// isPlainFilename reports whether name is a single path element, so it can't
+// escape the directory it is joined to.
+func isPlainFilename(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && !strings.ContainsAny(name, `/\`)
+}
+
+// copyAttachmentFiles copies a vault's finished attachment files into dst and
+// returns their paths relative to dst. In-progress uploads are skipped.
+func copyAttachmentFiles(dataDir, dst, dbFilename string) ([]string, error) {
+	src := attachmentDirFor(dataDir, dbFilename)
+	entries, err := os.ReadDir(src)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	relDir := filepath.Base(src)
+	if err := os.MkdirAll(filepath.Join(dst, relDir), 0700); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".part") {
+			continue
+		}
+		rel := filepath.Join(relDir, e.Name())
+		err := copyFile(filepath.Join(src, e.Name()), filepath.Join(dst, rel))
+		if os.IsNotExist(err) {
+			continue // deleted while we were copying
+		} else if err != nil {
+			return nil, err
+		}
+		files = append(files, rel)
+	}
+	return files, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func manifestEntry(dir, rel, kind string) (BackupManifestFile, error) {
+	path := filepath.Join(dir, rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return BackupManifestFile{}, err
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return BackupManifestFile{}, err
+	}
+	return BackupManifestFile{Path: filepath.ToSlash(rel), Kind: kind, Size: info.Size(), SHA256: sum}, nil
+}
+
+// packBackupArchive writes manifest.json followed by every manifest file.
+func packBackupArchive(w io.Writer, dir string, manifest BackupManifest) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: backupManifestName, Mode: 0600, Size: int64(len(manifestJSON)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+
+	for _, f := range manifest.Files {
+		if err := addFileToTar(tw, filepath.Join(dir, filepath.FromSlash(f.Path)), f.Path, manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addFileToTar(tw *tar.Writer, path, name string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// applyBackupRetention deletes all but the newest backup_retention_count
+// successful archives, locally and on destinations. Their history rows are
+// kept and marked pruned.
+func (s *Server) applyBackupRetention() {
+	keep := s.backupSchedule().RetentionCount
+
+	type expired struct {
+		id       int64
+		filename string
+	}
+	rows, err := s.systemDB.Query(`
+		SELECT id, filename FROM backups
+		WHERE status = 'success' AND pruned_at IS NULL
+		ORDER BY id DESC LIMIT -1 OFFSET ?
+	`, keep)
+	if err != nil {
+		s.logger.Println("applyBackupRetention: query error:", err)
+		return
+	}
+	var old []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.id, &e.filename); err == nil {
+			old = append(old, e)
+		}
+	}
+	rows.Close()
+
+	for _, e := range old {
+		path := filepath.Join(s.config.BackupDir, e.filename)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.logger.Printf("applyBackupRetention: remove %s failed: %v", path, err)
+			continue
+		}
+		os.Remove(path + ".sha256")
+		s.systemDB.Exec("UPDATE backups SET pruned_at = CURRENT_TIMESTAMP WHERE id = ?", e.id)
+		s.pruneRemoteCopies(e.id)
+		s.logger.Printf("applyBackupRetention: pruned %s", e.filename)
+	}
+}
+
+// backupDue reports whether no backup has succeeded within the schedule
+// interval. Failed runs don't count, but the next attempt waits
+// backupRetryDelay after any run so a persistent failure isn't retried
+// every tick.
+func (s *Server) backupDue(sched BackupSchedule) bool {
+	var succeeded, attempted int
+	err := s.systemDB.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM backups WHERE status = 'success' AND started_at > datetime('now', ?)),
+			(SELECT COUNT(*) FROM backups WHERE started_at > datetime('now', ?))
+	`, fmt.Sprintf("-%d hours", sched.IntervalHours),
+		fmt.Sprintf("-%d seconds", int64(backupRetryDelay.Seconds()))).Scan(&succeeded, &attempted)
+	return err == nil && succeeded == 0 && attempted == 0
+}
+
+// startBackupVerify marks the restore drill of a stored archive as running
+// and performs it in the background. It returns errVerifyRunning instead of
+// queueing when another drill is in progress.
+func (s *Server) startBackupVerify(id int64, filename string) error {
+	if !s.verifyMu.TryLock() {
+		return errVerifyRunning
+	}
+	if _, err := s.systemDB.Exec("UPDATE backups SET verify_status = 'running', verify_error = '' WHERE id = ?", id); err != nil {
+		s.verifyMu.Unlock()
+		return err
+	}
+
+	go func() {
+		defer s.verifyMu.Unlock()
+		s.runBackupVerify(id, filename)
+	}()
+	return nil
+}
+
+// runBackupVerify runs a restore drill on an archive: it is unpacked into a
+// temp dir, checked against its manifest and every DB gets an integrity
+// check. The outcome is recorded on the backup.
+func (s *Server) runBackupVerify(id int64, filename string) {
+	status, problems := "ok", ""
+	report, err := verifyBackupArchive(filepath.Join(s.config.BackupDir, filepath.Base(filename)), nil)
+	if err != nil {
+		status, problems = "failed", err.Error()
+	} else if !report.OK {
+		status, problems = "failed", strings.Join(report.Problems, "\n")
+	}
+
+	_, err = s.systemDB.Exec("UPDATE backups SET verified_at = CURRENT_TIMESTAMP, verify_status = ?, verify_error = ? WHERE id = ?",
+		status, problems, id)
+	if err != nil {
+		s.logger.Println("runBackupVerify: record failed:", err)
+	}
+	if status == "failed" {
+		s.logger.Printf("runBackupVerify: backup %d failed its restore drill: %s", id, problems)
+	} else {
+		s.logger.Printf("runBackupVerify: backup %d restored cleanly", id)
+	}
+}
+
+// verifyDue returns the newest stored archive when no restore drill has
+// finished within the drill interval.
+func (s *Server) verifyDue(sched BackupSchedule) (id int64, filename string, due bool) {
+	err := s.systemDB.QueryRow(`
+		SELECT id, filename FROM backups
+		WHERE status = 'success' AND pruned_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM backups WHERE verified_at > datetime('now', ?))
+		ORDER BY id DESC LIMIT 1
+	`, fmt.Sprintf("-%d hours", sched.VerifyIntervalHours)).Scan(&id, &filename)
+	return id, filename, err == nil
+}
+
+// runBackupScheduler starts scheduled backups and restore drills when they
+// are due. Runs that were interrupted by a previous shutdown are marked
+// failed first.
+func (s *Server) runBackupScheduler(done <-chan struct{}) {
+	s.systemDB.Exec(`
+		UPDATE backups SET status = 'failed', error = 'interrupted by server shutdown', completed_at = CURRENT_TIMESTAMP
+		WHERE status = 'running'
+	`)
+	s.systemDB.Exec(`
+		UPDATE backups SET verify_status = 'failed', verify_error = 'interrupted by server shutdown', verified_at = CURRENT_TIMESTAMP
+		WHERE verify_status = 'running'
+	`)
+
+	ticker := time.NewTicker(backupSchedulerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sched := s.backupSchedule()
+			if sched.VerifyIntervalHours > 0 {
+				if id, filename, due := s.verifyDue(sched); due {
+					if err := s.startBackupVerify(id, filename); err != nil && err != errVerifyRunning {
+						s.logger.Println("runBackupScheduler: drill start failed:", err)
+					}
+				}
+			}
+			if !sched.Enabled || !s.backupDue(sched) {
+				continue
+			}
+			if _, err := s.startBackup("scheduled"); err != nil && err != errBackupRunning {
+				s.logger.Println("runBackupScheduler: start failed:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// --- Backup Destinations ---
+//
+// After a backup succeeds, the archive is shipped to every enabled destination.
+// If server_settings has backup_encryption_recipient (an age X25519 public
+// key), shipped copies are encrypted to it first and get an ".age" suffix;
+// the archive in BACKUP_DIR stays plaintext so drills and restores work locally.
+// Destination credentials are sealed in backup_destinations.config and only
+// opened to talk to the destination.
+
+const backupUploadTimeout = 2 * time.Hour
+
+// BackupTarget stores archives in one place.
+type BackupTarget interface {
+	// Put stores size bytes from r under name, replacing any existing object.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Delete removes name. Missing objects are not an error.
+	Delete(ctx context.Context, name string) error
+	// Check verifies that the destination is reachable and writable.
+	Check(ctx context.Context) error
+}
+
+type LocalDestinationConfig struct {
+	Path string `json:"path"` // absolute; may be an NFS mount
+}
+
+type S3DestinationConfig struct {
+	Endpoint        string `json:"endpoint"` // host[:port], e.g. s3.amazonaws.com or minio:9000
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	DisableTLS      bool   `json:"disable_tls"`
+	PathStyle       bool   `json:"path_style"` // required by most MinIO-style servers
+}
+
+type SFTPDestinationConfig struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"private_key"` // PEM
+	HostKey    string `json:"host_key"`    // authorized_keys format, e.g. "ssh-ed25519 AAAA..."
+	Path       string `json:"path"`
+}
+
+// destinationSecrets lists config fields that are never returned by the API.
+var destinationSecrets = map[string][]string{
+	"s3":   {"secret_access_key"},
+	"sftp": {"password", "private_key"},
+}
+
+const (
+	maskedSecret = "********"
+	sealedPrefix = "sealed:"
+)
+
+// destinationSealKey encrypts the secret fields of stored destination configs.
+func (s *Server) destinationSealKey() []byte {
+	return deriveKey(string(s.dataKey), "backup destinations")
+}
+
+// sealDestinationSecrets encrypts the secret fields of a config for storage.
+// Fields that are already sealed are kept as they are.
+func sealDestinationSecrets(key []byte, kind string, config json.RawMessage) (string, error) {
+	var m map[string]any
+	if err := json.Unmarshal(config, &m); err != nil {
+		return "", err
+	}
+	for _, k := range destinationSecrets[kind] {
+		v, ok := m[k].(string)
+		if !ok || v == "" || strings.HasPrefix(v, sealedPrefix) {
+			continue
+		}
+		sealed, err := seal(key, []byte(v))
+		if err != nil {
+			return "", err
+		}
+		m[k] = sealedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	}
+	out, err := json.Marshal(m)
+	return string(out), err
+}
+
+// openDestinationConfig decrypts the secret fields of a stored config.
+// Plaintext values from before secrets were sealed are passed through.
+func openDestinationConfig(key []byte, kind, stored string) (json.RawMessage, error) {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(stored), &m); err != nil {
+		return nil, err
+	}
+	for _, k := range destinationSecrets[kind] {
+		v, ok := m[k].(string)
+		if !ok || !strings.HasPrefix(v, sealedPrefix) {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, sealedPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%s is corrupt", k)
+		}
+		plain, err := unseal(key, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s can't be decrypted with the data key; re-enter it", k)
+		}
+		m[k] = string(plain)
+	}
+	return json.Marshal(m)
+}
+
+// newStoredBackupTarget builds the target of a config as stored in
+// backup_destinations.
+func newStoredBackupTarget(key []byte, kind, stored string) (BackupTarget, error) {
+	config, err := openDestinationConfig(key, kind, stored)
+	if err != nil {
+		return nil, err
+	}
+	return newBackupTarget(kind, config)
+}
+
+// sealStoredDestinationSecrets seals secrets that were stored in plaintext
+// by an earlier version.
+func (s *Server) sealStoredDestinationSecrets() {
+	type dest struct {
+		id           int64
+		kind, config string
+	}
+	rows, err := s.systemDB.Query("SELECT id, type, config FROM backup_destinations")
+	if err != nil {
+		s.logger.Println("sealStoredDestinationSecrets:", err)
+		return
+	}
+	var dests []dest
+	for rows.Next() {
+		var d dest
+		if err := rows.Scan(&d.id, &d.kind, &d.config); err == nil {
+			dests = append(dests, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range dests {
+		var m map[string]any
+		json.Unmarshal([]byte(d.config), &m)
+		plain := false
+		for _, k := range destinationSecrets[d.kind] {
+			if v, ok := m[k].(string); ok && v != "" && !strings.HasPrefix(v, sealedPrefix) {
+				plain = true
+			}
+		}
+		if !plain {
+			continue
+		}
+		sealed, err := sealDestinationSecrets(s.destinationSealKey(), d.kind, json.RawMessage(d.config))
+		if err != nil {
+			s.logger.Println("sealStoredDestinationSecrets:", err)
+			continue
+		}
+		if _, err := s.systemDB.Exec("UPDATE backup_destinations SET config = ? WHERE id = ?", sealed, d.id); err != nil {
+			s.logger.Println("sealStoredDestinationSecrets:", err)
+			continue
+		}
+		s.logger.Printf("sealStoredDestinationSecrets: sealed the secrets of destination %d", d.id)
+	}
+}
+
+// newBackupTarget validates a destination config and builds its target.
+func newBackupTarget(kind string, config json.RawMessage) (BackupTarget, error) {
+	switch kind {
+	case "local":
+		var c LocalDestinationConfig
+		if err := json.Unmarshal(config, &c); err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(c.Path) {
+			return nil, errors.New("path must be absolute")
+		}
+		return localTarget{dir: filepath.Clean(c.Path)}, nil
+
+	case "s3":
+		var c S3DestinationConfig
+		if err := json.Unmarshal(config, &c); err != nil {
+			return nil, err
+		}
+		if c.Endpoint == "" || c.Bucket == "" || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return nil, errors.New("endpoint, bucket, access_key_id and secret_access_key are required")
+		}
+		lookup := minio.BucketLookupAuto
+		if c.PathStyle {
+			lookup = minio.BucketLookupPath
+		}
+		client, err := minio.New(c.Endpoint, &minio.Options{
+			Creds:        credentials.NewStaticV4(c.AccessKeyID, c.SecretAccessKey, ""),
+			Secure:       !c.DisableTLS,
+			Region:       c.Region,
+			BucketLookup: lookup,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3Target{client: client, bucket: c.Bucket, prefix: strings.Trim(c.Prefix, "/")}, nil
+
+	case "sftp":
+		var c SFTPDestinationConfig
+		if err := json.Unmarshal(config, &c); err != nil {
+			return nil, err
+		}
+		if c.Host == "" || c.User == "" || c.Path == "" {
+			return nil, errors.New("host, user and path are required")
+		}
+		if c.Password == "" && c.PrivateKey == "" {
+			return nil, errors.New("password or private_key is required")
+		}
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.HostKey))
+		if err != nil {
+			return nil, errors.New("host_key must be the server's public key in authorized_keys format")
+		}
+		auth := []ssh.AuthMethod{}
+		if c.PrivateKey != "" {
+			signer, err := ssh.ParsePrivateKey([]byte(c.PrivateKey))
+			if err != nil {
+				return nil, fmt.Errorf("invalid private_key: %w", err)
+			}
+			auth = append(auth, ssh.PublicKeys(signer))
+		}
+		if c.Password != "" {
+			auth = append(auth, ssh.Password(c.Password))
+		}
+		port := c.Port
+		if port == 0 {
+			port = 22
+		}
+		return sftpTarget{
+			addr: net.JoinHostPort(c.Host, strconv.Itoa(port)),
+			dir:  c.Path,
+			config: &ssh.ClientConfig{
+				User:            c.User,
+				Auth:            auth,
+				HostKeyCallback: ssh.FixedHostKey(hostKey),
+				Timeout:         30 * time.Second,
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown destination type %q", kind)
+}
+
+// --- local / NFS ---
+
+type localTarget struct {
+	dir string
+}
+
+func (t localTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return err
+	}
+	final := filepath.Join(t.dir, name)
+	tmp := final + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, final)
+}
+
+func (t localTarget) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(t.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t localTarget) Check(ctx context.Context) error {
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(t.dir, ".guardian-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// --- S3-compatible ---
+
+type s3Target struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func (t s3Target) key(name string) string {
+	if t.prefix == "" {
+		return name
+	}
+	return t.prefix + "/" + name
+}
+
+func (t s3Target) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := t.client.PutObject(ctx, t.bucket, t.key(name), r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (t s3Target) Delete(ctx context.Context, name string) error {
+	return t.client.RemoveObject(ctx, t.bucket, t.key(name), minio.RemoveObjectOptions{})
+}
+
+func (t s3Target) Check(ctx context.Context) error {
+	ok, err := t.client.BucketExists(ctx, t.bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %q does not exist", t.bucket)
+	}
+	return nil
+}
+
+// --- SFTP ---
+
+type sftpTarget struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+}
+
+func (t sftpTarget) connect() (*sftp.Client, func(), error) {
+	conn, err := ssh.Dial("tcp", t.addr, t.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, func() { client.Close(); conn.Close() }, nil
+}
+
+func (t sftpTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	client, closeFn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	if err := client.MkdirAll(t.dir); err != nil {
+		return err
+	}
+	final := path.Join(t.dir, name)
+	tmp := final + ".tmp"
+	out, err := client.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	return client.PosixRename(tmp, final)
+}
+
+func (t sftpTarget) Delete(ctx context.Context, name string) error {
+	client, closeFn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	err = client.Remove(path.Join(t.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t sftpTarget) Check(ctx context.Context) error {
+	client, closeFn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	return client.MkdirAll(t.dir)
+}
+
+// --- Shipping ---
+
+type backupDestination struct {
+	ID     int64
+	Name   string
+	Type   string
+	Target BackupTarget
+}
+
+// enabledDestinations loads the enabled destinations. Ones with a broken
+// config are returned with a nil Target so the failure gets recorded.
+func (s *Server) enabledDestinations() ([]backupDestination, map[int64]error, error) {
+	rows, err := s.systemDB.Query("SELECT id, name, type, config FROM backup_destinations WHERE enabled = 1 ORDER BY id")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var dests []backupDestination
+	broken := map[int64]error{}
+	for rows.Next() {
+		var d backupDestination
+		var config string
+		if err := rows.Scan(&d.ID, &d.Name, &d.Type, &config); err != nil {
+			return nil, nil, err
+		}
+		d.Target, err = newStoredBackupTarget(s.destinationSealKey(), d.Type, config)
+		if err != nil {
+			broken[d.ID] = err
+		}
+		dests = append(dests, d)
+	}
+	return dests, broken, rows.Err()
+}
+
+// encryptBackupArchive writes an age-encrypted copy of src to dst.
+func encryptBackupArchive(src, dst, recipient string) error {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return fmt.Errorf("invalid backup_encryption_recipient: %w", err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc, err := age.Encrypt(out, r)
+	if err == nil {
+		_, err = io.Copy(enc, in)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// shipBackup uploads a finished archive to every enabled destination and
+// records one backup_uploads row per destination.
+func (s *Server) shipBackup(backupID int64, filename string) {
+	dests, broken, err := s.enabledDestinations()
+	if err != nil {
+		s.logger.Println("shipBackup: load destinations failed:", err)
+		return
+	}
+	if len(dests) == 0 {
+		return
+	}
+
+	src := filepath.Join(s.config.BackupDir, filename)
+	name := filename
+	var encryptErr error
+	if recipient := strings.TrimSpace(s.getSetting("backup_encryption_recipient")); recipient != "" {
+		name = filename + ".age"
+		encrypted := filepath.Join(s.config.BackupDir, "."+name+".tmp")
+		encryptErr = encryptBackupArchive(src, encrypted, recipient)
+		if encryptErr == nil {
+			defer os.Remove(encrypted)
+			src = encrypted
+		}
+	}
+
+	for _, d := range dests {
+		started := time.Now()
+		res, err := s.systemDB.Exec("INSERT INTO backup_uploads (backup_id, destination_id, status, remote_name) VALUES (?, ?, 'running', ?)",
+			backupID, d.ID, name)
+		if err != nil {
+			s.logger.Println("shipBackup: record upload failed:", err)
+			continue
+		}
+		uploadID, _ := res.LastInsertId()
+
+		var size int64
+		switch {
+		case broken[d.ID] != nil:
+			err = broken[d.ID]
+		case encryptErr != nil:
+			err = encryptErr // never ship plaintext when encryption is configured
+		default:
+			size, err = uploadFile(d.Target, src, name)
+		}
+
+		status, errText := "success", ""
+		if err != nil {
+			status, errText = "failed", err.Error()
+			s.logger.Printf("shipBackup: %s to destination %q failed: %v", name, d.Name, err)
+		} else {
+			s.logger.Printf("shipBackup: %s uploaded to destination %q", name, d.Name)
+		}
+		s.systemDB.Exec(`
+			UPDATE backup_uploads SET status = ?, error = ?, size_bytes = ?, completed_at = CURRENT_TIMESTAMP, duration_ms = ?
+			WHERE id = ?
+		`, status, errText, size, time.Since(started).Milliseconds(), uploadID)
+	}
+}
+
+func uploadFile(target BackupTarget, src, name string) (int64, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backupUploadTimeout)
+	defer cancel()
+	return info.Size(), target.Put(ctx, name, f, info.Size())
+}
+
+// pruneRemoteCopies deletes the shipped copies of a backup that local
+// retention just removed.
+func (s *Server) pruneRemoteCopies(backupID int64) {
+	type upload struct {
+		id         int64
+		remoteName string
+		destType   string
+		config     string
+	}
+	rows, err := s.systemDB.Query(`
+		SELECT u.id, u.remote_name, d.type, d.config
+		FROM backup_uploads u JOIN backup_destinations d ON d.id = u.destination_id
+		WHERE u.backup_id = ? AND u.status = 'success'
+	`, backupID)
+	if err != nil {
+		s.logger.Println("pruneRemoteCopies: query error:", err)
+		return
+	}
+	var uploads []upload
+	for rows.Next() {
+		var u upload
+		if err := rows.Scan(&u.id, &u.remoteName, &u.destType, &u.config); err == nil {
+			uploads = append(uploads, u)
+		}
+	}
+	rows.Close()
+
+	for _, u := range uploads {
+		target, err := newStoredBackupTarget(s.destinationSealKey(), u.destType, u.config)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			err = target.Delete(ctx, u.remoteName)
+			cancel()
+		}
+		if err != nil {
+			s.logger.Printf("pruneRemoteCopies: delete %s failed: %v", u.remoteName, err)
+			continue
+		}
+		s.systemDB.Exec("UPDATE backup_uploads SET status = 'pruned' WHERE id = ?", u.id)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestDestinationSecretsAreSealed(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, dataKeySize)
+	config := json.RawMessage(`{"host":"nas","user":"backup","password":"hunter22","path":"/b","host_key":"x"}`)
+	stored, err := sealDestinationSecrets(key, "sftp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "hunter22") {
+		t.Fatalf("password stored in plaintext: %s", stored)
+	}
+
+	// Sealing again keeps the sealed value
+	again, err := sealDestinationSecrets(key, "sftp", json.RawMessage(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := openDestinationConfig(key, "sftp", again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c SFTPDestinationConfig
+	json.Unmarshal(opened, &c)
+	if c.Password != "hunter22" || c.User != "backup" {
+		t.Fatalf("opened config = %+v", c)
+	}
+
+	// Plaintext configs from before sealing still open
+	if opened, err := openDestinationConfig(key, "sftp", string(config)); err != nil || !bytes.Contains(opened, []byte("hunter22")) {
+		t.Fatalf("legacy config: %s, %v", opened, err)
+	}
+
+	// Another key gets an error naming the field, not garbage
+	if _, err := openDestinationConfig(bytes.Repeat([]byte{8}, dataKeySize), "sftp", stored); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Fatalf("open with wrong key = %v", err)
+	}
+}
+
+// TestS3DestinationMinIO ships an archive to a MinIO server and prunes it
+// again. It needs a running MinIO, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	GUARDIAN_TEST_MINIO=localhost:9000 go test -run MinIO
+//
+// GUARDIAN_TEST_MINIO_ACCESS_KEY and GUARDIAN_TEST_MINIO_SECRET_KEY default
+// to minioadmin.
+func TestS3DestinationMinIO(t *testing.T) {
+	endpoint := os.Getenv("GUARDIAN_TEST_MINIO")
+	if endpoint == "" {
+		t.Skip("GUARDIAN_TEST_MINIO not set")
+	}
+	accessKey := envOr("GUARDIAN_TEST_MINIO_ACCESS_KEY", "minioadmin")
+	secretKey := envOr("GUARDIAN_TEST_MINIO_SECRET_KEY", "minioadmin")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := minio.New(endpoint, &minio.Options{Creds: credentials.NewStaticV4(accessKey, secretKey, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := fmt.Sprintf("guardian-test-%d", time.Now().UnixNano())
+	if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for obj := range client.ListObjects(context.Background(), bucket, minio.ListObjectsOptions{Recursive: true}) {
+			client.RemoveObject(context.Background(), bucket, obj.Key, minio.RemoveObjectOptions{})
+		}
+		client.RemoveBucket(context.Background(), bucket)
+	})
+
+	s := newTestServer(t)
+	config, _ := json.Marshal(S3DestinationConfig{
+		Endpoint:        endpoint,
+		Bucket:          bucket,
+		Prefix:          "guardian",
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		DisableTLS:      true,
+		PathStyle:       true,
+	})
+	stored, err := sealDestinationSecrets(s.destinationSealKey(), "s3", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.systemDB.Exec("INSERT INTO backup_destinations (name, type, config, enabled) VALUES ('minio', 's3', ?, 1)", stored); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := newStoredBackupTarget(s.destinationSealKey(), "s3", stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Check(ctx); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	archive := []byte("not really a tarball")
+	filename := "guardian-backup-test-1.tar.gz"
+	if err := os.MkdirAll(s.config.BackupDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.config.BackupDir, filename), archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.shipBackup(1, filename)
+
+	var status, uploadErr string
+	s.systemDB.QueryRow("SELECT status, COALESCE(error, '') FROM backup_uploads WHERE backup_id = 1").Scan(&status, &uploadErr)
+	if status != "success" {
+		t.Fatalf("upload status = %q (%s)", status, uploadErr)
+	}
+	obj, err := client.GetObject(ctx, bucket, "guardian/"+filename, minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Fatalf("stored object = %q", got)
+	}
+
+	s.pruneRemoteCopies(1)
+
+	if _, err := client.StatObject(ctx, bucket, "guardian/"+filename, minio.StatObjectOptions{}); err == nil {
+		t.Fatal("object still present after pruning")
+	}
+	s.systemDB.QueryRow("SELECT status FROM backup_uploads WHERE backup_id = 1").Scan(&status)
+	if status != "pruned" {
+		t.Fatalf("upload status after prune = %q", status)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runTestBackup starts a manual backup, waits for it and returns its record.
+func runTestBackup(t *testing.T, s *Server) BackupRecord {
+	t.Helper()
+	id, err := s.startBackup("manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.backupMu.Lock()
+	s.backupMu.Unlock()
+	b, err := scanBackupRecord(s.systemDB.QueryRow("SELECT "+backupColumns+" FROM backups WHERE id = ?", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// readArchiveManifest returns the manifest of an archive and the names of
+// all entries in it.
+func readArchiveManifest(t *testing.T, path string) (BackupManifest, []string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest BackupManifest
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == backupManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sort.Strings(names)
+	return manifest, names
+}
+
+// TestBackupArchive checks that a backup holds every vault and finished
+// attachment, and that its checksums match the record and the sidecar.
+func TestBackupArchive(t *testing.T) {
+	s := newTestServer(t)
+	alice := addTestUser(t, s, "alice")
+	addTestUser(t, s, "bob")
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "a", EncryptedBlob: "blob"}}))
+	dir := attachmentDirFor(s.config.DataDir, "alice.db")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "done"), []byte("attachment"), 0600)
+	os.WriteFile(filepath.Join(dir, "upload.part"), []byte("half"), 0600)
+
+	b := runTestBackup(t, s)
+	if b.Status != "success" || b.DBCount != 3 || b.FileCount != 4 || b.Trigger != "manual" {
+		t.Fatalf("backup = %+v", b)
+	}
+
+	path := filepath.Join(s.config.BackupDir, b.Filename)
+	sum, err := fileSHA256(path)
+	if err != nil || sum != b.SHA256 {
+		t.Fatalf("archive sha256 %s, record says %s (%v)", sum, b.SHA256, err)
+	}
+	sidecar, _ := os.ReadFile(path + ".sha256")
+	if string(sidecar) != b.SHA256+"  "+b.Filename+"\n" {
+		t.Fatalf("sidecar = %q", sidecar)
+	}
+
+	manifest, names := readArchiveManifest(t, path)
+	want := []string{"alice.attachments/done", "alice.db", "bob.db", backupManifestName, "system.db"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("archive entries = %v, want %v", names, want)
+	}
+	for _, f := range manifest.Files {
+		if f.Path == "alice.db" && (f.UserID != alice || f.Username != "alice" || f.Kind != "vault") {
+			t.Fatalf("alice's manifest entry = %+v", f)
+		}
+	}
+
+	if entries, _ := filepath.Glob(filepath.Join(s.config.BackupDir, ".staging-*")); len(entries) != 0 {
+		t.Fatalf("staging left behind: %v", entries)
+	}
+}
+
+// TestBackupRetention checks that only the newest backup_retention_count
+// archives are kept and that pruned runs stay in the history.
+func TestBackupRetention(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "alice")
+	if _, err := s.systemDB.Exec("INSERT OR REPLACE INTO server_settings (key, value) VALUES ('backup_retention_count', '2')"); err != nil {
+		t.Fatal(err)
+	}
+
+	var backups []BackupRecord
+	for range 3 {
+		backups = append(backups, runTestBackup(t, s))
+	}
+
+	w := httptest.NewRecorder()
+	s.handleListBackups(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	list := decode[BackupListResponse](t, w)
+	if len(list.Backups) != 3 || list.Schedule.Enabled || list.Schedule.NextRunAt != nil {
+		t.Fatalf("list = %+v", list)
+	}
+	for i, b := range list.Backups {
+		pruned := i == 2
+		if (b.PrunedAt != nil) != pruned {
+			t.Fatalf("backup %d pruned = %v, want %v", b.ID, b.PrunedAt != nil, pruned)
+		}
+		_, err := os.Stat(filepath.Join(s.config.BackupDir, b.Filename))
+		if os.IsNotExist(err) != pruned {
+			t.Fatalf("archive of backup %d: %v", b.ID, err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetPathValue("id", strconv.FormatInt(backups[0].ID, 10))
+	w = httptest.NewRecorder()
+	s.handleDownloadBackup(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("download of pruned backup: %d, want 404", w.Code)
+	}
+}
+
+// TestBackupSchedule checks that scheduled backups are opt-in, that only a
+// successful run counts as done and that failures wait for the retry delay.
+func TestBackupSchedule(t *testing.T) {
+	s := newTestServer(t)
+	if sched := s.backupSchedule(); sched.Enabled || sched.IntervalHours != defaultBackupInterval {
+		t.Fatalf("default schedule = %+v", sched)
+	}
+	sched := BackupSchedule{Enabled: true, IntervalHours: 24}
+	if !s.backupDue(sched) {
+		t.Fatal("no backups yet, want due")
+	}
+
+	insert := func(status string, age time.Duration) {
+		t.Helper()
+		s.systemDB.Exec("DELETE FROM backups")
+		_, err := s.systemDB.Exec("INSERT INTO backups (trigger, status, started_at) VALUES ('scheduled', ?, ?)",
+			status, time.Now().UTC().Add(-age).Format("2006-01-02 15:04:05"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		status string
+		age    time.Duration
+		due    bool
+	}{
+		{"success", time.Hour, false},
+		{"success", 25 * time.Hour, true},
+		{"failed", time.Minute, false},
+		{"failed", backupRetryDelay + time.Minute, true},
+	} {
+		insert(tc.status, tc.age)
+		if due := s.backupDue(sched); due != tc.due {
+			t.Fatalf("%s run %s ago: due = %v, want %v", tc.status, tc.age, due, tc.due)
+		}
+	}
+
+	s.backupMu.Lock()
+	w := httptest.NewRecorder()
+	s.handleCreateBackup(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	s.backupMu.Unlock()
+	if w.Code != http.StatusConflict {
+		t.Fatalf("backup while one runs: %d, want 409", w.Code)
+	}
+}
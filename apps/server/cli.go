@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// --- Command Line Modes ---
+//
+// Without arguments the binary runs the server. The commands below are for
+// offline maintenance; stop the server before restoring into its data dir.
+
+var cliCommands = map[string]func(args []string) int{
+	"restore":         cmdRestore,
+	"verify":          cmdVerify,
+	"restore-replica": cmdRestoreReplica,
+	"migrate":         cmdMigrate,
+	"rotate-keys":     cmdRotateKeys,
+}
+
+// isCLICommand reports whether the process was started in a maintenance mode.
+func isCLICommand(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	_, ok := cliCommands[args[1]]
+	return ok
+}
+
+// runCLI dispatches a maintenance command and returns the exit code.
+func runCLI(args []string) int {
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+	return cmd(args[1:])
+}
+
+func cmdRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "./data", "data directory to restore into")
+	user := fs.String("user", "", "restore only this user (username or id) and their users row")
+	force := fs.Bool("force", false, "replace an existing data directory (it is moved aside, not deleted)")
+	identity := fs.String("identity", "", "age identity file for encrypted (.age) archives")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: guardian-server restore [--data-dir DIR] [--user NAME|ID] [--force] [--identity FILE] ARCHIVE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	archive := fs.Arg(0)
+	identities, err := loadAgeIdentities(*identity)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *user != "" {
+		u, err := restoreUser(archive, *dataDir, *user, identities)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "restore failed:", err)
+			return 1
+		}
+		fmt.Printf("Restored user %d (%s) from %s into %s\n", u.ID, u.Username, archive, *dataDir)
+		return 0
+	}
+
+	movedAside, err := restoreWholeServer(archive, *dataDir, *force, identities)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+	if movedAside != "" {
+		fmt.Printf("Previous data directory kept at %s\n", movedAside)
+	}
+	fmt.Printf("Restored %s into %s\n", archive, *dataDir)
+	return 0
+}
+
+// cmdVerify restores each archive into a temp dir and checks it. The exit
+// code is non-zero if any archive fails, so it can drive scheduled drills.
+func cmdVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print reports as JSON")
+	identity := fs.String("identity", "", "age identity file for encrypted (.age) archives")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: guardian-server verify [--json] [--identity FILE] ARCHIVE...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	identities, err := loadAgeIdentities(*identity)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	exit := 0
+	for _, archive := range fs.Args() {
+		report, err := verifyBackupArchive(archive, identities)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", archive, err)
+			exit = 1
+			continue
+		}
+		if !report.OK {
+			exit = 1
+		}
+
+		if *asJSON {
+			json.NewEncoder(os.Stdout).Encode(report)
+			continue
+		}
+		if report.OK {
+			fmt.Printf("%s: OK (%d databases, %d attachments)\n", archive, report.Databases, report.Attachments)
+			continue
+		}
+		fmt.Printf("%s: FAILED\n", archive)
+		for _, p := range report.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	return exit
+}
+
+// cmdRestoreReplica rebuilds a data directory from a WAL replica as of a
+// point in time (default: the latest shipped transaction).
+func cmdRestoreReplica(args []string) int {
+	fs := flag.NewFlagSet("restore-replica", flag.ExitOnError)
+	replicaDir := fs.String("replica-dir", os.Getenv("REPLICA_DIR"), "replica directory (defaults to $REPLICA_DIR)")
+	dataDir := fs.String("data-dir", "./data", "data directory to restore into")
+	at := fs.String("at", "", "restore to what had been shipped by this time (RFC 3339, e.g. 2026-01-02T15:04:05Z); default is latest")
+	force := fs.Bool("force", false, "replace an existing data directory (it is moved aside, not deleted)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: guardian-server restore-replica --replica-dir DIR [--data-dir DIR] [--at TIME] [--force]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *replicaDir == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	target := time.Now()
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid --at:", err)
+			return 2
+		}
+		target = t
+	}
+
+	if err := checkRestoreTarget(*dataDir, *force); err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(filepath.Clean(*dataDir)), ".guardian-restore-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+
+	report, err := restoreReplicaDataDir(context.Background(), localReplicaTarget{dir: *replicaDir}, tmp, target)
+	if err != nil {
+		os.RemoveAll(tmp)
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+	movedAside, err := installDataDir(tmp, *dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	if movedAside != "" {
+		fmt.Printf("Previous data directory kept at %s\n", movedAside)
+	}
+	fmt.Printf("Restored %s as of %s into %s\n", *replicaDir, target.UTC().Format(time.RFC3339), *dataDir)
+	return 0
+}
+
+// cmdMigrate applies pending schema migrations to system.db and every user
+// vault ahead of a server start. "migrate status" only reports versions. It
+// refuses to change anything while a server runs on the data directory.
+func cmdMigrate(args []string) int {
+	status := len(args) > 0 && args[0] == "status"
+	if status {
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "./data", "data directory to migrate")
+	backupDir := fs.String("backup-dir", envOr("BACKUP_DIR", "./backups"), "pre-migration snapshots go to pre-migrate/ under this directory")
+	dryRun := fs.Bool("dry-run", false, "run pending migrations in a transaction and roll them back")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: guardian-server migrate [status] [--data-dir DIR] [--backup-dir DIR] [--dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	systemPath := filepath.Join(*dataDir, "system.db")
+	if _, err := os.Stat(systemPath); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+
+	// A running server migrates vaults as it opens them and keeps their
+	// connections; changing the schema underneath it isn't safe.
+	switch release, err := lockDataDir(*dataDir); {
+	case err == nil:
+		defer release()
+	case status && errors.Is(err, errDataDirLocked):
+		fmt.Fprintf(os.Stderr, "migrate: warning: %s is in use by a running server\n", *dataDir)
+	case errors.Is(err, errDataDirLocked):
+		fmt.Fprintf(os.Stderr, "migrate: %s is in use by a running server; stop it first\n", *dataDir)
+		return 1
+	case !status:
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+
+	// The users list is read before system.db is migrated; id and db_path
+	// exist in every schema version.
+	sysDB, err := openSQLite(systemPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	defer sysDB.Close()
+	vaults, err := listUserVaults(sysDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate: list users:", err)
+		return 1
+	}
+
+	logger := log.New(os.Stdout, "", 0)
+	exit := 0
+	run := func(label string, db *sql.DB, path string, ms []migration) {
+		current, pending, err := pendingMigrations(db, ms)
+		switch {
+		case err != nil:
+			fmt.Printf("%s: %v\n", label, err)
+			exit = 1
+			return
+		case len(pending) == 0:
+			fmt.Printf("%s: version %d, up to date\n", label, current)
+			return
+		}
+
+		names := make([]string, len(pending))
+		for i, m := range pending {
+			names[i] = fmt.Sprintf("%d (%s)", m.version, m.name)
+		}
+		fmt.Printf("%s: version %d, pending %s\n", label, current, strings.Join(names, ", "))
+
+		switch {
+		case status:
+		case *dryRun:
+			if err := dryRunMigrations(db, pending); err != nil {
+				fmt.Printf("%s: dry run failed: %v\n", label, err)
+				exit = 1
+			}
+		default:
+			if err := migrateDB(db, path, ms, preMigrateDir(*backupDir), logger); err != nil {
+				fmt.Printf("%s: %v\n", label, err)
+				exit = 1
+			}
+		}
+	}
+
+	run("system.db", sysDB, systemPath, systemMigrations)
+	for _, v := range vaults {
+		label := fmt.Sprintf("%s (%s)", v.DBPath, v.Username)
+		path := filepath.Join(*dataDir, v.DBPath)
+		if !isPlainFilename(v.DBPath) {
+			fmt.Printf("%s: invalid db_path\n", label)
+			exit = 1
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			fmt.Printf("%s: missing\n", label)
+			exit = 1
+			continue
+		}
+		db, err := openSQLite(path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", label, err)
+			exit = 1
+			continue
+		}
+		run(label, db, path, userMigrations)
+		db.Close()
+	}
+	return exit
+}
+
+// listUserVaults returns every user's id, name and vault filename.
+func listUserVaults(sysDB *sql.DB) ([]snapshotUser, error) {
+	rows, err := sysDB.Query("SELECT id, username, db_path FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []snapshotUser
+	for rows.Next() {
+		var u snapshotUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.DBPath); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// envOr returns the environment variable key, or fallback if it is unset.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// loadAgeIdentities reads an age identity file; an empty path means none.
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// cmdRotateKeys starts a new JWT signing key. A running server picks it up
+// on its next token; the old key keeps verifying for the grace period.
+func cmdRotateKeys(args []string) int {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "./data", "data directory holding "+keyRingFilename)
+	alg := fs.String("alg", keyAlgHS256, "algorithm of the new key: HS256 or EdDSA")
+	graceHours := fs.Int("grace-hours", defaultJWTKeyGraceHours, "hours the previous key keeps verifying tokens")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: guardian-server rotate-keys [--data-dir DIR] [--alg HS256|EdDSA] [--grace-hours N]")
+		fmt.Fprintln(fs.Output(), "JWT_SECRET must be set to the server's secret.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *graceHours < 0 {
+		fs.Usage()
+		return 2
+	}
+	if SecretKey == "" {
+		fmt.Fprintln(os.Stderr, "rotate-keys: JWT_SECRET is not set")
+		return 1
+	}
+
+	keys, err := openKeyRing(*dataDir, SecretKey, *alg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rotate-keys:", err)
+		return 1
+	}
+	key, err := keys.Rotate(*alg, time.Duration(*graceHours)*time.Hour)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rotate-keys:", err)
+		return 1
+	}
+	fmt.Printf("now signing with %s key %s\n", key.Alg, key.KID)
+	for _, k := range keys.Info() {
+		if !k.Active {
+			fmt.Printf("  %s key %s verifies until %s\n", k.Alg, k.KID, k.VerifyUntil.Format(time.RFC3339))
+		}
+	}
+	return 0
+}
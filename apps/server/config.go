@@ -5,14 +5,16 @@ import (
 	"log"
 	"os"
 	"strings"
-	"time"
 )
 
 // --- Configuration ---
 var (
-	SecretKey     string
-	TokenDuration = 24 * time.Hour
-	Version       = "dev" // Default version, will be overridden by CI/CD during tagged builds
+	SecretKey string
+	// DefaultTombstoneRetentionDays is used when server_settings has no
+	// tombstone_retention_days. Clients whose cursor predates compaction must
+	// do a full resync.
+	DefaultTombstoneRetentionDays = 90
+	Version                       = "dev" // Default version, will be overridden by CI/CD during tagged builds
 )
 
 func init() {
@@ -20,6 +22,10 @@ func init() {
 	loadEnv()
 
 	SecretKey = os.Getenv("JWT_SECRET")
+}
+
+// requireSecretKey stops the server when JWT_SECRET is missing.
+func requireSecretKey() {
 	if SecretKey == "" {
 		log.Println("WARNING: JWT_SECRET environment variable is not set.")
 		log.Fatal("Please set JWT_SECRET in your .env file or environment variables to secure your tokens.")
@@ -53,6 +59,13 @@ func loadEnv() {
 }
 
 type Config struct {
-	Port    string
-	DataDir string
-}
\ No newline at end of file
+	Port      string
+	DataDir   string
+	BackupDir string // snapshot archives; keep it off the data volume if possible
+	// ReplicaDir receives continuous WAL replication; empty disables it
+	ReplicaDir string
+	// WebAuthn relying party. Security keys and passkeys are off until both
+	// are set.
+	WebAuthnRPID    string
+	WebAuthnOrigins []string
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// --- Data Directory Lock ---
+//
+// The server holds an exclusive lock on DATA_DIR/server.lock while it runs,
+// so maintenance commands that rewrite databases can tell that it is up. The
+// lock is released by the OS when the process exits, even after a crash.
+
+const dataDirLockName = "server.lock"
+
+var errDataDirLocked = errors.New("data directory is in use by a running server")
+
+// lockDataDir takes the data directory lock. It returns errDataDirLocked if
+// another process holds it; release drops it.
+func lockDataDir(dataDir string) (release func(), err error) {
+	f, err := os.OpenFile(filepath.Join(dataDir, dataDirLockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
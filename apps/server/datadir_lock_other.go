@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// tryLockFile is a no-op where flock is not available; maintenance commands
+// can't detect a running server there.
+func tryLockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+)
+
+// --- Data Key ---
+//
+// Secrets the server has to read back, TOTP secrets and backup destination
+// credentials, are sealed with keys derived from a random data key instead of
+// JWT_SECRET itself. The data key is kept in system.db, wrapped with a key
+// derived from JWT_SECRET, so it travels with backups and replicas but is
+// useless without the secret.
+
+const dataKeySize = 32
+
+// loadDataKey unwraps the data key of system.db, creating it on first start.
+func (s *Server) loadDataKey() error {
+	wrapKey := deriveKey(SecretKey, "data key")
+
+	var wrapped []byte
+	err := s.systemDB.QueryRow("SELECT wrapped_key FROM data_key WHERE id = 1").Scan(&wrapped)
+	if err == sql.ErrNoRows {
+		return s.createDataKey(wrapKey)
+	} else if err != nil {
+		return err
+	}
+	key, err := unseal(wrapKey, wrapped)
+	if err != nil {
+		return fmt.Errorf("the data key in system.db can't be decrypted with JWT_SECRET; " +
+			"start the server with the JWT_SECRET it was created with")
+	}
+	s.dataKey = key
+	return nil
+}
+
+// createDataKey stores a new data key.
+func (s *Server) createDataKey(wrapKey []byte) error {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	wrapped, err := seal(wrapKey, key)
+	if err != nil {
+		return err
+	}
+	if _, err := s.systemDB.Exec("INSERT INTO data_key (id, wrapped_key) VALUES (1, ?)", wrapped); err != nil {
+		return err
+	}
+	s.dataKey = key
+	s.logger.Println("loadDataKey: created the data key")
+	return nil
+}
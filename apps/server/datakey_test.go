@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestDataKeyReload checks that the key is created once and a restart
+// unwraps the same one.
+func TestDataKeyReload(t *testing.T) {
+	s := newTestServer(t)
+	key := s.dataKey
+	if len(key) != dataKeySize {
+		t.Fatalf("data key of %d bytes", len(key))
+	}
+	if err := s.loadDataKey(); err != nil || string(s.dataKey) != string(key) {
+		t.Fatalf("reload: %v", err)
+	}
+}
+
+func TestDataKeyWrongSecret(t *testing.T) {
+	s := newTestServer(t)
+
+	defer func(v string) { SecretKey = v }(SecretKey)
+	SecretKey = "another secret"
+	if err := s.loadDataKey(); err == nil || !strings.Contains(err.Error(), "JWT_SECRET") {
+		t.Fatalf("loadDataKey with another secret = %v", err)
+	}
+}
+
+func TestTOTPSecretUnsealable(t *testing.T) {
+	s := newTestServer(t)
+	res, err := s.systemDB.Exec("INSERT INTO users (username, password_hash, db_path) VALUES ('bob', 'x', 'bob.db')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := res.LastInsertId()
+	if _, err := s.systemDB.Exec("INSERT INTO user_totp (user_id, secret) VALUES (?, ?)", userID, []byte("not sealed with the data key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.totpSecret(int(userID)); !errors.Is(err, errTOTPUnsealable) {
+		t.Fatalf("totpSecret = %v, want errTOTPUnsealable", err)
+	}
+}
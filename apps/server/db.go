@@ -3,8 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log"
+	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	// Register the pure-Go SQLite driver ("sqlite") with database/sql.
 	_ "modernc.org/sqlite"
@@ -12,14 +18,24 @@ import (
 
 // --- DB Init ---
 
+// walAutoCheckpoint is off while WAL replication runs; see replication.go.
+var walAutoCheckpoint = true
+
 // sqliteDSN builds a proper DSN for modernc.org/sqlite with PRAGMAs baked in.
 // This ensures WAL mode and busy_timeout are applied to EVERY connection that
-// Go's database/sql pool opens, not just the first one.
+// Go's database/sql pool opens, not just the first one. Without
+// walAutoCheckpoint only the replicator resets a WAL, never before its frames
+// have been shipped.
 func sqliteDSN(path string) string {
-	return fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)", path)
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)", path)
+	if !walAutoCheckpoint {
+		dsn += "&_pragma=wal_autocheckpoint(0)"
+	}
+	return dsn
 }
 
-func initSystemDB(path string) (*sql.DB, error) {
+// openSQLite opens a database with a single connection.
+func openSQLite(path string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite", sqliteDSN(path))
 	if err != nil {
 		return nil, err
@@ -31,82 +47,204 @@ func initSystemDB(path string) (*sql.DB, error) {
 	db.SetMaxOpenConns(1)
 
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		is_admin BOOLEAN DEFAULT 0,
-		db_path TEXT NOT NULL,
-		friendly_name TEXT,
-		status TEXT DEFAULT 'ACTIVE',
-		role TEXT DEFAULT 'User',
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		last_login DATETIME
-	);
-
-	CREATE TABLE IF NOT EXISTS invites (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		token TEXT UNIQUE NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME,
-		expires_in TEXT,
-		used_at DATETIME,
-		use_count INTEGER DEFAULT 0,
-		max_uses INTEGER DEFAULT 1,
-		created_by INTEGER NOT NULL,
-		note TEXT,
-		status TEXT DEFAULT 'ACTIVE',
-		used_by TEXT,
-		FOREIGN KEY(created_by) REFERENCES users(id)
-	);
-	`
-	_, err = db.Exec(query)
-
-	// Migrations
-	db.Exec("ALTER TABLE invites ADD COLUMN used_by TEXT")
-	db.Exec("ALTER TABLE users ADD COLUMN status TEXT DEFAULT 'ACTIVE'")
-	db.Exec("ALTER TABLE users ADD COLUMN role TEXT DEFAULT 'User'")
-	db.Exec("ALTER TABLE users ADD COLUMN last_login DATETIME")
-	db.Exec("ALTER TABLE users ADD COLUMN preferences TEXT DEFAULT '{}'")
-	db.Exec("ALTER TABLE users ADD COLUMN salt TEXT DEFAULT ''")
-	db.Exec("ALTER TABLE users ADD COLUMN max_ws_per_ip INTEGER DEFAULT 0")
-
-	db.Exec(`
-		CREATE TABLE IF NOT EXISTS server_settings (
-			key TEXT PRIMARY KEY,
-			value TEXT NOT NULL
-		)
-	`)
+// initSystemDB opens system.db and applies pending migrations, copying the
+// database to snapshotDir first if there are any. logger may be nil.
+func initSystemDB(path, snapshotDir string, logger *log.Logger) (*sql.DB, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateDB(db, path, systemMigrations, snapshotDir, logger); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Setting defaults
 	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('max_ws_per_ip_default', '0')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('tombstone_retention_days', ?)", strconv.Itoa(DefaultTombstoneRetentionDays))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('history_max_revisions_default', ?)", strconv.Itoa(defaultHistoryMaxRevisions))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('history_max_age_days_default', ?)", strconv.Itoa(defaultHistoryMaxAgeDays))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('trash_retention_days_default', ?)", strconv.Itoa(defaultTrashRetentionDays))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('attachment_max_bytes', ?)", strconv.Itoa(defaultAttachmentMaxBytes))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('quota_max_items_default', '0')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('quota_max_bytes_default', '0')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('quota_max_blob_bytes_default', '0')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('backup_schedule_enabled', '0')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('backup_interval_hours', ?)", strconv.Itoa(defaultBackupInterval))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('backup_retention_count', ?)", strconv.Itoa(defaultBackupRetain))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('backup_verify_interval_hours', '0')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('backup_encryption_recipient', '')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('replica_snapshot_interval_hours', ?)", strconv.Itoa(defaultReplicaSnapshotHrs))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('replica_retention_hours', ?)", strconv.Itoa(defaultReplicaRetentionHrs))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('access_token_ttl_minutes', ?)", strconv.Itoa(defaultAccessTokenMinutes))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('refresh_token_ttl_days', ?)", strconv.Itoa(defaultRefreshTokenDays))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('jwt_signing_alg', 'HS256')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('require_2fa', 'off')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('webauthn_attestation', 'none')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('webauthn_allowed_aaguids', '')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('jwt_key_grace_hours', ?)", strconv.Itoa(defaultJWTKeyGraceHours))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('kdf_min_memory', ?)", strconv.Itoa(kdfDefaultMemory))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('kdf_min_iterations', ?)", strconv.Itoa(kdfDefaultIterations))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('kdf_min_pbkdf2_iterations', ?)", strconv.Itoa(defaultKDFMinPBKDF2Iterations))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('admin_recovery', 'off')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('admin_recovery_public_key', '')")
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_free_attempts', ?)", strconv.Itoa(defaultLoginFreeAttempts))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_ip_free_attempts', ?)", strconv.Itoa(defaultLoginIPFreeAttempts))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_invite_free_attempts', ?)", strconv.Itoa(defaultLoginInviteFreeAttempts))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_backoff_base_seconds', ?)", strconv.Itoa(defaultLoginBackoffBase))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_backoff_max_seconds', ?)", strconv.Itoa(defaultLoginBackoffMax))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_lockout_threshold', ?)", strconv.Itoa(defaultLoginLockoutThreshold))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_lockout_minutes', ?)", strconv.Itoa(defaultLoginLockoutMinutes))
+	db.Exec("INSERT OR IGNORE INTO server_settings (key, value) VALUES ('login_failure_window_minutes', ?)", strconv.Itoa(defaultLoginFailureWindow))
 
-	return db, err
+	return db, nil
 }
 
+// initUserDB creates a new user's vault database.
 func initUserDB(path string) error {
-	db, err := sql.Open("sqlite", sqliteDSN(path))
+	db, err := openSQLite(path)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	db.SetMaxOpenConns(1)
+	return migrateDB(db, path, userMigrations, "", nil)
+}
+
+// nextVaultSeq allocates the next change sequence number inside tx.
+func nextVaultSeq(tx *sql.Tx) (int64, error) {
+	var seq int64
+	err := tx.QueryRow("UPDATE vault_meta SET value = value + 1 WHERE key = 'last_seq' RETURNING value").Scan(&seq)
+	return seq, err
+}
+
+// writeVaultItem stores blob as the given revision of an item, archiving the
+// previous revision and clearing any tombstone or trash entry.
+func writeVaultItem(tx *sql.Tx, id, blob string, revision int) error {
+	seq, err := nextVaultSeq(tx)
+	if err != nil {
+		return err
+	}
+	if err := archiveVaultItem(tx, id); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO vault_items (id, encrypted_blob, revision, updated_at, seq) 
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+		ON CONFLICT(id) DO UPDATE SET 
+			encrypted_blob=excluded.encrypted_blob, 
+			revision=excluded.revision,
+			updated_at=CURRENT_TIMESTAMP,
+			seq=excluded.seq
+	`, id, blob, revision, seq)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM vault_trash WHERE id = ?", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM vault_tombstones WHERE id = ?", id)
+	return err
+}
+
+// deleteVaultItem removes an item, moves its blob to the trash for trashDays
+// and records a tombstone for the change feed.
+func deleteVaultItem(tx *sql.Tx, id string, revision int, trashDays int) error {
+	seq, err := nextVaultSeq(tx)
+	if err != nil {
+		return err
+	}
+	if err := archiveVaultItem(tx, id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO vault_trash (id, encrypted_blob, revision, deleted_at, purge_at)
+		SELECT id, encrypted_blob, revision, CURRENT_TIMESTAMP, datetime('now', ?) FROM vault_items WHERE id = ?
+	`, fmt.Sprintf("+%d days", trashDays), id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM vault_items WHERE id = ?", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO vault_tombstones (id, revision, seq, deleted_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(id) DO UPDATE SET revision = excluded.revision, seq = excluded.seq, deleted_at = CURRENT_TIMESTAMP
+	`, id, revision, seq)
+	return err
+}
+
+// archiveVaultItem copies the live revision of an item (if any) into its history.
+func archiveVaultItem(tx *sql.Tx, id string) error {
+	_, err := tx.Exec(`
+		INSERT OR REPLACE INTO vault_item_history (item_id, revision, encrypted_blob, updated_at, archived_at)
+		SELECT id, revision, encrypted_blob, updated_at, CURRENT_TIMESTAMP FROM vault_items WHERE id = ?
+	`, id)
+	return err
+}
 
-	query := `
-	CREATE TABLE IF NOT EXISTS vault_items (
-		id TEXT PRIMARY KEY,
-		encrypted_blob TEXT NOT NULL,
-		revision INTEGER DEFAULT 0,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-	_, err = db.Exec(query)
+// pruneItemHistory keeps only the newest maxRevisions archived revisions of an item.
+func pruneItemHistory(tx *sql.Tx, id string, maxRevisions int) error {
+	_, err := tx.Exec(`
+		DELETE FROM vault_item_history WHERE item_id = ? AND revision NOT IN (
+			SELECT revision FROM vault_item_history WHERE item_id = ? ORDER BY revision DESC LIMIT ?
+		)
+	`, id, id, maxRevisions)
 	return err
 }
 
+// pruneHistoryByAge drops archived revisions older than maxAge across the vault.
+func pruneHistoryByAge(db *sql.DB, maxAge time.Duration) (int64, error) {
+	res, err := db.Exec(
+		"DELETE FROM vault_item_history WHERE archived_at < datetime('now', ?)",
+		fmt.Sprintf("-%d seconds", int64(maxAge.Seconds())),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// compactTombstones drops tombstones older than the retention window and raises
+// the compacted_seq floor so clients with older cursors are told to resync.
+func compactTombstones(db *sql.DB, retention time.Duration) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var maxSeq sql.NullInt64
+	if err := tx.QueryRow(
+		"SELECT MAX(seq) FROM vault_tombstones WHERE deleted_at < datetime('now', ?)",
+		fmt.Sprintf("-%d seconds", int64(retention.Seconds())),
+	).Scan(&maxSeq); err != nil {
+		return 0, err
+	}
+	if !maxSeq.Valid {
+		return 0, nil
+	}
+
+	res, err := tx.Exec("DELETE FROM vault_tombstones WHERE seq <= ?", maxSeq.Int64)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE vault_meta SET value = MAX(value, ?) WHERE key = 'compacted_seq'", maxSeq.Int64); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // getUserDB returns a cached *sql.DB for the user's vault database.
 // Connections are pooled per-user and reused across requests.
 // IMPORTANT: Do NOT call db.Close() on the returned connection.
@@ -119,21 +257,38 @@ func (s *Server) getUserDB(ctx context.Context) (*sql.DB, error) {
 		return nil, fmt.Errorf("user not found")
 	}
 
+	return s.openUserDB(dbFilename)
+}
+
+// errVaultMissing is returned for a user whose vault file is gone.
+var errVaultMissing = errors.New("vault file missing")
+
+// openUserDB returns the cached connection for a vault file in DataDir,
+// opening it and applying pending migrations on first use. A missing file is
+// reported as errVaultMissing rather than created empty; vaults are only
+// created by registration and by an admin reconcile with recreate_missing.
+func (s *Server) openUserDB(dbFilename string) (*sql.DB, error) {
 	fullPath := filepath.Join(s.config.DataDir, dbFilename)
 
 	// Check cache first
 	if cached, ok := s.userDBs.Load(fullPath); ok {
 		return cached.(*sql.DB), nil
 	}
+	if _, err := os.Stat(fullPath); errors.Is(err, fs.ErrNotExist) {
+		return nil, errVaultMissing
+	}
 
 	// Open new connection with PRAGMAs baked into DSN
-	db, err := sql.Open("sqlite", sqliteDSN(fullPath))
+	db, err := openSQLite(fullPath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Single connection for SQLite to avoid SQLITE_BUSY
-	db.SetMaxOpenConns(1)
+	// Vaults are migrated lazily, on first open after an upgrade
+	if err := migrateDB(db, fullPath, userMigrations, preMigrateDir(s.config.BackupDir), s.logger); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// Cache it (if another goroutine raced us, use theirs and close ours)
 	actual, loaded := s.userDBs.LoadOrStore(fullPath, db)
@@ -143,4 +298,89 @@ func (s *Server) getUserDB(ctx context.Context) (*sql.DB, error) {
 	}
 
 	return db, nil
-}
\ No newline at end of file
+}
+
+// forEachUserVault opens every user's vault DB and calls fn with it.
+// Users whose DB can't be opened are logged and skipped; missing vaults are
+// skipped quietly, reconciliation and the user list already report them.
+func (s *Server) forEachUserVault(fn func(userID int, dbPath string, db *sql.DB)) {
+	type userVault struct {
+		id   int
+		path string
+	}
+
+	// Collect first: with MaxOpenConns(1) the open Rows would block fn's own queries.
+	rows, err := s.systemDB.Query("SELECT id, db_path FROM users")
+	if err != nil {
+		s.logger.Println("forEachUserVault: query error:", err)
+		return
+	}
+	var vaults []userVault
+	for rows.Next() {
+		var v userVault
+		if err := rows.Scan(&v.id, &v.path); err == nil {
+			vaults = append(vaults, v)
+		}
+	}
+	rows.Close()
+
+	for _, v := range vaults {
+		db, err := s.openUserDB(v.path)
+		if err == errVaultMissing {
+			continue
+		} else if err != nil {
+			s.logger.Printf("forEachUserVault: open %s failed: %v", v.path, err)
+			continue
+		}
+		fn(v.id, v.path, db)
+	}
+}
+
+// compactAllTombstones applies the tombstone retention window to every user vault.
+func (s *Server) compactAllTombstones() {
+	retention := time.Duration(s.getSettingInt("tombstone_retention_days", DefaultTombstoneRetentionDays)) * 24 * time.Hour
+	s.forEachUserVault(func(userID int, dbPath string, db *sql.DB) {
+		if n, err := compactTombstones(db, retention); err != nil {
+			s.logger.Printf("compactAllTombstones: %s failed: %v", dbPath, err)
+		} else if n > 0 {
+			s.logger.Printf("compactAllTombstones: removed %d tombstones from %s", n, dbPath)
+		}
+	})
+}
+
+// getSetting returns a server_settings value, or "" if it is not set.
+func (s *Server) getSetting(key string) string {
+	var val string
+	if err := s.systemDB.QueryRow("SELECT value FROM server_settings WHERE key = ?", key).Scan(&val); err != nil && err != sql.ErrNoRows {
+		s.logger.Printf("getSetting: %s: %v", key, err)
+	}
+	return val
+}
+
+// getSettingInt reads a positive integer from server_settings, returning
+// fallback if the key is missing or invalid.
+func (s *Server) getSettingInt(key string, fallback int) int {
+	var val string
+	if err := s.systemDB.QueryRow("SELECT value FROM server_settings WHERE key = ?", key).Scan(&val); err != nil {
+		return fallback
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// getSettingInt64 reads a non-negative integer from server_settings, returning
+// 0 if the key is missing or invalid.
+func (s *Server) getSettingInt64(key string) int64 {
+	var val string
+	if err := s.systemDB.QueryRow("SELECT value FROM server_settings WHERE key = ?", key).Scan(&val); err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Two-Factor Authentication ---
+//
+// Users enroll a TOTP secret or register a WebAuthn authenticator (see
+// handlers_webauthn.go) and get one-time recovery codes with their first
+// method. From then on a correct password at /auth/login only yields an
+// mfa_token, which /auth/login/2fa exchanges together with a code, or
+// /auth/webauthn/login/finish with an assertion, for a session. TOTP secrets
+// are sealed with the data key, which JWT_SECRET wraps (see datakey.go).
+//
+// The require_2fa setting ("off", "admins" or "all") makes 2FA mandatory.
+// Until an affected user has enrolled, their tokens only reach the 2FA and
+// session endpoints.
+
+const (
+	mfaLoginTTL         = 5 * time.Minute
+	mfaLoginMaxAttempts = 5
+)
+
+type pendingMFALogin struct {
+	userID     int
+	deviceName string
+	clientType string
+	expiresAt  time.Time
+	attempts   int
+}
+
+var (
+	pendingMFALogins   = make(map[string]*pendingMFALogin)
+	pendingMFALoginsMu sync.Mutex
+)
+
+// errTOTPUnsealable means a stored TOTP secret doesn't open with the data key.
+var errTOTPUnsealable = errors.New("TOTP secret can't be decrypted with the data key")
+
+// totpSealKey encrypts TOTP secrets at rest.
+func (s *Server) totpSealKey() []byte {
+	return deriveKey(string(s.dataKey), "totp")
+}
+
+// twoFactorError logs err and answers 500, saying so when a TOTP secret
+// can't be decrypted: only an admin reset gets the user past that.
+func (s *Server) twoFactorError(w http.ResponseWriter, where string, err error) {
+	s.logger.Printf("%s: %v", where, err)
+	if errors.Is(err, errTOTPUnsealable) {
+		http.Error(w, "Two-factor secret can't be decrypted; ask an admin to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "Database error", http.StatusInternalServerError)
+}
+
+// twoFactorRequired reports whether the require_2fa setting applies to a user.
+func (s *Server) twoFactorRequired(isAdmin bool) bool {
+	switch s.getSetting("require_2fa") {
+	case "all":
+		return true
+	case "admins":
+		return isAdmin
+	}
+	return false
+}
+
+// mfaSetupAllowed lists the paths a user who still has to enroll may use.
+func mfaSetupAllowed(path string) bool {
+	return strings.HasPrefix(path, "/api/2fa") || strings.HasPrefix(path, "/api/sessions")
+}
+
+// totpSecret returns a user's decrypted TOTP secret and whether enrollment
+// has been confirmed. It returns sql.ErrNoRows if the user has none.
+func (s *Server) totpSecret(userID int) (string, bool, error) {
+	var sealed []byte
+	var enabled bool
+	err := s.systemDB.QueryRow("SELECT secret, enabled_at IS NOT NULL FROM user_totp WHERE user_id = ?", userID).Scan(&sealed, &enabled)
+	if err != nil {
+		return "", false, err
+	}
+	secret, err := unseal(s.totpSealKey(), sealed)
+	if err != nil {
+		return "", false, fmt.Errorf("user %d: %w", userID, errTOTPUnsealable)
+	}
+	return string(secret), enabled, nil
+}
+
+// mfaMethods lists the second factors a user has set up.
+func (s *Server) mfaMethods(userID int) ([]string, error) {
+	var totp, webAuthn bool
+	err := s.systemDB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ?1 AND enabled_at IS NOT NULL),
+		       EXISTS(SELECT 1 FROM webauthn_credentials WHERE user_id = ?1)
+	`, userID).Scan(&totp, &webAuthn)
+	if err != nil {
+		return nil, err
+	}
+	methods := []string{}
+	if totp {
+		methods = append(methods, "totp")
+	}
+	if webAuthn {
+		methods = append(methods, "webauthn")
+	}
+	if len(methods) > 0 {
+		methods = append(methods, "recovery_code")
+	}
+	return methods, nil
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery code,
+// which is used up.
+func (s *Server) verifySecondFactor(userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	// TOTP codes are 6 digits, recovery codes 16 characters
+	if len(strings.ReplaceAll(code, " ", "")) == totpDigits {
+		secret, enabled, err := s.totpSecret(userID)
+		if err == sql.ErrNoRows || (err == nil && !enabled) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		step, ok := verifyTOTP(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		// Each code works once
+		res, err := s.systemDB.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := s.systemDB.Exec(`
+		UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n == 1 {
+		s.logger.Printf("verifySecondFactor: user %d used a recovery code", userID)
+	}
+	return n == 1, nil
+}
+
+// replaceRecoveryCodes discards a user's recovery codes and issues new ones.
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(c)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// pruneRecoveryCodes deletes a user's recovery codes once no second factor is
+// left for them to stand in for.
+func pruneRecoveryCodes(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`
+		DELETE FROM recovery_codes WHERE user_id = ?1
+		AND NOT EXISTS (SELECT 1 FROM user_totp WHERE user_id = ?1 AND enabled_at IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = ?1)
+	`, userID)
+	return err
+}
+
+// takeMFALogin returns a pending login that hasn't expired.
+func takeMFALogin(token string) (*pendingMFALogin, bool) {
+	pendingMFALoginsMu.Lock()
+	defer pendingMFALoginsMu.Unlock()
+	login, ok := pendingMFALogins[token]
+	if ok && time.Now().After(login.expiresAt) {
+		delete(pendingMFALogins, token)
+		return nil, false
+	}
+	return login, ok
+}
+
+func finishMFALogin(token string) {
+	pendingMFALoginsMu.Lock()
+	delete(pendingMFALogins, token)
+	pendingMFALoginsMu.Unlock()
+}
+
+// startMFALogin parks a login that passed the password check and returns the
+// token for its second step.
+func startMFALogin(userID int, deviceName, clientType string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	pendingMFALoginsMu.Lock()
+	defer pendingMFALoginsMu.Unlock()
+	for k, v := range pendingMFALogins {
+		if now.After(v.expiresAt) {
+			delete(pendingMFALogins, k)
+		}
+	}
+	pendingMFALogins[token] = &pendingMFALogin{
+		userID:     userID,
+		deviceName: deviceName,
+		clientType: clientType,
+		expiresAt:  now.Add(mfaLoginTTL),
+	}
+	return token, nil
+}
+
+// handleLoginMFA finishes a login with a TOTP or recovery code.
+func (s *Server) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	pendingMFALoginsMu.Lock()
+	login, ok := pendingMFALogins[req.MFAToken]
+	if ok && time.Now().After(login.expiresAt) {
+		delete(pendingMFALogins, req.MFAToken)
+		ok = false
+	}
+	if ok {
+		login.attempts++
+		if login.attempts >= mfaLoginMaxAttempts {
+			// Last try; a wrong code means signing in again
+			delete(pendingMFALogins, req.MFAToken)
+		}
+	}
+	pendingMFALoginsMu.Unlock()
+	if !ok {
+		http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	// The per-token attempt limit alone would let an attacker who has the
+	// password keep starting new logins
+	throttle := []throttleKey{s.usernameThrottle(login.userID), ipThrottle(r)}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return
+	}
+
+	valid, err := s.verifySecondFactor(login.userID, req.Code)
+	if err != nil {
+		s.twoFactorError(w, "handleLoginMFA", err)
+		return
+	}
+	if !valid {
+		s.recordLoginFailure(r, throttle...)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	finishMFALogin(req.MFAToken)
+	s.completeSecondFactorLogin(w, r, login.userID, login.deviceName, login.clientType)
+}
+
+// completeSecondFactorLogin signs in a user who passed a second factor (or a
+// passkey), re-checking the account status since the first step.
+func (s *Server) completeSecondFactorLogin(w http.ResponseWriter, r *http.Request, userID int, deviceName, clientType string) {
+	var username, salt, status string
+	var isAdmin bool
+	err := s.systemDB.QueryRow("SELECT username, is_admin, salt, COALESCE(NULLIF(status, ''), 'ACTIVE') FROM users WHERE id = ?",
+		userID).Scan(&username, &isAdmin, &salt, &status)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status == UserStatusDisabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+	s.completeLogin(w, r, userID, username, isAdmin, salt, status, deviceName, clientType, false)
+}
+
+func (s *Server) handleGetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	var st TwoFactorStatus
+	var isAdmin bool
+	err := s.systemDB.QueryRow(`
+		SELECT u.is_admin,
+		       EXISTS(SELECT 1 FROM user_totp WHERE user_id = u.id AND enabled_at IS NOT NULL),
+		       (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = u.id),
+		       (SELECT COUNT(*) FROM recovery_codes WHERE user_id = u.id AND used_at IS NULL)
+		FROM users u WHERE u.id = ?
+	`, userID).Scan(&isAdmin, &st.TOTPEnabled, &st.WebAuthnCredentials, &st.RecoveryCodesLeft)
+	if err != nil {
+		s.logger.Println("handleGetTwoFactor:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	st.Required = s.twoFactorRequired(isAdmin)
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleEnrollTOTP creates a TOTP secret. It takes effect once confirmed;
+// enrolling again before that replaces it.
+func (s *Server) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	var username string
+	if err := s.systemDB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	sealed, err := seal(s.totpSealKey(), []byte(secret))
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := s.systemDB.Exec(`
+		INSERT INTO user_totp (user_id, secret) VALUES (?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_step = 0, created_at = CURRENT_TIMESTAMP
+		WHERE enabled_at IS NULL
+	`, userID, sealed)
+	if err != nil {
+		s.logger.Println("handleEnrollTOTP:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, TOTPEnrollResponse{Secret: secret, OTPAuthURL: totpURL(username, secret)})
+}
+
+// handleConfirmTOTP enables 2FA once the user proves their app has the secret,
+// and returns the recovery codes. They are shown only this once.
+func (s *Server) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	secret, enabled, err := s.totpSecret(userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No pending enrollment", http.StatusConflict)
+		return
+	} else if err != nil {
+		s.twoFactorError(w, "handleConfirmTOTP", err)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	step, ok := verifyTOTP(secret, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP, last_step = ? WHERE user_id = ? AND enabled_at IS NULL", step, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil || tx.Commit() != nil {
+		s.logger.Println("handleConfirmTOTP: recovery codes:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("handleConfirmTOTP: user %d enabled two-factor authentication", userID)
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP turns 2FA off. It takes the password and a current code,
+// so a stolen session alone can't remove the second factor.
+func (s *Server) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var isAdmin, webAuthn bool
+	err := s.systemDB.QueryRow("SELECT is_admin, EXISTS(SELECT 1 FROM webauthn_credentials WHERE user_id = users.id) FROM users WHERE id = ?",
+		userID).Scan(&isAdmin, &webAuthn)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !webAuthn && s.twoFactorRequired(isAdmin) {
+		http.Error(w, "Two-factor authentication is required on this server", http.StatusForbidden)
+		return
+	}
+	if !s.verifyUserSecret(w, r, userID, req.Password, req.AuthHash) {
+		return
+	}
+	valid, err := s.verifySecondFactor(userID, req.Code)
+	if err != nil {
+		s.twoFactorError(w, "handleDisableTOTP", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.removeTOTP(userID); err != nil {
+		s.logger.Println("handleDisableTOTP:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("handleDisableTOTP: user %d disabled two-factor authentication", userID)
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// handleRegenerateRecoveryCodes replaces all recovery codes after checking a
+// current code.
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	valid, err := s.verifySecondFactor(userID, req.Code)
+	if err != nil {
+		s.twoFactorError(w, "handleRegenerateRecoveryCodes", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil || tx.Commit() != nil {
+		s.logger.Println("handleRegenerateRecoveryCodes:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// removeTOTP deletes a user's TOTP secret, and their recovery codes if no
+// authenticator is left.
+func (s *Server) removeTOTP(userID int) error {
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if err := pruneRecoveryCodes(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeTwoFactor deletes all of a user's second factors and recovery codes.
+func (s *Server) removeTwoFactor(userID int) error {
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"user_totp", "webauthn_credentials", "recovery_codes"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleAdminResetTwoFactor removes a user's 2FA, e.g. after they lost their
+// device and recovery codes, and signs out their devices: whoever has the
+// lost device may be signed in on it. If 2FA is required they must enroll
+// again.
+func (s *Server) handleAdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	adminID := r.Context().Value(userIDKey).(int)
+
+	if err := s.removeTwoFactor(id); err != nil {
+		s.logger.Println("handleAdminResetTwoFactor:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	revoked, err := s.revokeUserSessions(id, "", revokedCloseReason)
+	if err != nil {
+		s.logger.Println("handleAdminResetTwoFactor:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, adminID, id, "2fa.reset", fmt.Sprintf("%d sessions revoked", revoked))
+	s.logger.Printf("handleAdminResetTwoFactor: admin %d reset two-factor authentication of user %d", adminID, id)
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Two-factor authentication reset"})
+}
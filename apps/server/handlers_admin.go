@@ -11,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"filippo.io/age"
 )
 
 // --- Admin Handlers ---
@@ -198,10 +200,16 @@ func (s *Server) handleDeleteInvite(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleListUsers lists all users. Item counts are the ones last stored by the
+// stats sampler, so listing never opens a vault; a vault file that is gone is
+// reported as missing and empty.
 func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
-	s.logger.Println("handleListUsers: starting")
 	rows, err := s.systemDB.Query(`
-		SELECT id, username, is_admin, friendly_name, status, role, db_path, created_at, last_login, max_ws_per_ip
+		SELECT id, username, is_admin, friendly_name, status, role, db_path, created_at, last_login, max_ws_per_ip,
+			history_max_revisions, history_max_age_days, trash_retention_days,
+			quota_max_items, quota_max_bytes, quota_max_blob_bytes, vault_items,
+			EXISTS(SELECT 1 FROM user_totp t WHERE t.user_id = users.id AND t.enabled_at IS NOT NULL)
+			OR EXISTS(SELECT 1 FROM webauthn_credentials c WHERE c.user_id = users.id)
 		FROM users ORDER BY created_at DESC
 	`)
 	if err != nil {
@@ -214,43 +222,49 @@ func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
 	users := []AdminUserResponse{}
 	for rows.Next() {
 		var u User
+		var twoFactor bool
+		var vaultItems int
 		err := rows.Scan(
 			&u.ID, &u.Username, &u.IsAdmin, &u.FriendlyName,
 			&u.Status, &u.Role, &u.DBPath, &u.CreatedAt, &u.LastLogin, &u.MaxWsPerIP,
+			&u.HistoryMaxRevisions, &u.HistoryMaxAgeDays, &u.TrashRetentionDays,
+			&u.QuotaMaxItems, &u.QuotaMaxBytes, &u.QuotaMaxBlobBytes, &vaultItems, &twoFactor,
 		)
 		if err != nil {
 			s.logger.Println("User scan error:", err)
 			continue
 		}
 
-		s.logger.Printf("handleListUsers: processing user %d (%s)", u.ID, u.Username)
-
-		// Calculate used space (doesn't require opening DB)
-		var dbSize, overheadSize int64
 		userDBPath := filepath.Join(s.config.DataDir, u.DBPath)
-		s.logger.Printf("handleListUsers: checking file size at %s", userDBPath)
-		if info, err := os.Stat(userDBPath); err == nil {
-			dbSize = info.Size()
-		}
-		for _, suffix := range []string{"-wal", "-shm"} {
-			if info, err := os.Stat(userDBPath + suffix); err == nil {
-				overheadSize += info.Size()
-			}
+		dbSize, overheadSize := fileSizes(userDBPath)
+
+		vaultMissing := false
+		if _, err := os.Stat(userDBPath); os.IsNotExist(err) {
+			vaultMissing = true
+			vaultItems = 0
 		}
 
 		users = append(users, AdminUserResponse{
-			ID:                u.ID,
-			Username:          u.Username,
-			IsAdmin:           u.IsAdmin,
-			FriendlyName:      u.FriendlyName,
-			Status:            u.Status,
-			Role:              u.Role,
-			MaxWsPerIP:        u.MaxWsPerIP,
-			VaultItems:        0,
-			UsedSpace:         formatBytes(dbSize),
-			UsedSpaceOverhead: formatBytes(overheadSize),
-			CreatedAt:         u.CreatedAt,
-			LastLogin:         u.LastLogin,
+			ID:                  u.ID,
+			Username:            u.Username,
+			IsAdmin:             u.IsAdmin,
+			FriendlyName:        u.FriendlyName,
+			Status:              u.Status,
+			Role:                u.Role,
+			MaxWsPerIP:          u.MaxWsPerIP,
+			HistoryMaxRevisions: u.HistoryMaxRevisions,
+			HistoryMaxAgeDays:   u.HistoryMaxAgeDays,
+			TrashRetentionDays:  u.TrashRetentionDays,
+			QuotaMaxItems:       u.QuotaMaxItems,
+			QuotaMaxBytes:       u.QuotaMaxBytes,
+			QuotaMaxBlobBytes:   u.QuotaMaxBlobBytes,
+			VaultItems:          vaultItems,
+			VaultMissing:        vaultMissing,
+			UsedSpace:           formatBytes(dbSize),
+			UsedSpaceOverhead:   formatBytes(overheadSize),
+			TwoFactorEnabled:    twoFactor,
+			CreatedAt:           u.CreatedAt,
+			LastLogin:           u.LastLogin,
 		})
 	}
 
@@ -259,7 +273,6 @@ func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.logger.Printf("handleListUsers: processed %d users, sending response", len(users))
 	writeJSON(w, http.StatusOK, users)
 }
 
@@ -301,6 +314,54 @@ func (s *Server) handleUpdateSetting(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Key is required", http.StatusBadRequest)
 		return
 	}
+	if req.Key == "jwt_signing_alg" && req.Value != keyAlgHS256 && req.Value != keyAlgEdDSA {
+		http.Error(w, "jwt_signing_alg must be HS256 or EdDSA", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "require_2fa" && req.Value != "off" && req.Value != "admins" && req.Value != "all" {
+		http.Error(w, "require_2fa must be off, admins or all", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "webauthn_attestation" && req.Value != "none" && req.Value != "required" {
+		http.Error(w, "webauthn_attestation must be none or required", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "webauthn_allowed_aaguids" {
+		if _, err := parseAAGUIDList(req.Value); err != nil {
+			http.Error(w, "webauthn_allowed_aaguids must be a comma-separated list of AAGUIDs", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Key == "admin_recovery" && req.Value != "off" && req.Value != "optional" && req.Value != "required" {
+		http.Error(w, "admin_recovery must be off, optional or required", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "admin_recovery_public_key" && len(req.Value) > maxWrappedKeyLen {
+		http.Error(w, "admin_recovery_public_key is too long", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "backup_verify_interval_hours" {
+		if n, err := strconv.Atoi(req.Value); err != nil || n < 0 {
+			http.Error(w, "backup_verify_interval_hours must be 0 (off) or a number of hours", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Key == "attachment_max_bytes" {
+		if n, err := strconv.ParseInt(req.Value, 10, 64); err != nil || n <= 0 {
+			http.Error(w, "attachment_max_bytes must be a positive number of bytes", http.StatusBadRequest)
+			return
+		}
+	}
+	if !validKDFSetting(req.Key, req.Value) || !validLoginThrottleSetting(req.Key, req.Value) {
+		http.Error(w, req.Key+" is out of range", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "backup_encryption_recipient" && strings.TrimSpace(req.Value) != "" {
+		if _, err := age.ParseX25519Recipient(strings.TrimSpace(req.Value)); err != nil {
+			http.Error(w, "backup_encryption_recipient must be an age X25519 public key (age1...)", http.StatusBadRequest)
+			return
+		}
+	}
 
 	_, err := s.systemDB.Exec(`
 		INSERT INTO server_settings (key, value) VALUES (?, ?)
@@ -311,15 +372,33 @@ func (s *Server) handleUpdateSetting(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	if req.Key == "admin_recovery" || req.Key == "admin_recovery_public_key" {
+		adminID := r.Context().Value(userIDKey).(int)
+		s.audit(r, adminID, 0, "recovery.setting_changed", req.Key+" = "+req.Value)
+	}
 
 	writeJSON(w, http.StatusOK, map[string]string{"message": "Setting updated"})
 }
 
+// Upper bounds of the per-user overrides.
+const (
+	maxWsPerIPOverride          = 1000
+	maxHistoryRevisionsOverride = 1000
+	maxRetentionDaysOverride    = 3650
+)
+
 // handleUpdateUser updates fields on a user by ID
 type updateUserRequest struct {
-	MaxWsPerIP *int    `json:"max_ws_per_ip"`
-	Status     *string `json:"status"`
-	Role       *string `json:"role"`
+	MaxWsPerIP          *int    `json:"max_ws_per_ip"`
+	Status              *string `json:"status"`
+	Role                *string `json:"role"`
+	HistoryMaxRevisions *int    `json:"history_max_revisions"`
+	HistoryMaxAgeDays   *int    `json:"history_max_age_days"`
+	TrashRetentionDays  *int    `json:"trash_retention_days"`
+	// Quotas: 0 inherits the server default, -1 means unlimited
+	QuotaMaxItems     *int64 `json:"quota_max_items"`
+	QuotaMaxBytes     *int64 `json:"quota_max_bytes"`
+	QuotaMaxBlobBytes *int64 `json:"quota_max_blob_bytes"`
 }
 
 func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -336,27 +415,65 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.MaxWsPerIP != nil {
-		_, err := s.systemDB.Exec("UPDATE users SET max_ws_per_ip = ? WHERE id = ?", *req.MaxWsPerIP, id)
-		if err != nil {
-			s.logger.Println("handleUpdateUser: max_ws_per_ip error:", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
+	// Everything is checked before anything is written, and written in one
+	// transaction, so an edit is applied whole or not at all. 0 inherits the
+	// server default for the overrides.
+	type update struct {
+		column string
+		value  any
+	}
+	var updates []update
+	limits := []struct {
+		column string
+		value  *int
+		max    int
+	}{
+		{"max_ws_per_ip", req.MaxWsPerIP, maxWsPerIPOverride},
+		{"history_max_revisions", req.HistoryMaxRevisions, maxHistoryRevisionsOverride},
+		{"history_max_age_days", req.HistoryMaxAgeDays, maxRetentionDaysOverride},
+		{"trash_retention_days", req.TrashRetentionDays, maxRetentionDaysOverride},
+	}
+	for _, l := range limits {
+		if l.value == nil {
+			continue
+		}
+		if *l.value < 0 || *l.value > l.max {
+			http.Error(w, fmt.Sprintf("Invalid %s. Must be between 0 (server default) and %d", l.column, l.max), http.StatusBadRequest)
 			return
 		}
+		updates = append(updates, update{l.column, *l.value})
+	}
+
+	quotas := []struct {
+		column string
+		value  *int64
+	}{
+		{"quota_max_items", req.QuotaMaxItems},
+		{"quota_max_bytes", req.QuotaMaxBytes},
+		{"quota_max_blob_bytes", req.QuotaMaxBlobBytes},
+	}
+	for _, q := range quotas {
+		if q.value == nil {
+			continue
+		}
+		if *q.value < -1 {
+			http.Error(w, "Invalid "+q.column+". Use -1 for unlimited or 0 for the server default", http.StatusBadRequest)
+			return
+		}
+		updates = append(updates, update{q.column, *q.value})
 	}
 
 	if req.Status != nil {
-		validStatuses := map[string]bool{"ACTIVE": true, "DISABLED": true, "SUSPENDED": true}
+		validStatuses := map[string]bool{UserStatusActive: true, UserStatusDisabled: true, UserStatusSuspended: true}
 		if !validStatuses[*req.Status] {
 			http.Error(w, "Invalid status. Must be ACTIVE, DISABLED, or SUSPENDED", http.StatusBadRequest)
 			return
 		}
-		_, err := s.systemDB.Exec("UPDATE users SET status = ? WHERE id = ?", *req.Status, id)
-		if err != nil {
-			s.logger.Println("handleUpdateUser: status error:", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
+		if *req.Status != UserStatusActive && id == r.Context().Value(userIDKey).(int) {
+			http.Error(w, "You cannot disable or suspend your own account", http.StatusBadRequest)
 			return
 		}
+		updates = append(updates, update{"status", *req.Status})
 	}
 
 	if req.Role != nil {
@@ -365,13 +482,110 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid role. Must be User or Admin", http.StatusBadRequest)
 			return
 		}
-		_, err := s.systemDB.Exec("UPDATE users SET role = ?, is_admin = ? WHERE id = ?", *req.Role, *req.Role == "Admin", id)
-		if err != nil {
-			s.logger.Println("handleUpdateUser: role error:", err)
+		updates = append(updates, update{"role", *req.Role}, update{"is_admin", *req.Role == "Admin"})
+	}
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for _, u := range updates {
+		if _, err := tx.Exec("UPDATE users SET "+u.column+" = ? WHERE id = ?", u.value, id); err != nil {
+			s.logger.Println("handleUpdateUser: "+u.column+" error:", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		s.logger.Println("handleUpdateUser: commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Tokens are checked against status on every request; live connections
+	// are closed so clients pick up the change now.
+	if req.Status != nil {
+		switch *req.Status {
+		case UserStatusDisabled:
+			// Revoked too, so re-enabling the account doesn't revive old tokens
+			if _, err := s.revokeUserSessions(id, "", CloseReason{Code: wsCloseAccountDisabled, Text: "account disabled"}); err != nil {
+				s.logger.Println("handleUpdateUser: revoke sessions error:", err)
+			}
+			s.sseHub.DisconnectUser(id, CloseReason{Code: wsCloseAccountDisabled, Text: "account disabled"})
+		case UserStatusSuspended:
+			s.sseHub.DisconnectUser(id, CloseReason{Code: wsCloseAccountSuspended, Text: "account suspended"})
+		}
+	}
 
 	writeJSON(w, http.StatusOK, map[string]string{"message": "User updated"})
-}
\ No newline at end of file
+}
+
+// handleGetReconcileReport returns the result of the last vault reconciliation
+// (run at startup and by handleReconcile).
+func (s *Server) handleGetReconcileReport(w http.ResponseWriter, r *http.Request) {
+	report := s.lastReconcile.Load()
+	if report == nil {
+		http.Error(w, "No reconciliation has run", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleReconcile checks users against vault files now. With ?dry_run=true
+// it reports without moving or creating anything. Missing vaults are only
+// recreated empty with ?recreate_missing=true.
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(userIDKey).(int)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	recreate, _ := strconv.ParseBool(r.URL.Query().Get("recreate_missing"))
+
+	report, err := s.reconcileVaults("manual", dryRun, recreate)
+	if err != nil {
+		s.logger.Println("handleReconcile:", err)
+		http.Error(w, "Reconciliation failed", http.StatusInternalServerError)
+		return
+	}
+	for _, issue := range report.Issues {
+		if issue.Action == "recreated" && issue.Error == "" && !dryRun {
+			s.audit(r, adminID, issue.UserID, "vault.recreated", issue.File)
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleListJWTKeys lists the token signing keys (never their secrets).
+func (s *Server) handleListJWTKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.keys.Info())
+}
+
+// handleRotateJWTKeys starts signing with a new key. Tokens signed with the
+// old one stay valid for jwt_key_grace_hours.
+func (s *Server) handleRotateJWTKeys(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alg string `json:"alg"` // defaults to the jwt_signing_alg setting
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Alg == "" {
+		req.Alg = s.jwtSigningAlg()
+	}
+	if req.Alg != keyAlgHS256 && req.Alg != keyAlgEdDSA {
+		http.Error(w, "alg must be HS256 or EdDSA", http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.keys.Rotate(req.Alg, s.jwtKeyGrace())
+	if err != nil {
+		s.logger.Println("handleRotateJWTKeys:", err)
+		http.Error(w, "Key rotation failed", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("handleRotateJWTKeys: now signing with %s key %s", key.Alg, key.KID)
+	writeJSON(w, http.StatusOK, s.keys.Info())
+}
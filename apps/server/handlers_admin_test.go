@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// updateUser runs handleUpdateUser for userID as admin 1.
+func updateUser(t *testing.T, s *Server, userID int, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(data))
+	r.SetPathValue("id", strconv.Itoa(userID))
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, 1))
+	w := httptest.NewRecorder()
+	s.handleUpdateUser(w, r)
+	return w
+}
+
+// TestUpdateUserHistoryOverrides checks that the history overrides are
+// range-checked and that a rejected edit changes nothing.
+func TestUpdateUserHistoryOverrides(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+
+	for _, body := range []map[string]any{
+		{"history_max_revisions": -1},
+		{"history_max_age_days": maxRetentionDaysOverride + 1},
+		{"history_max_revisions": 5, "quota_max_items": -2},
+		{"history_max_revisions": 5, "status": "GONE"},
+	} {
+		if w := updateUser(t, s, userID, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("update %v: %d, want 400", body, w.Code)
+		}
+	}
+	if limits := s.getHistoryLimits(userID); limits.MaxRevisions != defaultHistoryMaxRevisions {
+		t.Fatalf("rejected edit stored max revisions %d", limits.MaxRevisions)
+	}
+
+	if w := updateUser(t, s, userID, map[string]any{"history_max_revisions": 5, "history_max_age_days": 7}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	if limits := s.getHistoryLimits(userID); limits.MaxRevisions != 5 || limits.MaxAgeDays != 7 {
+		t.Fatalf("limits = %+v, want 5 revisions and 7 days", limits)
+	}
+}
+
+// TestUpdateUserTrashRetention checks that the trash override is
+// range-checked and decides when a deleted item is purged.
+func TestUpdateUserTrashRetention(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := addTestUser(t, s, "alice"), addTestUser(t, s, "bob")
+
+	if w := updateUser(t, s, alice, map[string]any{"trash_retention_days": -1}); w.Code != http.StatusBadRequest {
+		t.Fatalf("negative retention: %d, want 400", w.Code)
+	}
+	if w := updateUser(t, s, alice, map[string]any{"trash_retention_days": 1}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	trashed := func(userID int) int64 {
+		t.Helper()
+		decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "blob"}}))
+		decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", Revision: 1}}))
+		db, err := s.getUserDB(context.WithValue(context.Background(), userIDKey, userID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Two days from now
+		n, err := purgeTrash(db, "purge_at < datetime('now', '+2 days')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := trashed(alice); n != 1 {
+		t.Fatalf("%d of alice's items purged after two days, want 1 with a 1-day override", n)
+	}
+	if n := trashed(bob); n != 0 {
+		t.Fatalf("bob's item purged after two days with the %d-day default", defaultTrashRetentionDays)
+	}
+}
+
+// TestListUsersVaultItems checks that the user list reports the item counts
+// stored by the stats collector and shows a missing vault as empty.
+func TestListUsersVaultItems(t *testing.T) {
+	s := newTestServer(t)
+	aliceID := addTestUser(t, s, "alice")
+	addTestUser(t, s, "bob")
+	if _, err := s.systemDB.Exec("UPDATE users SET friendly_name = username"); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := s.openUserDB("alice.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO vault_items (id, encrypted_blob, revision) VALUES ('a', 'x', 1), ('b', 'x', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(s.config.DataDir, "bob.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func() map[string]AdminUserResponse {
+		w := httptest.NewRecorder()
+		s.handleListUsers(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		users := decode[[]AdminUserResponse](t, w)
+		byName := map[string]AdminUserResponse{}
+		for _, u := range users {
+			byName[u.Username] = u
+		}
+		if len(byName) != 2 {
+			t.Fatalf("listed %d users, want 2", len(byName))
+		}
+		return byName
+	}
+
+	users := list()
+	if users["alice"].VaultItems != 0 || users["alice"].VaultMissing {
+		t.Fatalf("alice before sampling: %+v", users["alice"])
+	}
+	if !users["bob"].VaultMissing || users["bob"].VaultItems != 0 {
+		t.Fatalf("bob: %+v", users["bob"])
+	}
+
+	stats, err := s.collectStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.storeVaultItemCounts(stats)
+	if users = list(); users["alice"].VaultItems != 2 || users["alice"].ID != aliceID {
+		t.Fatalf("alice after sampling: %+v", users["alice"])
+	}
+	if !users["bob"].VaultMissing || users["bob"].VaultItems != 0 {
+		t.Fatalf("bob after sampling: %+v", users["bob"])
+	}
+}
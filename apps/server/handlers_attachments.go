@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- Vault Attachments ---
+//
+// Attachments are client-encrypted files linked to a vault item. The server
+// never sees plaintext: it stores the bytes under <uuid>.attachments/ next to
+// the user's <uuid>.db and checks them against the SHA-256 declared up front.
+//
+// Uploads are resumable: POST creates a pending attachment, then the client
+// PATCHes chunks with an Upload-Offset header. On 409 the response carries the
+// server's current offset so the client can continue from there.
+
+const (
+	attachmentMaxChunk        = 8 << 20 // 8 MiB per PATCH
+	defaultAttachmentMaxBytes = 100 << 20
+	attachmentIOWindow        = 2 * time.Minute
+)
+
+// attachmentMaxBytes is the largest attachment the server accepts, from the
+// attachment_max_bytes setting.
+func (s *Server) attachmentMaxBytes() int64 {
+	if n := s.getSettingInt64("attachment_max_bytes"); n > 0 {
+		return n
+	}
+	return defaultAttachmentMaxBytes
+}
+
+// attachmentUploadLocks serialises chunk writes per attachment id.
+var attachmentUploadLocks sync.Map // map[string]*sync.Mutex
+
+// getUserAttachmentDir returns the directory holding a user's attachment files.
+func (s *Server) getUserAttachmentDir(userID int) (string, error) {
+	var dbFilename string
+	if err := s.systemDB.QueryRow("SELECT db_path FROM users WHERE id = ?", userID).Scan(&dbFilename); err != nil {
+		return "", fmt.Errorf("user not found")
+	}
+	return attachmentDirFor(s.config.DataDir, dbFilename), nil
+}
+
+func attachmentDirFor(dataDir, dbFilename string) string {
+	return filepath.Join(dataDir, strings.TrimSuffix(dbFilename, ".db")+".attachments")
+}
+
+func attachmentPaths(dir, id string) (final, partial string) {
+	final = filepath.Join(dir, id)
+	return final, final + ".part"
+}
+
+// removeOrphanAttachments deletes attachments whose parent item is neither live
+// nor in the trash, so they disappear together with a purged item.
+func removeOrphanAttachments(db *sql.DB, dir string) (int, error) {
+	rows, err := db.Query(`
+		SELECT id FROM vault_attachments
+		WHERE item_id NOT IN (SELECT id FROM vault_items)
+		  AND item_id NOT IN (SELECT id FROM vault_trash)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		final, partial := attachmentPaths(dir, id)
+		os.Remove(final)
+		os.Remove(partial)
+		if _, err := db.Exec("DELETE FROM vault_attachments WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+func (s *Server) handleListAttachments(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("id")
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, item_id, encrypted_name, size, sha256, uploaded, status, created_at
+		FROM vault_attachments WHERE item_id = ? ORDER BY created_at
+	`, itemID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attachments := []VaultAttachment{}
+	for rows.Next() {
+		var a VaultAttachment
+		if err := rows.Scan(&a.ID, &a.ItemID, &a.EncryptedName, &a.Size, &a.SHA256, &a.Uploaded, &a.Status, &a.CreatedAt); err != nil {
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, attachments)
+}
+
+// handleCreateAttachment registers a pending upload for a live vault item.
+func (s *Server) handleCreateAttachment(w http.ResponseWriter, r *http.Request) {
+	itemID := r.PathValue("id")
+	userID := r.Context().Value(userIDKey).(int)
+
+	var req CreateAttachmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if sum, err := hex.DecodeString(req.SHA256); err != nil || len(sum) != sha256.Size {
+		http.Error(w, "sha256 must be a hex-encoded SHA-256 digest", http.StatusBadRequest)
+		return
+	}
+	if maxSize := s.attachmentMaxBytes(); req.Size <= 0 || req.Size > maxSize {
+		http.Error(w, fmt.Sprintf("size must be between 1 and %d bytes", maxSize), http.StatusBadRequest)
+		return
+	}
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	dir, err := s.getUserAttachmentDir(userID)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM vault_items WHERE id = ?", itemID).Scan(&exists); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	// Pending uploads count against the quota at their declared size.
+	usage, err := queryVaultUsage(db)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	quota := s.getVaultQuota(userID)
+	if qe := quota.checkBlob(req.Size, usage); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+	after := VaultUsage{Items: usage.Items, Bytes: usage.Bytes + req.Size}
+	if qe := quota.checkUsage(usage, after); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.logger.Println("handleCreateAttachment: mkdir error:", err)
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	a := VaultAttachment{
+		ID:            uuid.New().String(),
+		ItemID:        itemID,
+		EncryptedName: req.EncryptedName,
+		Size:          req.Size,
+		SHA256:        req.SHA256,
+		Status:        "PENDING",
+	}
+	_, partial := attachmentPaths(dir, a.ID)
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	err = db.QueryRow(`
+		INSERT INTO vault_attachments (id, item_id, encrypted_name, size, sha256, uploaded, status)
+		VALUES (?, ?, ?, ?, ?, 0, 'PENDING') RETURNING created_at
+	`, a.ID, a.ItemID, a.EncryptedName, a.Size, a.SHA256).Scan(&a.CreatedAt)
+	if err != nil {
+		os.Remove(partial)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", "0")
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// handleUploadAttachmentChunk appends one chunk at Upload-Offset. When the
+// last byte arrives the file's SHA-256 is checked; a mismatch discards the
+// upload so the client can start over.
+func (s *Server) handleUploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	userID := r.Context().Value(userIDKey).(int)
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset header required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	dir, err := s.getUserAttachmentDir(userID)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	lock, _ := attachmentUploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		http.Error(w, "Another upload for this attachment is in progress", http.StatusConflict)
+		return
+	}
+	defer mu.Unlock()
+
+	var size int64
+	var expectedSum, status string
+	err = db.QueryRow("SELECT size, sha256, status FROM vault_attachments WHERE id = ?", id).Scan(&size, &expectedSum, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status == "COMPLETE" {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(size, 10))
+		http.Error(w, "Upload already complete", http.StatusConflict)
+		return
+	}
+
+	// The partial file's length is the source of truth for the resume offset.
+	final, partial := attachmentPaths(dir, id)
+	info, err := os.Stat(partial)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	current := info.Size()
+	if offset != current {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(attachmentIOWindow))
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	limit := min(size-current, attachmentMaxChunk)
+	body := http.MaxBytesReader(w, r.Body, limit)
+	written, err := io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		// Keep whatever arrived intact; the client resumes from the new offset.
+		current += written
+		db.Exec("UPDATE vault_attachments SET uploaded = ? WHERE id = ?", current, id)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		http.Error(w, "Chunk too large or interrupted", http.StatusRequestEntityTooLarge)
+		return
+	}
+	current += written
+
+	if current < size {
+		db.Exec("UPDATE vault_attachments SET uploaded = ? WHERE id = ?", current, id)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sum, err := fileSHA256(partial)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	if sum != expectedSum {
+		os.Truncate(partial, 0)
+		db.Exec("UPDATE vault_attachments SET uploaded = 0 WHERE id = ?", id)
+		w.Header().Set("Upload-Offset", "0")
+		http.Error(w, "Checksum mismatch, upload discarded", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := os.Rename(partial, final); err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE vault_attachments SET uploaded = ?, status = 'COMPLETE', completed_at = CURRENT_TIMESTAMP WHERE id = ?", current, id); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	attachmentUploadLocks.Delete(id)
+
+	s.sseHub.BroadcastToUser(userID, "vault_updated")
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDownloadAttachment streams a completed attachment. Range requests are
+// supported so large downloads can resume too.
+func (s *Server) handleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	userID := r.Context().Value(userIDKey).(int)
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	dir, err := s.getUserAttachmentDir(userID)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	var sum, status string
+	var completedAt sql.NullTime
+	err = db.QueryRow("SELECT sha256, status, completed_at FROM vault_attachments WHERE id = ?", id).Scan(&sum, &status, &completedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status != "COMPLETE" {
+		http.Error(w, "Upload not complete", http.StatusConflict)
+		return
+	}
+
+	final, _ := attachmentPaths(dir, id)
+	f, err := os.Open(final)
+	if err != nil {
+		s.logger.Printf("handleDownloadAttachment: %s missing: %v", id, err)
+		http.Error(w, "Attachment content missing", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(attachmentIOWindow))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-SHA256", sum)
+	w.Header().Set("ETag", `"`+sum+`"`)
+	http.ServeContent(w, r, "", completedAt.Time, f)
+}
+
+func (s *Server) handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	userID := r.Context().Value(userIDKey).(int)
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	dir, err := s.getUserAttachmentDir(userID)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM vault_attachments WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	final, partial := attachmentPaths(dir, id)
+	os.Remove(final)
+	os.Remove(partial)
+	attachmentUploadLocks.Delete(id)
+
+	s.sseHub.BroadcastToUser(userID, "vault_updated")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// uploadChunk PATCHes data at offset into attachment id as userID.
+func uploadChunk(s *Server, userID int, id string, offset int64, data []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/", bytes.NewReader(data))
+	r.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	r.SetPathValue("id", id)
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	w := httptest.NewRecorder()
+	s.handleUploadAttachmentChunk(w, r)
+	return w
+}
+
+// created decodes the attachment from a 201 response.
+func created(t *testing.T, w *httptest.ResponseRecorder) VaultAttachment {
+	t.Helper()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var a VaultAttachment
+	if err := json.Unmarshal(w.Body.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestAttachmentUpload checks the resumable upload, the download with range
+// support and deletion of an attachment.
+func TestAttachmentUpload(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a1"}}))
+	content := []byte("encrypted attachment")
+	create := func(itemID string, req CreateAttachmentRequest) *httptest.ResponseRecorder {
+		return callPath(t, s.handleCreateAttachment, http.MethodPost, userID, req, "id", itemID)
+	}
+
+	if w := create("missing", CreateAttachmentRequest{Size: int64(len(content)), SHA256: sha256Hex(content)}); w.Code != http.StatusNotFound {
+		t.Fatalf("attachment on an unknown item: %d, want 404", w.Code)
+	}
+	w := create("a", CreateAttachmentRequest{Size: int64(len(content)), SHA256: sha256Hex(content)})
+	a := created(t, w)
+	if w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("new upload offset %q, want 0", w.Header().Get("Upload-Offset"))
+	}
+
+	if w := uploadChunk(s, userID, a.ID, 5, content[5:]); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("chunk at the wrong offset: %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := uploadChunk(s, userID, a.ID, 0, content[:5]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk: %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := callPath(t, s.handleDownloadAttachment, http.MethodGet, userID, nil, "id", a.ID); w.Code != http.StatusConflict {
+		t.Fatalf("download of a pending upload: %d, want 409", w.Code)
+	}
+	if w := uploadChunk(s, userID, a.ID, 5, content[5:]); w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+
+	w = callPath(t, s.handleDownloadAttachment, http.MethodGet, userID, nil, "id", a.ID)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) || w.Header().Get("X-Content-SHA256") != a.SHA256 {
+		t.Fatalf("download: %d %q", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=10-")
+	r.SetPathValue("id", a.ID)
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	w = httptest.NewRecorder()
+	s.handleDownloadAttachment(w, r)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[10:]) {
+		t.Fatalf("ranged download: %d %q", w.Code, w.Body)
+	}
+
+	if w := callPath(t, s.handleDeleteAttachment, http.MethodDelete, userID, nil, "id", a.ID); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if w := callPath(t, s.handleDownloadAttachment, http.MethodGet, userID, nil, "id", a.ID); w.Code != http.StatusNotFound {
+		t.Fatalf("download after delete: %d, want 404", w.Code)
+	}
+}
+
+// TestAttachmentChecksumAndLimit checks that an upload not matching its
+// declared digest is discarded and that the attachment_max_bytes setting
+// bounds the declared size.
+func TestAttachmentChecksumAndLimit(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a1"}}))
+	content := []byte("encrypted attachment")
+
+	a := created(t, callPath(t, s.handleCreateAttachment, http.MethodPost, userID,
+		CreateAttachmentRequest{Size: int64(len(content)), SHA256: sha256Hex([]byte("something else"))}, "id", "a"))
+	if w := uploadChunk(s, userID, a.ID, 0, content); w.Code != http.StatusUnprocessableEntity || w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("upload with the wrong digest: %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	if _, err := s.systemDB.Exec("INSERT OR REPLACE INTO server_settings (key, value) VALUES ('attachment_max_bytes', '10')"); err != nil {
+		t.Fatal(err)
+	}
+	w := callPath(t, s.handleCreateAttachment, http.MethodPost, userID,
+		CreateAttachmentRequest{Size: int64(len(content)), SHA256: sha256Hex(content)}, "id", "a")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("attachment above attachment_max_bytes: %d, want 400", w.Code)
+	}
+}
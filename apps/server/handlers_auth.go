@@ -1,18 +1,16 @@
 package main
 
 import (
-	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // --- Handlers ---
@@ -39,6 +37,11 @@ func (s *Server) handleValidateInvite(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	// Invite tokens and the setup code can be guessed like passwords
+	throttle := []throttleKey{ipThrottle(r), inviteThrottle}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return
+	}
 
 	var userCount int
 	s.systemDB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
@@ -47,6 +50,7 @@ func (s *Server) handleValidateInvite(w http.ResponseWriter, r *http.Request) {
 		// Setup Mode
 		setupCode := os.Getenv("ADMIN_INVITE_CODE")
 		if setupCode != "" && req.Token != setupCode {
+			s.recordLoginFailure(r, throttle...)
 			http.Error(w, "Invalid setup code", http.StatusForbidden)
 			return
 		}
@@ -57,6 +61,7 @@ func (s *Server) handleValidateInvite(w http.ResponseWriter, r *http.Request) {
 		var expiresAt *time.Time
 		err := s.systemDB.QueryRow("SELECT status, use_count, max_uses, expires_at FROM invites WHERE token = ?", req.Token).Scan(&status, &useCount, &maxUses, &expiresAt)
 		if err == sql.ErrNoRows {
+			s.recordLoginFailure(r, throttle...)
 			http.Error(w, "Invalid invite token", http.StatusForbidden)
 			return
 		}
@@ -85,6 +90,11 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	throttle := []throttleKey{ipThrottle(r), inviteThrottle}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return
+	}
+
 	// 1. Check User Count
 	var userCount int
 	s.systemDB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
@@ -97,6 +107,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		if setupCode != "" {
 			if req.InviteToken != setupCode {
 				s.logger.Println("Failed admin setup attempt: Invalid setup code")
+				s.recordLoginFailure(r, throttle...)
 				http.Error(w, "Invalid admin setup code", http.StatusForbidden)
 				return
 			}
@@ -122,6 +133,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		`, req.InviteToken).Scan(&inviteID, &useCount, &maxUses, &status, &expiresAt)
 
 		if err == sql.ErrNoRows {
+			s.recordLoginFailure(r, throttle...)
 			http.Error(w, "Invalid invite token", http.StatusForbidden)
 			return
 		} else if err != nil {
@@ -150,16 +162,25 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 2. Generate random salt for key derivation
-	salt := make([]byte, 16)
-	if _, err := rand.Read(salt); err != nil {
-		http.Error(w, "Failed to generate salt", http.StatusInternalServerError)
+	// 2. Credentials. New accounts start on the auth hash, derived by the
+	// client with its own salt and parameters; only logins of existing
+	// accounts still take a password.
+	saltB64, kdf := req.Salt, req.KDFParams
+	if !validEncoded(req.AuthHash, authHashSize) || !validEncoded(req.Salt, saltSize) {
+		http.Error(w, "Invalid auth hash or salt", http.StatusBadRequest)
+		return
+	}
+	if err := kdf.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.kdfMinimum().allows(kdf) {
+		http.Error(w, "KDF parameters are below the server minimum", http.StatusBadRequest)
 		return
 	}
-	saltB64 := base64.StdEncoding.EncodeToString(salt)
 
-	// 3. Hash Password
-	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	// 3. Hash the auth hash
+	hashed, err := hashAuthHash(req.AuthHash)
 	if err != nil {
 		http.Error(w, "Error processing password", http.StatusInternalServerError)
 		return
@@ -175,16 +196,56 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		friendlyName = req.Username
 	}
 
-	// 4. Create User in System DB
+	// 4. Create the vault, then the user row and invite update in a single
+	// transaction. A crash in between leaves only a vault file that belongs
+	// to nobody, which reconcileVaults quarantines; regMu keeps it from
+	// seeing the file before the row is committed.
 	role := "User"
 	if isAdmin {
 		role = "Admin"
 	}
 
-	res, err := s.systemDB.Exec(`
-		INSERT INTO users (username, password_hash, is_admin, db_path, friendly_name, status, role, salt) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, req.Username, string(hashed), isAdmin, dbFilename, friendlyName, "ACTIVE", role, saltB64)
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+
+	if err := initUserDB(dbPath); err != nil {
+		s.logger.Println("CRITICAL: Failed to init user db:", err)
+		removeVaultFiles(dbPath)
+		http.Error(w, "Failed to initialize storage", http.StatusInternalServerError)
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			removeVaultFiles(dbPath)
+		}
+	}()
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Two setup requests may have both seen an empty users table
+	if isAdmin {
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if userCount > 0 {
+			http.Error(w, "Setup already completed", http.StatusConflict)
+			return
+		}
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO users (username, password_hash, is_admin, db_path, friendly_name, status, role, salt, auth_scheme,
+			kdf, kdf_memory, kdf_iterations, kdf_parallelism) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.Username, hashed, isAdmin, dbFilename, friendlyName, "ACTIVE", role, saltB64, authSchemeHash,
+		kdf.KDF, kdf.KDFMemory, kdf.KDFIterations, kdf.KDFParallelism)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
@@ -198,9 +259,10 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 
 	newUserID, _ := res.LastInsertId()
 
-	// 5. Update Invite Usage (if applicable)
+	// 5. Consume the invite. The use_count check is repeated here so two
+	// registrations can't both take an invite's last use.
 	if !isAdmin {
-		_, err := s.systemDB.Exec(`
+		res, err := tx.Exec(`
 			UPDATE invites 
 			SET use_count = use_count + 1, 
 			    used_at = CURRENT_TIMESTAMP,
@@ -209,20 +271,25 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 					ELSE used_by || "," || CAST(? AS TEXT) 
 				END,
 			    status = CASE WHEN max_uses > 0 AND use_count + 1 >= max_uses THEN 'USED' ELSE status END
-			WHERE token = ?
+			WHERE token = ? AND status = 'ACTIVE' AND (max_uses <= 0 OR use_count < max_uses)
 		`, newUserID, newUserID, req.InviteToken)
 		if err != nil {
-			s.logger.Println("Warning: Failed to update invite usage:", err)
+			s.logger.Println("Register error: invite update:", err)
+			http.Error(w, "Registration failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Invite has reached maximum uses", http.StatusForbidden)
+			return
 		}
 	}
 
-	// 6. Init User Database
-	if err := initUserDB(dbPath); err != nil {
-		// Rollback user creation ideally, but for now just log error
-		s.logger.Println("CRITICAL: Failed to init user db:", err)
-		http.Error(w, "Failed to initialize storage", http.StatusInternalServerError)
+	if err := tx.Commit(); err != nil {
+		s.logger.Println("Register error: commit:", err)
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
 		return
 	}
+	committed = true
 
 	writeJSON(w, http.StatusCreated, map[string]string{"message": "User registered successfully"})
 }
@@ -233,13 +300,19 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	throttle := []throttleKey{userThrottle(req.Username), ipThrottle(r)}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return
+	}
 
 	var id int
-	var passwordHash string
+	var passwordHash, scheme string
 	var isAdmin bool
 	var salt string
-	err := s.systemDB.QueryRow("SELECT id, password_hash, is_admin, salt FROM users WHERE username = ?", req.Username).Scan(&id, &passwordHash, &isAdmin, &salt)
+	var status string
+	err := s.systemDB.QueryRow("SELECT id, password_hash, auth_scheme, is_admin, salt, COALESCE(NULLIF(status, ''), 'ACTIVE') FROM users WHERE username = ?", req.Username).Scan(&id, &passwordHash, &scheme, &isAdmin, &salt, &status)
 	if err == sql.ErrNoRows {
+		s.recordLoginFailure(r, throttle...)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -247,23 +320,59 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+	ok, upgrade := checkAuthSecret(passwordHash, scheme, req.Password, req.AuthHash)
+	if !ok {
+		s.recordLoginFailure(r, throttle...)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Retroactively generate salt for existing users who don't have one
-	if salt == "" {
-		rawSalt := make([]byte, 16)
-		if _, err := rand.Read(rawSalt); err != nil {
-			http.Error(w, "Failed to generate salt", http.StatusInternalServerError)
+	// Checked after the password so status doesn't reveal which usernames exist
+	if status == UserStatusDisabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	// The password proved it's the owner; from now on only the auth hash
+	// derived from it is accepted
+	if upgrade {
+		if err := s.upgradeAuthHash(id, req.AuthHash); err != nil {
+			s.logger.Println("handleLogin: auth hash upgrade:", err)
+		} else {
+			s.logger.Printf("handleLogin: user %d moved to auth hash login\n", id)
+		}
+	}
+
+	methods, err := s.mfaMethods(id)
+	if err != nil {
+		s.logger.Println("handleLogin: 2fa lookup:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(methods) > 0 {
+		mfaToken, err := startMFALogin(id, req.DeviceName, req.ClientType)
+		if err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
 			return
 		}
-		salt = base64.StdEncoding.EncodeToString(rawSalt)
-		s.systemDB.Exec("UPDATE users SET salt = ? WHERE id = ?", salt, id)
+		writeJSON(w, http.StatusOK, MFARequiredResponse{MFARequired: true, MFAToken: mfaToken, Methods: methods, ExpiresIn: int64(mfaLoginTTL.Seconds())})
+		return
 	}
 
-	token, err := createToken(id)
+	s.completeLogin(w, r, id, req.Username, isAdmin, salt, status, req.DeviceName, req.ClientType, s.twoFactorRequired(isAdmin))
+}
+
+// completeLogin opens a session for an authenticated user and writes the
+// AuthResponse.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, id int, username string, isAdmin bool, salt, status, deviceName, clientType string, mfaSetupRequired bool) {
+	sessionID, refreshToken, err := s.createSession(id, r, deviceName, clientType)
+	if err != nil {
+		s.logger.Println("completeLogin: create session:", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	accessTTL := s.accessTokenTTL()
+	token, err := s.createToken(id, sessionID, accessTTL)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
@@ -271,6 +380,173 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	// Update last login
 	s.systemDB.Exec("UPDATE users SET last_login = CURRENT_TIMESTAMP WHERE id = ?", id)
+	if _, err := s.clearLoginFailures(userThrottle(username)); err != nil {
+		s.logger.Println("completeLogin: clear login failures:", err)
+	}
 
-	writeJSON(w, http.StatusOK, AuthResponse{Token: token, Username: req.Username, IsAdmin: isAdmin, Salt: salt})
-}
\ No newline at end of file
+	writeJSON(w, http.StatusOK, AuthResponse{Token: token, Username: username, IsAdmin: isAdmin, Salt: salt, Status: status, SessionID: sessionID,
+		RefreshToken: refreshToken, ExpiresIn: int64(accessTTL.Seconds()), MFASetupRequired: mfaSetupRequired,
+		KDFUpgradeRequired: s.kdfUpgradeRequired(id),
+		RecoveryEscrowRequired: s.recoveryEscrowRequired(id),
+	})
+}
+
+// handleRefresh exchanges a refresh token for a new access token and a new
+// refresh token. The old refresh token stops working; presenting it again
+// revokes the session, since only a stolen copy would still be using it.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	hash := hashRefreshToken(req.RefreshToken)
+	// Read before Begin: the transaction holds the only connection
+	accessTTL, refreshTTL := s.accessTokenTTL(), s.refreshTokenTTL()
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sessionID, status string
+	var userID int
+	var used, expired, revoked bool
+	err = tx.QueryRow(`
+		SELECT t.session_id, s.user_id, COALESCE(NULLIF(u.status, ''), 'ACTIVE'),
+		       t.used_at IS NOT NULL, t.expires_at <= CURRENT_TIMESTAMP, s.revoked_at IS NOT NULL
+		FROM refresh_tokens t
+		JOIN sessions s ON s.id = t.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE t.token_hash = ?
+	`, hash).Scan(&sessionID, &userID, &status, &used, &expired, &revoked)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		s.logger.Println("handleRefresh: lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case revoked:
+		http.Error(w, "Session revoked", http.StatusUnauthorized)
+		return
+	case used:
+		tx.Rollback()
+		s.logger.Printf("handleRefresh: refresh token reused for session %s of user %d, revoking session", sessionID, userID)
+		if _, err := s.revokeSession(0, sessionID); err != nil {
+			s.logger.Println("handleRefresh: revoke error:", err)
+		}
+		http.Error(w, "Refresh token reuse detected; session revoked", http.StatusUnauthorized)
+		return
+	case expired:
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	case status == UserStatusDisabled:
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = ?", hash); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	refreshToken, err := issueRefreshToken(tx, sessionID, refreshTTL)
+	if err != nil {
+		s.logger.Println("handleRefresh: issue error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := s.createToken(userID, sessionID, accessTTL)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, RefreshResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTTL.Seconds()),
+		SessionID:    sessionID,
+	})
+}
+
+// handleJWKS publishes the public keys that verify EdDSA-signed tokens.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, s.keys.JWKS())
+}
+
+// handleChangePassword switches the signed-in user to a new master password.
+// The client sends the auth hash derived from it, the new salt and the vault
+// re-encrypted under the new key; all of it is applied together or not at
+// all. Every other session is signed out afterwards.
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	sessionID := r.Context().Value(sessionIDKey).(string)
+	var req ChangePasswordRequest
+	if !decodeRekeyRequest(w, r, &req) {
+		return
+	}
+	if !validEncoded(req.NewAuthHash, authHashSize) || !validEncoded(req.Salt, saltSize) {
+		http.Error(w, "Invalid auth hash or salt", http.StatusBadRequest)
+		return
+	}
+
+	kdf := req.KDFParams
+	if kdf.KDF == "" {
+		err := s.systemDB.QueryRow("SELECT kdf, kdf_memory, kdf_iterations, kdf_parallelism FROM users WHERE id = ?", userID).
+			Scan(&kdf.KDF, &kdf.KDFMemory, &kdf.KDFIterations, &kdf.KDFParallelism)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		if err := kdf.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.kdfMinimum().allows(kdf) {
+			http.Error(w, "KDF parameters are below the server minimum", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.verifyUserSecret(w, r, userID, req.Password, req.AuthHash) {
+		return
+	}
+	if qe := s.checkRekeyQuota(userID, req.Vault); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	cursor, err := s.rekeyAccount(r, userID, db, accountKeys{authHash: req.NewAuthHash, salt: req.Salt, KDFParams: kdf}, req.Vault)
+	if err != nil {
+		s.logger.Printf("handleChangePassword: user %d: %v", userID, err)
+		writeRekeyError(w, err)
+		return
+	}
+
+	revoked, err := s.revokeUserSessions(userID, sessionID, CloseReason{Code: wsClosePasswordChanged, Text: "password changed"})
+	if err != nil {
+		s.logger.Printf("handleChangePassword: user %d: revoke sessions: %v", userID, err)
+	}
+	s.audit(r, userID, userID, "password.changed", strconv.FormatInt(revoked, 10)+" other sessions revoked")
+	s.logger.Printf("handleChangePassword: user %d changed password, %d other sessions revoked", userID, revoked)
+	s.sseHub.BroadcastToUser(userID, "vault_rekeyed")
+	writeJSON(w, http.StatusOK, RekeyResponse{Message: "Password changed", Cursor: cursor, SessionsRevoked: revoked})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestInviteGuessesThrottled checks that one client guessing invite tokens
+// doesn't lock out another, and that the backstop across clients holds and
+// can be cleared.
+func TestInviteGuessesThrottled(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "admin")
+	guess := func(addr string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"token":"GRDN-WRONG"}`))
+		r.RemoteAddr = addr + ":4000"
+		w := httptest.NewRecorder()
+		s.handleValidateInvite(w, r)
+		return w.Code
+	}
+
+	for i := 0; i <= defaultLoginIPFreeAttempts; i++ {
+		guess("198.51.100.1")
+	}
+	if code := guess("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("guess past the address limit: %d, want 429", code)
+	}
+	if code := guess("198.51.100.2"); code != http.StatusForbidden {
+		t.Fatalf("guess from another address: %d, want 403", code)
+	}
+
+	// The backstop, lowered to what has been counted so far
+	s.systemDB.Exec("UPDATE server_settings SET value = ? WHERE key = 'login_invite_free_attempts'", strconv.Itoa(defaultLoginIPFreeAttempts+2))
+	guess("198.51.100.3")
+	if code := guess("198.51.100.4"); code != http.StatusTooManyRequests {
+		t.Fatalf("guess past the backstop: %d, want 429", code)
+	}
+	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	r.SetPathValue("scope", inviteThrottle.scope)
+	r.SetPathValue("key", inviteThrottle.key)
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, 1))
+	w := httptest.NewRecorder()
+	s.handleAdminClearLoginThrottle(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("clear the backstop: %d %s", w.Code, w.Body)
+	}
+	if code := guess("198.51.100.5"); code != http.StatusForbidden {
+		t.Fatalf("guess after clearing: %d, want 403", code)
+	}
+}
+
+// TestRegisterRequiresAuthHash checks that new accounts can't be created with
+// a plain password.
+func TestRegisterRequiresAuthHash(t *testing.T) {
+	s := newTestServer(t)
+	t.Setenv("ADMIN_INVITE_CODE", "")
+	register := func(body any) int {
+		t.Helper()
+		return call(t, s.handleRegister, 0, body).Code
+	}
+
+	if code := register(map[string]string{"username": "alice", "password": "correct horse"}); code != http.StatusBadRequest {
+		t.Fatalf("register with a password: %d, want 400", code)
+	}
+	salt, _ := newSalt()
+	authHash := base64.StdEncoding.EncodeToString(make([]byte, authHashSize))
+	if code := register(RegisterRequest{Username: "alice", AuthHash: authHash, Salt: salt}); code != http.StatusBadRequest {
+		t.Fatalf("register without KDF parameters: %d, want 400", code)
+	}
+	if code := register(RegisterRequest{Username: "alice", AuthHash: authHash, Salt: salt, KDFParams: s.defaultKDF()}); code != http.StatusCreated {
+		t.Fatalf("register with an auth hash: %d, want 201", code)
+	}
+	var scheme string
+	s.systemDB.QueryRow("SELECT auth_scheme FROM users WHERE username = 'alice'").Scan(&scheme)
+	if scheme != authSchemeHash {
+		t.Fatalf("new account on scheme %q", scheme)
+	}
+}
+
+// TestPasswordRecheckThrottled checks that a signed-in session can't keep
+// guessing the password a sensitive change asks for.
+func TestPasswordRecheckThrottled(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+	for i := 0; i <= defaultLoginFreeAttempts; i++ {
+		if code := call(t, s.handleDisableTOTP, userID, TwoFactorRequest{Password: "guess"}).Code; code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: %d, want 401", i, code)
+		}
+	}
+	if code := call(t, s.handleDisableTOTP, userID, TwoFactorRequest{Password: "guess"}).Code; code != http.StatusTooManyRequests {
+		t.Fatalf("guess past the limit: %d, want 429", code)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Backup Admin API ---
+
+const backupColumns = `id, trigger, status, COALESCE(filename, ''), size_bytes, COALESCE(sha256, ''), db_count, file_count,
+	COALESCE(error, ''), started_at, completed_at, duration_ms, pruned_at, verified_at, COALESCE(verify_status, ''),
+	COALESCE(verify_error, '')`
+
+func scanBackupRecord(row interface{ Scan(...any) error }) (BackupRecord, error) {
+	var b BackupRecord
+	var completedAt, prunedAt, verifiedAt sql.NullTime
+	err := row.Scan(&b.ID, &b.Trigger, &b.Status, &b.Filename, &b.SizeBytes, &b.SHA256, &b.DBCount, &b.FileCount,
+		&b.Error, &b.StartedAt, &completedAt, &b.DurationMs, &prunedAt, &verifiedAt, &b.VerifyStatus, &b.VerifyError)
+	if completedAt.Valid {
+		b.CompletedAt = &completedAt.Time
+	}
+	if prunedAt.Valid {
+		b.PrunedAt = &prunedAt.Time
+	}
+	if verifiedAt.Valid {
+		b.VerifiedAt = &verifiedAt.Time
+	}
+	b.Size = formatBytes(b.SizeBytes)
+	return b, err
+}
+
+// handleListBackups returns the schedule and the backup history, newest first.
+func (s *Server) handleListBackups(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.systemDB.Query("SELECT " + backupColumns + " FROM backups ORDER BY id DESC LIMIT 200")
+	if err != nil {
+		s.logger.Println("handleListBackups: query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	resp := BackupListResponse{Backups: []BackupRecord{}}
+	for rows.Next() {
+		b, err := scanBackupRecord(rows)
+		if err != nil {
+			s.logger.Println("handleListBackups: scan error:", err)
+			continue
+		}
+		resp.Backups = append(resp.Backups, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+	rows.Close()
+
+	resp.Schedule = s.backupSchedule()
+	if resp.Schedule.Enabled {
+		next := time.Now().UTC()
+		if len(resp.Backups) > 0 {
+			next = resp.Backups[0].StartedAt.Add(time.Duration(resp.Schedule.IntervalHours) * time.Hour)
+		}
+		resp.Schedule.NextRunAt = &next
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetBackup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid backup ID", http.StatusBadRequest)
+		return
+	}
+
+	b, err := scanBackupRecord(s.systemDB.QueryRow("SELECT "+backupColumns+" FROM backups WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b)
+}
+
+// handleCreateBackup starts a manual backup. The run continues in the
+// background; poll GET /api/admin/backups/{id} for its outcome.
+func (s *Server) handleCreateBackup(w http.ResponseWriter, r *http.Request) {
+	id, err := s.startBackup("manual")
+	if err == errBackupRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		s.logger.Println("handleCreateBackup: start failed:", err)
+		http.Error(w, "Failed to start backup", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := scanBackupRecord(s.systemDB.QueryRow("SELECT "+backupColumns+" FROM backups WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, b)
+}
+
+// handleDownloadBackup streams a finished archive.
+func (s *Server) handleDownloadBackup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid backup ID", http.StatusBadRequest)
+		return
+	}
+
+	var filename, sum string
+	err = s.systemDB.QueryRow("SELECT filename, sha256 FROM backups WHERE id = ? AND status = 'success' AND pruned_at IS NULL", id).
+		Scan(&filename, &sum)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.config.BackupDir, filepath.Base(filename)))
+	if err != nil {
+		http.Error(w, "Backup archive missing", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Backup archive unreadable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("X-Content-SHA256", sum)
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
+
+// handleVerifyBackup starts a restore drill on a stored archive (see
+// runBackupVerify). The drill continues in the background; poll
+// GET /api/admin/backups/{id} until verify_status is no longer running.
+func (s *Server) handleVerifyBackup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid backup ID", http.StatusBadRequest)
+		return
+	}
+
+	var filename string
+	err = s.systemDB.QueryRow("SELECT filename FROM backups WHERE id = ? AND status = 'success' AND pruned_at IS NULL", id).
+		Scan(&filename)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.startBackupVerify(id, filename); err == errVerifyRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		s.logger.Println("handleVerifyBackup: start failed:", err)
+		http.Error(w, "Failed to start verification", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := scanBackupRecord(s.systemDB.QueryRow("SELECT "+backupColumns+" FROM backups WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, b)
+}
+
+// --- Backup Destinations ---
+
+// maskDestinationConfig replaces secret fields with maskedSecret.
+func maskDestinationConfig(kind, config string) json.RawMessage {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(config), &m); err != nil {
+		return json.RawMessage("{}")
+	}
+	for _, k := range destinationSecrets[kind] {
+		if v, ok := m[k].(string); ok && v != "" {
+			m[k] = maskedSecret
+		}
+	}
+	out, _ := json.Marshal(m)
+	return out
+}
+
+// mergeDestinationSecrets keeps the stored value for secret fields the client
+// sent back masked (or left out), so editing a destination doesn't require
+// re-entering its credentials.
+func mergeDestinationSecrets(kind string, incoming json.RawMessage, stored string) (json.RawMessage, error) {
+	var in, old map[string]any
+	if err := json.Unmarshal(incoming, &in); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(stored), &old)
+	for _, k := range destinationSecrets[kind] {
+		if v, present := in[k]; !present || v == maskedSecret {
+			if oldVal, ok := old[k]; ok {
+				in[k] = oldVal
+			} else {
+				delete(in, k)
+			}
+		}
+	}
+	return json.Marshal(in)
+}
+
+const backupUploadColumns = `id, backup_id, destination_id, status, remote_name, size_bytes, COALESCE(error, ''),
+	started_at, completed_at, duration_ms`
+
+func scanBackupUpload(row interface{ Scan(...any) error }) (BackupUpload, error) {
+	var u BackupUpload
+	var completedAt sql.NullTime
+	err := row.Scan(&u.ID, &u.BackupID, &u.DestinationID, &u.Status, &u.RemoteName, &u.SizeBytes, &u.Error,
+		&u.StartedAt, &completedAt, &u.DurationMs)
+	if completedAt.Valid {
+		u.CompletedAt = &completedAt.Time
+	}
+	u.Size = formatBytes(u.SizeBytes)
+	return u, err
+}
+
+func (s *Server) loadBackupDestination(id int64) (BackupDestinationResponse, string, error) {
+	var d BackupDestinationResponse
+	var config string
+	err := s.systemDB.QueryRow("SELECT id, name, type, config, enabled, created_at, updated_at FROM backup_destinations WHERE id = ?", id).
+		Scan(&d.ID, &d.Name, &d.Type, &config, &d.Enabled, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return d, "", err
+	}
+	d.Config = maskDestinationConfig(d.Type, config)
+
+	if u, err := scanBackupUpload(s.systemDB.QueryRow("SELECT "+backupUploadColumns+" FROM backup_uploads WHERE destination_id = ? ORDER BY id DESC LIMIT 1", id)); err == nil {
+		d.LastUpload = &u
+	}
+	return d, config, nil
+}
+
+func (s *Server) handleListBackupDestinations(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.systemDB.Query("SELECT id FROM backup_destinations ORDER BY id")
+	if err != nil {
+		s.logger.Println("handleListBackupDestinations: query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	dests := []BackupDestinationResponse{}
+	for _, id := range ids {
+		d, _, err := s.loadBackupDestination(id)
+		if err != nil {
+			continue
+		}
+		dests = append(dests, d)
+	}
+
+	writeJSON(w, http.StatusOK, dests)
+}
+
+func (s *Server) handleCreateBackupDestination(w http.ResponseWriter, r *http.Request) {
+	var req BackupDestinationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := newBackupTarget(req.Type, req.Config); err != nil {
+		http.Error(w, "Invalid destination: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+
+	config, err := sealDestinationSecrets(s.destinationSealKey(), req.Type, req.Config)
+	if err != nil {
+		s.logger.Println("handleCreateBackupDestination: seal error:", err)
+		http.Error(w, "Failed to encrypt credentials", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := s.systemDB.Exec("INSERT INTO backup_destinations (name, type, config, enabled) VALUES (?, ?, ?, ?)",
+		strings.TrimSpace(req.Name), req.Type, config, enabled)
+	if err != nil {
+		s.logger.Println("handleCreateBackupDestination: insert error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	d, _, err := s.loadBackupDestination(id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// handleUpdateBackupDestination changes name, enabled flag and/or config.
+// The type of a destination can't be changed.
+func (s *Server) handleUpdateBackupDestination(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid destination ID", http.StatusBadRequest)
+		return
+	}
+
+	var req BackupDestinationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	current, storedConfig, err := s.loadBackupDestination(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Destination not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if req.Type != "" && req.Type != current.Type {
+		http.Error(w, "Destination type cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	name := current.Name
+	if strings.TrimSpace(req.Name) != "" {
+		name = strings.TrimSpace(req.Name)
+	}
+	enabled := current.Enabled
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+	config := storedConfig
+	if len(req.Config) > 0 {
+		merged, err := mergeDestinationSecrets(current.Type, req.Config, storedConfig)
+		if err != nil {
+			http.Error(w, "Invalid config", http.StatusBadRequest)
+			return
+		}
+		opened, err := openDestinationConfig(s.destinationSealKey(), current.Type, string(merged))
+		if err == nil {
+			_, err = newBackupTarget(current.Type, opened)
+		}
+		if err != nil {
+			http.Error(w, "Invalid destination: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if config, err = sealDestinationSecrets(s.destinationSealKey(), current.Type, merged); err != nil {
+			s.logger.Println("handleUpdateBackupDestination: seal error:", err)
+			http.Error(w, "Failed to encrypt credentials", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = s.systemDB.Exec("UPDATE backup_destinations SET name = ?, config = ?, enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		name, config, enabled, id)
+	if err != nil {
+		s.logger.Println("handleUpdateBackupDestination: update error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	d, _, err := s.loadBackupDestination(id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// handleDeleteBackupDestination removes a destination and its upload history.
+// Copies already shipped there are left in place.
+func (s *Server) handleDeleteBackupDestination(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid destination ID", http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.systemDB.Exec("DELETE FROM backup_destinations WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Destination not found", http.StatusNotFound)
+		return
+	}
+	s.systemDB.Exec("DELETE FROM backup_uploads WHERE destination_id = ?", id)
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Destination deleted"})
+}
+
+// handleTestBackupDestination checks that a destination is reachable and writable.
+func (s *Server) handleTestBackupDestination(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid destination ID", http.StatusBadRequest)
+		return
+	}
+
+	d, config, err := s.loadBackupDestination(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Destination not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := newStoredBackupTarget(s.destinationSealKey(), d.Type, config)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		err = target.Check(ctx)
+		cancel()
+	}
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+// handleListBackupUploads returns a destination's upload history, newest first.
+func (s *Server) handleListBackupUploads(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid destination ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.systemDB.Query("SELECT "+backupUploadColumns+" FROM backup_uploads WHERE destination_id = ? ORDER BY id DESC LIMIT 200", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	uploads := []BackupUpload{}
+	for rows.Next() {
+		u, err := scanBackupUpload(rows)
+		if err != nil {
+			continue
+		}
+		uploads = append(uploads, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, uploads)
+}
+
+// handleReplicationStatus reports WAL replication progress and lag per database.
+func (s *Server) handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	resp := ReplicationResponse{Databases: []ReplicaStatus{}}
+	if s.replicator != nil {
+		resp.Enabled = true
+		resp.Target = s.replicator.target.String()
+		resp.Databases = s.replicator.Status()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
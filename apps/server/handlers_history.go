@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Vault Item History ---
+
+const (
+	defaultHistoryMaxRevisions = 20
+	defaultHistoryMaxAgeDays   = 365
+)
+
+type historyLimits struct {
+	MaxRevisions int
+	MaxAgeDays   int
+}
+
+// getHistoryLimits returns the effective history depth and age for a user.
+// Per-user overrides win when set (> 0); otherwise server_settings defaults apply.
+func (s *Server) getHistoryLimits(userID int) historyLimits {
+	limits := historyLimits{
+		MaxRevisions: s.getSettingInt("history_max_revisions_default", defaultHistoryMaxRevisions),
+		MaxAgeDays:   s.getSettingInt("history_max_age_days_default", defaultHistoryMaxAgeDays),
+	}
+
+	var maxRevisions, maxAgeDays int
+	err := s.systemDB.QueryRow("SELECT history_max_revisions, history_max_age_days FROM users WHERE id = ?", userID).
+		Scan(&maxRevisions, &maxAgeDays)
+	if err != nil {
+		return limits
+	}
+	if maxRevisions > 0 {
+		limits.MaxRevisions = maxRevisions
+	}
+	if maxAgeDays > 0 {
+		limits.MaxAgeDays = maxAgeDays
+	}
+	return limits
+}
+
+// pruneAllHistory applies each user's history age limit to their vault.
+func (s *Server) pruneAllHistory() {
+	s.forEachUserVault(func(userID int, dbPath string, db *sql.DB) {
+		maxAge := time.Duration(s.getHistoryLimits(userID).MaxAgeDays) * 24 * time.Hour
+		if n, err := pruneHistoryByAge(db, maxAge); err != nil {
+			s.logger.Printf("pruneAllHistory: %s failed: %v", dbPath, err)
+		} else if n > 0 {
+			s.logger.Printf("pruneAllHistory: removed %d old revisions from %s", n, dbPath)
+		}
+	})
+}
+
+// handleListItemHistory lists the archived revisions of one item, newest first.
+// Blobs are omitted; fetch a single revision to get its content.
+func (s *Server) handleListItemHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT revision, LENGTH(encrypted_blob), updated_at, archived_at
+		FROM vault_item_history WHERE item_id = ? ORDER BY revision DESC
+	`, id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []VaultItemHistoryEntry{}
+	for rows.Next() {
+		var e VaultItemHistoryEntry
+		var updatedAt sql.NullString
+		if err := rows.Scan(&e.Revision, &e.Size, &updatedAt, &e.ArchivedAt); err != nil {
+			continue
+		}
+		e.UpdatedAt = updatedAt.String
+		revisions = append(revisions, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, revisions)
+}
+
+// handleGetItemRevision returns the encrypted blob of one archived revision.
+func (s *Server) handleGetItemRevision(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	revision, err := strconv.Atoi(r.PathValue("revision"))
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	item := VaultItem{ID: id, Revision: revision}
+	var updatedAt sql.NullString
+	err = db.QueryRow("SELECT encrypted_blob, updated_at FROM vault_item_history WHERE item_id = ? AND revision = ?", id, revision).
+		Scan(&item.EncryptedBlob, &updatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	item.UpdatedAt = updatedAt.String
+
+	writeJSON(w, http.StatusOK, item)
+}
+
+// handleRestoreItemRevision writes an archived blob back as a new revision.
+// An optional body {"revision": n} guards against restoring over an edit the
+// client hasn't seen, using the same base-revision rule as PUT /vault/items.
+func (s *Server) handleRestoreItemRevision(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	revision, err := strconv.Atoi(r.PathValue("revision"))
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Revision *int `json:"revision"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	limits := s.getHistoryLimits(userID)
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	usageBefore, err := queryVaultUsage(tx)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var blob string
+	err = tx.QueryRow("SELECT encrypted_blob FROM vault_item_history WHERE item_id = ? AND revision = ?", id, revision).Scan(&blob)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	current, _, err := loadVaultItemState(tx, id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if req.Revision != nil && *req.Revision != current.Revision {
+		writeJSON(w, http.StatusConflict, VaultConflictResponse{Error: "revision_conflict", Conflicts: []VaultConflict{current}})
+		return
+	}
+
+	quota := s.getVaultQuota(userID)
+	if qe := quota.checkBlob(int64(len(blob)), usageBefore); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+
+	newRevision := current.Revision + 1
+	if err := writeVaultItem(tx, id, blob, newRevision); err != nil {
+		http.Error(w, "Restore failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := pruneItemHistory(tx, id, limits.MaxRevisions); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	usageAfter, err := queryVaultUsage(tx)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if qe := quota.checkUsage(usageBefore, usageAfter); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	s.sseHub.BroadcastToUser(userID, "vault_updated")
+
+	writeJSON(w, http.StatusOK, VaultItemRevision{ID: id, Revision: newRevision})
+}
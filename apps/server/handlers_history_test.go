@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// callPath runs a handler as userID with path values given as name, value
+// pairs and an optional JSON body.
+func callPath(t *testing.T, h http.HandlerFunc, method string, userID int, body any, pathValues ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, "/", bytes.NewReader(data))
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// TestItemHistory checks that edits archive earlier revisions up to the
+// user's limit and that an archived revision can be fetched and restored.
+func TestItemHistory(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "admin")
+	userID := addTestUser(t, s, "alice")
+	if w := updateUser(t, s, userID, map[string]any{"history_max_revisions": 2}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	for rev, blob := range []string{"v1", "v2", "v3", "v4", "v5"} {
+		decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: blob, Revision: rev}}))
+	}
+
+	history := decode[[]VaultItemHistoryEntry](t, callPath(t, s.handleListItemHistory, http.MethodGet, userID, nil, "id", "a"))
+	if len(history) != 2 || history[0].Revision != 4 || history[1].Revision != 3 {
+		t.Fatalf("history = %+v, want revisions 4 and 3", history)
+	}
+
+	old := decode[VaultItem](t, callPath(t, s.handleGetItemRevision, http.MethodGet, userID, nil, "id", "a", "revision", "3"))
+	if old.EncryptedBlob != "v3" {
+		t.Fatalf("revision 3 = %q, want v3", old.EncryptedBlob)
+	}
+	if w := callPath(t, s.handleGetItemRevision, http.MethodGet, userID, nil, "id", "a", "revision", "1"); w.Code != http.StatusNotFound {
+		t.Fatalf("pruned revision: %d, want 404", w.Code)
+	}
+
+	if w := callPath(t, s.handleRestoreItemRevision, http.MethodPost, userID, map[string]int{"revision": 4}, "id", "a", "revision", "3"); w.Code != http.StatusConflict {
+		t.Fatalf("restore over an unseen edit: %d, want 409", w.Code)
+	}
+	restored := decode[VaultItemRevision](t, callPath(t, s.handleRestoreItemRevision, http.MethodPost, userID, map[string]int{"revision": 5}, "id", "a", "revision", "3"))
+	if restored.Revision != 6 {
+		t.Fatalf("restored revision = %d, want 6", restored.Revision)
+	}
+	items := decode[[]VaultItem](t, get(t, s.handleListItems, userID, "/vault/items"))
+	if len(items) != 1 || items[0].EncryptedBlob != "v3" || items[0].Revision != 6 {
+		t.Fatalf("items after restore = %+v", items)
+	}
+}
+
+// TestItemHistoryRetention checks that archived revisions older than the
+// user's age limit are dropped.
+func TestItemHistoryRetention(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "admin")
+	userID := addTestUser(t, s, "alice")
+	if w := updateUser(t, s, userID, map[string]any{"history_max_age_days": 7}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	for rev, blob := range []string{"v1", "v2", "v3"} {
+		decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: blob, Revision: rev}}))
+	}
+	db, err := s.openUserDB("alice.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE vault_item_history SET archived_at = datetime('now', '-8 days') WHERE revision = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.pruneAllHistory()
+
+	history := decode[[]VaultItemHistoryEntry](t, callPath(t, s.handleListItemHistory, http.MethodGet, userID, nil, "id", "a"))
+	if len(history) != 1 || history[0].Revision != 2 {
+		t.Fatalf("history after pruning = %+v, want only revision 2", history)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- Client KDF Parameters ---
+//
+// Each account stores the algorithm and cost its master key is derived with,
+// so the cost can be raised over time. Admins set a floor with the
+// kdf_min_* settings; accounts below it are told to upgrade at login, and
+// the upgrade re-encrypts the vault under the new key.
+
+const (
+	kdfArgon2id = "argon2id"
+	kdfPBKDF2   = "pbkdf2-sha256" // legacy fallback when Argon2 WASM is unavailable
+
+	// What packages/core/crypto/argon2.ts has always used
+	kdfDefaultMemory     = 32 * 1024 // KiB
+	kdfDefaultIterations = 4
+	kdfDefaultParallel   = 1
+
+	kdfMinMemory           = 8 * 1024
+	kdfMaxMemory           = 1024 * 1024
+	kdfMaxIterations       = 64
+	kdfMaxParallel         = 16
+	kdfMinPBKDF2Iterations = 100000
+	kdfMaxPBKDF2Iterations = 10000000
+
+	defaultKDFMinPBKDF2Iterations = 600000
+)
+
+// legacyKDF is what clients derived with before parameters were stored.
+var legacyKDF = KDFParams{KDF: kdfArgon2id, KDFMemory: kdfDefaultMemory, KDFIterations: kdfDefaultIterations, KDFParallelism: kdfDefaultParallel}
+
+// validate checks that p is a supported algorithm with sane costs.
+func (p KDFParams) validate() error {
+	switch p.KDF {
+	case kdfArgon2id:
+		if p.KDFMemory < kdfMinMemory || p.KDFMemory > kdfMaxMemory {
+			return fmt.Errorf("kdf_memory must be between %d and %d KiB", kdfMinMemory, kdfMaxMemory)
+		}
+		if p.KDFIterations < 1 || p.KDFIterations > kdfMaxIterations {
+			return fmt.Errorf("kdf_iterations must be between 1 and %d", kdfMaxIterations)
+		}
+		if p.KDFParallelism < 1 || p.KDFParallelism > kdfMaxParallel {
+			return fmt.Errorf("kdf_parallelism must be between 1 and %d", kdfMaxParallel)
+		}
+	case kdfPBKDF2:
+		if p.KDFIterations < kdfMinPBKDF2Iterations || p.KDFIterations > kdfMaxPBKDF2Iterations {
+			return fmt.Errorf("kdf_iterations must be between %d and %d", kdfMinPBKDF2Iterations, kdfMaxPBKDF2Iterations)
+		}
+		if p.KDFMemory != 0 || p.KDFParallelism != 0 {
+			return fmt.Errorf("kdf_memory and kdf_parallelism must be 0 for %s", kdfPBKDF2)
+		}
+	default:
+		return fmt.Errorf("kdf must be %s or %s", kdfArgon2id, kdfPBKDF2)
+	}
+	return nil
+}
+
+// kdfMinimum is the admin-set floor for new and upgraded parameters.
+type kdfMinimum struct {
+	memory, iterations, pbkdf2Iterations int
+}
+
+func (s *Server) kdfMinimum() kdfMinimum {
+	return kdfMinimum{
+		memory:           s.getSettingInt("kdf_min_memory", kdfDefaultMemory),
+		iterations:       s.getSettingInt("kdf_min_iterations", kdfDefaultIterations),
+		pbkdf2Iterations: s.getSettingInt("kdf_min_pbkdf2_iterations", defaultKDFMinPBKDF2Iterations),
+	}
+}
+
+func (m kdfMinimum) allows(p KDFParams) bool {
+	if p.KDF == kdfPBKDF2 {
+		return p.KDFIterations >= m.pbkdf2Iterations
+	}
+	return p.KDFMemory >= m.memory && p.KDFIterations >= m.iterations
+}
+
+// defaultKDF is what new accounts are expected to use: the client default,
+// raised to the server minimum.
+func (s *Server) defaultKDF() KDFParams {
+	m := s.kdfMinimum()
+	return KDFParams{
+		KDF:            kdfArgon2id,
+		KDFMemory:      max(kdfDefaultMemory, m.memory),
+		KDFIterations:  max(kdfDefaultIterations, m.iterations),
+		KDFParallelism: kdfDefaultParallel,
+	}
+}
+
+// kdfUpgradeRequired reports whether a user's parameters are below the
+// current minimum.
+func (s *Server) kdfUpgradeRequired(userID int) bool {
+	var p KDFParams
+	err := s.systemDB.QueryRow("SELECT kdf, kdf_memory, kdf_iterations, kdf_parallelism FROM users WHERE id = ?", userID).
+		Scan(&p.KDF, &p.KDFMemory, &p.KDFIterations, &p.KDFParallelism)
+	if err != nil {
+		return false
+	}
+	return !s.kdfMinimum().allows(p)
+}
+
+// validKDFSetting checks a kdf_min_* value against the bounds validate uses.
+func validKDFSetting(key, value string) bool {
+	if !strings.HasPrefix(key, "kdf_min_") {
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return false
+	}
+	switch key {
+	case "kdf_min_memory":
+		return n >= kdfMinMemory && n <= kdfMaxMemory
+	case "kdf_min_iterations":
+		return n >= 1 && n <= kdfMaxIterations
+	case "kdf_min_pbkdf2_iterations":
+		return n >= kdfMinPBKDF2Iterations && n <= kdfMaxPBKDF2Iterations
+	}
+	return true
+}
+
+// accountKeys are the credentials stored for an account after a re-key.
+type accountKeys struct {
+	authHash string
+	salt     string
+	KDFParams
+}
+
+// rekeyAccount re-encrypts a user's vault and switches the account to new
+// credentials. The two databases can't share a transaction, so the vault is
+// committed first along with a vault_rekey row holding the new credentials;
+// finishRekey then moves them to the users row and removes it. A crash in
+// between leaves the row for finishPendingRekeys to roll forward at startup.
+// Escrowed copies of the old master key are useless afterwards and are
+// dropped.
+func (s *Server) rekeyAccount(r *http.Request, userID int, db *sql.DB, keys accountKeys, rk VaultRekey) (int64, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(keys.authHash), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	vtx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer vtx.Rollback()
+	cursor, err := rekeyVault(vtx, rk)
+	if err != nil {
+		return 0, err
+	}
+	_, err = vtx.Exec("INSERT OR REPLACE INTO vault_rekey (id, password_hash, salt, kdf, kdf_memory, kdf_iterations, kdf_parallelism) VALUES (1, ?, ?, ?, ?, ?, ?)",
+		string(hashed), keys.salt, keys.KDF, keys.KDFMemory, keys.KDFIterations, keys.KDFParallelism)
+	if err != nil {
+		return 0, err
+	}
+	if err := vtx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if _, err := s.finishRekey(r, userID, db); err != nil {
+		s.logger.Printf("CRITICAL: rekeyAccount: user %d: vault re-keyed but credentials not updated, retried at startup: %v", userID, err)
+		return 0, err
+	}
+	return cursor, nil
+}
+
+// finishRekey moves the credentials of a committed vault re-key to the users
+// row. It reports whether the vault had a pending re-key, and is safe to
+// repeat.
+func (s *Server) finishRekey(r *http.Request, userID int, db *sql.DB) (bool, error) {
+	var hashed string
+	var keys accountKeys
+	err := db.QueryRow("SELECT password_hash, salt, kdf, kdf_memory, kdf_iterations, kdf_parallelism FROM vault_rekey WHERE id = 1").
+		Scan(&hashed, &keys.salt, &keys.KDF, &keys.KDFMemory, &keys.KDFIterations, &keys.KDFParallelism)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	stx, err := s.systemDB.Begin()
+	if err != nil {
+		return true, err
+	}
+	defer stx.Rollback()
+	const update = "UPDATE users SET password_hash = ?, auth_scheme = ?, salt = ?, kdf = ?, kdf_memory = ?, kdf_iterations = ?, kdf_parallelism = ? WHERE id = ?"
+	_, err = stx.Exec(update, hashed, authSchemeHash, keys.salt, keys.KDF, keys.KDFMemory, keys.KDFIterations, keys.KDFParallelism, userID)
+	if err != nil {
+		return true, err
+	}
+	res, err := stx.Exec("DELETE FROM recovery_escrow WHERE user_id = ?", userID)
+	if err != nil {
+		return true, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.auditTx(stx, r, userID, userID, "recovery.escrow_cleared", "master key changed")
+	}
+	if err := stx.Commit(); err != nil {
+		return true, err
+	}
+
+	// Left behind, the row is applied again at startup, which changes nothing
+	if _, err := db.Exec("DELETE FROM vault_rekey"); err != nil {
+		s.logger.Printf("finishRekey: user %d: %v", userID, err)
+	}
+	return true, nil
+}
+
+// finishPendingRekeys rolls forward re-keys that were interrupted after the
+// vault was committed.
+func (s *Server) finishPendingRekeys() {
+	s.forEachUserVault(func(userID int, dbPath string, db *sql.DB) {
+		finished, err := s.finishRekey(nil, userID, db)
+		if err != nil {
+			s.logger.Printf("CRITICAL: finishPendingRekeys: user %d (%s): %v", userID, dbPath, err)
+		} else if finished {
+			s.logger.Printf("finishPendingRekeys: finished the interrupted re-key of user %d", userID)
+		}
+	})
+}
+
+// writeRekeyError maps rekeyAccount errors to responses.
+func writeRekeyError(w http.ResponseWriter, err error) {
+	var mismatch rekeyMismatchError
+	switch {
+	case errors.Is(err, errVaultChanged):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "vault_changed"})
+	case errors.As(err, &mismatch):
+		http.Error(w, mismatch.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Re-key failed", http.StatusInternalServerError)
+	}
+}
+
+// handleUpgradeKDF switches the signed-in user to new KDF parameters and a
+// new salt, together with the vault re-encrypted under the resulting key.
+func (s *Server) handleUpgradeKDF(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req KDFUpgradeRequest
+	if !decodeRekeyRequest(w, r, &req) {
+		return
+	}
+	if err := req.KDFParams.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.kdfMinimum().allows(req.KDFParams) {
+		http.Error(w, "KDF parameters are below the server minimum", http.StatusBadRequest)
+		return
+	}
+	if !validEncoded(req.NewAuthHash, authHashSize) || !validEncoded(req.Salt, saltSize) {
+		http.Error(w, "Invalid auth hash or salt", http.StatusBadRequest)
+		return
+	}
+
+	if !s.verifyUserSecret(w, r, userID, req.Password, req.AuthHash) {
+		return
+	}
+	if qe := s.checkRekeyQuota(userID, req.Vault); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	cursor, err := s.rekeyAccount(r, userID, db, accountKeys{authHash: req.NewAuthHash, salt: req.Salt, KDFParams: req.KDFParams}, req.Vault)
+	if err != nil {
+		s.logger.Printf("handleUpgradeKDF: user %d: %v", userID, err)
+		writeRekeyError(w, err)
+		return
+	}
+
+	s.logger.Printf("handleUpgradeKDF: user %d now on %s m=%d t=%d p=%d", userID, req.KDF, req.KDFMemory, req.KDFIterations, req.KDFParallelism)
+	s.sseHub.BroadcastToUser(userID, "vault_rekeyed")
+	writeJSON(w, http.StatusOK, RekeyResponse{Message: "KDF parameters updated", Cursor: cursor})
+}
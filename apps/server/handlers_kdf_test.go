@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestRekeyRollsForwardAfterInterruption fails the users update of a re-key
+// after the vault was committed and checks that startup finishes it.
+func TestRekeyRollsForwardAfterInterruption(t *testing.T) {
+	s := newTestServer(t)
+	if err := initUserDB(filepath.Join(s.config.DataDir, "alice.db")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.systemDB.Exec("INSERT INTO users (username, password_hash, db_path, salt) VALUES ('alice', 'old hash', 'alice.db', 'old salt')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	userID := int(id)
+	if _, err := s.systemDB.Exec("INSERT INTO recovery_escrow (user_id, kind, wrapped_key) VALUES (?, 'admin', 'wrapped with the old key')", userID); err != nil {
+		t.Fatal(err)
+	}
+	db, err := s.openUserDB("alice.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO vault_items (id, encrypted_blob, seq) VALUES ('a', 'old blob', 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server goes away between the two commits
+	if _, err := s.systemDB.Exec("CREATE TRIGGER interrupt BEFORE UPDATE ON users BEGIN SELECT RAISE(ABORT, 'interrupted'); END"); err != nil {
+		t.Fatal(err)
+	}
+	keys := accountKeys{authHash: "new auth hash", salt: "new salt", KDFParams: legacyKDF}
+	rk := VaultRekey{Items: []VaultRekeyItem{{ID: "a", EncryptedBlob: "new blob"}}}
+	r := httptest.NewRequest("POST", "/", nil)
+	if _, err := s.rekeyAccount(r, userID, db, keys, rk); err == nil {
+		t.Fatal("rekeyAccount succeeded with the users update failing")
+	}
+	var blob string
+	db.QueryRow("SELECT encrypted_blob FROM vault_items WHERE id = 'a'").Scan(&blob)
+	if blob != "new blob" {
+		t.Fatalf("vault item = %q, want the re-encrypted blob", blob)
+	}
+
+	if _, err := s.systemDB.Exec("DROP TRIGGER interrupt"); err != nil {
+		t.Fatal(err)
+	}
+	s.finishPendingRekeys()
+
+	var salt, scheme string
+	var escrowed, pending int
+	s.systemDB.QueryRow("SELECT salt, auth_scheme FROM users WHERE id = ?", userID).Scan(&salt, &scheme)
+	s.systemDB.QueryRow("SELECT COUNT(*) FROM recovery_escrow WHERE user_id = ?", userID).Scan(&escrowed)
+	db.QueryRow("SELECT COUNT(*) FROM vault_rekey").Scan(&pending)
+	if salt != "new salt" || scheme != authSchemeHash || escrowed != 0 || pending != 0 {
+		t.Fatalf("after startup: salt %q, scheme %q, %d escrowed keys, %d pending re-keys", salt, scheme, escrowed, pending)
+	}
+	if w := httptest.NewRecorder(); !s.verifyUserSecret(w, r, userID, "", "new auth hash") {
+		t.Fatalf("new auth hash not accepted: %d %s", w.Code, w.Body)
+	}
+
+	// Nothing left to do on the next start
+	if finished, err := s.finishRekey(nil, userID, db); err != nil || finished {
+		t.Fatalf("finishRekey again = %v, %v", finished, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- Client-side auth hash ---
+//
+// Clients never send the master password. They fetch the salt and KDF
+// parameters (see handlers_kdf.go) from /auth/prelogin, derive the master key locally (the same key
+// that encrypts the vault) and log in with
+//
+//	auth_hash = base64(HKDF-SHA256(master key, info "guardian-auth-hash"))
+//
+// The server stores a bcrypt of auth_hash, so neither the server nor a TLS
+// terminating proxy learns the password or the vault key. Accounts created by
+// older clients hold a bcrypt of the password itself (auth_scheme
+// "password"); they switch over the first time a client logs in with both.
+
+const (
+	authSchemePassword = "password"
+	authSchemeHash     = "auth_hash"
+
+	authHashSize = 32
+	saltSize     = 16
+)
+
+func newSalt() (string, error) {
+	raw := make([]byte, saltSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// validEncoded reports whether v is standard base64 of exactly n bytes.
+func validEncoded(v string, n int) bool {
+	raw, err := base64.StdEncoding.DecodeString(v)
+	return err == nil && len(raw) == n
+}
+
+// fakeSalt is what prelogin answers for an unknown username: random-looking
+// but the same on every call, so it can't be told apart from a real account.
+func fakeSalt(username string) string {
+	mac := hmac.New(sha256.New, deriveKey(SecretKey, "prelogin"))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)[:saltSize])
+}
+
+// checkAuthSecret verifies a login secret against the stored hash. upgrade is
+// set when a legacy account proved its password and sent a well-formed
+// auth_hash, which should then replace the stored hash.
+func checkAuthSecret(passwordHash, scheme, password, authHash string) (ok, upgrade bool) {
+	if scheme == authSchemeHash {
+		return authHash != "" && bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(authHash)) == nil, false
+	}
+	if password == "" || bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) != nil {
+		return false, false
+	}
+	return true, validEncoded(authHash, authHashSize)
+}
+
+// hashAuthHash returns the bcrypt of an auth hash to store.
+func hashAuthHash(authHash string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(authHash), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+// upgradeAuthHash moves a legacy account to the auth hash scheme.
+func (s *Server) upgradeAuthHash(userID int, authHash string) error {
+	hashed, err := hashAuthHash(authHash)
+	if err != nil {
+		return err
+	}
+	_, err = s.systemDB.Exec("UPDATE users SET password_hash = ?, auth_scheme = ? WHERE id = ? AND auth_scheme = ?",
+		hashed, authSchemeHash, userID, authSchemePassword)
+	return err
+}
+
+// verifyUserSecret re-verifies a signed-in user's master password (or auth
+// hash) before a sensitive change. Failures count against the login throttle
+// like a failed login, so a stolen session can't be used to guess it. It
+// writes the error and returns false unless the secret is right.
+func (s *Server) verifyUserSecret(w http.ResponseWriter, r *http.Request, userID int, password, authHash string) bool {
+	var username, passwordHash, scheme string
+	err := s.systemDB.QueryRow("SELECT username, password_hash, auth_scheme FROM users WHERE id = ?", userID).
+		Scan(&username, &passwordHash, &scheme)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	throttle := []throttleKey{userThrottle(username), ipThrottle(r)}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return false
+	}
+	if ok, _ := checkAuthSecret(passwordHash, scheme, password, authHash); !ok {
+		s.recordLoginFailure(r, throttle...)
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handlePrelogin tells a client how to derive its master key and which
+// secret to log in with. Unknown usernames get a stable fake answer.
+func (s *Server) handlePrelogin(w http.ResponseWriter, r *http.Request) {
+	var req PreloginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	resp := PreloginResponse{Salt: fakeSalt(req.Username)}
+	err := s.systemDB.QueryRow("SELECT salt, auth_scheme, kdf, kdf_memory, kdf_iterations, kdf_parallelism FROM users WHERE username = ?",
+		req.Username).Scan(&resp.Salt, &resp.AuthScheme, &resp.KDF, &resp.KDFMemory, &resp.KDFIterations, &resp.KDFParallelism)
+	if err == sql.ErrNoRows {
+		// Unknown users look like an account created or upgraded today
+		resp.AuthScheme, resp.KDFParams = authSchemeHash, s.defaultKDF()
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
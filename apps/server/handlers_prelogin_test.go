@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// TestPreloginUnknownUser checks that an unknown username gets the same kind
+// of answer as a migrated account.
+func TestPreloginUnknownUser(t *testing.T) {
+	s := newTestServer(t)
+	prelogin := func(username string) PreloginResponse {
+		t.Helper()
+		return decode[PreloginResponse](t, call(t, s.handlePrelogin, 0, PreloginRequest{Username: username}))
+	}
+
+	kdf := s.defaultKDF()
+	salt, _ := newSalt()
+	if _, err := s.systemDB.Exec(`
+		INSERT INTO users (username, password_hash, db_path, salt, auth_scheme, kdf, kdf_memory, kdf_iterations, kdf_parallelism)
+		VALUES ('alice', 'x', 'alice.db', ?, ?, ?, ?, ?, ?)
+	`, salt, authSchemeHash, kdf.KDF, kdf.KDFMemory, kdf.KDFIterations, kdf.KDFParallelism); err != nil {
+		t.Fatal(err)
+	}
+	// A legacy account doesn't change what unknown users are told
+	if _, err := s.systemDB.Exec("INSERT INTO users (username, password_hash, db_path, auth_scheme) VALUES ('bob', 'x', 'bob.db', ?)", authSchemePassword); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, nobody := prelogin("alice"), prelogin("nobody")
+	if nobody.AuthScheme != alice.AuthScheme || nobody.KDFParams != alice.KDFParams {
+		t.Fatalf("unknown user = %+v, migrated account = %+v", nobody, alice)
+	}
+	if !validEncoded(nobody.Salt, saltSize) || nobody.Salt == alice.Salt {
+		t.Fatalf("fake salt %q isn't a salt of its own", nobody.Salt)
+	}
+	if again := prelogin("nobody"); again.Salt != nobody.Salt {
+		t.Fatal("fake salt changes between calls")
+	}
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- Account Recovery ---
+//
+// A forgotten master password normally loses the vault, since the server
+// never has the key. Users can opt in to escrowing a copy of their master key,
+// wrapped client-side:
+//
+//   - with a printed recovery code ("code" escrow). The client also derives a
+//     verifier from the code; presenting it at /auth/recovery/code releases
+//     the wrapped key.
+//   - to the admin recovery public key ("admin" escrow), when admin_recovery
+//     is optional or required. The user files a request with an ephemeral
+//     public key; an admin approves it by unwrapping the escrow with the
+//     offline private key and re-wrapping it to the ephemeral key.
+//
+// Either way the client ends up with the old master key and a recovery
+// token, fetches the vault, re-encrypts it under a new password and
+// completes the recovery like a password change. Every step is audited.
+
+const (
+	escrowCode  = "code"
+	escrowAdmin = "admin"
+
+	recoveryGrantTTL   = 15 * time.Minute   // to finish after using a recovery code
+	recoveryRequestTTL = 7 * 24 * time.Hour // for an admin to decide
+	recoveryApproveTTL = 24 * time.Hour     // for the user to pick up an approval
+
+	maxWrappedKeyLen = 8192
+)
+
+func hashRecoverySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// adminGrantToken is the recovery token of an approved admin request. It is
+// derived from the request token, so every poll hands out the same one until
+// it is used.
+func adminGrantToken(requestID, requestToken string) string {
+	mac := hmac.New(sha256.New, deriveKey(SecretKey, "recovery grant"))
+	mac.Write([]byte(requestID + "\x00" + requestToken))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// adminRecovery returns the admin_recovery policy (off, optional, required)
+// and the current admin public key with its id. Without a key the policy is
+// treated as off.
+func (s *Server) adminRecovery() (policy, publicKey, keyID string) {
+	policy = s.getSetting("admin_recovery")
+	publicKey = s.getSetting("admin_recovery_public_key")
+	if publicKey == "" || (policy != "optional" && policy != "required") {
+		return "off", "", ""
+	}
+	return policy, publicKey, adminRecoveryKeyID(publicKey)
+}
+
+// adminRecoveryKeyID identifies an admin public key, so escrow wrapped to a
+// replaced key can be told apart.
+func adminRecoveryKeyID(publicKey string) string {
+	return hashRecoverySecret(publicKey)[:16]
+}
+
+// recoveryEscrowRequired reports whether the user still has to escrow their
+// key to the current admin key.
+func (s *Server) recoveryEscrowRequired(userID int) bool {
+	policy, _, keyID := s.adminRecovery()
+	if policy != "required" {
+		return false
+	}
+	var current bool
+	err := s.systemDB.QueryRow("SELECT EXISTS(SELECT 1 FROM recovery_escrow WHERE user_id = ? AND kind = ? AND key_id = ?)",
+		userID, escrowAdmin, keyID).Scan(&current)
+	return err == nil && !current
+}
+
+// handleGetRecovery shows which escrows the user has.
+func (s *Server) handleGetRecovery(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	policy, publicKey, keyID := s.adminRecovery()
+	status := RecoveryStatus{AdminRecovery: policy, AdminPublicKey: publicKey, AdminKeyID: keyID}
+
+	rows, err := s.systemDB.Query("SELECT kind, key_id FROM recovery_escrow WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, id string
+		if err := rows.Scan(&kind, &id); err != nil {
+			continue
+		}
+		switch kind {
+		case escrowCode:
+			status.CodeEscrow = true
+		case escrowAdmin:
+			status.AdminEscrow = true
+			status.AdminEscrowCurrent = keyID != "" && id == keyID
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// decodeEscrowRequest reads the body of an escrow change and re-checks the
+// user's password. It writes the error response itself.
+func (s *Server) decodeEscrowRequest(w http.ResponseWriter, r *http.Request) (RecoveryEscrowRequest, bool) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req RecoveryEscrowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return req, false
+	}
+	if !s.verifyUserSecret(w, r, userID, req.Password, req.AuthHash) {
+		return req, false
+	}
+	if r.Method == http.MethodPut && (req.WrappedKey == "" || len(req.WrappedKey) > maxWrappedKeyLen) {
+		http.Error(w, "Invalid wrapped key", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// handleSetCodeEscrow stores the master key wrapped with a recovery code.
+func (s *Server) handleSetCodeEscrow(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	req, ok := s.decodeEscrowRequest(w, r)
+	if !ok {
+		return
+	}
+	if !validEncoded(req.Verifier, authHashSize) {
+		http.Error(w, "Invalid verifier", http.StatusBadRequest)
+		return
+	}
+
+	_, err := s.systemDB.Exec(`
+		INSERT OR REPLACE INTO recovery_escrow (user_id, kind, wrapped_key, verifier_hash, key_id) VALUES (?, ?, ?, ?, '')
+	`, userID, escrowCode, req.WrappedKey, hashRecoverySecret(req.Verifier))
+	if err != nil {
+		s.logger.Println("handleSetCodeEscrow:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, userID, userID, "recovery.code_escrowed", "")
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Recovery code set"})
+}
+
+// handleSetAdminEscrow stores the master key wrapped to the admin key.
+func (s *Server) handleSetAdminEscrow(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	policy, _, keyID := s.adminRecovery()
+	if policy == "off" {
+		http.Error(w, "Admin recovery is not enabled on this server", http.StatusForbidden)
+		return
+	}
+	req, ok := s.decodeEscrowRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.KeyID != keyID {
+		http.Error(w, "Admin recovery key has changed", http.StatusConflict)
+		return
+	}
+
+	_, err := s.systemDB.Exec(`
+		INSERT OR REPLACE INTO recovery_escrow (user_id, kind, wrapped_key, verifier_hash, key_id) VALUES (?, ?, ?, '', ?)
+	`, userID, escrowAdmin, req.WrappedKey, keyID)
+	if err != nil {
+		s.logger.Println("handleSetAdminEscrow:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, userID, userID, "recovery.admin_escrowed", "key "+keyID)
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Admin recovery enabled"})
+}
+
+// handleDeleteEscrow removes one kind of escrow. Admin escrow can't be
+// removed while admin_recovery is required.
+func (s *Server) handleDeleteEscrow(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	kind := r.PathValue("kind")
+	if kind != escrowCode && kind != escrowAdmin {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if policy, _, _ := s.adminRecovery(); kind == escrowAdmin && policy == "required" {
+		http.Error(w, "Admin recovery is required on this server", http.StatusForbidden)
+		return
+	}
+	if _, ok := s.decodeEscrowRequest(w, r); !ok {
+		return
+	}
+
+	res, err := s.systemDB.Exec("DELETE FROM recovery_escrow WHERE user_id = ? AND kind = ?", userID, kind)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.audit(r, userID, userID, "recovery."+kind+"_escrow_removed", "")
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Recovery removed"})
+}
+
+// handleRecoveryCode releases the code-wrapped key to whoever proves they
+// hold the recovery code.
+func (s *Server) handleRecoveryCode(w http.ResponseWriter, r *http.Request) {
+	var req RecoveryCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	throttle := []throttleKey{userThrottle(req.Username), ipThrottle(r)}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return
+	}
+
+	var userID int
+	var status, wrappedKey, verifierHash string
+	err := s.systemDB.QueryRow(`
+		SELECT u.id, COALESCE(NULLIF(u.status, ''), 'ACTIVE'), e.wrapped_key, e.verifier_hash
+		FROM users u JOIN recovery_escrow e ON e.user_id = u.id AND e.kind = ?
+		WHERE u.username = ?
+	`, escrowCode, req.Username).Scan(&userID, &status, &wrappedKey, &verifierHash)
+	if err == sql.ErrNoRows {
+		s.recordLoginFailure(r, throttle...)
+		http.Error(w, "Invalid recovery code", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashRecoverySecret(req.Verifier)), []byte(verifierHash)) != 1 {
+		s.recordLoginFailure(r, throttle...)
+		s.audit(r, 0, userID, "recovery.code_failed", "")
+		http.Error(w, "Invalid recovery code", http.StatusUnauthorized)
+		return
+	}
+	if status == UserStatusDisabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	token, err := newRecoveryToken()
+	if err != nil {
+		http.Error(w, "Failed to start recovery", http.StatusInternalServerError)
+		return
+	}
+	id := uuid.New().String()
+	_, err = s.systemDB.Exec(`
+		INSERT INTO recovery_requests (id, user_id, kind, status, recovery_token_hash, expires_at)
+		VALUES (?, ?, ?, 'APPROVED', ?, datetime('now', ?))
+	`, id, userID, escrowCode, hashRecoverySecret(token), fmt.Sprintf("+%d seconds", int64(recoveryGrantTTL.Seconds())))
+	if err != nil {
+		s.logger.Println("handleRecoveryCode:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, 0, userID, "recovery.code_used", "request "+id)
+	writeJSON(w, http.StatusOK, RecoveryGrant{RecoveryToken: token, WrappedKey: wrappedKey, ExpiresIn: int64(recoveryGrantTTL.Seconds())})
+}
+
+// handleCreateRecoveryRequest asks the admins to recover an account. The
+// answer looks the same whether or not the account exists and has admin
+// escrow; only real requests are stored.
+func (s *Server) handleCreateRecoveryRequest(w http.ResponseWriter, r *http.Request) {
+	var req CreateRecoveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.PublicKey == "" || len(req.PublicKey) > maxWrappedKeyLen {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+	// Every request counts, real or not, so they can't be used to flood the
+	// admins or to probe usernames
+	throttle := []throttleKey{recoveryThrottle(req.Username), ipThrottle(r)}
+	if !s.checkLoginThrottle(w, throttle...) {
+		return
+	}
+	s.recordLoginFailure(r, throttle...)
+
+	token, err := newRecoveryToken()
+	if err != nil {
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+	resp := RecoveryRequestCreated{RequestID: uuid.New().String(), RequestToken: token}
+
+	policy, _, keyID := s.adminRecovery()
+	var userID int
+	err = s.systemDB.QueryRow(`
+		SELECT u.id FROM users u JOIN recovery_escrow e ON e.user_id = u.id AND e.kind = ? AND e.key_id = ?
+		WHERE u.username = ?
+	`, escrowAdmin, keyID, req.Username).Scan(&userID)
+	if policy == "off" || err == sql.ErrNoRows {
+		writeJSON(w, http.StatusAccepted, resp)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	// One open request per user. A new one doesn't replace it: anyone can
+	// file one, and the admins may already be checking the first.
+	var pendingID string
+	err = tx.QueryRow("SELECT id FROM recovery_requests WHERE user_id = ? AND kind = ? AND status = 'PENDING' AND expires_at > CURRENT_TIMESTAMP",
+		userID, escrowAdmin).Scan(&pendingID)
+	if err == nil {
+		s.auditTx(tx, r, 0, userID, "recovery.request_refused", "request "+pendingID+" is still pending")
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, resp)
+		return
+	} else if err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO recovery_requests (id, user_id, kind, status, request_token_hash, public_key, expires_at, created_ip, created_user_agent)
+		VALUES (?, ?, ?, 'PENDING', ?, ?, datetime('now', ?), ?, ?)
+	`, resp.RequestID, userID, escrowAdmin, hashRecoverySecret(token), req.PublicKey, fmt.Sprintf("+%d seconds", int64(recoveryRequestTTL.Seconds())),
+		getClientIP(r), truncate(r.UserAgent(), maxUserAgentLen))
+	if err != nil {
+		s.logger.Println("handleCreateRecoveryRequest:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.auditTx(tx, r, 0, userID, "recovery.requested", "request "+resp.RequestID)
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// handleRecoveryRequestStatus lets the requester poll a request. Once it is
+// approved each poll returns the re-wrapped key with the recovery token, the
+// same one until it is used.
+func (s *Server) handleRecoveryRequestStatus(w http.ResponseWriter, r *http.Request) {
+	var req RecoveryRequestStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+
+	var status, wrappedKey string
+	var userID int
+	var remaining int64
+	err := s.systemDB.QueryRow(`
+		SELECT user_id, status, wrapped_key, CAST(strftime('%s', expires_at) AS INTEGER) - CAST(strftime('%s', 'now') AS INTEGER) FROM recovery_requests
+		WHERE id = ? AND kind = ? AND request_token_hash = ?
+	`, id, escrowAdmin, hashRecoverySecret(req.RequestToken)).Scan(&userID, &status, &wrappedKey, &remaining)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Recovery request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if remaining <= 0 && (status == "PENDING" || status == "APPROVED") {
+		status = "EXPIRED"
+	}
+	if status != "APPROVED" {
+		writeJSON(w, http.StatusOK, RecoveryRequestStatus{Status: status})
+		return
+	}
+
+	token := adminGrantToken(id, req.RequestToken)
+	res, err := s.systemDB.Exec("UPDATE recovery_requests SET recovery_token_hash = ? WHERE id = ? AND status = 'APPROVED' AND recovery_token_hash = ''",
+		hashRecoverySecret(token), id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.audit(r, 0, userID, "recovery.grant_issued", "admin request "+id)
+	}
+	writeJSON(w, http.StatusOK, RecoveryRequestStatus{Status: status, RecoveryGrant: &RecoveryGrant{
+		RecoveryToken: token, WrappedKey: wrappedKey, ExpiresIn: remaining,
+	}})
+}
+
+// recoveryGrantUser resolves a recovery token to its request and user.
+func (s *Server) recoveryGrantUser(token string) (requestID, kind string, userID int, dbPath string, err error) {
+	err = s.systemDB.QueryRow(`
+		SELECT q.id, q.kind, q.user_id, u.db_path FROM recovery_requests q JOIN users u ON u.id = q.user_id
+		WHERE q.recovery_token_hash = ? AND q.status = 'APPROVED' AND q.expires_at > CURRENT_TIMESTAMP
+	`, hashRecoverySecret(token)).Scan(&requestID, &kind, &userID, &dbPath)
+	return
+}
+
+// handleRecoveryVault returns the encrypted vault to a recovering client so
+// it can re-encrypt it under the new password.
+func (s *Server) handleRecoveryVault(w http.ResponseWriter, r *http.Request) {
+	var req RecoveryTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RecoveryToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	requestID, kind, userID, dbPath, err := s.recoveryGrantUser(req.RecoveryToken)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired recovery token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := RecoveryVaultResponse{Items: []VaultRekeyItem{}, Trash: []VaultRekeyItem{}, Attachments: []AttachmentRekey{}}
+	err = s.systemDB.QueryRow("SELECT salt, kdf, kdf_memory, kdf_iterations, kdf_parallelism FROM users WHERE id = ?", userID).
+		Scan(&resp.Salt, &resp.KDF, &resp.KDFMemory, &resp.KDFIterations, &resp.KDFParallelism)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	db, err := s.openUserDB(dbPath)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+	if err := readRekeySnapshot(db, &resp); err != nil {
+		s.logger.Println("handleRecoveryVault:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, 0, userID, "recovery.vault_read", kind+" request "+requestID)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readRekeySnapshot reads every encrypted value a re-key has to replace, as
+// of one cursor.
+func readRekeySnapshot(db *sql.DB, resp *RecoveryVaultResponse) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow("SELECT value FROM vault_meta WHERE key = 'last_seq'").Scan(&resp.Cursor); err != nil {
+		return err
+	}
+	for _, q := range []struct {
+		query string
+		dst   *[]VaultRekeyItem
+	}{
+		{"SELECT id, encrypted_blob FROM vault_items", &resp.Items},
+		{"SELECT id, encrypted_blob FROM vault_trash", &resp.Trash},
+	} {
+		rows, err := tx.Query(q.query)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var it VaultRekeyItem
+			if err := rows.Scan(&it.ID, &it.EncryptedBlob); err != nil {
+				rows.Close()
+				return err
+			}
+			*q.dst = append(*q.dst, it)
+		}
+		rows.Close()
+	}
+	rows, err := tx.Query("SELECT id, encrypted_name FROM vault_attachments")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a AttachmentRekey
+		if err := rows.Scan(&a.ID, &a.EncryptedName); err != nil {
+			return err
+		}
+		resp.Attachments = append(resp.Attachments, a)
+	}
+	return rows.Err()
+}
+
+// handleCompleteRecovery sets the new password and re-encrypted vault, then
+// signs out every session. The user logs in normally afterwards, so 2FA
+// still applies.
+func (s *Server) handleCompleteRecovery(w http.ResponseWriter, r *http.Request) {
+	var req CompleteRecoveryRequest
+	if !decodeRekeyRequest(w, r, &req) {
+		return
+	}
+	if req.RecoveryToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !validEncoded(req.NewAuthHash, authHashSize) || !validEncoded(req.Salt, saltSize) {
+		http.Error(w, "Invalid auth hash or salt", http.StatusBadRequest)
+		return
+	}
+	if err := req.KDFParams.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.kdfMinimum().allows(req.KDFParams) {
+		http.Error(w, "KDF parameters are below the server minimum", http.StatusBadRequest)
+		return
+	}
+
+	requestID, kind, userID, dbPath, err := s.recoveryGrantUser(req.RecoveryToken)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired recovery token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if qe := s.checkRekeyQuota(userID, req.Vault); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+	db, err := s.openUserDB(dbPath)
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Claim the request first, so a grant completes once; it is handed back if
+	// the re-key fails
+	res, err := s.systemDB.Exec("UPDATE recovery_requests SET status = 'COMPLETED', completed_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'APPROVED'", requestID)
+	if err != nil {
+		s.logger.Printf("handleCompleteRecovery: user %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Invalid or expired recovery token", http.StatusUnauthorized)
+		return
+	}
+	cursor, err := s.rekeyAccount(r, userID, db, accountKeys{authHash: req.NewAuthHash, salt: req.Salt, KDFParams: req.KDFParams}, req.Vault)
+	if err != nil {
+		s.logger.Printf("handleCompleteRecovery: user %d: %v", userID, err)
+		if _, err := s.systemDB.Exec("UPDATE recovery_requests SET status = 'APPROVED', completed_at = NULL WHERE id = ?", requestID); err != nil {
+			s.logger.Printf("handleCompleteRecovery: request %s: reopen: %v", requestID, err)
+		}
+		writeRekeyError(w, err)
+		return
+	}
+	if _, err := s.systemDB.Exec("UPDATE recovery_requests SET recovery_token_hash = '' WHERE id = ?", requestID); err != nil {
+		// Harmless: the token only works while the request is approved
+		s.logger.Printf("handleCompleteRecovery: request %s: %v", requestID, err)
+	}
+	s.audit(r, 0, userID, "recovery.completed", kind+" request "+requestID)
+
+	revoked, err := s.revokeUserSessions(userID, "", CloseReason{Code: wsClosePasswordChanged, Text: "password changed"})
+	if err != nil {
+		s.logger.Printf("handleCompleteRecovery: user %d: revoke sessions: %v", userID, err)
+	}
+	s.sseHub.BroadcastToUser(userID, "vault_rekeyed")
+	writeJSON(w, http.StatusOK, RekeyResponse{Message: "Account recovered", Cursor: cursor, SessionsRevoked: revoked})
+}
+
+// handleAdminListRecoveryRequests lists admin recovery requests, newest first.
+func (s *Server) handleAdminListRecoveryRequests(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.systemDB.Query(`
+		SELECT q.id, q.user_id, u.username, q.kind,
+		       CASE WHEN q.status IN ('PENDING', 'APPROVED') AND q.expires_at <= CURRENT_TIMESTAMP THEN 'EXPIRED' ELSE q.status END,
+		       q.public_key, COALESCE(e.wrapped_key, ''), COALESCE(e.key_id, ''),
+		       q.created_at, q.created_ip, q.created_user_agent, q.expires_at, COALESCE(q.decided_by, 0), q.decided_at
+		FROM recovery_requests q
+		JOIN users u ON u.id = q.user_id
+		LEFT JOIN recovery_escrow e ON e.user_id = q.user_id AND e.kind = ?
+		WHERE q.kind = ?
+		ORDER BY q.created_at DESC LIMIT 200
+	`, escrowAdmin, escrowAdmin)
+	if err != nil {
+		s.logger.Println("handleAdminListRecoveryRequests:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []AdminRecoveryRequest{}
+	for rows.Next() {
+		var q AdminRecoveryRequest
+		if err := rows.Scan(&q.ID, &q.UserID, &q.Username, &q.Kind, &q.Status, &q.PublicKey, &q.WrappedKey, &q.KeyID,
+			&q.CreatedAt, &q.CreatedIP, &q.CreatedUserAgent, &q.ExpiresAt, &q.DecidedBy, &q.DecidedAt); err != nil {
+			s.logger.Println("handleAdminListRecoveryRequests:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if q.Status != "PENDING" {
+			// Only needed while the request can still be approved
+			q.WrappedKey = ""
+		}
+		requests = append(requests, q)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+// handleAdminDecideRecoveryRequest approves or denies a pending request.
+// Approval carries the master key re-wrapped to the requester's public key.
+// Admins can't approve their own requests.
+func (s *Server) handleAdminDecideRecoveryRequest(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(userIDKey).(int)
+	id := r.PathValue("id")
+	approve := r.PathValue("decision") == "approve"
+	if !approve && r.PathValue("decision") != "deny" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var req ApproveRecoveryRequest
+	if approve {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.WrappedKey == "" || len(req.WrappedKey) > maxWrappedKeyLen {
+			http.Error(w, "Invalid wrapped key", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var userID int
+	err := s.systemDB.QueryRow("SELECT user_id FROM recovery_requests WHERE id = ? AND kind = ? AND status = 'PENDING' AND expires_at > CURRENT_TIMESTAMP",
+		id, escrowAdmin).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No pending recovery request", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if approve && userID == adminID {
+		http.Error(w, "Another admin must approve your own recovery", http.StatusForbidden)
+		return
+	}
+
+	status, action, message := "DENIED", "recovery.denied", "Recovery request denied"
+	expires := "+0 seconds"
+	if approve {
+		status, action, message = "APPROVED", "recovery.approved", "Recovery request approved"
+		expires = fmt.Sprintf("+%d seconds", int64(recoveryApproveTTL.Seconds()))
+	}
+	res, err := s.systemDB.Exec(`
+		UPDATE recovery_requests SET status = ?, wrapped_key = ?, decided_by = ?, decided_at = CURRENT_TIMESTAMP,
+		       expires_at = CASE WHEN ? = 'APPROVED' THEN datetime('now', ?) ELSE expires_at END
+		WHERE id = ? AND status = 'PENDING'
+	`, status, req.WrappedKey, adminID, status, expires, id)
+	if err != nil {
+		s.logger.Println("handleAdminDecideRecoveryRequest:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "No pending recovery request", http.StatusNotFound)
+		return
+	}
+	s.audit(r, adminID, userID, action, "request "+id)
+	s.logger.Printf("handleAdminDecideRecoveryRequest: admin %d set recovery request %s of user %d to %s", adminID, id, userID, status)
+	writeJSON(w, http.StatusOK, map[string]string{"message": message})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRecoveryRequestKeepsPending checks that a second request neither
+// replaces the pending one nor reaches the admins, and that filing requests
+// is throttled.
+func TestRecoveryRequestKeepsPending(t *testing.T) {
+	s := newTestServer(t)
+	s.systemDB.Exec("UPDATE server_settings SET value = 'optional' WHERE key = 'admin_recovery'")
+	s.systemDB.Exec("UPDATE server_settings SET value = 'admin public key' WHERE key = 'admin_recovery_public_key'")
+	res, err := s.systemDB.Exec("INSERT INTO users (username, password_hash, db_path) VALUES ('alice', 'x', 'alice.db')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := res.LastInsertId()
+	if _, err := s.systemDB.Exec("INSERT INTO recovery_escrow (user_id, kind, wrapped_key, key_id) VALUES (?, ?, 'wrapped', ?)",
+		userID, escrowAdmin, adminRecoveryKeyID("admin public key")); err != nil {
+		t.Fatal(err)
+	}
+
+	file := func() int {
+		t.Helper()
+		return call(t, s.handleCreateRecoveryRequest, 0, CreateRecoveryRequest{Username: "alice", PublicKey: "ephemeral key"}).Code
+	}
+	if code := file(); code != http.StatusAccepted {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := file(); code != http.StatusAccepted {
+		t.Fatalf("second request: %d, want the same answer as the first", code)
+	}
+	requests := decode[[]AdminRecoveryRequest](t, call(t, s.handleAdminListRecoveryRequests, 0, nil))
+	if len(requests) != 1 || requests[0].Status != "PENDING" {
+		t.Fatalf("requests = %+v, want the first one still pending", requests)
+	}
+	if requests[0].CreatedIP == "" {
+		t.Fatal("creation IP not recorded")
+	}
+
+	for i := 0; i < defaultLoginFreeAttempts; i++ {
+		file()
+	}
+	if code := file(); code != http.StatusTooManyRequests {
+		t.Fatalf("request after %d: %d, want 429", defaultLoginFreeAttempts+2, code)
+	}
+}
+
+// TestRecoveryGrantStableAcrossPolls checks that polling an approved request
+// hands out one recovery token and audits it once.
+func TestRecoveryGrantStableAcrossPolls(t *testing.T) {
+	s := newTestServer(t)
+	s.systemDB.Exec("UPDATE server_settings SET value = 'optional' WHERE key = 'admin_recovery'")
+	s.systemDB.Exec("UPDATE server_settings SET value = 'admin public key' WHERE key = 'admin_recovery_public_key'")
+	userID := addTestUser(t, s, "alice")
+	adminID := addTestUser(t, s, "admin")
+	if _, err := s.systemDB.Exec("INSERT INTO recovery_escrow (user_id, kind, wrapped_key, key_id) VALUES (?, ?, 'wrapped', ?)",
+		userID, escrowAdmin, adminRecoveryKeyID("admin public key")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := call(t, s.handleCreateRecoveryRequest, 0, CreateRecoveryRequest{Username: "alice", PublicKey: "ephemeral key"})
+	var created RecoveryRequestCreated
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	body, _ := json.Marshal(ApproveRecoveryRequest{WrappedKey: "rewrapped"})
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.SetPathValue("id", created.RequestID)
+	r.SetPathValue("decision", "approve")
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, adminID))
+	w = httptest.NewRecorder()
+	s.handleAdminDecideRecoveryRequest(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+
+	poll := func() RecoveryRequestStatus {
+		t.Helper()
+		body, _ := json.Marshal(RecoveryRequestStatusRequest{RequestToken: created.RequestToken})
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.SetPathValue("id", created.RequestID)
+		w := httptest.NewRecorder()
+		s.handleRecoveryRequestStatus(w, r)
+		return decode[RecoveryRequestStatus](t, w)
+	}
+	first, second := poll(), poll()
+	if first.RecoveryGrant == nil || second.RecoveryGrant == nil || first.RecoveryToken != second.RecoveryToken {
+		t.Fatalf("polls = %+v, %+v, want the same grant", first, second)
+	}
+	if _, _, got, _, err := s.recoveryGrantUser(first.RecoveryToken); err != nil || got != userID {
+		t.Fatalf("recovery token resolves to user %d: %v", got, err)
+	}
+	var issued int
+	s.systemDB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'recovery.grant_issued'").Scan(&issued)
+	if issued != 1 {
+		t.Fatalf("%d grant audits after two polls, want 1", issued)
+	}
+}
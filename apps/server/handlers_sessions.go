@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- Sessions ---
+//
+// Every login creates a sessions row, and the access tokens issued for it
+// carry the row id as their jti. validateToken rejects tokens whose session
+// is revoked, so signing a device out takes effect on its next request, and
+// its WebSocket is closed right away.
+//
+// Access tokens last access_token_ttl_minutes, 15 by default. Clients renew
+// them at /auth/refresh with an opaque refresh token that is replaced on
+// every use; a session lasts as long as it is refreshed within
+// refresh_token_ttl_days. Presenting a refresh
+// token that was already used means it was copied, so the whole session is
+// revoked.
+
+const (
+	maxDeviceNameLen = 100
+	maxUserAgentLen  = 255
+	sessionRetention = 7 * 24 * 60 * 60 // seconds a revoked or expired row is kept
+
+	defaultAccessTokenMinutes = 15
+	defaultRefreshTokenDays   = 30
+)
+
+var revokedCloseReason = CloseReason{Code: wsCloseSessionRevoked, Text: "session revoked"}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func (s *Server) accessTokenTTL() time.Duration {
+	return time.Duration(s.getSettingInt("access_token_ttl_minutes", defaultAccessTokenMinutes)) * time.Minute
+}
+
+func (s *Server) refreshTokenTTL() time.Duration {
+	return time.Duration(s.getSettingInt("refresh_token_ttl_days", defaultRefreshTokenDays)) * 24 * time.Hour
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token for a session and extends the
+// session to the token's expiry.
+func issueRefreshToken(tx *sql.Tx, sessionID string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expires := fmt.Sprintf("+%d seconds", int64(ttl.Seconds()))
+
+	_, err := tx.Exec("INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES (?, ?, datetime('now', ?))",
+		hashRefreshToken(token), sessionID, expires)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE sessions SET expires_at = datetime('now', ?) WHERE id = ?", expires, sessionID); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// createSession records a new session for userID and returns its id and
+// first refresh token.
+func (s *Server) createSession(userID int, r *http.Request, deviceName, clientType string) (string, string, error) {
+	ttl := s.refreshTokenTTL()
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New().String()
+	_, err = tx.Exec(`
+		INSERT INTO sessions (id, user_id, device_name, client_type, ip, user_agent, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, datetime('now', ?))
+	`, id, userID, truncate(deviceName, maxDeviceNameLen), truncate(clientType, 32), getClientIP(r),
+		truncate(r.UserAgent(), maxUserAgentLen), fmt.Sprintf("+%d seconds", int64(ttl.Seconds())))
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := issueRefreshToken(tx, id, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	return id, refreshToken, tx.Commit()
+}
+
+// touchSession updates last_seen_at and ip, at most once a minute per session.
+func (s *Server) touchSession(id, ip string) {
+	s.systemDB.Exec(`
+		UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP, ip = ?
+		WHERE id = ? AND last_seen_at < datetime('now', '-1 minute')
+	`, ip, id)
+}
+
+// listSessions returns a user's live sessions, most recently used first.
+func (s *Server) listSessions(userID int, currentID string) ([]Session, error) {
+	rows, err := s.systemDB.Query(`
+		SELECT id, user_id, device_name, client_type, ip, user_agent, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.UserID, &sess.DeviceName, &sess.ClientType, &sess.IP, &sess.UserAgent,
+			&sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sess.Current = sess.ID == currentID
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// revokeSession revokes one live session and closes its WebSockets. It
+// reports false if the session doesn't exist or is already revoked. A
+// userID of 0 matches any user.
+func (s *Server) revokeSession(userID int, sessionID string) (bool, error) {
+	var owner int
+	err := s.systemDB.QueryRow(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND (? = 0 OR user_id = ?) AND revoked_at IS NULL
+		RETURNING user_id
+	`, sessionID, userID, userID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	s.sseHub.DisconnectSession(owner, sessionID, revokedCloseReason)
+	return true, nil
+}
+
+// revokeUserSessions revokes all of a user's sessions except exceptID (which
+// may be empty) and closes their WebSockets with reason.
+func (s *Server) revokeUserSessions(userID int, exceptID string, reason CloseReason) (int64, error) {
+	rows, err := s.systemDB.Query(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND id != ? AND revoked_at IS NULL
+		RETURNING id
+	`, userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		s.sseHub.DisconnectSession(userID, id, reason)
+	}
+	return int64(len(ids)), nil
+}
+
+// pruneSessions deletes sessions that expired or were revoked over a week ago.
+func (s *Server) pruneSessions() {
+	age := fmt.Sprintf("-%d seconds", sessionRetention)
+	res, err := s.systemDB.Exec(`
+		DELETE FROM sessions WHERE expires_at < datetime('now', ?) OR revoked_at < datetime('now', ?)
+	`, age, age)
+	if err != nil {
+		s.logger.Println("pruneSessions:", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.logger.Printf("pruneSessions: removed %d sessions", n)
+	}
+	if _, err := s.systemDB.Exec("DELETE FROM refresh_tokens WHERE session_id NOT IN (SELECT id FROM sessions)"); err != nil {
+		s.logger.Println("pruneSessions: refresh tokens:", err)
+	}
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	currentID, _ := r.Context().Value(sessionIDKey).(string)
+
+	sessions, err := s.listSessions(userID, currentID)
+	if err != nil {
+		s.logger.Println("handleListSessions:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// handleRevokeSession signs out one of the caller's devices (or the caller).
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	ok, err := s.revokeSession(userID, r.PathValue("id"))
+	if err != nil {
+		s.logger.Println("handleRevokeSession:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Session revoked"})
+}
+
+func (s *Server) handleAdminListUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	currentID, _ := r.Context().Value(sessionIDKey).(string)
+
+	sessions, err := s.listSessions(id, currentID)
+	if err != nil {
+		s.logger.Println("handleAdminListUserSessions:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// handleAdminRevokeUserSessions signs a user out everywhere.
+func (s *Server) handleAdminRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	n, err := s.revokeUserSessions(id, "", revokedCloseReason)
+	if err != nil {
+		s.logger.Println("handleAdminRevokeUserSessions:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Sessions revoked", "revoked": n})
+}
+
+func (s *Server) handleAdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	ok, err := s.revokeSession(0, r.PathValue("id"))
+	if err != nil {
+		s.logger.Println("handleAdminRevokeSession:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Session revoked"})
+}
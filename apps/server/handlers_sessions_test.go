@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// useTestKeyRing lets s sign and check tokens.
+func useTestKeyRing(t *testing.T, s *Server) {
+	t.Helper()
+	keys, err := openKeyRing(s.config.DataDir, SecretKey, s.jwtSigningAlg())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keys = keys
+}
+
+// newSessionTestServer returns a server that can sign tokens and a session
+// for a new user, with its first refresh token.
+func newSessionTestServer(t *testing.T) (s *Server, sessionID, refreshToken string) {
+	t.Helper()
+	s = newTestServer(t)
+	useTestKeyRing(t, s)
+	userID := addTestUser(t, s, "alice")
+
+	sessionID, refreshToken, err := s.createSession(userID, httptest.NewRequest(http.MethodPost, "/", nil), "laptop", "desktop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, sessionID, refreshToken
+}
+
+// signIn starts a session for userID and returns its id and an access token.
+func signIn(t *testing.T, s *Server, userID int) (sessionID, token string) {
+	t.Helper()
+	sessionID, _, err := s.createSession(userID, httptest.NewRequest(http.MethodPost, "/", nil), "laptop", "desktop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = s.createToken(userID, sessionID, s.accessTokenTTL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionID, token
+}
+
+// bearer returns a request carrying token as its bearer token.
+func bearer(method, token string) *http.Request {
+	r := httptest.NewRequest(method, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func refresh(t *testing.T, s *Server, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, s.handleRefresh, 0, RefreshRequest{RefreshToken: token})
+}
+
+// TestRefreshRotates checks that a refresh returns a new refresh token for
+// the same session and an access token that validates.
+func TestRefreshRotates(t *testing.T) {
+	s, sessionID, first := newSessionTestServer(t)
+
+	resp := decode[RefreshResponse](t, refresh(t, s, first))
+	if resp.RefreshToken == "" || resp.RefreshToken == first {
+		t.Fatalf("refresh token not rotated: %q", resp.RefreshToken)
+	}
+	if resp.SessionID != sessionID {
+		t.Fatalf("session %q, want %q", resp.SessionID, sessionID)
+	}
+	if resp.ExpiresIn != defaultAccessTokenMinutes*60 {
+		t.Fatalf("expires_in %d, want %d", resp.ExpiresIn, defaultAccessTokenMinutes*60)
+	}
+	if _, err := s.validateToken(bearer(http.MethodGet, resp.Token)); err != nil {
+		t.Fatalf("refreshed access token rejected: %v", err)
+	}
+
+	next := decode[RefreshResponse](t, refresh(t, s, resp.RefreshToken))
+	if next.RefreshToken == resp.RefreshToken {
+		t.Fatal("second refresh returned the same token")
+	}
+}
+
+// TestRefreshReuseRevokesSession checks that presenting a rotated refresh
+// token revokes the whole session, including the token that replaced it.
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	s, sessionID, first := newSessionTestServer(t)
+
+	resp := decode[RefreshResponse](t, refresh(t, s, first))
+
+	if w := refresh(t, s, first); w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused token: %d, want 401", w.Code)
+	}
+	var revoked bool
+	if err := s.systemDB.QueryRow("SELECT revoked_at IS NOT NULL FROM sessions WHERE id = ?", sessionID).Scan(&revoked); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Fatal("session not revoked after refresh token reuse")
+	}
+
+	if w := refresh(t, s, resp.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("rotated token after reuse: %d, want 401", w.Code)
+	}
+	if _, err := s.validateToken(bearer(http.MethodGet, resp.Token)); err == nil {
+		t.Fatal("access token still valid after session revoked")
+	}
+}
+
+// authed runs h behind withUserAuth as the holder of token, with an optional
+// {id} path value.
+func authed(s *Server, h http.HandlerFunc, method, token, id string) *httptest.ResponseRecorder {
+	r := bearer(method, token)
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	s.withUserAuth(h)(w, r)
+	return w
+}
+
+// TestListAndRevokeSessions checks that users see and revoke only their own
+// sessions, and that a revoked device is cut off at once.
+func TestListAndRevokeSessions(t *testing.T) {
+	s := newTestServer(t)
+	useTestKeyRing(t, s)
+	alice, bob := addTestUser(t, s, "alice"), addTestUser(t, s, "bob")
+	laptop, laptopToken := signIn(t, s, alice)
+	phone, phoneToken := signIn(t, s, alice)
+	bobSession, bobToken := signIn(t, s, bob)
+	kick := s.sseHub.AddClient(alice, phone, make(chan string, 1))
+
+	list := func(token string) []Session {
+		t.Helper()
+		return decode[[]Session](t, authed(s, s.handleListSessions, http.MethodGet, token, ""))
+	}
+	sessions := list(laptopToken)
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(sessions))
+	}
+	for _, sess := range sessions {
+		if sess.UserID != alice || sess.Current != (sess.ID == laptop) {
+			t.Fatalf("session = %+v", sess)
+		}
+	}
+
+	if w := authed(s, s.handleRevokeSession, http.MethodDelete, laptopToken, bobSession); w.Code != http.StatusNotFound {
+		t.Fatalf("revoke another user's session: %d, want 404", w.Code)
+	}
+	if w := authed(s, s.handleRevokeSession, http.MethodDelete, laptopToken, phone); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if code := kicked(kick); code != revokedCloseReason.Code {
+		t.Fatalf("WebSocket close code %d, want %d", code, revokedCloseReason.Code)
+	}
+	if code := authCall(s, http.MethodGet, "/vault/items", phoneToken); code != http.StatusUnauthorized {
+		t.Fatalf("revoked token: %d, want 401", code)
+	}
+	if w := authed(s, s.handleRevokeSession, http.MethodDelete, laptopToken, phone); w.Code != http.StatusNotFound {
+		t.Fatalf("revoke twice: %d, want 404", w.Code)
+	}
+	if sessions := list(laptopToken); len(sessions) != 1 || sessions[0].ID != laptop {
+		t.Fatalf("sessions after revoke = %+v", sessions)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	r.SetPathValue("id", strconv.Itoa(alice))
+	w := httptest.NewRecorder()
+	s.handleAdminRevokeUserSessions(w, r)
+	if resp := decode[map[string]any](t, w); resp["revoked"] != float64(1) {
+		t.Fatalf("admin revoke = %v, want 1 revoked", resp)
+	}
+	if code := authCall(s, http.MethodGet, "/vault/items", laptopToken); code != http.StatusUnauthorized {
+		t.Fatalf("token after sign-out everywhere: %d, want 401", code)
+	}
+	if code := authCall(s, http.MethodGet, "/vault/items", bobToken); code != http.StatusOK {
+		t.Fatalf("bob's token: %d, want 200", code)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// --- Storage Analytics ---
+
+const (
+	statsSampleInterval = time.Hour
+	statsSampleKeepDays = 100
+)
+
+// fileSizes returns the size of a SQLite file and of its -wal/-shm companions.
+func fileSizes(path string) (db, overhead int64) {
+	if info, err := os.Stat(path); err == nil {
+		db = info.Size()
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if info, err := os.Stat(path + suffix); err == nil {
+			overhead += info.Size()
+		}
+	}
+	return db, overhead
+}
+
+// dirSize sums the sizes of regular files directly inside dir.
+func dirSize(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// collectStats gathers server-wide totals and per-user usage. Every user
+// vault is opened, so this is meant for the admin API and the sampler, not
+// for hot paths.
+func (s *Server) collectStats() (AdminStats, error) {
+	stats := AdminStats{
+		UsersByStatus: map[string]int{},
+		PerUser:       []UserStorageStats{},
+		CollectedAt:   time.Now().UTC(),
+	}
+
+	rows, err := s.systemDB.Query("SELECT status, COUNT(*) FROM users GROUP BY status")
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var status sql.NullString
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			continue
+		}
+		key := status.String
+		if key == "" {
+			key = "ACTIVE"
+		}
+		stats.UsersByStatus[key] += n
+		stats.TotalUsers += n
+	}
+	rows.Close()
+
+	rows, err = s.systemDB.Query("SELECT id, username, db_path FROM users ORDER BY id")
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var u UserStorageStats
+		if err := rows.Scan(&u.UserID, &u.Username, &u.dbPath); err != nil {
+			continue
+		}
+		stats.PerUser = append(stats.PerUser, u)
+	}
+	rows.Close()
+
+	stats.Storage.SystemDBBytes, stats.Storage.WALBytes = fileSizes(filepath.Join(s.config.DataDir, "system.db"))
+
+	for i := range stats.PerUser {
+		u := &stats.PerUser[i]
+		u.DBBytes, u.WALBytes = fileSizes(filepath.Join(s.config.DataDir, u.dbPath))
+		u.AttachmentBytes = dirSize(attachmentDirFor(s.config.DataDir, u.dbPath))
+
+		if db, err := s.openUserDB(u.dbPath); err == nil {
+			if usage, err := queryVaultUsage(db); err == nil {
+				u.VaultItems = usage.Items
+				u.BlobBytes = usage.Bytes
+			}
+		} else if err == errVaultMissing {
+			u.VaultMissing = true
+		} else {
+			s.logger.Printf("collectStats: open %s failed: %v", u.dbPath, err)
+		}
+
+		stats.VaultItems += u.VaultItems
+		stats.Storage.UserDBBytes += u.DBBytes
+		stats.Storage.WALBytes += u.WALBytes
+		stats.Storage.AttachmentBytes += u.AttachmentBytes
+	}
+	stats.Storage.TotalBytes = stats.Storage.SystemDBBytes + stats.Storage.UserDBBytes +
+		stats.Storage.WALBytes + stats.Storage.AttachmentBytes
+
+	stats.ActiveSessions, stats.ConnectedUsers = s.sseHub.ClientCount()
+
+	return stats, nil
+}
+
+// storeVaultItemCounts saves the per-user item counts from stats into the
+// users table, where handleListUsers reads them.
+func (s *Server) storeVaultItemCounts(stats AdminStats) {
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		s.logger.Println("storeVaultItemCounts: begin failed:", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, u := range stats.PerUser {
+		if _, err := tx.Exec("UPDATE users SET vault_items = ? WHERE id = ?", u.VaultItems, u.UserID); err != nil {
+			s.logger.Println("storeVaultItemCounts: update failed:", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		s.logger.Println("storeVaultItemCounts: commit failed:", err)
+	}
+}
+
+// recordStatsSample stores one stats snapshot for the growth time series and
+// drops samples older than statsSampleKeepDays.
+func (s *Server) recordStatsSample() {
+	stats, err := s.collectStats()
+	if err != nil {
+		s.logger.Println("recordStatsSample: collect failed:", err)
+		return
+	}
+	s.storeVaultItemCounts(stats)
+
+	_, err = s.systemDB.Exec(`
+		INSERT INTO stats_samples (total_users, vault_items, db_bytes, wal_bytes, attachment_bytes, active_sessions)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, stats.TotalUsers, stats.VaultItems,
+		stats.Storage.SystemDBBytes+stats.Storage.UserDBBytes, stats.Storage.WALBytes,
+		stats.Storage.AttachmentBytes, stats.ActiveSessions)
+	if err != nil {
+		s.logger.Println("recordStatsSample: insert failed:", err)
+		return
+	}
+
+	s.systemDB.Exec("DELETE FROM stats_samples WHERE sampled_at < datetime('now', ?)", fmt.Sprintf("-%d days", statsSampleKeepDays))
+}
+
+// runStatsSampler records a sample at startup and then every statsSampleInterval.
+func (s *Server) runStatsSampler(done <-chan struct{}) {
+	s.recordStatsSample()
+
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.recordStatsSample()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.collectStats()
+	if err != nil {
+		s.logger.Println("handleAdminStats: collect failed:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.storeVaultItemCounts(stats)
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleAdminStatsHistory returns the sampled growth series for the last 7, 30
+// or 90 days. The 7-day range keeps hourly points; longer ranges keep the
+// last sample of each day.
+func (s *Server) handleAdminStatsHistory(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || (n != 7 && n != 30 && n != 90) {
+			http.Error(w, "days must be 7, 30 or 90", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	bucket := "%Y-%m-%d"
+	if days == 7 {
+		bucket = "%Y-%m-%d %H"
+	}
+
+	rows, err := s.systemDB.Query(`
+		SELECT sampled_at, total_users, vault_items, db_bytes, wal_bytes, attachment_bytes, active_sessions
+		FROM stats_samples
+		WHERE id IN (
+			SELECT MAX(id) FROM stats_samples WHERE sampled_at >= datetime('now', ?)
+			GROUP BY strftime(?, sampled_at)
+		)
+		ORDER BY sampled_at
+	`, fmt.Sprintf("-%d days", days), bucket)
+	if err != nil {
+		s.logger.Println("handleAdminStatsHistory: query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	points := []StatsSample{}
+	for rows.Next() {
+		var p StatsSample
+		if err := rows.Scan(&p.SampledAt, &p.TotalUsers, &p.VaultItems, &p.DBBytes, &p.WALBytes, &p.AttachmentBytes, &p.ActiveSessions); err != nil {
+			continue
+		}
+		points = append(points, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, StatsHistoryResponse{Days: days, Points: points})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAdminStats checks the totals, the per-user rows and the connected
+// client count reported by the stats endpoint.
+func TestAdminStats(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := addTestUser(t, s, "alice"), addTestUser(t, s, "bob")
+	if _, err := s.systemDB.Exec("UPDATE users SET status = 'SUSPENDED' WHERE id = ?", bob); err != nil {
+		t.Fatal(err)
+	}
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "a", EncryptedBlob: "1234"}, {ID: "b", EncryptedBlob: "56"}}))
+	s.sseHub.AddClient(alice, "s1", make(chan string, 1))
+	s.sseHub.AddClient(alice, "s2", make(chan string, 1))
+
+	w := httptest.NewRecorder()
+	s.handleAdminStats(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	stats := decode[AdminStats](t, w)
+	if stats.TotalUsers != 2 || stats.UsersByStatus["ACTIVE"] != 1 || stats.UsersByStatus["SUSPENDED"] != 1 {
+		t.Fatalf("users = %d %v", stats.TotalUsers, stats.UsersByStatus)
+	}
+	if stats.VaultItems != 2 || stats.ActiveSessions != 2 || stats.ConnectedUsers != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if len(stats.PerUser) != 2 || stats.PerUser[0].VaultItems != 2 || stats.PerUser[0].BlobBytes != 6 || stats.PerUser[0].DBBytes == 0 {
+		t.Fatalf("per user = %+v", stats.PerUser)
+	}
+	if stats.Storage.TotalBytes < stats.Storage.SystemDBBytes+stats.Storage.UserDBBytes {
+		t.Fatalf("storage = %+v", stats.Storage)
+	}
+
+	var stored int64
+	if err := s.systemDB.QueryRow("SELECT vault_items FROM users WHERE id = ?", alice).Scan(&stored); err != nil || stored != 2 {
+		t.Fatalf("stored vault_items = %d, %v", stored, err)
+	}
+}
+
+// TestAdminStatsHistory checks that samples show up in the history series
+// and that only the supported ranges are accepted.
+func TestAdminStatsHistory(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "alice")
+	s.recordStatsSample()
+	s.recordStatsSample()
+
+	history := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.handleAdminStatsHistory(w, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		return w
+	}
+	if w := history("?days=5"); w.Code != http.StatusBadRequest {
+		t.Fatalf("days=5: %d, want 400", w.Code)
+	}
+	// Both samples fall in the same hour and day, so each range keeps one.
+	for _, query := range []string{"?days=7", ""} {
+		resp := decode[StatsHistoryResponse](t, history(query))
+		if len(resp.Points) != 1 || resp.Points[0].TotalUsers != 1 {
+			t.Fatalf("history%s = %+v", query, resp)
+		}
+	}
+}
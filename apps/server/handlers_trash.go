@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// --- Vault Trash ---
+
+const defaultTrashRetentionDays = 30
+
+// getTrashRetentionDays returns how long a user's deleted items stay in the
+// trash. A per-user override wins when set (> 0).
+func (s *Server) getTrashRetentionDays(userID int) int {
+	var days int
+	err := s.systemDB.QueryRow("SELECT trash_retention_days FROM users WHERE id = ?", userID).Scan(&days)
+	if err == nil && days > 0 {
+		return days
+	}
+	return s.getSettingInt("trash_retention_days_default", defaultTrashRetentionDays)
+}
+
+// purgeTrash permanently deletes the trashed items matching cond, together
+// with the history of those that weren't re-created meanwhile, so nothing
+// of a purged item stays readable.
+func purgeTrash(db *sql.DB, cond string, args ...any) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM vault_item_history
+		WHERE item_id IN (SELECT id FROM vault_trash WHERE `+cond+`)
+		AND item_id NOT IN (SELECT id FROM vault_items)
+	`, args...); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM vault_trash WHERE "+cond, args...)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// purgeAllTrash removes trashed items whose purge date has passed, along
+// with their history and attachments.
+func (s *Server) purgeAllTrash() {
+	s.forEachUserVault(func(userID int, dbPath string, db *sql.DB) {
+		n, err := purgeTrash(db, "purge_at < datetime('now')")
+		if err != nil {
+			s.logger.Printf("purgeAllTrash: %s failed: %v", dbPath, err)
+			return
+		}
+		if n > 0 {
+			s.logger.Printf("purgeAllTrash: purged %d items from %s", n, dbPath)
+		}
+		if _, err := removeOrphanAttachments(db, attachmentDirFor(s.config.DataDir, dbPath)); err != nil {
+			s.logger.Printf("purgeAllTrash: attachment cleanup for %s failed: %v", dbPath, err)
+		}
+	})
+}
+
+// cleanupUserAttachments drops attachments left without a parent after a purge.
+func (s *Server) cleanupUserAttachments(userID int, db *sql.DB) {
+	dir, err := s.getUserAttachmentDir(userID)
+	if err != nil {
+		return
+	}
+	if _, err := removeOrphanAttachments(db, dir); err != nil {
+		s.logger.Printf("cleanupUserAttachments: user %d failed: %v", userID, err)
+	}
+}
+
+func (s *Server) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, encrypted_blob, revision, deleted_at, purge_at FROM vault_trash ORDER BY deleted_at DESC")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []TrashItem{}
+	for rows.Next() {
+		var item TrashItem
+		if err := rows.Scan(&item.ID, &item.EncryptedBlob, &item.Revision, &item.DeletedAt, &item.PurgeAt); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleRestoreTrashItem brings a trashed item back as a new revision on top
+// of its tombstone. It fails with 409 if the id was re-created meanwhile.
+func (s *Server) handleRestoreTrashItem(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	userID := r.Context().Value(userIDKey).(int)
+	limits := s.getHistoryLimits(userID)
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	usageBefore, err := queryVaultUsage(tx)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var blob string
+	var trashedRevision int
+	err = tx.QueryRow("SELECT encrypted_blob, revision FROM vault_trash WHERE id = ?", id).Scan(&blob, &trashedRevision)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not in trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	current, exists, err := loadVaultItemState(tx, id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if exists && !current.Deleted {
+		writeJSON(w, http.StatusConflict, VaultConflictResponse{Error: "item_exists", Conflicts: []VaultConflict{current}})
+		return
+	}
+
+	quota := s.getVaultQuota(userID)
+	if qe := quota.checkBlob(int64(len(blob)), usageBefore); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+
+	// The delete was revision trashedRevision+1; count on from there even if
+	// its tombstone has been compacted, so no client's base revision matches.
+	newRevision := max(current.Revision, trashedRevision+1) + 1
+	if err := writeVaultItem(tx, id, blob, newRevision); err != nil {
+		http.Error(w, "Restore failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := pruneItemHistory(tx, id, limits.MaxRevisions); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	usageAfter, err := queryVaultUsage(tx)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if qe := quota.checkUsage(usageBefore, usageAfter); qe != nil {
+		writeQuotaError(w, qe)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	s.sseHub.BroadcastToUser(userID, "vault_updated")
+
+	writeJSON(w, http.StatusOK, VaultItemRevision{ID: id, Revision: newRevision})
+}
+
+// handlePurgeTrashItem permanently removes one item, its history and its
+// attachments from the trash.
+func (s *Server) handlePurgeTrashItem(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	n, err := purgeTrash(db, "id = ?", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Item not in trash", http.StatusNotFound)
+		return
+	}
+	s.cleanupUserAttachments(r.Context().Value(userIDKey).(int), db)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEmptyTrash permanently removes every item (with its history and
+// attachments) in the user's trash.
+func (s *Server) handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	n, err := purgeTrash(db, "1")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.cleanupUserAttachments(r.Context().Value(userIDKey).(int), db)
+
+	writeJSON(w, http.StatusOK, map[string]int64{"purged": n})
+}
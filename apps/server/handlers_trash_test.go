@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestTrashRestore checks that a deleted item waits in the trash, comes back
+// as a new revision, and leaves the trash once re-created under its id.
+func TestTrashRestore(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{
+		{ID: "a", EncryptedBlob: "a1"}, {ID: "b", EncryptedBlob: "b1"},
+	}))
+	if w := callPath(t, s.handleDeleteItem, http.MethodDelete, userID, nil, "id", "a"); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+
+	trash := decode[[]TrashItem](t, get(t, s.handleListTrash, userID, "/vault/trash"))
+	if len(trash) != 1 || trash[0].ID != "a" || trash[0].EncryptedBlob != "a1" || trash[0].PurgeAt == "" {
+		t.Fatalf("trash = %+v, want a with a purge date", trash)
+	}
+	if items := decode[[]VaultItem](t, get(t, s.handleListItems, userID, "/vault/items")); len(items) != 1 || items[0].ID != "b" {
+		t.Fatalf("items after delete = %+v, want only b", items)
+	}
+
+	// The tombstone may be compacted before the restore; the trash row still
+	// carries the revision to restore on top of.
+	db, err := s.openUserDB("alice.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("UPDATE vault_tombstones SET deleted_at = datetime('now', '-2 hours')")
+	if _, err := compactTombstones(db, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := decode[VaultItemRevision](t, callPath(t, s.handleRestoreTrashItem, http.MethodPost, userID, nil, "id", "a"))
+	if restored.Revision != 3 {
+		t.Fatalf("restored revision = %d, want 3", restored.Revision)
+	}
+	if trash := decode[[]TrashItem](t, get(t, s.handleListTrash, userID, "/vault/trash")); len(trash) != 0 {
+		t.Fatalf("trash after restore = %+v", trash)
+	}
+	if w := callPath(t, s.handleRestoreTrashItem, http.MethodPost, userID, nil, "id", "a"); w.Code != http.StatusNotFound {
+		t.Fatalf("second restore: %d, want 404", w.Code)
+	}
+
+	// b is deleted, then re-created by a client that saw the deletion
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "b", Revision: 1}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "b", EncryptedBlob: "b2", Revision: 2}}))
+	if w := callPath(t, s.handleRestoreTrashItem, http.MethodPost, userID, nil, "id", "b"); w.Code != http.StatusNotFound {
+		t.Fatalf("restore over a re-created item: %d %s, want 404", w.Code, w.Body)
+	}
+}
+
+// TestTrashPurge checks that purging drops the item and its history for good.
+func TestTrashPurge(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a1"}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a2", Revision: 1}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", Revision: 2}}))
+
+	if w := callPath(t, s.handlePurgeTrashItem, http.MethodDelete, userID, nil, "id", "a"); w.Code != http.StatusNoContent {
+		t.Fatalf("purge: %d %s", w.Code, w.Body)
+	}
+	if w := callPath(t, s.handlePurgeTrashItem, http.MethodDelete, userID, nil, "id", "a"); w.Code != http.StatusNotFound {
+		t.Fatalf("second purge: %d, want 404", w.Code)
+	}
+	if w := callPath(t, s.handleRestoreTrashItem, http.MethodPost, userID, nil, "id", "a"); w.Code != http.StatusNotFound {
+		t.Fatalf("restore after purge: %d, want 404", w.Code)
+	}
+	if history := decode[[]VaultItemHistoryEntry](t, callPath(t, s.handleListItemHistory, http.MethodGet, userID, nil, "id", "a")); len(history) != 0 {
+		t.Fatalf("history after purge = %+v", history)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 // --- Vault Handlers ---
 
+// maxUpsertBodyBytes caps the body of a PUT /vault/items batch.
+const maxUpsertBodyBytes = 64 << 20
+
 func (s *Server) handleListItems(w http.ResponseWriter, r *http.Request) {
 	db, err := s.getUserDB(r.Context())
 	if err != nil {
@@ -15,7 +21,22 @@ func (s *Server) handleListItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query("SELECT id, encrypted_blob, revision, updated_at FROM vault_items")
+	// Read the cursor and the rows in one transaction so a client that follows up
+	// with /vault/changes?since=<cursor> never misses a concurrent write.
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var cursor int64
+	if err := tx.QueryRow("SELECT value FROM vault_meta WHERE key = 'last_seq'").Scan(&cursor); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.Query("SELECT id, encrypted_blob, revision, updated_at FROM vault_items")
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -36,17 +57,156 @@ func (s *Server) handleListItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("X-Vault-Cursor", strconv.FormatInt(cursor, 10))
 	writeJSON(w, http.StatusOK, items)
 }
 
-// handleUpsertItems adds or updates one or more vault items for the user
+// handleListChanges returns the upserts and deletions recorded after the
+// given cursor. Clients whose cursor predates tombstone compaction get 410
+// and must fall back to a full GET /vault/items.
+func (s *Server) handleListChanges(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var cursor, compacted int64
+	err = tx.QueryRow(`
+		SELECT
+			(SELECT value FROM vault_meta WHERE key = 'last_seq'),
+			(SELECT value FROM vault_meta WHERE key = 'compacted_seq')
+	`).Scan(&cursor, &compacted)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A cursor of 0 means "no local state", so missing tombstones don't matter.
+	// A cursor ahead of the server (e.g. after a restore) can't be trusted either.
+	if since > cursor {
+		writeJSON(w, http.StatusGone, VaultChangesError{Error: "cursor_invalid", FullResync: true, Cursor: cursor})
+		return
+	}
+	if since > 0 && since < compacted {
+		writeJSON(w, http.StatusGone, VaultChangesError{Error: "cursor_too_old", FullResync: true, Cursor: cursor})
+		return
+	}
+
+	resp := VaultChangesResponse{Cursor: cursor, Items: []VaultItem{}, Tombstones: []VaultTombstone{}}
+
+	rows, err := tx.Query("SELECT id, encrypted_blob, revision, updated_at FROM vault_items WHERE seq > ? ORDER BY seq", since)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var item VaultItem
+		if err := rows.Scan(&item.ID, &item.EncryptedBlob, &item.Revision, &item.UpdatedAt); err != nil {
+			continue
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	if since > 0 {
+		rows, err = tx.Query("SELECT id, revision, deleted_at FROM vault_tombstones WHERE seq > ? ORDER BY seq", since)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var t VaultTombstone
+			if err := rows.Scan(&t.ID, &t.Revision, &t.DeletedAt); err != nil {
+				continue
+			}
+			resp.Tombstones = append(resp.Tombstones, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Database iteration error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// loadVaultItemState returns the stored revision of an item, falling back to
+// its tombstone when it has been deleted. exists is false if neither is found.
+func loadVaultItemState(tx *sql.Tx, id string) (state VaultConflict, exists bool, err error) {
+	err = tx.QueryRow("SELECT id, encrypted_blob, revision FROM vault_items WHERE id = ?", id).
+		Scan(&state.ID, &state.EncryptedBlob, &state.Revision)
+	if err == nil {
+		return state, true, nil
+	} else if err != sql.ErrNoRows {
+		return state, false, err
+	}
+
+	err = tx.QueryRow("SELECT id, revision FROM vault_tombstones WHERE id = ?", id).Scan(&state.ID, &state.Revision)
+	if err == nil {
+		state.Deleted = true
+		return state, true, nil
+	} else if err != sql.ErrNoRows {
+		return state, false, err
+	}
+	return VaultConflict{ID: id}, false, nil
+}
+
+// handleUpsertItems adds or updates one or more vault items for the user.
+//
+// Each item's revision is the base revision the client's edit was made
+// against. The write is rejected with 409 if it doesn't match the stored
+// revision (a deleted item's stored revision is its tombstone's); otherwise
+// the server assigns stored+1 (or 1 for a new item). An unknown id with a
+// base revision above 0 was deleted and its tombstone compacted away, so it
+// is reported as a deleted conflict rather than created afresh.
+// The batch is applied atomically: any conflict rolls back the whole request.
 func (s *Server) handleUpsertItems(w http.ResponseWriter, r *http.Request) {
 	var items []VaultItem
-	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpsertBodyBytes)).Decode(&items); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
+	for _, item := range items {
+		if strings.TrimSpace(item.ID) == "" {
+			http.Error(w, "Item id is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	limits := s.getHistoryLimits(userID)
+	trashDays := s.getTrashRetentionDays(userID)
+	quota := s.getVaultQuota(userID)
+
 	db, err := s.getUserDB(r.Context())
 	if err != nil {
 		http.Error(w, "Storage access failed", http.StatusInternalServerError)
@@ -58,40 +218,106 @@ func (s *Server) handleUpsertItems(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`
-		INSERT INTO vault_items (id, encrypted_blob, revision, updated_at) 
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(id) DO UPDATE SET 
-			encrypted_blob=excluded.encrypted_blob, 
-			revision=excluded.revision,
-			updated_at=CURRENT_TIMESTAMP
-	`)
+	usageBefore, err := queryVaultUsage(tx)
 	if err != nil {
-		tx.Rollback()
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer stmt.Close()
+
+	results := make([]VaultItemRevision, 0, len(items))
+	conflicts := []VaultConflict{}
+	wrote := false
 
 	for _, item := range items {
+		current, exists, err := loadVaultItemState(tx, item.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		live := exists && !current.Deleted
+
 		// Allow clients to delete items via the same PUT endpoint (useful when DELETE is blocked).
-		// Convention: revision <= 0 OR empty encrypted_blob indicates a tombstone delete.
-		if item.Revision <= 0 || strings.TrimSpace(item.EncryptedBlob) == "" {
-			if _, err := tx.Exec("DELETE FROM vault_items WHERE id = ?", item.ID); err != nil {
-				tx.Rollback()
+		// Convention: an empty encrypted_blob indicates a tombstone delete. Like
+		// an edit, it has to be made against the current revision.
+		if strings.TrimSpace(item.EncryptedBlob) == "" {
+			if !live {
+				// Already deleted (or never existed): nothing to do.
+				results = append(results, VaultItemRevision{ID: item.ID, Revision: current.Revision, Deleted: true})
+				continue
+			}
+			if item.Revision != current.Revision {
+				conflicts = append(conflicts, current)
+				continue
+			}
+			newRevision := current.Revision + 1
+			if err := deleteVaultItem(tx, item.ID, newRevision, trashDays); err != nil {
 				http.Error(w, "Delete failed: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if err := pruneItemHistory(tx, item.ID, limits.MaxRevisions); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			results = append(results, VaultItemRevision{ID: item.ID, Revision: newRevision, Deleted: true})
 			continue
 		}
 
-		_, err := stmt.Exec(item.ID, item.EncryptedBlob, item.Revision)
-		if err != nil {
-			tx.Rollback()
+		if qe := quota.checkBlob(int64(len(item.EncryptedBlob)), usageBefore); qe != nil {
+			writeQuotaError(w, qe)
+			return
+		}
+
+		// A tombstone is treated like any other stored revision: only a client
+		// that has seen the deletion may bring the item back.
+		newRevision := 1
+		if exists {
+			if item.Revision != current.Revision {
+				conflicts = append(conflicts, current)
+				continue
+			}
+			newRevision = current.Revision + 1
+		} else if item.Revision > 0 {
+			conflicts = append(conflicts, VaultConflict{ID: item.ID, Deleted: true})
+			continue
+		}
+
+		if err := writeVaultItem(tx, item.ID, item.EncryptedBlob, newRevision); err != nil {
 			http.Error(w, "Save failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		wrote = true
+		if err := pruneItemHistory(tx, item.ID, limits.MaxRevisions); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, VaultItemRevision{ID: item.ID, Revision: newRevision})
+	}
+
+	if len(conflicts) > 0 {
+		writeJSON(w, http.StatusConflict, VaultConflictResponse{Error: "revision_conflict", Conflicts: conflicts})
+		return
+	}
+
+	// Deleted items move to the trash and history, which count towards the
+	// quota until purged; a batch of deletes alone is always allowed.
+	if wrote {
+		usageAfter, err := queryVaultUsage(tx)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if qe := quota.checkUsage(usageBefore, usageAfter); qe != nil {
+			writeQuotaError(w, qe)
+			return
+		}
+	}
+
+	var cursor int64
+	if err := tx.QueryRow("SELECT value FROM vault_meta WHERE key = 'last_seq'").Scan(&cursor); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -99,22 +325,19 @@ func (s *Server) handleUpsertItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve user ID from context safely (to use for broadcasting event)
-	userID, ok := r.Context().Value(userIDKey).(int)
-	if ok {
-		s.sseHub.BroadcastToUser(userID, "vault_updated")
-	}
+	s.sseHub.BroadcastToUser(userID, "vault_updated")
 
-	writeJSON(w, http.StatusOK, map[string]string{"message": "Items synced"})
+	writeJSON(w, http.StatusOK, UpsertItemsResponse{Message: "Items synced", Items: results, Cursor: cursor})
 }
 
-// handleDeleteItem removes a single vault item by id for the authenticated user
+// handleDeleteItem moves a single vault item to the trash for the authenticated user
 func (s *Server) handleDeleteItem(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
 		http.Error(w, "Missing item id", http.StatusBadRequest)
 		return
 	}
+	userID := r.Context().Value(userIDKey).(int)
 
 	db, err := s.getUserDB(r.Context())
 	if err != nil {
@@ -122,24 +345,40 @@ func (s *Server) handleDeleteItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := db.Exec("DELETE FROM vault_items WHERE id = ?", id)
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Delete failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
+	var revision int
+	err = tx.QueryRow("SELECT revision FROM vault_items WHERE id = ?", id).Scan(&revision)
+	if err == sql.ErrNoRows {
 		// Idempotent: still return success so clients can delete without
 		// worrying about whether the server already purged the entry.
 		writeJSON(w, http.StatusOK, map[string]string{"message": "Item not found (already deleted)"})
 		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
 
-	// Broadcast vault change to other sessions
-	if userID, ok := r.Context().Value(userIDKey).(int); ok {
-		s.sseHub.BroadcastToUser(userID, "vault_updated")
+	if err := deleteVaultItem(tx, id, revision+1, s.getTrashRetentionDays(userID)); err != nil {
+		http.Error(w, "Delete failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := pruneItemHistory(tx, id, s.getHistoryLimits(userID).MaxRevisions); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Commit failed", http.StatusInternalServerError)
+		return
 	}
 
+	// Broadcast vault change to other sessions
+	s.sseHub.BroadcastToUser(userID, "vault_updated")
+
 	writeJSON(w, http.StatusOK, map[string]string{"message": "Item deleted"})
-}
\ No newline at end of file
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestUpsertRevisionConflicts checks that edits and deletes made against a
+// stale revision are rejected and leave the item alone.
+func TestUpsertRevisionConflicts(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+	upsert := func(items ...VaultItem) *httptest.ResponseRecorder {
+		t.Helper()
+		return call(t, s.handleUpsertItems, userID, items)
+	}
+
+	decode[UpsertItemsResponse](t, upsert(VaultItem{ID: "a", EncryptedBlob: "v1"}))
+	saved := decode[UpsertItemsResponse](t, upsert(VaultItem{ID: "a", EncryptedBlob: "v2", Revision: 1}))
+	if saved.Items[0].Revision != 2 {
+		t.Fatalf("revision after edit = %d, want 2", saved.Items[0].Revision)
+	}
+
+	for _, stale := range []VaultItem{
+		{ID: "a", EncryptedBlob: "v3", Revision: 1},
+		{ID: "a", Revision: 1},
+		{ID: "a"}, // a delete without a revision
+	} {
+		w := upsert(stale)
+		if w.Code != http.StatusConflict {
+			t.Fatalf("stale write %+v: %d %s, want 409", stale, w.Code, w.Body)
+		}
+		var conflict VaultConflictResponse
+		json.Unmarshal(w.Body.Bytes(), &conflict)
+		if len(conflict.Conflicts) != 1 || conflict.Conflicts[0].Revision != 2 || conflict.Conflicts[0].EncryptedBlob != "v2" {
+			t.Fatalf("conflict = %+v, want the stored revision 2", conflict)
+		}
+	}
+
+	deleted := decode[UpsertItemsResponse](t, upsert(VaultItem{ID: "a", Revision: 2}))
+	if !deleted.Items[0].Deleted || deleted.Items[0].Revision != 3 {
+		t.Fatalf("delete at the current revision = %+v", deleted.Items[0])
+	}
+}
+
+// get runs a GET handler for target as userID.
+func get(t *testing.T, h http.HandlerFunc, userID int, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// TestChangeFeed checks that /vault/changes returns only what changed after
+// the cursor and refuses a cursor the server never handed out.
+func TestChangeFeed(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{
+		{ID: "a", EncryptedBlob: "a1"}, {ID: "b", EncryptedBlob: "b1"},
+	}))
+	all := decode[VaultChangesResponse](t, get(t, s.handleListChanges, userID, "/vault/changes"))
+	if len(all.Items) != 2 || all.Cursor == 0 {
+		t.Fatalf("full feed = %+v, want both items and a cursor", all)
+	}
+
+	empty := decode[VaultChangesResponse](t, get(t, s.handleListChanges, userID, "/vault/changes?since="+strconv.FormatInt(all.Cursor, 10)))
+	if len(empty.Items) != 0 || empty.Cursor != all.Cursor {
+		t.Fatalf("feed at the cursor = %+v, want nothing new", empty)
+	}
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a2", Revision: 1}}))
+	delta := decode[VaultChangesResponse](t, get(t, s.handleListChanges, userID, "/vault/changes?since="+strconv.FormatInt(all.Cursor, 10)))
+	if len(delta.Items) != 1 || delta.Items[0].ID != "a" || delta.Items[0].EncryptedBlob != "a2" || delta.Cursor <= all.Cursor {
+		t.Fatalf("delta = %+v, want only the edit of a", delta)
+	}
+
+	if w := get(t, s.handleListChanges, userID, "/vault/changes?since=-1"); w.Code != http.StatusBadRequest {
+		t.Fatalf("negative cursor: %d, want 400", w.Code)
+	}
+	w := get(t, s.handleListChanges, userID, "/vault/changes?since="+strconv.FormatInt(delta.Cursor+1, 10))
+	var gone VaultChangesError
+	json.Unmarshal(w.Body.Bytes(), &gone)
+	if w.Code != http.StatusGone || gone.Error != "cursor_invalid" || !gone.FullResync {
+		t.Fatalf("cursor ahead of the server: %d %+v, want 410 cursor_invalid", w.Code, gone)
+	}
+}
+
+// TestTombstonesAndCompaction checks that a delete reaches the change feed
+// as a tombstone that guards the revision, and that compacting it sends
+// clients with an older cursor to a full resync.
+func TestTombstonesAndCompaction(t *testing.T) {
+	s := newTestServer(t)
+	userID := addTestUser(t, s, "alice")
+	since := func(cursor int64) *httptest.ResponseRecorder {
+		return get(t, s.handleListChanges, userID, "/vault/changes?since="+strconv.FormatInt(cursor, 10))
+	}
+
+	created := decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a1"}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", Revision: 1}}))
+
+	feed := decode[VaultChangesResponse](t, since(created.Cursor))
+	if len(feed.Items) != 0 || len(feed.Tombstones) != 1 || feed.Tombstones[0].ID != "a" || feed.Tombstones[0].Revision != 2 {
+		t.Fatalf("feed after delete = %+v, want one tombstone at revision 2", feed)
+	}
+
+	// Only a client that saw the deletion may bring the item back
+	if w := call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "a2", Revision: 1}}); w.Code != http.StatusConflict {
+		t.Fatalf("recreate over the tombstone at a stale revision: %d, want 409", w.Code)
+	}
+
+	db, err := s.openUserDB("alice.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := compactTombstones(db, time.Hour); err != nil || n != 0 {
+		t.Fatalf("compacting a fresh tombstone: %d, %v", n, err)
+	}
+	if _, err := db.Exec("UPDATE vault_tombstones SET deleted_at = datetime('now', '-2 hours')"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := compactTombstones(db, time.Hour); err != nil || n != 1 {
+		t.Fatalf("compacting an expired tombstone: %d, %v", n, err)
+	}
+
+	w := since(created.Cursor)
+	var gone VaultChangesError
+	json.Unmarshal(w.Body.Bytes(), &gone)
+	if w.Code != http.StatusGone || gone.Error != "cursor_too_old" || gone.Cursor != feed.Cursor {
+		t.Fatalf("cursor before compaction: %d %+v, want 410 cursor_too_old", w.Code, gone)
+	}
+	decode[VaultChangesResponse](t, since(0))
+	decode[VaultChangesResponse](t, since(feed.Cursor))
+}
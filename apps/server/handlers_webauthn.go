@@ -0,0 +1,578 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// --- WebAuthn / Passkeys ---
+//
+// Authenticators are registered by signed-in users and count as a second
+// factor. A login can then finish with an assertion instead of a TOTP code
+// (mfa_token from /auth/login), or skip the password entirely: a passkey
+// ceremony without mfa_token requires user verification on the authenticator
+// and signs in whoever the discoverable credential belongs to.
+//
+// Admins set the attestation policy. webauthn_attestation "required" asks
+// authenticators for attestation and rejects those that send none or only
+// self attestation; webauthn_allowed_aaguids limits registration to the
+// listed authenticator models. Attestation certificates are checked for a
+// valid signature but not against the FIDO metadata service.
+
+const (
+	webAuthnCeremonyTTL = 5 * time.Minute
+	maxCredentialName   = 64
+)
+
+type webAuthnCeremony struct {
+	register  bool
+	userID    int    // registering user; 0 for logins until verified
+	mfaToken  string // set when the login is the second step of a password login
+	session   webauthn.SessionData
+	expiresAt time.Time
+}
+
+var (
+	pendingWebAuthn   = make(map[string]*webAuthnCeremony)
+	pendingWebAuthnMu sync.Mutex
+)
+
+func startWebAuthnCeremony(c *webAuthnCeremony) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	c.expiresAt = now.Add(webAuthnCeremonyTTL)
+	pendingWebAuthnMu.Lock()
+	defer pendingWebAuthnMu.Unlock()
+	for k, v := range pendingWebAuthn {
+		if now.After(v.expiresAt) {
+			delete(pendingWebAuthn, k)
+		}
+	}
+	pendingWebAuthn[id] = c
+	return id, nil
+}
+
+// takeWebAuthnCeremony removes and returns a ceremony; each can be finished
+// once.
+func takeWebAuthnCeremony(id string, register bool) (*webAuthnCeremony, bool) {
+	pendingWebAuthnMu.Lock()
+	defer pendingWebAuthnMu.Unlock()
+	c, ok := pendingWebAuthn[id]
+	delete(pendingWebAuthn, id)
+	if !ok || c.register != register || time.Now().After(c.expiresAt) {
+		return nil, false
+	}
+	return c, true
+}
+
+// webAuthnUser adapts a user and their credentials to webauthn.User.
+type webAuthnUser struct {
+	id          int
+	username    string
+	handle      []byte
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte                         { return u.handle }
+func (u *webAuthnUser) WebAuthnName() string                       { return u.username }
+func (u *webAuthnUser) WebAuthnDisplayName() string                { return u.username }
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+var errWebAuthnNotConfigured = errors.New("WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS must be set to use security keys")
+
+// webAuthn returns the relying party from WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS.
+// Both have to be set: deriving them from the Host and X-Forwarded-Proto
+// headers would let whoever controls those headers pick the relying party.
+func (s *Server) webAuthn() (*webauthn.WebAuthn, error) {
+	rpID, origins := s.config.WebAuthnRPID, s.config.WebAuthnOrigins
+	if rpID == "" || len(origins) == 0 {
+		return nil, errWebAuthnNotConfigured
+	}
+
+	attestation := protocol.PreferNoAttestation
+	if s.getSetting("webauthn_attestation") == "required" {
+		attestation = protocol.PreferDirectAttestation
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:                  rpID,
+		RPDisplayName:         "Guardian",
+		RPOrigins:             origins,
+		AttestationPreference: attestation,
+	})
+}
+
+// loadWebAuthnUser reads a user's credentials. With create set, a user
+// handle is assigned if the user doesn't have one yet.
+func (s *Server) loadWebAuthnUser(userID int, create bool) (*webAuthnUser, error) {
+	u := &webAuthnUser{id: userID}
+	if err := s.systemDB.QueryRow("SELECT username, webauthn_handle FROM users WHERE id = ?", userID).Scan(&u.username, &u.handle); err != nil {
+		return nil, err
+	}
+	if len(u.handle) == 0 && create {
+		u.handle = make([]byte, 32)
+		if _, err := rand.Read(u.handle); err != nil {
+			return nil, err
+		}
+		if _, err := s.systemDB.Exec("UPDATE users SET webauthn_handle = ? WHERE id = ?", u.handle, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := s.systemDB.Query("SELECT credential FROM webauthn_credentials WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var raw string
+		var cred webauthn.Credential
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(raw), &cred); err != nil {
+			return nil, err
+		}
+		u.credentials = append(u.credentials, cred)
+	}
+	return u, rows.Err()
+}
+
+func credentialID(cred *webauthn.Credential) string {
+	return base64.RawURLEncoding.EncodeToString(cred.ID)
+}
+
+// parseAAGUIDList parses the webauthn_allowed_aaguids setting.
+func parseAAGUIDList(list string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := uuid.Parse(field)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// checkAttestationPolicy applies the admin's attestation settings to a new
+// credential and returns a reason to reject it, or "".
+func (s *Server) checkAttestationPolicy(cred *webauthn.Credential) string {
+	if s.getSetting("webauthn_attestation") == "required" {
+		switch metadata.AuthenticatorAttestationType(cred.AttestationType) {
+		case "", metadata.None, metadata.BasicSurrogate:
+			return "This server requires an authenticator with attestation"
+		}
+	}
+
+	allowed, _ := parseAAGUIDList(s.getSetting("webauthn_allowed_aaguids"))
+	if len(allowed) > 0 {
+		aaguid, err := uuid.FromBytes(cred.Authenticator.AAGUID)
+		if err != nil || !slices.Contains(allowed, aaguid) {
+			return "This authenticator model is not allowed on this server"
+		}
+	}
+	return ""
+}
+
+// handleWebAuthnRegisterBegin starts registering an authenticator for the
+// signed-in user.
+func (s *Server) handleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	wa, err := s.webAuthn()
+	if err != nil {
+		s.logger.Println("handleWebAuthnRegisterBegin:", err)
+		http.Error(w, "WebAuthn is not configured correctly", http.StatusInternalServerError)
+		return
+	}
+	user, err := s.loadWebAuthnUser(userID, true)
+	if err != nil {
+		s.logger.Println("handleWebAuthnRegisterBegin:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	exclude := make([]protocol.CredentialDescriptor, len(user.credentials))
+	for i, c := range user.credentials {
+		exclude[i] = c.Descriptor()
+	}
+	creation, session, err := wa.BeginRegistration(user,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		}),
+	)
+	if err != nil {
+		s.logger.Println("handleWebAuthnRegisterBegin:", err)
+		http.Error(w, "Failed to start registration", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := startWebAuthnCeremony(&webAuthnCeremony{register: true, userID: userID, session: *session})
+	if err != nil {
+		http.Error(w, "Failed to start registration", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, WebAuthnOptions{CeremonyID: id, Options: creation})
+}
+
+// handleWebAuthnRegisterFinish verifies the authenticator's response and
+// stores the credential. The user's first second factor also gets them
+// recovery codes.
+func (s *Server) handleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req WebAuthnRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	ceremony, ok := takeWebAuthnCeremony(req.CeremonyID, true)
+	if !ok || ceremony.userID != userID {
+		http.Error(w, "Registration expired, start again", http.StatusBadRequest)
+		return
+	}
+
+	wa, err := s.webAuthn()
+	if err != nil {
+		http.Error(w, "WebAuthn is not configured correctly", http.StatusInternalServerError)
+		return
+	}
+	user, err := s.loadWebAuthnUser(userID, false)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	cred, err := wa.CreateCredential(user, ceremony.session, parsed)
+	if err != nil {
+		s.logger.Printf("handleWebAuthnRegisterFinish: user %d: %v", userID, err)
+		http.Error(w, "Registration failed", http.StatusBadRequest)
+		return
+	}
+	if reason := s.checkAttestationPolicy(cred); reason != "" {
+		s.logger.Printf("handleWebAuthnRegisterFinish: user %d: rejected %s attestation from %x", userID, cred.AttestationType, cred.Authenticator.AAGUID)
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Security key"
+	}
+	record, err := json.Marshal(cred)
+	if err != nil {
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO webauthn_credentials (id, user_id, name, credential) VALUES (?, ?, ?, ?)",
+		credentialID(cred), userID, truncate(name, maxCredentialName), string(record))
+	if err != nil {
+		s.logger.Println("handleWebAuthnRegisterFinish:", err)
+		http.Error(w, "Credential already registered", http.StatusConflict)
+		return
+	}
+	var resp WebAuthnRegisterResponse
+	var haveCodes bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM recovery_codes WHERE user_id = ?)", userID).Scan(&haveCodes); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !haveCodes {
+		if resp.RecoveryCodes, err = replaceRecoveryCodes(tx, userID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("handleWebAuthnRegisterFinish: user %d registered authenticator %s", userID, credentialID(cred))
+	resp.Credential = credentialInfo(cred, credentialID(cred), name, time.Now().UTC(), nil)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func credentialInfo(cred *webauthn.Credential, id, name string, createdAt time.Time, lastUsed *time.Time) WebAuthnCredentialInfo {
+	info := WebAuthnCredentialInfo{
+		ID:              id,
+		Name:            name,
+		AttestationType: cred.AttestationType,
+		BackupEligible:  cred.Flags.BackupEligible,
+		CreatedAt:       createdAt,
+		LastUsedAt:      lastUsed,
+	}
+	if aaguid, err := uuid.FromBytes(cred.Authenticator.AAGUID); err == nil {
+		info.AAGUID = aaguid.String()
+	}
+	return info
+}
+
+func (s *Server) handleListWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	rows, err := s.systemDB.Query(`
+		SELECT id, name, credential, created_at, last_used_at FROM webauthn_credentials
+		WHERE user_id = ? ORDER BY created_at
+	`, userID)
+	if err != nil {
+		s.logger.Println("handleListWebAuthnCredentials:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	creds := []WebAuthnCredentialInfo{}
+	for rows.Next() {
+		var id, name, record string
+		var createdAt time.Time
+		var lastUsed *time.Time
+		var cred webauthn.Credential
+		if err := rows.Scan(&id, &name, &record, &createdAt, &lastUsed); err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(record), &cred)
+		creds = append(creds, credentialInfo(&cred, id, name, createdAt, lastUsed))
+	}
+	writeJSON(w, http.StatusOK, creds)
+}
+
+// handleDeleteWebAuthnCredential removes an authenticator. Like disabling
+// TOTP it takes the password.
+func (s *Server) handleDeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var isAdmin, totp bool
+	var others int
+	err := s.systemDB.QueryRow(`
+		SELECT is_admin,
+		       EXISTS(SELECT 1 FROM user_totp WHERE user_id = users.id AND enabled_at IS NOT NULL),
+		       (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = users.id AND id != ?)
+		FROM users WHERE id = ?
+	`, r.PathValue("id"), userID).Scan(&isAdmin, &totp, &others)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !s.verifyUserSecret(w, r, userID, req.Password, req.AuthHash) {
+		return
+	}
+	if !totp && others == 0 && s.twoFactorRequired(isAdmin) {
+		http.Error(w, "Two-factor authentication is required on this server", http.StatusForbidden)
+		return
+	}
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	if err := pruneRecoveryCodes(tx, userID); err != nil || tx.Commit() != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("handleDeleteWebAuthnCredential: user %d removed authenticator %s", userID, r.PathValue("id"))
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Credential removed"})
+}
+
+// handleWebAuthnLoginBegin starts an assertion: for the user of a pending
+// password login if mfa_token is given, otherwise for any passkey.
+func (s *Server) handleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	var req WebAuthnLoginBeginRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	wa, err := s.webAuthn()
+	if err != nil {
+		s.logger.Println("handleWebAuthnLoginBegin:", err)
+		http.Error(w, "WebAuthn is not configured correctly", http.StatusInternalServerError)
+		return
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	if req.MFAToken != "" {
+		login, ok := takeMFALogin(req.MFAToken)
+		if !ok {
+			http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+			return
+		}
+		user, err := s.loadWebAuthnUser(login.userID, false)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(user.credentials) == 0 {
+			http.Error(w, "No security keys registered", http.StatusBadRequest)
+			return
+		}
+		assertion, session, err = wa.BeginLogin(user)
+	} else {
+		// The passkey replaces the password, so the authenticator must
+		// verify the user (PIN or biometrics)
+		assertion, session, err = wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+	if err != nil {
+		s.logger.Println("handleWebAuthnLoginBegin:", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := startWebAuthnCeremony(&webAuthnCeremony{mfaToken: req.MFAToken, session: *session})
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, WebAuthnOptions{CeremonyID: id, Options: assertion})
+}
+
+// handleWebAuthnLoginFinish verifies an assertion and signs the user in.
+// A sign count that didn't increase means the key may have been cloned, and
+// the login is refused.
+func (s *Server) handleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	var req WebAuthnLoginFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !s.checkLoginThrottle(w, ipThrottle(r)) {
+		return
+	}
+	ceremony, ok := takeWebAuthnCeremony(req.CeremonyID, false)
+	if !ok {
+		http.Error(w, "Login expired, start again", http.StatusUnauthorized)
+		return
+	}
+	wa, err := s.webAuthn()
+	if err != nil {
+		http.Error(w, "WebAuthn is not configured correctly", http.StatusInternalServerError)
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var cred *webauthn.Credential
+	deviceName, clientType := req.DeviceName, req.ClientType
+	if ceremony.mfaToken != "" {
+		login, ok := takeMFALogin(ceremony.mfaToken)
+		if !ok {
+			http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+			return
+		}
+		userKey := s.usernameThrottle(login.userID)
+		if !s.checkLoginThrottle(w, userKey) {
+			return
+		}
+		user, err := s.loadWebAuthnUser(login.userID, false)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if cred, err = wa.ValidateLogin(user, ceremony.session, parsed); err != nil {
+			s.logger.Printf("handleWebAuthnLoginFinish: user %d: %v", login.userID, err)
+			s.recordLoginFailure(r, userKey, ipThrottle(r))
+			http.Error(w, "Invalid security key response", http.StatusUnauthorized)
+			return
+		}
+		userID, deviceName, clientType = login.userID, login.deviceName, login.clientType
+	} else {
+		findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+			var id int
+			if err := s.systemDB.QueryRow("SELECT id FROM users WHERE webauthn_handle = ?", userHandle).Scan(&id); err != nil {
+				return nil, err
+			}
+			return s.loadWebAuthnUser(id, false)
+		}
+		user, c, err := wa.ValidatePasskeyLogin(findUser, ceremony.session, parsed)
+		if err != nil {
+			s.logger.Println("handleWebAuthnLoginFinish: passkey:", err)
+			s.recordLoginFailure(r, ipThrottle(r))
+			http.Error(w, "Invalid passkey", http.StatusUnauthorized)
+			return
+		}
+		userID, cred = user.(*webAuthnUser).id, c
+	}
+
+	id := credentialID(cred)
+	if cred.Authenticator.CloneWarning {
+		s.logger.Printf("handleWebAuthnLoginFinish: sign count of authenticator %s (user %d) went backwards, possible clone", id, userID)
+		http.Error(w, "Security key rejected: its signature counter went backwards", http.StatusUnauthorized)
+		return
+	}
+	record, err := json.Marshal(cred)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	res, err := s.systemDB.Exec("UPDATE webauthn_credentials SET credential = ?, last_used_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?",
+		string(record), id, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Removed while the ceremony ran
+		http.Error(w, "Invalid security key response", http.StatusUnauthorized)
+		return
+	}
+
+	if ceremony.mfaToken != "" {
+		finishMFALogin(ceremony.mfaToken)
+	}
+	s.completeSecondFactorLogin(w, r, userID, deviceName, clientType)
+}
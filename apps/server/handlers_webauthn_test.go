@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testRPID   = "vault.example.com"
+	testOrigin = "https://vault.example.com"
+)
+
+var b64url = base64.RawURLEncoding
+
+// Just enough CBOR for an attestation object and a COSE key.
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	}
+	return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+}
+
+func cborInt(i int) []byte {
+	if i < 0 {
+		return cborHead(1, -1-i)
+	}
+	return cborHead(0, i)
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, len(b)), b...) }
+func cborText(s string) []byte  { return append(cborHead(3, len(s)), s...) }
+
+func cborMap(pairs ...[]byte) []byte {
+	out := cborHead(5, len(pairs)/2)
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// softAuthenticator is a P-256 authenticator with a single resident
+// credential, answering the options the server hands out.
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	handle    []byte
+	signCount uint32
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": testOrigin, "crossOrigin": false})
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, extra []byte) []byte {
+	rpHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, extra...)
+}
+
+// create answers navigator.credentials.create with "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, options json.RawMessage) json.RawMessage {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if a.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	a.credID = make([]byte, 16)
+	rand.Read(a.credID)
+	if a.handle, err = b64url.DecodeString(opts.PublicKey.User.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	coseKey := cborMap(
+		cborInt(1), cborInt(2), // kty: EC2
+		cborInt(3), cborInt(-7), // alg: ES256
+		cborInt(-1), cborInt(1), // crv: P-256
+		cborInt(-2), cborBytes(a.key.X.FillBytes(make([]byte, 32))),
+		cborInt(-3), cborBytes(a.key.Y.FillBytes(make([]byte, 32))),
+	)
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(append(attested, a.credID...), coseKey...)
+	attObj := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(a.authData(0x45, attested)), // UP, UV, AT
+	)
+
+	cred, _ := json.Marshal(map[string]any{
+		"id": b64url.EncodeToString(a.credID), "rawId": b64url.EncodeToString(a.credID), "type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64url.EncodeToString(a.clientData("webauthn.create", opts.PublicKey.Challenge)),
+			"attestationObject": b64url.EncodeToString(attObj),
+		},
+	})
+	return cred
+}
+
+// get answers navigator.credentials.get after bumping the sign count.
+func (a *softAuthenticator) get(t *testing.T, options json.RawMessage) json.RawMessage {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatal(err)
+	}
+	a.signCount++
+	clientData := a.clientData("webauthn.get", opts.PublicKey.Challenge)
+	authData := a.authData(0x05, nil) // UP, UV
+	cdHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, _ := json.Marshal(map[string]any{
+		"id": b64url.EncodeToString(a.credID), "rawId": b64url.EncodeToString(a.credID), "type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64url.EncodeToString(clientData),
+			"authenticatorData": b64url.EncodeToString(authData),
+			"signature":         b64url.EncodeToString(sig),
+			"userHandle":        b64url.EncodeToString(a.handle),
+		},
+	})
+	return cred
+}
+
+// newWebAuthnTestServer returns a server with a relying party, signing keys
+// and a user "alice" with password "correct horse".
+func newWebAuthnTestServer(t *testing.T) (*Server, int) {
+	t.Helper()
+	s := newTestServer(t)
+	s.config.WebAuthnRPID = testRPID
+	s.config.WebAuthnOrigins = []string{testOrigin}
+	keys, err := openKeyRing(s.config.DataDir, SecretKey, s.jwtSigningAlg())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keys = keys
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	res, err := s.systemDB.Exec("INSERT INTO users (username, password_hash, db_path) VALUES ('alice', ?, 'alice.db')", string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return s, int(id)
+}
+
+// call runs a handler with a JSON body, as userID when it's not 0.
+func call(t *testing.T, h http.HandlerFunc, userID int, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	if userID != 0 {
+		r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+type testCeremony struct {
+	CeremonyID string          `json:"ceremony_id"`
+	Options    json.RawMessage `json:"options"`
+}
+
+func registerSoftAuthenticator(t *testing.T, s *Server, userID int) *softAuthenticator {
+	t.Helper()
+	begin := decode[testCeremony](t, call(t, s.handleWebAuthnRegisterBegin, userID, nil))
+	a := &softAuthenticator{}
+	resp := decode[WebAuthnRegisterResponse](t, call(t, s.handleWebAuthnRegisterFinish, userID,
+		WebAuthnRegisterRequest{CeremonyID: begin.CeremonyID, Name: "Soft key", Credential: a.create(t, begin.Options)}))
+	if resp.Credential.ID != b64url.EncodeToString(a.credID) || resp.Credential.Name != "Soft key" {
+		t.Fatalf("registered %+v", resp.Credential)
+	}
+	if len(resp.RecoveryCodes) == 0 {
+		t.Fatal("first second factor came without recovery codes")
+	}
+	return a
+}
+
+// passkeyLogin runs a login ceremony, as the second step of a password login
+// when mfaToken is set.
+func passkeyLogin(t *testing.T, s *Server, a *softAuthenticator, mfaToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	begin := decode[testCeremony](t, call(t, s.handleWebAuthnLoginBegin, 0, WebAuthnLoginBeginRequest{MFAToken: mfaToken}))
+	return call(t, s.handleWebAuthnLoginFinish, 0, WebAuthnLoginFinishRequest{CeremonyID: begin.CeremonyID, Credential: a.get(t, begin.Options)})
+}
+
+func TestWebAuthnRegisterAndSecondFactorLogin(t *testing.T) {
+	s, userID := newWebAuthnTestServer(t)
+	a := registerSoftAuthenticator(t, s, userID)
+
+	// A password login now stops for the second factor
+	mfa := decode[MFARequiredResponse](t, call(t, s.handleLogin, 0, LoginRequest{Username: "alice", Password: "correct horse"}))
+	if !mfa.MFARequired || mfa.MFAToken == "" {
+		t.Fatalf("login = %+v, want mfa_required", mfa)
+	}
+	auth := decode[AuthResponse](t, passkeyLogin(t, s, a, mfa.MFAToken))
+	if auth.Token == "" || auth.Username != "alice" {
+		t.Fatalf("login = %+v", auth)
+	}
+	if _, ok := takeMFALogin(mfa.MFAToken); ok {
+		t.Fatal("mfa_token still usable after the login finished")
+	}
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	s, userID := newWebAuthnTestServer(t)
+	a := registerSoftAuthenticator(t, s, userID)
+
+	auth := decode[AuthResponse](t, passkeyLogin(t, s, a, ""))
+	if auth.Token == "" || auth.Username != "alice" {
+		t.Fatalf("login = %+v", auth)
+	}
+
+	// The sign count is kept for the next login
+	var lastUsed *string
+	s.systemDB.QueryRow("SELECT last_used_at FROM webauthn_credentials WHERE user_id = ?", userID).Scan(&lastUsed)
+	if lastUsed == nil {
+		t.Fatal("last_used_at not set")
+	}
+	if w := passkeyLogin(t, s, a, ""); w.Code != http.StatusOK {
+		t.Fatalf("second login: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestWebAuthnSignCountRegression(t *testing.T) {
+	s, userID := newWebAuthnTestServer(t)
+	a := registerSoftAuthenticator(t, s, userID)
+	if w := passkeyLogin(t, s, a, ""); w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+
+	// A clone replays the counter the original already used
+	a.signCount--
+	if w := passkeyLogin(t, s, a, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login with a used sign count: %d %s, want 401", w.Code, w.Body)
+	}
+}
+
+func TestWebAuthnRequiresRelyingParty(t *testing.T) {
+	s, userID := newWebAuthnTestServer(t)
+	s.config.WebAuthnOrigins = nil
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Host = "attacker.example"
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	w := httptest.NewRecorder()
+	s.handleWebAuthnRegisterBegin(w, r)
+	if w.Code == http.StatusOK {
+		t.Fatal("registration started without WEBAUTHN_ORIGINS")
+	}
+}
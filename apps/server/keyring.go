@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+// --- JWT Signing Keys ---
+//
+// Tokens are signed with the newest key of a key ring kept in
+// DataDir/jwt-keys.enc and name it in their kid header. Rotating adds a key
+// and retires the previous one, which keeps verifying tokens until its grace
+// period ends, so nobody is signed out. The file is encrypted with a key
+// derived from JWT_SECRET: neither the data directory nor the secret alone is
+// enough to mint tokens. Public halves of EdDSA keys are published at
+// /.well-known/jwks.json for services that verify Guardian tokens.
+
+const (
+	keyRingFilename = "jwt-keys.enc"
+
+	keyAlgHS256 = "HS256"
+	keyAlgEdDSA = "EdDSA"
+
+	defaultJWTKeyGraceHours = 24
+)
+
+type signingKey struct {
+	KID         string     `json:"kid"`
+	Alg         string     `json:"alg"`
+	Secret      []byte     `json:"secret"` // HMAC key, or Ed25519 seed
+	CreatedAt   time.Time  `json:"created_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+	VerifyUntil *time.Time `json:"verify_until,omitempty"` // set when retired
+}
+
+func (k signingKey) usable(now time.Time) bool {
+	return k.VerifyUntil == nil || now.Before(*k.VerifyUntil)
+}
+
+// KeyRing holds the signing keys. The last key signs; all usable keys verify.
+type KeyRing struct {
+	path    string
+	sealKey []byte
+
+	mu      sync.RWMutex
+	keys    []signingKey
+	modTime time.Time
+}
+
+// deriveKey derives a 32-byte key for one purpose from a server secret.
+func deriveKey(secret, purpose string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("guardian "+purpose)), key)
+	return key
+}
+
+// seal encrypts plaintext with AES-256-GCM; the nonce is prepended.
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal reverses seal.
+func unseal(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// openKeyRing loads the key ring in dataDir, creating it with one key of alg
+// if it doesn't exist yet.
+func openKeyRing(dataDir, secret, alg string) (*KeyRing, error) {
+	kr := &KeyRing{
+		path:    filepath.Join(dataDir, keyRingFilename),
+		sealKey: deriveKey(secret, "jwt key ring"),
+	}
+	err := kr.load()
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := newSigningKey(alg)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys = []signingKey{key}
+		return kr, kr.save()
+	}
+	return kr, err
+}
+
+func newSigningKey(alg string) (signingKey, error) {
+	key := signingKey{Alg: alg, CreatedAt: time.Now().UTC()}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return key, err
+	}
+	key.KID = hex.EncodeToString(id)
+
+	switch alg {
+	case keyAlgHS256:
+		key.Secret = make([]byte, 32)
+	case keyAlgEdDSA:
+		key.Secret = make([]byte, ed25519.SeedSize)
+	default:
+		return key, fmt.Errorf("unsupported signing algorithm %q (use %s or %s)", alg, keyAlgHS256, keyAlgEdDSA)
+	}
+	_, err := rand.Read(key.Secret)
+	return key, err
+}
+
+// load reads and decrypts the key ring file. Callers hold mu or own kr.
+func (kr *KeyRing) load() error {
+	data, err := os.ReadFile(kr.path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(kr.path)
+	if err != nil {
+		return err
+	}
+	plain, err := unseal(kr.sealKey, data)
+	if err != nil {
+		return fmt.Errorf("%s can't be decrypted with JWT_SECRET; if the secret was changed on purpose, "+
+			"delete the file to start a new key ring (clients sign in again with their refresh tokens)", kr.path)
+	}
+	var keys []signingKey
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return fmt.Errorf("%s: %w", kr.path, err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s holds no keys", kr.path)
+	}
+	kr.keys, kr.modTime = keys, info.ModTime()
+	return nil
+}
+
+// save encrypts and atomically replaces the key ring file.
+func (kr *KeyRing) save() error {
+	plain, err := json.Marshal(kr.keys)
+	if err != nil {
+		return err
+	}
+	data, err := seal(kr.sealKey, plain)
+	if err != nil {
+		return err
+	}
+	tmp := kr.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, kr.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if info, err := os.Stat(kr.path); err == nil {
+		kr.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// reloadIfChanged picks up a rotation made by the rotate-keys command while
+// the server is running.
+func (kr *KeyRing) reloadIfChanged() {
+	info, err := os.Stat(kr.path)
+	if err != nil {
+		return
+	}
+	kr.mu.RLock()
+	changed := !info.ModTime().Equal(kr.modTime)
+	kr.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.load() // on error the keys in memory stay in use
+}
+
+// Rotate adds a new signing key of alg. The previous key verifies for grace
+// longer; keys whose grace period has ended are dropped.
+func (kr *KeyRing) Rotate(alg string, grace time.Duration) (signingKey, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	// Another process may have rotated since we loaded
+	if err := kr.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return signingKey{}, err
+	}
+	key, err := newSigningKey(alg)
+	if err != nil {
+		return key, err
+	}
+
+	now := time.Now().UTC()
+	until := now.Add(grace)
+	keys := []signingKey{}
+	for _, k := range kr.keys {
+		if k.RetiredAt == nil {
+			k.RetiredAt, k.VerifyUntil = &now, &until
+		}
+		if k.usable(now) {
+			keys = append(keys, k)
+		}
+	}
+	previous := kr.keys
+	kr.keys = append(keys, key)
+	if err := kr.save(); err != nil {
+		kr.keys = previous
+		return key, err
+	}
+	return key, nil
+}
+
+// Sign signs claims with the active key and sets the kid header.
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	kr.reloadIfChanged()
+	kr.mu.RLock()
+	key := kr.keys[len(kr.keys)-1]
+	kr.mu.RUnlock()
+
+	var token *jwt.Token
+	var signKey any
+	switch key.Alg {
+	case keyAlgEdDSA:
+		token, signKey = jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims), ed25519.NewKeyFromSeed(key.Secret)
+	default:
+		token, signKey = jwt.NewWithClaims(jwt.SigningMethodHS256, claims), key.Secret
+	}
+	token.Header["kid"] = key.KID
+	return token.SignedString(signKey)
+}
+
+// Keyfunc resolves the verification key for a parsed token by its kid.
+func (kr *KeyRing) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("missing kid")
+	}
+
+	key, ok := kr.find(kid)
+	if !ok {
+		kr.reloadIfChanged()
+		if key, ok = kr.find(kid); !ok {
+			return nil, errors.New("unknown kid")
+		}
+	}
+	if !key.usable(time.Now()) {
+		return nil, errors.New("key retired")
+	}
+
+	switch key.Alg {
+	case keyAlgEdDSA:
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return ed25519.NewKeyFromSeed(key.Secret).Public(), nil
+	default:
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.Secret, nil
+	}
+}
+
+func (kr *KeyRing) find(kid string) (signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.KID == kid {
+			return k, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// Info lists the keys without their secrets, active key last.
+func (kr *KeyRing) Info() []JWTKeyInfo {
+	kr.reloadIfChanged()
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	now := time.Now()
+	infos := []JWTKeyInfo{}
+	for i, k := range kr.keys {
+		if !k.usable(now) {
+			continue
+		}
+		infos = append(infos, JWTKeyInfo{
+			KID:         k.KID,
+			Alg:         k.Alg,
+			CreatedAt:   k.CreatedAt,
+			RetiredAt:   k.RetiredAt,
+			VerifyUntil: k.VerifyUntil,
+			Active:      i == len(kr.keys)-1,
+		})
+	}
+	return infos
+}
+
+// JWKS returns the public keys of the usable EdDSA keys.
+func (kr *KeyRing) JWKS() JWKSet {
+	kr.reloadIfChanged()
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	now := time.Now()
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range kr.keys {
+		if k.Alg != keyAlgEdDSA || !k.usable(now) {
+			continue
+		}
+		pub := ed25519.NewKeyFromSeed(k.Secret).Public().(ed25519.PublicKey)
+		set.Keys = append(set.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+			KID: k.KID,
+			Alg: keyAlgEdDSA,
+			Use: "sig",
+		})
+	}
+	return set
+}
+
+// jwtKeyGrace is how long a retired key keeps verifying tokens. It is never
+// shorter than the access token lifetime.
+func (s *Server) jwtKeyGrace() time.Duration {
+	grace := time.Duration(s.getSettingInt("jwt_key_grace_hours", defaultJWTKeyGraceHours)) * time.Hour
+	if ttl := s.accessTokenTTL(); grace < ttl {
+		grace = ttl
+	}
+	return grace
+}
+
+// jwtSigningAlg is the algorithm for new keys (jwt_signing_alg setting).
+func (s *Server) jwtSigningAlg() string {
+	if alg := s.getSetting("jwt_signing_alg"); alg == keyAlgEdDSA {
+		return alg
+	}
+	return keyAlgHS256
+}
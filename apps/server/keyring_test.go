@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signTest signs a short-lived token with kr and returns it with its kid.
+func signTest(t *testing.T, kr *KeyRing) (token, kid string) {
+	t.Helper()
+	token, err := kr.Sign(jwt.RegisteredClaims{Subject: "1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ = parsed.Header["kid"].(string)
+	return token, kid
+}
+
+// verifies reports whether kr accepts token, and why not.
+func verifies(kr *KeyRing, token string) error {
+	_, err := jwt.Parse(token, kr.Keyfunc)
+	return err
+}
+
+// TestKeyRingRotation checks that a rotated key keeps verifying for its grace
+// period only, and that tokens are looked up by kid.
+func TestKeyRingRotation(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := openKeyRing(dir, "secret", keyAlgHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, oldKID := signTest(t, kr)
+
+	if _, err := kr.Rotate(keyAlgHS256, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	newToken, newKID := signTest(t, kr)
+	if newKID == oldKID || newKID == "" {
+		t.Fatalf("kid after rotation = %q, was %q", newKID, oldKID)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if err := verifies(kr, token); err != nil {
+			t.Fatalf("token rejected during grace period: %v", err)
+		}
+	}
+	info := kr.Info()
+	if len(info) != 2 || info[0].KID != oldKID || info[0].VerifyUntil == nil || !info[1].Active || info[1].KID != newKID {
+		t.Fatalf("info = %+v", info)
+	}
+
+	// Rotating without grace drops the key it retires; the key retired
+	// earlier keeps its own grace period
+	if _, err := kr.Rotate(keyAlgHS256, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifies(kr, newToken); err == nil {
+		t.Fatal("token of a dropped key still verifies")
+	}
+	if err := verifies(kr, oldToken); err != nil {
+		t.Fatalf("token rejected during its key's grace period: %v", err)
+	}
+	if info := kr.Info(); len(info) != 2 || info[0].KID != oldKID {
+		t.Fatalf("info = %+v, want the first key and the active one", info)
+	}
+
+	// Without a kid, or with one that doesn't exist, nothing is tried
+	noKID, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"}).SignedString([]byte("x"))
+	if err := verifies(kr, noKID); err == nil || !strings.Contains(err.Error(), "missing kid") {
+		t.Fatalf("token without kid: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	forged.Header["kid"] = "0000000000000000"
+	unknown, _ := forged.SignedString([]byte("x"))
+	if err := verifies(kr, unknown); err == nil || !strings.Contains(err.Error(), "unknown kid") {
+		t.Fatalf("token with unknown kid: %v", err)
+	}
+}
+
+// TestKeyRingFile checks that the key ring is stored encrypted, reopens
+// with the same secret only, and that a rotation by another process is
+// picked up.
+func TestKeyRingFile(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := openKeyRing(dir, "secret", keyAlgHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, keyRingFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, kr.keys[0].Secret) || bytes.Contains(data, []byte(kr.keys[0].KID)) {
+		t.Fatal("key ring file holds key material in plaintext")
+	}
+
+	if _, err := openKeyRing(dir, "other secret", keyAlgHS256); err == nil {
+		t.Fatal("key ring opened with the wrong secret")
+	}
+	other, err := openKeyRing(dir, "secret", keyAlgHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := signTest(t, kr)
+	if err := verifies(other, token); err != nil {
+		t.Fatalf("reopened key ring rejects token: %v", err)
+	}
+
+	// Make sure the rotated file gets a new mtime
+	time.Sleep(10 * time.Millisecond)
+	key, err := other.Rotate(keyAlgEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, kid := signTest(t, kr)
+	if kid != key.KID {
+		t.Fatalf("signed with %q, want the rotated key %q", kid, key.KID)
+	}
+	if err := verifies(other, token); err != nil {
+		t.Fatalf("EdDSA token rejected: %v", err)
+	}
+}
+
+// TestKeyRingAlgorithmConfusion checks that a token can't pick a different
+// algorithm than the key its kid names.
+func TestKeyRingAlgorithmConfusion(t *testing.T) {
+	kr, err := openKeyRing(t.TempDir(), "secret", keyAlgEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, kid := signTest(t, kr)
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	forged.Header["kid"] = kid
+	pub := kr.JWKS().Keys[0].X
+	token, _ := forged.SignedString([]byte(pub))
+	if err := verifies(kr, token); err == nil || !strings.Contains(err.Error(), "unexpected signing method") {
+		t.Fatalf("HS256 token for an EdDSA key: %v", err)
+	}
+}
+
+// TestRotateJWTKeysKeepsSessions checks that rotating through the admin API
+// leaves existing tokens valid and publishes the new EdDSA key.
+func TestRotateJWTKeysKeepsSessions(t *testing.T) {
+	s := newTestServer(t)
+	useTestKeyRing(t, s)
+	userID := addTestUser(t, s, "alice")
+	_, oldToken := signIn(t, s, userID)
+
+	w := httptest.NewRecorder()
+	s.handleRotateJWTKeys(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"alg":"RS256"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("rotate to RS256: %d, want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.handleRotateJWTKeys(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"alg":"EdDSA"}`)))
+	info := decode[[]JWTKeyInfo](t, w)
+	if len(info) != 2 || info[1].Alg != keyAlgEdDSA || info[0].VerifyUntil == nil {
+		t.Fatalf("keys after rotation = %+v", info)
+	}
+	if grace := info[0].VerifyUntil.Sub(*info[0].RetiredAt); grace != defaultJWTKeyGraceHours*time.Hour {
+		t.Fatalf("grace period %s, want %dh", grace, defaultJWTKeyGraceHours)
+	}
+
+	_, newToken := signIn(t, s, userID)
+	for _, token := range []string{oldToken, newToken} {
+		if code := authCall(s, http.MethodGet, "/vault/items", token); code != http.StatusOK {
+			t.Fatalf("token after rotation: %d, want 200", code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.handleJWKS(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	jwks := decode[JWKSet](t, w)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KID != info[1].KID || jwks.Keys[0].Crv != "Ed25519" {
+		t.Fatalf("jwks = %+v", jwks)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -24,37 +25,82 @@ var content embed.FS
 
 // --- Server ---
 type Server struct {
-	systemDB *sql.DB
-	config   Config
-	logger   *log.Logger
-	userDBs  sync.Map // map[string]*sql.DB - cached user DB connections
-	sseHub   *SSEHub
+	systemDB   *sql.DB
+	config     Config
+	logger     *log.Logger
+	userDBs    sync.Map // map[string]*sql.DB - cached user DB connections
+	sseHub     *SSEHub
+	backupMu   sync.Mutex  // held while a backup runs
+	verifyMu   sync.Mutex  // held while a restore drill runs
+	replicator *Replicator // nil unless REPLICA_DIR is set
+
+	regMu         sync.Mutex // held from vault creation until the user row commits
+	lastReconcile atomic.Pointer[ReconcileReport]
+	keys          *KeyRing // JWT signing keys
+	dataKey       []byte   // seals secrets kept in system.db, see datakey.go
 }
 
 func main() {
+	if isCLICommand(os.Args) {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+	requireSecretKey()
+
 	// 1. Configuration
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
+	backupDir := os.Getenv("BACKUP_DIR")
+	if backupDir == "" {
+		backupDir = "./backups"
+	}
+
 	config := Config{
-		Port:    port,
-		DataDir: "./data",
+		Port:       port,
+		DataDir:    "./data",
+		BackupDir:  backupDir,
+		ReplicaDir: os.Getenv("REPLICA_DIR"),
+
+		WebAuthnRPID: os.Getenv("WEBAUTHN_RP_ID"),
+	}
+	for _, o := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			config.WebAuthnOrigins = append(config.WebAuthnOrigins, o)
+		}
+	}
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
 	}
+	trustedProxies = proxies
 
 	// 2. Setup Logger
 	logger := log.New(os.Stdout, "[GUARDIAN-API] ", log.LstdFlags)
 	logger.Println("Starting Guardian Server (Multi-Tenant)...")
+	if config.WebAuthnRPID == "" || len(config.WebAuthnOrigins) == 0 {
+		logger.Println("WEBAUTHN_RP_ID or WEBAUTHN_ORIGINS not set; security keys and passkeys are disabled")
+	}
 
 	// 3. Ensure Data Directory
 	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
 		logger.Fatalf("Failed to create data directory: %v", err)
 	}
+	releaseDataDir, err := lockDataDir(config.DataDir)
+	if err != nil {
+		logger.Fatalf("Failed to lock data directory: %v", err)
+	}
+	defer releaseDataDir()
+
+	// Only the replicator may reset WALs while replication runs
+	if config.ReplicaDir != "" {
+		walAutoCheckpoint = false
+	}
 
 	// 4. Setup System Database
 	systemDBPath := filepath.Join(config.DataDir, "system.db")
-	sysDB, err := initSystemDB(systemDBPath)
+	sysDB, err := initSystemDB(systemDBPath, preMigrateDir(config.BackupDir), logger)
 	if err != nil {
 		logger.Fatalf("Failed to initialize system database: %v", err)
 	}
@@ -69,6 +115,27 @@ func main() {
 		sseHub:   NewSSEHub(),
 	}
 
+	keys, err := openKeyRing(config.DataDir, SecretKey, server.jwtSigningAlg())
+	if err != nil {
+		logger.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+	server.keys = keys
+
+	if err := server.loadDataKey(); err != nil {
+		logger.Fatalf("Failed to load the data key: %v", err)
+	}
+	server.sealStoredDestinationSecrets()
+
+	// Repair users without a vault and quarantine vaults without a user
+	if _, err := server.reconcileVaults("startup", false, false); err != nil {
+		logger.Printf("Vault reconciliation failed: %v", err)
+	}
+	server.finishPendingRekeys()
+
+	if config.ReplicaDir != "" {
+		server.replicator = newReplicator(server, localReplicaTarget{dir: config.ReplicaDir})
+	}
+
 	mux := http.NewServeMux()
 
 	// 6. Define Routes
@@ -76,7 +143,19 @@ func main() {
 
 	// Auth
 	mux.HandleFunc("POST /auth/register", server.handleRegister)
+	mux.HandleFunc("POST /auth/prelogin", server.handlePrelogin)
 	mux.HandleFunc("POST /auth/login", server.handleLogin)
+	mux.HandleFunc("POST /auth/login/2fa", server.handleLoginMFA)
+	mux.HandleFunc("POST /auth/webauthn/login/begin", server.handleWebAuthnLoginBegin)
+	mux.HandleFunc("POST /auth/webauthn/login/finish", server.handleWebAuthnLoginFinish)
+	mux.HandleFunc("POST /auth/refresh", server.handleRefresh)
+	mux.HandleFunc("POST /auth/change-password", server.withUserAuth(server.handleChangePassword))
+	mux.HandleFunc("POST /auth/recovery/code", server.handleRecoveryCode)
+	mux.HandleFunc("POST /auth/recovery/requests", server.handleCreateRecoveryRequest)
+	mux.HandleFunc("POST /auth/recovery/requests/{id}/status", server.handleRecoveryRequestStatus)
+	mux.HandleFunc("POST /auth/recovery/vault", server.handleRecoveryVault)
+	mux.HandleFunc("POST /auth/recovery/complete", server.handleCompleteRecovery)
+	mux.HandleFunc("GET /.well-known/jwks.json", server.handleJWKS)
 	mux.HandleFunc("POST /auth/validate-invite", server.handleValidateInvite)
 	mux.HandleFunc("GET /auth/setup-status", server.handleSetupStatus)
 
@@ -86,6 +165,38 @@ func main() {
 	mux.HandleFunc("DELETE /api/admin/invites/{id}", server.withAdminAuth(server.handleDeleteInvite))
 	mux.HandleFunc("GET /api/admin/users", server.withAdminAuth(server.handleListUsers))
 	mux.HandleFunc("PUT /api/admin/users/{id}", server.withAdminAuth(server.handleUpdateUser))
+	mux.HandleFunc("GET /api/admin/users/{id}/sessions", server.withAdminAuth(server.handleAdminListUserSessions))
+	mux.HandleFunc("DELETE /api/admin/users/{id}/sessions", server.withAdminAuth(server.handleAdminRevokeUserSessions))
+	mux.HandleFunc("DELETE /api/admin/users/{id}/2fa", server.withAdminAuth(server.handleAdminResetTwoFactor))
+	mux.HandleFunc("POST /api/admin/users/{id}/unlock", server.withAdminAuth(server.handleAdminUnlockUser))
+	mux.HandleFunc("GET /api/admin/login-throttle", server.withAdminAuth(server.handleListLoginThrottle))
+	mux.HandleFunc("DELETE /api/admin/login-throttle/{scope}/{key}", server.withAdminAuth(server.handleAdminClearLoginThrottle))
+	mux.HandleFunc("GET /api/admin/recovery-requests", server.withAdminAuth(server.handleAdminListRecoveryRequests))
+	mux.HandleFunc("POST /api/admin/recovery-requests/{id}/{decision}", server.withAdminAuth(server.handleAdminDecideRecoveryRequest))
+	mux.HandleFunc("GET /api/admin/audit", server.withAdminAuth(server.handleListAuditLog))
+	mux.HandleFunc("DELETE /api/admin/sessions/{id}", server.withAdminAuth(server.handleAdminRevokeSession))
+	mux.HandleFunc("GET /api/admin/stats", server.withAdminAuth(server.handleAdminStats))
+	mux.HandleFunc("GET /api/admin/stats/history", server.withAdminAuth(server.handleAdminStatsHistory))
+	mux.HandleFunc("GET /api/admin/reconcile", server.withAdminAuth(server.handleGetReconcileReport))
+	mux.HandleFunc("POST /api/admin/reconcile", server.withAdminAuth(server.handleReconcile))
+
+	// Admin / Backups
+	mux.HandleFunc("GET /api/admin/backups", server.withAdminAuth(server.handleListBackups))
+	mux.HandleFunc("POST /api/admin/backups", server.withAdminAuth(server.handleCreateBackup))
+	mux.HandleFunc("GET /api/admin/backups/{id}", server.withAdminAuth(server.handleGetBackup))
+	mux.HandleFunc("GET /api/admin/backups/{id}/download", server.withAdminAuth(server.handleDownloadBackup))
+	mux.HandleFunc("POST /api/admin/backups/{id}/verify", server.withAdminAuth(server.handleVerifyBackup))
+	mux.HandleFunc("GET /api/admin/backup-destinations", server.withAdminAuth(server.handleListBackupDestinations))
+	mux.HandleFunc("POST /api/admin/backup-destinations", server.withAdminAuth(server.handleCreateBackupDestination))
+	mux.HandleFunc("PUT /api/admin/backup-destinations/{id}", server.withAdminAuth(server.handleUpdateBackupDestination))
+	mux.HandleFunc("DELETE /api/admin/backup-destinations/{id}", server.withAdminAuth(server.handleDeleteBackupDestination))
+	mux.HandleFunc("POST /api/admin/backup-destinations/{id}/test", server.withAdminAuth(server.handleTestBackupDestination))
+	mux.HandleFunc("GET /api/admin/backup-destinations/{id}/uploads", server.withAdminAuth(server.handleListBackupUploads))
+	mux.HandleFunc("GET /api/admin/replication", server.withAdminAuth(server.handleReplicationStatus))
+
+	// Admin / Token signing keys
+	mux.HandleFunc("GET /api/admin/jwt-keys", server.withAdminAuth(server.handleListJWTKeys))
+	mux.HandleFunc("POST /api/admin/jwt-keys/rotate", server.withAdminAuth(server.handleRotateJWTKeys))
 
 	// Admin / Settings
 	mux.HandleFunc("GET /api/admin/settings", server.withAdminAuth(server.handleListSettings))
@@ -94,11 +205,49 @@ func main() {
 	// Vault Operations (Protected)
 	mux.HandleFunc("GET /vault/items", server.withUserAuth(server.handleListItems))
 	mux.HandleFunc("PUT /vault/items", server.withUserAuth(server.handleUpsertItems))
+	mux.HandleFunc("GET /vault/changes", server.withUserAuth(server.handleListChanges))
+	mux.HandleFunc("GET /vault/usage", server.withUserAuth(server.handleGetUsage))
 	mux.HandleFunc("DELETE /vault/items/{id}", server.withUserAuth(server.handleDeleteItem))
+	mux.HandleFunc("GET /vault/items/{id}/history", server.withUserAuth(server.handleListItemHistory))
+	mux.HandleFunc("GET /vault/items/{id}/history/{revision}", server.withUserAuth(server.handleGetItemRevision))
+	mux.HandleFunc("POST /vault/items/{id}/history/{revision}/restore", server.withUserAuth(server.handleRestoreItemRevision))
+	mux.HandleFunc("GET /vault/items/{id}/attachments", server.withUserAuth(server.handleListAttachments))
+	mux.HandleFunc("POST /vault/items/{id}/attachments", server.withUserAuth(server.handleCreateAttachment))
+	mux.HandleFunc("PATCH /vault/attachments/{id}", server.withUserAuth(server.handleUploadAttachmentChunk))
+	mux.HandleFunc("GET /vault/attachments/{id}", server.withUserAuth(server.handleDownloadAttachment))
+	mux.HandleFunc("DELETE /vault/attachments/{id}", server.withUserAuth(server.handleDeleteAttachment))
+	mux.HandleFunc("GET /vault/trash", server.withUserAuth(server.handleListTrash))
+	mux.HandleFunc("DELETE /vault/trash", server.withUserAuth(server.handleEmptyTrash))
+	mux.HandleFunc("POST /vault/trash/{id}/restore", server.withUserAuth(server.handleRestoreTrashItem))
+	mux.HandleFunc("DELETE /vault/trash/{id}", server.withUserAuth(server.handlePurgeTrashItem))
 
 	// WebSocket Events (challenge-response auth, no token in URL)
 	mux.HandleFunc("GET /ws/events", server.handleWebSocket)
 
+	// Sessions (signed-in devices)
+	mux.HandleFunc("GET /api/sessions", server.withUserAuth(server.handleListSessions))
+	mux.HandleFunc("DELETE /api/sessions/{id}", server.withUserAuth(server.handleRevokeSession))
+
+	// Account credentials
+	mux.HandleFunc("POST /api/account/kdf", server.withUserAuth(server.handleUpgradeKDF))
+
+	// Account recovery
+	mux.HandleFunc("GET /api/recovery", server.withUserAuth(server.handleGetRecovery))
+	mux.HandleFunc("PUT /api/recovery/code", server.withUserAuth(server.handleSetCodeEscrow))
+	mux.HandleFunc("PUT /api/recovery/admin", server.withUserAuth(server.handleSetAdminEscrow))
+	mux.HandleFunc("DELETE /api/recovery/{kind}", server.withUserAuth(server.handleDeleteEscrow))
+
+	// Two-factor authentication
+	mux.HandleFunc("GET /api/2fa", server.withUserAuth(server.handleGetTwoFactor))
+	mux.HandleFunc("POST /api/2fa/totp/enroll", server.withUserAuth(server.handleEnrollTOTP))
+	mux.HandleFunc("POST /api/2fa/totp/confirm", server.withUserAuth(server.handleConfirmTOTP))
+	mux.HandleFunc("POST /api/2fa/totp/disable", server.withUserAuth(server.handleDisableTOTP))
+	mux.HandleFunc("POST /api/2fa/recovery-codes", server.withUserAuth(server.handleRegenerateRecoveryCodes))
+	mux.HandleFunc("POST /api/2fa/webauthn/register/begin", server.withUserAuth(server.handleWebAuthnRegisterBegin))
+	mux.HandleFunc("POST /api/2fa/webauthn/register/finish", server.withUserAuth(server.handleWebAuthnRegisterFinish))
+	mux.HandleFunc("GET /api/2fa/webauthn/credentials", server.withUserAuth(server.handleListWebAuthnCredentials))
+	mux.HandleFunc("DELETE /api/2fa/webauthn/credentials/{id}", server.withUserAuth(server.handleDeleteWebAuthnCredential))
+
 	// User Preferences
 	// Register both exact and trailing slash to accommodate various clients/proxies
 	mux.HandleFunc("/api/preferences", server.handlePreferences)
@@ -184,21 +333,42 @@ func main() {
 		}
 	}()
 
-	// Periodic WAL checkpoint to keep -wal/-shm files small
+	// Periodic WAL checkpoint to keep -wal/-shm files small,
+	// plus less frequent compaction of old tombstones, item history and trash
 	checkpointDone := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
+		compactTicker := time.NewTicker(6 * time.Hour)
+		defer compactTicker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				server.checkpointAllDBs()
+			case <-compactTicker.C:
+				server.compactAllTombstones()
+				server.pruneAllHistory()
+				server.purgeAllTrash()
+				server.pruneSessions()
+				server.pruneLoginThrottle()
 			case <-checkpointDone:
 				return
 			}
 		}
 	}()
 
+	// Hourly storage samples for the admin growth charts
+	go server.runStatsSampler(checkpointDone)
+
+	// Scheduled snapshot backups (backup_* keys in server_settings)
+	go server.runBackupScheduler(checkpointDone)
+
+	// Continuous WAL replication
+	if server.replicator != nil {
+		logger.Println("Replicating databases to", server.replicator.target)
+		go server.replicator.Run()
+	}
+
 	// Wait for interrupt signal
 	<-stop
 	logger.Println("Shutting down server...")
@@ -217,7 +387,10 @@ func main() {
 		logger.Fatalf("Server shutdown failed: %v", err)
 	}
 
-	// Final checkpoint and close all cached user DB connections
+	// Ship the last WAL frames, then final checkpoint and close all cached user DB connections
+	if server.replicator != nil {
+		server.replicator.Stop()
+	}
 	server.checkpointAllDBs()
 	server.userDBs.Range(func(key, value any) bool {
 		if db, ok := value.(*sql.DB); ok {
@@ -231,7 +404,13 @@ func main() {
 
 // checkpointAllDBs runs WAL checkpoint on system DB and all cached user DBs.
 // TRUNCATE mode merges WAL into the main DB and truncates the WAL file to zero bytes.
+// With replication on, the replicator ships pending frames before truncating.
 func (s *Server) checkpointAllDBs() {
+	if s.replicator != nil {
+		s.replicator.checkpointAll()
+		return
+	}
+
 	// Checkpoint system DB
 	if s.systemDB != nil {
 		s.systemDB.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
@@ -244,4 +423,4 @@ func (s *Server) checkpointAllDBs() {
 		}
 		return true
 	})
-}
\ No newline at end of file
+}
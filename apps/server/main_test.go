@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if SecretKey == "" {
+		SecretKey = "test secret"
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server with a fresh system DB in a temp dir.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	config := Config{
+		DataDir:   filepath.Join(dir, "data"),
+		BackupDir: filepath.Join(dir, "backups"),
+	}
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	if testing.Verbose() {
+		logger = log.New(os.Stderr, "[test] ", log.LstdFlags)
+	}
+
+	db, err := initSystemDB(filepath.Join(config.DataDir, "system.db"), preMigrateDir(config.BackupDir), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{systemDB: db, config: config, logger: logger, sseHub: NewSSEHub()}
+	if err := s.loadDataKey(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.userDBs.Range(func(_, v any) bool {
+			v.(interface{ Close() error }).Close()
+			return true
+		})
+		db.Close()
+	})
+	return s
+}
+
+// addTestUser creates a user with an empty vault and returns its ID.
+func addTestUser(t *testing.T, s *Server, username string) int {
+	t.Helper()
+	dbPath := username + ".db"
+	if err := initUserDB(filepath.Join(s.config.DataDir, dbPath)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.systemDB.Exec("INSERT INTO users (username, password_hash, db_path) VALUES (?, 'x', ?)", username, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
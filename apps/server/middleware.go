@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,8 +17,9 @@ import (
 func corsHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Upload-Offset, Range")
+		w.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, X-Content-SHA256, X-Vault-Cursor")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -28,15 +30,25 @@ func corsHandler(next http.Handler) http.Handler {
 	})
 }
 
-// withUserAuth validates JWT and adds user_id to context
+// withUserAuth validates JWT and adds user_id and session_id to context.
+// Suspended accounts are limited to GET requests.
 func (s *Server) withUserAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := s.validateToken(r)
+		auth, err := s.validateToken(r)
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
-		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		if auth.status == UserStatusSuspended && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Forbidden: account suspended (read-only)", http.StatusForbidden)
+			return
+		}
+		if auth.mfaSetupRequired && !mfaSetupAllowed(r.URL.Path) {
+			http.Error(w, "Forbidden: two-factor authentication setup required", http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userIDKey, auth.userID)
+		ctx = context.WithValue(ctx, sessionIDKey, auth.sessionID)
 		next(w, r.WithContext(ctx))
 	}
 }
@@ -45,12 +57,21 @@ func (s *Server) withUserAuth(next http.HandlerFunc) http.HandlerFunc {
 func (s *Server) withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.logger.Println("withAdminAuth: validating token")
-		userID, err := s.validateToken(r)
+		auth, err := s.validateToken(r)
 		if err != nil {
 			s.logger.Println("withAdminAuth: token validation failed:", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if auth.status != UserStatusActive {
+			http.Error(w, "Forbidden: account "+strings.ToLower(auth.status), http.StatusForbidden)
+			return
+		}
+		if auth.mfaSetupRequired {
+			http.Error(w, "Forbidden: two-factor authentication setup required", http.StatusForbidden)
+			return
+		}
+		userID := auth.userID
 
 		// Check Admin Status in DB
 		var isAdmin bool
@@ -63,51 +84,87 @@ func (s *Server) withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
 
 		s.logger.Printf("withAdminAuth: user %d is admin, proceeding\n", userID)
 		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, sessionIDKey, auth.sessionID)
 		next(w, r.WithContext(ctx))
 	}
 }
 
-func (s *Server) validateToken(r *http.Request) (int, error) {
+// authInfo is what a valid token resolves to.
+type authInfo struct {
+	userID    int
+	sessionID string
+	status    string
+	// The require_2fa setting applies and the user hasn't enrolled yet
+	mfaSetupRequired bool
+}
+
+// validateToken checks the bearer token against its session and returns the
+// user's id, session and account status. Tokens of revoked or expired
+// sessions and of disabled accounts are rejected.
+func (s *Server) validateToken(r *http.Request) (authInfo, error) {
+	var auth authInfo
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return 0, fmt.Errorf("missing header")
+		return auth, fmt.Errorf("missing header")
 	}
 
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return []byte(SecretKey), nil
-	})
+	token, err := jwt.Parse(tokenString, s.keys.Keyfunc, jwt.WithValidMethods([]string{keyAlgHS256, keyAlgEdDSA}))
 
 	if err != nil || !token.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return auth, fmt.Errorf("invalid token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return 0, fmt.Errorf("invalid claims")
+		return auth, fmt.Errorf("invalid claims")
 	}
 
 	userIDFloat, ok := claims["sub"].(float64)
 	if !ok {
-		return 0, fmt.Errorf("invalid user id")
+		return auth, fmt.Errorf("invalid user id")
+	}
+	auth.userID = int(userIDFloat)
+
+	// Tokens issued before sessions existed have no jti and must be renewed
+	auth.sessionID, _ = claims["jti"].(string)
+	if auth.sessionID == "" {
+		return auth, fmt.Errorf("session expired")
+	}
+
+	var isAdmin, twoFactor bool
+	err = s.systemDB.QueryRow(`
+		SELECT COALESCE(NULLIF(u.status, ''), 'ACTIVE'), u.is_admin,
+		       EXISTS(SELECT 1 FROM user_totp t WHERE t.user_id = u.id AND t.enabled_at IS NOT NULL)
+		       OR EXISTS(SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id)
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.id = ? AND s.user_id = ? AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+	`, auth.sessionID, auth.userID).Scan(&auth.status, &isAdmin, &twoFactor)
+	if err == sql.ErrNoRows {
+		return auth, fmt.Errorf("session revoked or expired")
+	} else if err != nil {
+		return auth, fmt.Errorf("database error")
+	}
+	if auth.status == UserStatusDisabled {
+		return auth, fmt.Errorf("account disabled")
 	}
+	auth.mfaSetupRequired = !twoFactor && s.twoFactorRequired(isAdmin)
 
-	return int(userIDFloat), nil
+	s.touchSession(auth.sessionID, getClientIP(r))
+	return auth, nil
 }
 
 // --- Helpers ---
 
-func createToken(userID int) (string, error) {
+// createToken signs a token for a session; jti is the sessions row id.
+func (s *Server) createToken(userID int, sessionID string, ttl time.Duration) (string, error) {
 	claims := jwt.MapClaims{
 		"sub": userID,
+		"jti": sessionID,
 		"iss": "guardian-server",
-		"exp": time.Now().Add(TokenDuration).Unix(),
+		"exp": time.Now().Add(ttl).Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(SecretKey))
+	return s.keys.Sign(claims)
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
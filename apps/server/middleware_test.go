@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authCall runs a request with token through withUserAuth and returns the
+// status; the wrapped handler answers 200.
+func authCall(s *Server, method, path, token string) int {
+	r := bearer(method, token)
+	r.URL.Path = path
+	w := httptest.NewRecorder()
+	s.withUserAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})(w, r)
+	return w.Code
+}
+
+// kicked returns the reason a hub client was told to close, or 0.
+func kicked(kick <-chan CloseReason) int {
+	select {
+	case reason := <-kick:
+		return reason.Code
+	default:
+		return 0
+	}
+}
+
+// TestDisabledAccountRevoked checks that disabling an account rejects its
+// tokens, closes its connections and revokes its sessions, so enabling it
+// again doesn't bring old tokens back.
+func TestDisabledAccountRevoked(t *testing.T) {
+	s := newTestServer(t)
+	useTestKeyRing(t, s)
+	addTestUser(t, s, "admin")
+	userID := addTestUser(t, s, "alice")
+	sessionID, token := signIn(t, s, userID)
+	kick := s.sseHub.AddClient(userID, sessionID, make(chan string, 1))
+
+	if code := authCall(s, http.MethodGet, "/vault/items", token); code != http.StatusOK {
+		t.Fatalf("active account: %d, want 200", code)
+	}
+
+	if w := updateUser(t, s, userID, map[string]any{"status": UserStatusDisabled}); w.Code != http.StatusOK {
+		t.Fatalf("disable: %d %s", w.Code, w.Body)
+	}
+	if code := kicked(kick); code != wsCloseAccountDisabled {
+		t.Fatalf("WebSocket close code %d, want %d", code, wsCloseAccountDisabled)
+	}
+	if code := authCall(s, http.MethodGet, "/vault/items", token); code != http.StatusUnauthorized {
+		t.Fatalf("disabled account: %d, want 401", code)
+	}
+	var revoked bool
+	if err := s.systemDB.QueryRow("SELECT revoked_at IS NOT NULL FROM sessions WHERE id = ?", sessionID).Scan(&revoked); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Fatal("session not revoked when the account was disabled")
+	}
+
+	if w := updateUser(t, s, userID, map[string]any{"status": UserStatusActive}); w.Code != http.StatusOK {
+		t.Fatalf("enable: %d %s", w.Code, w.Body)
+	}
+	if code := authCall(s, http.MethodGet, "/vault/items", token); code != http.StatusUnauthorized {
+		t.Fatalf("old token after re-enabling: %d, want 401", code)
+	}
+}
+
+// TestSuspendedAccountReadOnly checks that a suspended account keeps its
+// sessions but may only read, and that its connections are closed.
+func TestSuspendedAccountReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	useTestKeyRing(t, s)
+	addTestUser(t, s, "admin")
+	userID := addTestUser(t, s, "alice")
+	sessionID, token := signIn(t, s, userID)
+	kick := s.sseHub.AddClient(userID, sessionID, make(chan string, 1))
+
+	if w := updateUser(t, s, userID, map[string]any{"status": UserStatusSuspended}); w.Code != http.StatusOK {
+		t.Fatalf("suspend: %d %s", w.Code, w.Body)
+	}
+	if code := kicked(kick); code != wsCloseAccountSuspended {
+		t.Fatalf("WebSocket close code %d, want %d", code, wsCloseAccountSuspended)
+	}
+
+	for _, tc := range []struct {
+		method string
+		want   int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodPut, http.StatusForbidden},
+		{http.MethodPost, http.StatusForbidden},
+		{http.MethodDelete, http.StatusForbidden},
+	} {
+		if code := authCall(s, tc.method, "/vault/items", token); code != tc.want {
+			t.Errorf("%s as suspended: %d, want %d", tc.method, code, tc.want)
+		}
+	}
+}
+
+// TestMFASetupAllowlist checks that under require_2fa a user who hasn't
+// enrolled can reach only the 2FA and session endpoints.
+func TestMFASetupAllowlist(t *testing.T) {
+	s := newTestServer(t)
+	useTestKeyRing(t, s)
+	userID := addTestUser(t, s, "alice")
+	_, token := signIn(t, s, userID)
+	if _, err := s.systemDB.Exec("INSERT OR REPLACE INTO server_settings (key, value) VALUES ('require_2fa', 'all')"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/api/2fa", http.StatusOK},
+		{http.MethodPost, "/api/2fa/totp/enroll", http.StatusOK},
+		{http.MethodGet, "/api/sessions", http.StatusOK},
+		{http.MethodGet, "/vault/items", http.StatusForbidden},
+		{http.MethodPut, "/api/preferences", http.StatusForbidden},
+	} {
+		if code := authCall(s, tc.method, tc.path, token); code != tc.want {
+			t.Errorf("%s %s before enrolling: %d, want %d", tc.method, tc.path, code, tc.want)
+		}
+	}
+
+	if _, err := s.systemDB.Exec("INSERT INTO user_totp (user_id, secret, enabled_at) VALUES (?, x'00', CURRENT_TIMESTAMP)", userID); err != nil {
+		t.Fatal(err)
+	}
+	if code := authCall(s, http.MethodGet, "/vault/items", token); code != http.StatusOK {
+		t.Fatalf("after enrolling: %d, want 200", code)
+	}
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Schema Migrations ---
+//
+// Every database records the last migration applied to it in PRAGMA
+// user_version. Migrations run in order, each in its own transaction together
+// with the version bump, so a failed migration leaves the database at the
+// previous version. Released migrations must never be edited or reordered;
+// schema changes are made by appending a new one.
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// systemMigrations are applied to system.db at startup.
+var systemMigrations = []migration{
+	{1, "baseline schema", migrateSystemBaseline},
+	{2, "sessions", migrateSystemSessions},
+	{3, "refresh tokens", migrateSystemRefreshTokens},
+	{4, "two-factor authentication", migrateSystemTwoFactor},
+	{5, "webauthn credentials", migrateSystemWebAuthn},
+	{6, "client-side auth hash", migrateSystemAuthHash},
+	{7, "kdf parameters", migrateSystemKDFParams},
+	{8, "account recovery and audit log", migrateSystemRecovery},
+	{9, "login throttling", migrateSystemLoginThrottle},
+	{10, "data key", migrateSystemDataKey},
+	{11, "recovery request origin", migrateSystemRecoveryOrigin},
+	{12, "sampled vault item counts", migrateSystemVaultItemCounts},
+}
+
+// userMigrations are applied to each vault DB the first time it is opened.
+var userMigrations = []migration{
+	{1, "baseline vault schema", migrateUserBaseline},
+	{2, "pending re-key", migrateUserPendingRekey},
+}
+
+// preMigrateDir is where databases are copied before they are migrated.
+func preMigrateDir(backupDir string) string {
+	return filepath.Join(backupDir, "pre-migrate")
+}
+
+// migrateMu serializes migrations so two requests opening the same vault
+// don't both try to upgrade it.
+var migrateMu sync.Mutex
+
+// schemaVersion returns the PRAGMA user_version of db.
+func schemaVersion(db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRow("PRAGMA user_version").Scan(&v)
+	return v, err
+}
+
+// latestVersion is the version a database has once all of ms is applied.
+func latestVersion(ms []migration) int {
+	if len(ms) == 0 {
+		return 0
+	}
+	return ms[len(ms)-1].version
+}
+
+// pendingMigrations returns the current version of db and the migrations it
+// still needs. A database newer than this binary is an error: running an old
+// server against it could silently drop data.
+func pendingMigrations(db *sql.DB, ms []migration) (int, []migration, error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	if latest := latestVersion(ms); current > latest {
+		return current, nil, fmt.Errorf("schema version %d is newer than this server supports (%d)", current, latest)
+	}
+	var pending []migration
+	for _, m := range ms {
+		if m.version > current {
+			pending = append(pending, m)
+		}
+	}
+	return current, pending, nil
+}
+
+// migrateDB applies the pending migrations in ms to the database at path. If
+// snapshotDir is set and the database already holds tables, it is first
+// copied there with VACUUM INTO. logger may be nil.
+func migrateDB(db *sql.DB, path string, ms []migration, snapshotDir string, logger *log.Logger) error {
+	migrateMu.Lock()
+	defer migrateMu.Unlock()
+
+	current, pending, err := pendingMigrations(db, ms)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if snapshotDir != "" {
+		snapshot, err := snapshotBeforeMigrate(db, path, current, snapshotDir)
+		if err != nil {
+			return fmt.Errorf("%s: pre-migration snapshot: %w", filepath.Base(path), err)
+		}
+		if snapshot != "" && logger != nil {
+			logger.Printf("migrate: %s snapshot saved to %s", filepath.Base(path), snapshot)
+		}
+	}
+
+	for _, m := range pending {
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("%s: migration %d (%s): %w", filepath.Base(path), m.version, m.name, err)
+		}
+		if logger != nil {
+			logger.Printf("migrate: %s -> version %d (%s)", filepath.Base(path), m.version, m.name)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs one migration and bumps user_version in the same
+// transaction.
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	// PRAGMA arguments can't be bound; version is a compile-time constant.
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dryRunMigrations applies the pending migrations inside one transaction and
+// rolls it back, so errors surface without changing the database.
+func dryRunMigrations(db *sql.DB, pending []migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range pending {
+		if err := m.up(tx); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// snapshotBeforeMigrate copies a database that holds data into dir and
+// returns the copy's path. Empty databases (new vaults) are not copied.
+func snapshotBeforeMigrate(db *sql.DB, path string, version int, dir string) (string, error) {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+		return "", err
+	}
+	if tables == 0 {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(filepath.Base(path), ".db")
+	dst := filepath.Join(dir, fmt.Sprintf("%s-v%d-%s.db", base, version, time.Now().UTC().Format("20060102T150405Z")))
+	if _, err := db.Exec("VACUUM INTO ?", dst); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, nil
+}
+
+// addColumnIfMissing adds a column unless the table already has it, and
+// reports whether it was added.
+func addColumnIfMissing(tx *sql.Tx, table, column, decl string) (bool, error) {
+	cols, err := txTableColumns(tx, table)
+	if err != nil {
+		return false, err
+	}
+	if cols[column] {
+		return false, nil
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err == nil, err
+}
+
+func txTableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// execAll runs statements in order, stopping at the first error.
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSystemBaseline creates the system schema as it stood before
+// versioned migrations. Databases created by older releases are at version 0
+// with some subset of it, so every step is idempotent.
+func migrateSystemBaseline(tx *sql.Tx) error {
+	err := execAll(tx, `
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			is_admin BOOLEAN DEFAULT 0,
+			db_path TEXT NOT NULL,
+			friendly_name TEXT,
+			status TEXT DEFAULT 'ACTIVE',
+			role TEXT DEFAULT 'User',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_login DATETIME
+		)`, `
+		CREATE TABLE IF NOT EXISTS invites (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME,
+			expires_in TEXT,
+			used_at DATETIME,
+			use_count INTEGER DEFAULT 0,
+			max_uses INTEGER DEFAULT 1,
+			created_by INTEGER NOT NULL,
+			note TEXT,
+			status TEXT DEFAULT 'ACTIVE',
+			used_by TEXT,
+			FOREIGN KEY(created_by) REFERENCES users(id)
+		)`, `
+		CREATE TABLE IF NOT EXISTS server_settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`, `
+		CREATE TABLE IF NOT EXISTS stats_samples (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sampled_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			total_users INTEGER NOT NULL,
+			vault_items INTEGER NOT NULL,
+			db_bytes INTEGER NOT NULL,
+			wal_bytes INTEGER NOT NULL,
+			attachment_bytes INTEGER NOT NULL,
+			active_sessions INTEGER NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS idx_stats_samples_sampled_at ON stats_samples(sampled_at)", `
+		CREATE TABLE IF NOT EXISTS backups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			trigger TEXT NOT NULL,
+			status TEXT NOT NULL,
+			filename TEXT,
+			size_bytes INTEGER DEFAULT 0,
+			sha256 TEXT,
+			db_count INTEGER DEFAULT 0,
+			file_count INTEGER DEFAULT 0,
+			error TEXT,
+			started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			completed_at DATETIME,
+			duration_ms INTEGER DEFAULT 0,
+			pruned_at DATETIME,
+			verified_at DATETIME,
+			verify_status TEXT,
+			verify_error TEXT
+		)`, `
+		CREATE TABLE IF NOT EXISTS backup_destinations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			config TEXT NOT NULL,
+			enabled BOOLEAN DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`, `
+		CREATE TABLE IF NOT EXISTS backup_uploads (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			backup_id INTEGER NOT NULL,
+			destination_id INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			remote_name TEXT NOT NULL,
+			size_bytes INTEGER DEFAULT 0,
+			error TEXT,
+			started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			completed_at DATETIME,
+			duration_ms INTEGER DEFAULT 0
+		)`,
+		"CREATE INDEX IF NOT EXISTS idx_backup_uploads_destination ON backup_uploads(destination_id, id)",
+	)
+	if err != nil {
+		return err
+	}
+
+	// Columns added to existing tables by earlier releases
+	columns := []struct{ table, column, decl string }{
+		{"invites", "used_by", "TEXT"},
+		{"users", "status", "TEXT DEFAULT 'ACTIVE'"},
+		{"users", "role", "TEXT DEFAULT 'User'"},
+		{"users", "last_login", "DATETIME"},
+		{"users", "preferences", "TEXT DEFAULT '{}'"},
+		{"users", "salt", "TEXT DEFAULT ''"},
+		{"users", "max_ws_per_ip", "INTEGER DEFAULT 0"},
+		{"users", "history_max_revisions", "INTEGER DEFAULT 0"},
+		{"users", "history_max_age_days", "INTEGER DEFAULT 0"},
+		{"users", "trash_retention_days", "INTEGER DEFAULT 0"},
+		{"users", "quota_max_items", "INTEGER DEFAULT 0"},
+		{"users", "quota_max_bytes", "INTEGER DEFAULT 0"},
+		{"users", "quota_max_blob_bytes", "INTEGER DEFAULT 0"},
+		{"backups", "verified_at", "DATETIME"},
+		{"backups", "verify_status", "TEXT"},
+		{"backups", "verify_error", "TEXT"},
+	}
+	for _, c := range columns {
+		if _, err := addColumnIfMissing(tx, c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSystemSessions adds the session registry; every token carries the id
+// of its row as the jti claim.
+func migrateSystemSessions(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			device_name TEXT DEFAULT '',
+			client_type TEXT DEFAULT '',
+			ip TEXT DEFAULT '',
+			user_agent TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		"CREATE INDEX idx_sessions_user ON sessions(user_id)",
+	)
+}
+
+// migrateSystemRefreshTokens stores hashed refresh tokens. Used tokens are
+// kept until their session is pruned so that replaying one can be detected.
+func migrateSystemRefreshTokens(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY(session_id) REFERENCES sessions(id)
+		)`,
+		"CREATE INDEX idx_refresh_tokens_session ON refresh_tokens(session_id)",
+	)
+}
+
+// migrateSystemTwoFactor stores encrypted TOTP secrets and hashed recovery
+// codes. last_step is the newest TOTP time step accepted, so a code can't be
+// replayed.
+func migrateSystemTwoFactor(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE user_totp (
+			user_id INTEGER PRIMARY KEY,
+			secret BLOB NOT NULL,
+			enabled_at DATETIME,
+			last_step INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`, `
+		CREATE TABLE recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			used_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		"CREATE INDEX idx_recovery_codes_user ON recovery_codes(user_id)",
+	)
+}
+
+// migrateSystemWebAuthn stores registered authenticators. credential holds
+// the library's JSON record, including the sign count; webauthn_handle is the
+// random user handle passkeys are bound to.
+func migrateSystemWebAuthn(tx *sql.Tx) error {
+	if _, err := addColumnIfMissing(tx, "users", "webauthn_handle", "BLOB"); err != nil {
+		return err
+	}
+	return execAll(tx,
+		"CREATE UNIQUE INDEX idx_users_webauthn_handle ON users(webauthn_handle)", `
+		CREATE TABLE webauthn_credentials (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			name TEXT DEFAULT '',
+			credential TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_used_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		"CREATE INDEX idx_webauthn_credentials_user ON webauthn_credentials(user_id)",
+	)
+}
+
+// migrateSystemAuthHash records whether password_hash is a bcrypt of the
+// master password (legacy) or of the client-derived auth hash, and gives
+// every account a salt so prelogin can answer before the first login.
+func migrateSystemAuthHash(tx *sql.Tx) error {
+	if _, err := addColumnIfMissing(tx, "users", "auth_scheme", "TEXT NOT NULL DEFAULT 'password'"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id FROM users WHERE salt IS NULL OR salt = ''")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		salt, err := newSalt()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE users SET salt = ? WHERE id = ?", salt, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSystemKDFParams stores each account's master key derivation
+// parameters. Existing accounts get the ones clients have always used.
+func migrateSystemKDFParams(tx *sql.Tx) error {
+	for _, col := range [][2]string{
+		{"kdf", "TEXT NOT NULL DEFAULT 'argon2id'"},
+		{"kdf_memory", "INTEGER NOT NULL DEFAULT 32768"},
+		{"kdf_iterations", "INTEGER NOT NULL DEFAULT 4"},
+		{"kdf_parallelism", "INTEGER NOT NULL DEFAULT 1"},
+	} {
+		if _, err := addColumnIfMissing(tx, "users", col[0], col[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSystemRecovery adds key escrow for account recovery and the audit
+// log. recovery_escrow holds the user's master key wrapped client-side, once
+// per kind: "code" (with a recovery code, verifier_hash proves knowledge of
+// it) and "admin" (to the admin recovery public key identified by key_id).
+func migrateSystemRecovery(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE recovery_escrow (
+			user_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			wrapped_key TEXT NOT NULL,
+			verifier_hash TEXT DEFAULT '',
+			key_id TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, kind),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`, `
+		CREATE TABLE recovery_requests (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			status TEXT NOT NULL,
+			request_token_hash TEXT DEFAULT '',
+			recovery_token_hash TEXT DEFAULT '',
+			public_key TEXT DEFAULT '',
+			wrapped_key TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			decided_by INTEGER,
+			decided_at DATETIME,
+			completed_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		"CREATE INDEX idx_recovery_requests_user ON recovery_requests(user_id)",
+		"CREATE UNIQUE INDEX idx_recovery_requests_token ON recovery_requests(recovery_token_hash) WHERE recovery_token_hash != ''", `
+		CREATE TABLE audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			actor_id INTEGER,
+			user_id INTEGER,
+			action TEXT NOT NULL,
+			detail TEXT DEFAULT '',
+			ip TEXT DEFAULT ''
+		)`,
+		"CREATE INDEX idx_audit_log_user ON audit_log(user_id)",
+	)
+}
+
+// migrateSystemLoginThrottle adds the failed login counters. Times are unix
+// seconds.
+func migrateSystemLoginThrottle(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE login_throttle (
+			scope TEXT NOT NULL,
+			key TEXT NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure INTEGER NOT NULL DEFAULT 0,
+			blocked_until INTEGER NOT NULL DEFAULT 0,
+			locked_until INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (scope, key)
+		)`,
+	)
+}
+
+// migrateSystemDataKey adds the table holding the wrapped data key (one row).
+func migrateSystemDataKey(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE data_key (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			wrapped_key BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+	)
+}
+
+// migrateSystemRecoveryOrigin records where recovery requests were filed
+// from, for the admins deciding them.
+func migrateSystemRecoveryOrigin(tx *sql.Tx) error {
+	if _, err := addColumnIfMissing(tx, "recovery_requests", "created_ip", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err := addColumnIfMissing(tx, "recovery_requests", "created_user_agent", "TEXT DEFAULT ''")
+	return err
+}
+
+// migrateSystemVaultItemCounts keeps each user's last sampled item count so
+// the admin user list doesn't have to open every vault.
+func migrateSystemVaultItemCounts(tx *sql.Tx) error {
+	_, err := addColumnIfMissing(tx, "users", "vault_items", "INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// migrateUserBaseline creates the vault schema as it stood before versioned
+// migrations, upgrading vaults from older releases in place.
+func migrateUserBaseline(tx *sql.Tx) error {
+	err := execAll(tx, `
+		CREATE TABLE IF NOT EXISTS vault_items (
+			id TEXT PRIMARY KEY,
+			encrypted_blob TEXT NOT NULL,
+			revision INTEGER DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			seq INTEGER DEFAULT 0
+		)`, `
+		CREATE TABLE IF NOT EXISTS vault_tombstones (
+			id TEXT PRIMARY KEY,
+			revision INTEGER DEFAULT 0,
+			seq INTEGER NOT NULL,
+			deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`, `
+		CREATE TABLE IF NOT EXISTS vault_meta (
+			key TEXT PRIMARY KEY,
+			value INTEGER NOT NULL
+		)`, `
+		CREATE TABLE IF NOT EXISTS vault_item_history (
+			item_id TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			encrypted_blob TEXT NOT NULL,
+			updated_at DATETIME,
+			archived_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (item_id, revision)
+		)`, `
+		CREATE TABLE IF NOT EXISTS vault_trash (
+			id TEXT PRIMARY KEY,
+			encrypted_blob TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			purge_at DATETIME NOT NULL
+		)`, `
+		CREATE TABLE IF NOT EXISTS vault_attachments (
+			id TEXT PRIMARY KEY,
+			item_id TEXT NOT NULL,
+			encrypted_name TEXT DEFAULT '',
+			size INTEGER NOT NULL,
+			sha256 TEXT NOT NULL,
+			uploaded INTEGER DEFAULT 0,
+			status TEXT DEFAULT 'PENDING',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			completed_at DATETIME
+		)`,
+		"INSERT OR IGNORE INTO vault_meta (key, value) VALUES ('last_seq', 0)",
+		"INSERT OR IGNORE INTO vault_meta (key, value) VALUES ('compacted_seq', 0)",
+	)
+	if err != nil {
+		return err
+	}
+
+	// Vaults created before the change feed have no seq column. Number the
+	// existing rows so a since=0 sync still returns them.
+	added, err := addColumnIfMissing(tx, "vault_items", "seq", "INTEGER DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		err = execAll(tx,
+			"UPDATE vault_items SET seq = rowid",
+			"UPDATE vault_meta SET value = (SELECT COALESCE(MAX(seq), 0) FROM vault_items) WHERE key = 'last_seq'",
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return execAll(tx,
+		"CREATE INDEX IF NOT EXISTS idx_vault_items_seq ON vault_items(seq)",
+		"CREATE INDEX IF NOT EXISTS idx_vault_tombstones_seq ON vault_tombstones(seq)",
+		"CREATE INDEX IF NOT EXISTS idx_vault_attachments_item ON vault_attachments(item_id)",
+	)
+}
+
+// migrateUserPendingRekey adds the row a re-key leaves in the vault until the
+// users row has the credentials the vault was re-encrypted for.
+func migrateUserPendingRekey(tx *sql.Tx) error {
+	return execAll(tx, `
+		CREATE TABLE vault_rekey (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			password_hash TEXT NOT NULL,
+			salt TEXT NOT NULL,
+			kdf TEXT NOT NULL,
+			kdf_memory INTEGER NOT NULL,
+			kdf_iterations INTEGER NOT NULL,
+			kdf_parallelism INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+	)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// preMigrationSystemSchema is system.db as the last release before versioned
+// migrations left it, with all of its ad-hoc ALTER TABLEs applied.
+const preMigrationSystemSchema = `
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		is_admin BOOLEAN DEFAULT 0,
+		db_path TEXT NOT NULL,
+		friendly_name TEXT,
+		status TEXT DEFAULT 'ACTIVE',
+		role TEXT DEFAULT 'User',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_login DATETIME,
+		preferences TEXT DEFAULT '{}',
+		salt TEXT DEFAULT '',
+		max_ws_per_ip INTEGER DEFAULT 0
+	);
+	CREATE TABLE invites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT UNIQUE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		expires_in TEXT,
+		used_at DATETIME,
+		use_count INTEGER DEFAULT 0,
+		max_uses INTEGER DEFAULT 1,
+		created_by INTEGER NOT NULL,
+		note TEXT,
+		status TEXT DEFAULT 'ACTIVE',
+		used_by TEXT,
+		FOREIGN KEY(created_by) REFERENCES users(id)
+	);
+	CREATE TABLE server_settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	INSERT INTO server_settings (key, value) VALUES ('max_ws_per_ip_default', '3');
+	INSERT INTO users (username, password_hash, is_admin, db_path, salt) VALUES ('alice', '$2a$10$hash', 1, 'user_alice.db', 'c2FsdA==');
+	INSERT INTO invites (token, created_by, note) VALUES ('invite-token', 1, 'for bob');
+`
+
+// preMigrationVaultSchema is a vault from before the change feed.
+const preMigrationVaultSchema = `
+	CREATE TABLE vault_items (
+		id TEXT PRIMARY KEY,
+		encrypted_blob TEXT NOT NULL,
+		revision INTEGER DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO vault_items (id, encrypted_blob, revision) VALUES ('a', 'blob-a', 1), ('b', 'blob-b', 4);
+`
+
+func createDB(t *testing.T, path, schema string) {
+	t.Helper()
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateSystemFromPreMigrationRelease(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "system.db")
+	createDB(t, path, preMigrationSystemSchema)
+
+	snapshots := filepath.Join(dir, "pre-migrate")
+	db, err := initSystemDB(path, snapshots, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if v, _ := schemaVersion(db); v != latestVersion(systemMigrations) {
+		t.Fatalf("user_version = %d, want %d", v, latestVersion(systemMigrations))
+	}
+	if entries, _ := os.ReadDir(snapshots); len(entries) != 1 {
+		t.Fatalf("%d pre-migration snapshots, want 1", len(entries))
+	}
+
+	// Existing rows and settings survive
+	var username, salt string
+	var isAdmin bool
+	if err := db.QueryRow("SELECT username, salt, is_admin FROM users WHERE id = 1").Scan(&username, &salt, &isAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" || salt != "c2FsdA==" || !isAdmin {
+		t.Fatalf("user = %q %q %v", username, salt, isAdmin)
+	}
+	var note string
+	if err := db.QueryRow("SELECT note FROM invites WHERE token = 'invite-token'").Scan(&note); err != nil || note != "for bob" {
+		t.Fatalf("invite note = %q, %v", note, err)
+	}
+	var wsDefault string
+	db.QueryRow("SELECT value FROM server_settings WHERE key = 'max_ws_per_ip_default'").Scan(&wsDefault)
+	if wsDefault != "3" {
+		t.Fatalf("max_ws_per_ip_default = %q, want the stored 3", wsDefault)
+	}
+
+	// Every later table exists and works
+	for _, q := range []string{
+		"SELECT COUNT(*) FROM sessions",
+		"SELECT COUNT(*) FROM recovery_requests",
+		"SELECT COUNT(*) FROM audit_log",
+		"SELECT COUNT(*) FROM login_throttle",
+		"SELECT COUNT(*) FROM backup_destinations",
+	} {
+		var n int
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			t.Errorf("%s: %v", q, err)
+		}
+	}
+
+	// Starting again is a no-op
+	db.Close()
+	db, err = initSystemDB(path, snapshots, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if entries, _ := os.ReadDir(snapshots); len(entries) != 1 {
+		t.Fatalf("%d pre-migration snapshots after restart, want 1", len(entries))
+	}
+}
+
+func TestMigrateVaultFromPreMigrationRelease(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "user_alice.db")
+	createDB(t, path, preMigrationVaultSchema)
+
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrateDB(db, path, userMigrations, filepath.Join(dir, "pre-migrate"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := schemaVersion(db); v != latestVersion(userMigrations) {
+		t.Fatalf("user_version = %d, want %d", v, latestVersion(userMigrations))
+	}
+
+	// Existing items are numbered so a full sync still returns them
+	var lastSeq, numbered int
+	db.QueryRow("SELECT value FROM vault_meta WHERE key = 'last_seq'").Scan(&lastSeq)
+	db.QueryRow("SELECT COUNT(*) FROM vault_items WHERE seq > 0").Scan(&numbered)
+	if numbered != 2 || lastSeq < 2 {
+		t.Fatalf("numbered %d items, last_seq %d", numbered, lastSeq)
+	}
+}
+
+func TestFailedMigrationKeepsVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	broken := errors.New("broken migration")
+	ms := []migration{
+		{1, "first", func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE one (id INTEGER)")
+			return err
+		}},
+		{2, "second", func(tx *sql.Tx) error {
+			if _, err := tx.Exec("CREATE TABLE two (id INTEGER)"); err != nil {
+				return err
+			}
+			return broken
+		}},
+	}
+	if err := migrateDB(db, path, ms, "", nil); !errors.Is(err, broken) {
+		t.Fatalf("migrateDB = %v, want the migration's error", err)
+	}
+	if v, _ := schemaVersion(db); v != 1 {
+		t.Fatalf("user_version = %d, want 1", v)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'two'").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("table of the failed migration exists (%d, %v)", n, err)
+	}
+}
+
+func TestDataDirLock(t *testing.T) {
+	dir := t.TempDir()
+	release, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockDataDir(dir); !errors.Is(err, errDataDirLocked) {
+		release()
+		t.Skipf("second lock = %v; flock not supported here", err)
+	}
+	release()
+	release, err = lockDataDir(dir)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	release()
+}
@@ -1,40 +1,68 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // contextKey is a custom type for context keys to avoid collisions
 type contextKey string
 
 const userIDKey contextKey = "user_id"
 
+// sessionIDKey holds the id (jti) of the session a request was made with.
+const sessionIDKey contextKey = "session_id"
+
+// Account statuses. DISABLED accounts can't log in and their tokens stop
+// working at once; SUSPENDED accounts keep read-only access to their vault.
+const (
+	UserStatusActive    = "ACTIVE"
+	UserStatusDisabled  = "DISABLED"
+	UserStatusSuspended = "SUSPENDED"
+)
+
 // --- Models ---
 type User struct {
-	ID           int        `json:"id"`
-	Username     string     `json:"username"`
-	PasswordHash string     `json:"-"`
-	IsAdmin      bool       `json:"is_admin"`
-	DBPath       string     `json:"db_path"`
-	FriendlyName string     `json:"friendly_name"`
-	Status       string     `json:"status"`
-	Role         string     `json:"role"`
-	MaxWsPerIP   int        `json:"max_ws_per_ip"`
-	CreatedAt    time.Time  `json:"created_at"`
-	LastLogin    *time.Time `json:"last_login"`
+	ID                  int        `json:"id"`
+	Username            string     `json:"username"`
+	PasswordHash        string     `json:"-"`
+	IsAdmin             bool       `json:"is_admin"`
+	DBPath              string     `json:"db_path"`
+	FriendlyName        string     `json:"friendly_name"`
+	Status              string     `json:"status"`
+	Role                string     `json:"role"`
+	MaxWsPerIP          int        `json:"max_ws_per_ip"`
+	HistoryMaxRevisions int        `json:"history_max_revisions"`
+	HistoryMaxAgeDays   int        `json:"history_max_age_days"`
+	TrashRetentionDays  int        `json:"trash_retention_days"`
+	QuotaMaxItems       int64      `json:"quota_max_items"`
+	QuotaMaxBytes       int64      `json:"quota_max_bytes"`
+	QuotaMaxBlobBytes   int64      `json:"quota_max_blob_bytes"`
+	CreatedAt           time.Time  `json:"created_at"`
+	LastLogin           *time.Time `json:"last_login"`
 }
 
 type AdminUserResponse struct {
-	ID                int        `json:"id"`
-	Username          string     `json:"username"`
-	IsAdmin           bool       `json:"is_admin"`
-	FriendlyName      string     `json:"friendly_name"`
-	Status            string     `json:"status"`
-	Role              string     `json:"role"`
-	MaxWsPerIP        int        `json:"max_ws_per_ip"`
-	VaultItems        int        `json:"vault_items"`
-	UsedSpace         string     `json:"used_space"`
-	UsedSpaceOverhead string     `json:"used_space_overhead"`
-	CreatedAt         time.Time  `json:"created_at"`
-	LastLogin         *time.Time `json:"last_login"`
+	ID                  int        `json:"id"`
+	Username            string     `json:"username"`
+	IsAdmin             bool       `json:"is_admin"`
+	FriendlyName        string     `json:"friendly_name"`
+	Status              string     `json:"status"`
+	Role                string     `json:"role"`
+	MaxWsPerIP          int        `json:"max_ws_per_ip"`
+	HistoryMaxRevisions int        `json:"history_max_revisions"`
+	HistoryMaxAgeDays   int        `json:"history_max_age_days"`
+	TrashRetentionDays  int        `json:"trash_retention_days"`
+	QuotaMaxItems       int64      `json:"quota_max_items"`
+	QuotaMaxBytes       int64      `json:"quota_max_bytes"`
+	QuotaMaxBlobBytes   int64      `json:"quota_max_blob_bytes"`
+	VaultItems          int        `json:"vault_items"`
+	VaultMissing        bool       `json:"vault_missing,omitempty"`
+	UsedSpace           string     `json:"used_space"`
+	UsedSpaceOverhead   string     `json:"used_space_overhead"`
+	TwoFactorEnabled    bool       `json:"two_factor_enabled"`
+	CreatedAt           time.Time  `json:"created_at"`
+	LastLogin           *time.Time `json:"last_login"`
 }
 
 type Invite struct {
@@ -53,8 +81,11 @@ type Invite struct {
 }
 
 type RegisterRequest struct {
-	Username    string `json:"username"`
-	Password    string `json:"password"`
+	Username string `json:"username"`
+	// The auth hash and the salt and parameters it was derived with
+	AuthHash string `json:"auth_hash"`
+	Salt     string `json:"salt"`
+	KDFParams
 	InviteToken string `json:"invite_token"`
 	DBName      string `json:"db_name"` // Friendly name
 }
@@ -67,14 +98,199 @@ type CreateInviteRequest struct {
 
 type LoginRequest struct {
 	Username string `json:"username"`
-	Password string `json:"password"`
+	AuthHash string `json:"auth_hash,omitempty"`
+	// Only accepted for accounts still on the password scheme; sent along
+	// with auth_hash it migrates the account
+	Password string `json:"password,omitempty"`
+	// Optional, shown in the session list
+	DeviceName string `json:"device_name"`
+	ClientType string `json:"client_type"` // web, desktop, mobile, extension
 }
 
-type AuthResponse struct {
-	Token    string `json:"token"`
+type PreloginRequest struct {
 	Username string `json:"username"`
-	IsAdmin  bool   `json:"is_admin"`
-	Salt     string `json:"salt"`
+}
+
+// KDFParams are a user's master key derivation settings. Memory and
+// parallelism are 0 for pbkdf2-sha256.
+type KDFParams struct {
+	KDF            string `json:"kdf"`        // argon2id, pbkdf2-sha256
+	KDFMemory      int    `json:"kdf_memory"` // KiB
+	KDFIterations  int    `json:"kdf_iterations"`
+	KDFParallelism int    `json:"kdf_parallelism"`
+}
+
+// PreloginResponse tells a client how to derive the master key and what
+// auth_scheme the account is on (password or auth_hash).
+type PreloginResponse struct {
+	Salt       string `json:"salt"`
+	AuthScheme string `json:"auth_scheme"`
+	KDFParams
+}
+
+// KDFUpgradeRequest moves an account to new KDF parameters. The vault is
+// re-encrypted under the new master key in the same request.
+type KDFUpgradeRequest struct {
+	AuthHash string `json:"auth_hash"`
+	Password string `json:"password,omitempty"` // accounts still on the password scheme
+	// Derived from the new salt and parameters
+	NewAuthHash string `json:"new_auth_hash"`
+	Salt        string `json:"salt"`
+	KDFParams
+	Vault VaultRekey `json:"vault"`
+}
+
+// VaultRekey is a complete re-encryption of a vault. Cursor is the
+// last_seq it was made from; Items, Trash and Attachments must cover every
+// live item, trash entry and attachment.
+type VaultRekey struct {
+	Cursor      int64             `json:"cursor"`
+	Items       []VaultRekeyItem  `json:"items"`
+	Trash       []VaultRekeyItem  `json:"trash"`
+	Attachments []AttachmentRekey `json:"attachments"`
+}
+
+type VaultRekeyItem struct {
+	ID            string `json:"id"`
+	EncryptedBlob string `json:"encrypted_blob"`
+}
+
+// AttachmentRekey carries an attachment's re-encrypted name. File contents
+// are encrypted with per-file keys kept in the item and don't change.
+type AttachmentRekey struct {
+	ID            string `json:"id"`
+	EncryptedName string `json:"encrypted_name"`
+}
+
+// ChangePasswordRequest replaces the master password. KDF parameters are
+// kept unless new ones are given.
+type ChangePasswordRequest struct {
+	AuthHash    string `json:"auth_hash"`
+	Password    string `json:"password,omitempty"` // accounts still on the password scheme
+	NewAuthHash string `json:"new_auth_hash"`
+	Salt        string `json:"salt"`
+	KDFParams
+	Vault VaultRekey `json:"vault"`
+}
+
+type RekeyResponse struct {
+	Message         string `json:"message"`
+	Cursor          int64  `json:"cursor"`
+	SessionsRevoked int64  `json:"sessions_revoked,omitempty"`
+}
+
+type AuthResponse struct {
+	Token     string `json:"token"`
+	Username  string `json:"username"`
+	IsAdmin   bool   `json:"is_admin"`
+	Salt      string `json:"salt"`
+	Status    string `json:"status"`
+	SessionID string `json:"session_id"`
+	// Token is an access token valid for ExpiresIn seconds; renew it at
+	// /auth/refresh with RefreshToken.
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	// Set when the server requires 2FA and the user hasn't enrolled yet; only
+	// the /api/2fa and /api/sessions endpoints accept the token until then.
+	MFASetupRequired bool `json:"mfa_setup_required,omitempty"`
+	// The account's KDF parameters are below the server minimum; the client
+	// should re-key at /api/account/kdf
+	KDFUpgradeRequired bool `json:"kdf_upgrade_required,omitempty"`
+	// admin_recovery is required and the master key isn't escrowed to the
+	// current admin key; the client should PUT /api/recovery/admin
+	RecoveryEscrowRequired bool `json:"recovery_escrow_required,omitempty"`
+}
+
+// MFARequiredResponse is the login response for users with 2FA enabled. The
+// login is finished at /auth/login/2fa.
+type MFARequiredResponse struct {
+	MFARequired bool     `json:"mfa_required"`
+	MFAToken    string   `json:"mfa_token"`
+	Methods     []string `json:"methods"` // totp, webauthn, recovery_code
+	ExpiresIn   int64    `json:"expires_in"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"` // TOTP code or recovery code
+}
+
+type TwoFactorRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password,omitempty"`
+	AuthHash string `json:"auth_hash,omitempty"`
+}
+
+type TwoFactorStatus struct {
+	TOTPEnabled         bool `json:"totp_enabled"`
+	WebAuthnCredentials int  `json:"webauthn_credentials"`
+	RecoveryCodesLeft   int  `json:"recovery_codes_left"`
+	Required            bool `json:"required"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// WebAuthnOptions starts a ceremony: pass Options to
+// navigator.credentials.create() or .get() and send the result back with
+// CeremonyID.
+type WebAuthnOptions struct {
+	CeremonyID string `json:"ceremony_id"`
+	Options    any    `json:"options"`
+}
+
+type WebAuthnRegisterRequest struct {
+	CeremonyID string          `json:"ceremony_id"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"` // PublicKeyCredential as JSON
+}
+
+type WebAuthnRegisterResponse struct {
+	Credential WebAuthnCredentialInfo `json:"credential"`
+	// Set when this is the user's first second factor
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type WebAuthnLoginBeginRequest struct {
+	// From a password login's mfa_required response. Without it the ceremony
+	// is a passwordless passkey login.
+	MFAToken string `json:"mfa_token"`
+}
+
+type WebAuthnLoginFinishRequest struct {
+	CeremonyID string          `json:"ceremony_id"`
+	Credential json.RawMessage `json:"credential"`
+	DeviceName string          `json:"device_name"`
+	ClientType string          `json:"client_type"`
+}
+
+type WebAuthnCredentialInfo struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	AAGUID          string     `json:"aaguid"`
+	AttestationType string     `json:"attestation_type"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshResponse carries a new access token and the refresh token that
+// replaces the one just used.
+type RefreshResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	SessionID    string `json:"session_id"`
 }
 
 type VaultItem struct {
@@ -82,4 +298,451 @@ type VaultItem struct {
 	EncryptedBlob string `json:"encrypted_blob"`
 	Revision      int    `json:"revision"`
 	UpdatedAt     string `json:"updated_at,omitempty"`
-}
\ No newline at end of file
+}
+
+// VaultItemRevision reports the revision the server assigned to an upserted item.
+type VaultItemRevision struct {
+	ID       string `json:"id"`
+	Revision int    `json:"revision"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+type UpsertItemsResponse struct {
+	Message string              `json:"message"`
+	Items   []VaultItemRevision `json:"items"`
+	Cursor  int64               `json:"cursor"`
+}
+
+// VaultConflict describes the server's current state of an item whose
+// base revision did not match the stored one. Deleted is set (and the blob
+// left empty) when the stored state is a tombstone.
+type VaultConflict struct {
+	ID            string `json:"id"`
+	EncryptedBlob string `json:"encrypted_blob"`
+	Revision      int    `json:"revision"`
+	Deleted       bool   `json:"deleted,omitempty"`
+}
+
+type VaultConflictResponse struct {
+	Error     string          `json:"error"`
+	Conflicts []VaultConflict `json:"conflicts"`
+}
+
+// VaultTombstone marks an item deleted at the given revision.
+type VaultTombstone struct {
+	ID        string `json:"id"`
+	Revision  int    `json:"revision"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+type VaultChangesResponse struct {
+	Cursor     int64            `json:"cursor"`
+	Items      []VaultItem      `json:"items"`
+	Tombstones []VaultTombstone `json:"tombstones"`
+}
+
+type VaultChangesError struct {
+	Error      string `json:"error"`
+	FullResync bool   `json:"full_resync"`
+	Cursor     int64  `json:"cursor"`
+}
+
+// VaultItemHistoryEntry describes one archived revision without its blob.
+type VaultItemHistoryEntry struct {
+	Revision   int    `json:"revision"`
+	Size       int64  `json:"size"`
+	UpdatedAt  string `json:"updated_at"`
+	ArchivedAt string `json:"archived_at"`
+}
+
+// TrashItem is a deleted item that can still be restored until PurgeAt.
+type TrashItem struct {
+	ID            string `json:"id"`
+	EncryptedBlob string `json:"encrypted_blob"`
+	Revision      int    `json:"revision"`
+	DeletedAt     string `json:"deleted_at"`
+	PurgeAt       string `json:"purge_at"`
+}
+
+type CreateAttachmentRequest struct {
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`         // hex digest of the encrypted content
+	EncryptedName string `json:"encrypted_name"` // optional, opaque to the server
+}
+
+type VaultAttachment struct {
+	ID            string `json:"id"`
+	ItemID        string `json:"item_id"`
+	EncryptedName string `json:"encrypted_name"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`
+	Uploaded      int64  `json:"uploaded"`
+	Status        string `json:"status"` // "PENDING", "COMPLETE"
+	CreatedAt     string `json:"created_at"`
+}
+
+// VaultQuota holds a user's effective storage limits; 0 means unlimited.
+type VaultQuota struct {
+	MaxItems     int64 `json:"max_items"`
+	MaxBytes     int64 `json:"max_bytes"`
+	MaxBlobBytes int64 `json:"max_blob_bytes"`
+}
+
+type VaultUsage struct {
+	Items int64 `json:"items"`
+	Bytes int64 `json:"bytes"`
+}
+
+type VaultUsageResponse struct {
+	Usage  VaultUsage `json:"usage"`
+	Limits VaultQuota `json:"limits"`
+}
+
+// QuotaError is returned with 413 (single blob too large) or 507 (vault full).
+type QuotaError struct {
+	Error  string     `json:"error"`
+	Quota  string     `json:"quota"` // "max_items", "max_bytes" or "max_blob_bytes"
+	Limit  int64      `json:"limit"`
+	Usage  VaultUsage `json:"usage"`
+	Limits VaultQuota `json:"limits"`
+}
+
+type AdminStats struct {
+	TotalUsers     int                `json:"total_users"`
+	UsersByStatus  map[string]int     `json:"users_by_status"`
+	VaultItems     int64              `json:"vault_items"`
+	Storage        StorageStats       `json:"storage"`
+	ActiveSessions int                `json:"active_sessions"` // connected SSE/WebSocket clients
+	ConnectedUsers int                `json:"connected_users"`
+	PerUser        []UserStorageStats `json:"per_user"`
+	CollectedAt    time.Time          `json:"collected_at"`
+}
+
+type StorageStats struct {
+	SystemDBBytes   int64 `json:"system_db_bytes"`
+	UserDBBytes     int64 `json:"user_db_bytes"`
+	WALBytes        int64 `json:"wal_bytes"` // -wal and -shm files of all databases
+	AttachmentBytes int64 `json:"attachment_bytes"`
+	TotalBytes      int64 `json:"total_bytes"`
+}
+
+type UserStorageStats struct {
+	UserID          int    `json:"user_id"`
+	Username        string `json:"username"`
+	VaultItems      int64  `json:"vault_items"`
+	BlobBytes       int64  `json:"blob_bytes"`
+	DBBytes         int64  `json:"db_bytes"`
+	WALBytes        int64  `json:"wal_bytes"`
+	AttachmentBytes int64  `json:"attachment_bytes"`
+	VaultMissing    bool   `json:"vault_missing,omitempty"`
+	dbPath          string
+}
+
+type StatsSample struct {
+	SampledAt       time.Time `json:"sampled_at"`
+	TotalUsers      int       `json:"total_users"`
+	VaultItems      int64     `json:"vault_items"`
+	DBBytes         int64     `json:"db_bytes"`
+	WALBytes        int64     `json:"wal_bytes"`
+	AttachmentBytes int64     `json:"attachment_bytes"`
+	ActiveSessions  int       `json:"active_sessions"`
+}
+
+type StatsHistoryResponse struct {
+	Days   int           `json:"days"`
+	Points []StatsSample `json:"points"`
+}
+
+type BackupSchedule struct {
+	Enabled             bool       `json:"enabled"`
+	IntervalHours       int        `json:"interval_hours"`
+	RetentionCount      int        `json:"retention_count"`
+	VerifyIntervalHours int        `json:"verify_interval_hours"` // restore drill of the newest archive, 0 = off
+	Directory           string     `json:"directory"`
+	NextRunAt           *time.Time `json:"next_run_at,omitempty"`
+}
+
+type BackupRecord struct {
+	ID          int64      `json:"id"`
+	Trigger     string     `json:"trigger"` // manual, scheduled
+	Status      string     `json:"status"`  // running, success, failed
+	Filename    string     `json:"filename,omitempty"`
+	SizeBytes   int64      `json:"size_bytes"`
+	Size        string     `json:"size"`
+	SHA256      string     `json:"sha256,omitempty"`
+	DBCount     int        `json:"db_count"`
+	FileCount   int        `json:"file_count"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	DurationMs  int64      `json:"duration_ms"`
+	PrunedAt    *time.Time `json:"pruned_at,omitempty"` // archive removed by retention
+	// Outcome of the last restore drill (POST /api/admin/backups/{id}/verify
+	// or the scheduled drill)
+	VerifiedAt   *time.Time `json:"verified_at,omitempty"`
+	VerifyStatus string     `json:"verify_status,omitempty"` // running, ok, failed
+	VerifyError  string     `json:"verify_error,omitempty"`
+}
+
+type BackupListResponse struct {
+	Schedule BackupSchedule `json:"schedule"`
+	Backups  []BackupRecord `json:"backups"`
+}
+
+// BackupManifest is stored as manifest.json inside every backup archive.
+type BackupManifest struct {
+	Format        int                  `json:"format"`
+	CreatedAt     time.Time            `json:"created_at"`
+	ServerVersion string               `json:"server_version"`
+	Files         []BackupManifestFile `json:"files"`
+}
+
+type BackupManifestFile struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"` // system, vault, attachment
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type BackupVerifyReport struct {
+	Archive     string    `json:"archive"`
+	CreatedAt   time.Time `json:"created_at"`
+	Databases   int       `json:"databases"`
+	Attachments int       `json:"attachments"`
+	OK          bool      `json:"ok"`
+	Problems    []string  `json:"problems"`
+}
+
+type BackupDestinationRequest struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"` // local, s3, sftp
+	Enabled *bool           `json:"enabled"`
+	Config  json.RawMessage `json:"config"`
+}
+
+type BackupDestinationResponse struct {
+	ID         int64           `json:"id"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Enabled    bool            `json:"enabled"`
+	Config     json.RawMessage `json:"config"` // secrets masked
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	LastUpload *BackupUpload   `json:"last_upload,omitempty"`
+}
+
+type BackupUpload struct {
+	ID            int64      `json:"id"`
+	BackupID      int64      `json:"backup_id"`
+	DestinationID int64      `json:"destination_id"`
+	Status        string     `json:"status"` // running, success, failed, pruned
+	RemoteName    string     `json:"remote_name"`
+	SizeBytes     int64      `json:"size_bytes"`
+	Size          string     `json:"size"`
+	Error         string     `json:"error,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	DurationMs    int64      `json:"duration_ms"`
+}
+
+type ReplicaStatus struct {
+	Database      string     `json:"database"`
+	Generation    string     `json:"generation"`
+	SnapshotAt    *time.Time `json:"snapshot_at,omitempty"`
+	LastSyncAt    *time.Time `json:"last_sync_at,omitempty"`
+	LastShippedAt *time.Time `json:"last_shipped_at,omitempty"`
+	ShippedBytes  int64      `json:"shipped_bytes"` // of the current WAL
+	PendingBytes  int64      `json:"pending_bytes"` // committed but not yet shipped
+	LagSeconds    float64    `json:"lag_seconds"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type ReplicationResponse struct {
+	Enabled   bool            `json:"enabled"`
+	Target    string          `json:"target,omitempty"`
+	Databases []ReplicaStatus `json:"databases"`
+}
+
+// ReconcileReport is the result of checking users against vault files.
+type ReconcileReport struct {
+	RanAt        time.Time        `json:"ran_at"`
+	Trigger      string           `json:"trigger"` // startup | manual
+	DryRun       bool             `json:"dry_run"`
+	UsersChecked int              `json:"users_checked"`
+	Issues       []ReconcileIssue `json:"issues"`
+}
+
+// ReconcileIssue is one vault that didn't match its user (or had none).
+type ReconcileIssue struct {
+	Kind     string `json:"kind"` // missing_vault | stray_vault | invalid_path
+	File     string `json:"file"`
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Action   string `json:"action"` // recreated | restored_from_quarantine | quarantined | reported | none
+	MovedTo  string `json:"moved_to,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Session is a signed-in device. Its id is the jti of the device's token.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	DeviceName string    `json:"device_name"`
+	ClientType string    `json:"client_type"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// JWTKeyInfo describes a token signing key without its secret.
+type JWTKeyInfo struct {
+	KID         string     `json:"kid"`
+	Alg         string     `json:"alg"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RetiredAt   *time.Time `json:"retired_at"`
+	VerifyUntil *time.Time `json:"verify_until"`
+	Active      bool       `json:"active"`
+}
+
+// JWKSet is a JSON Web Key Set (RFC 7517) of public verification keys.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	KID string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ActorID   int       `json:"actor_id,omitempty"` // 0 for unauthenticated requests
+	Actor     string    `json:"actor,omitempty"`
+	UserID    int       `json:"user_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+// LoginThrottleEntry is a failure counter for a username or client IP.
+type LoginThrottleEntry struct {
+	Scope        string     `json:"scope"` // user or ip
+	Key          string     `json:"key"`
+	Failures     int        `json:"failures"`
+	LastFailure  time.Time  `json:"last_failure"`
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+}
+
+// RecoveryStatus describes a user's escrowed keys and the server policy.
+type RecoveryStatus struct {
+	CodeEscrow         bool   `json:"code_escrow"`
+	AdminEscrow        bool   `json:"admin_escrow"`
+	AdminEscrowCurrent bool   `json:"admin_escrow_current"` // wrapped to the current admin key
+	AdminRecovery      string `json:"admin_recovery"`       // off, optional, required
+	AdminPublicKey     string `json:"admin_public_key,omitempty"`
+	AdminKeyID         string `json:"admin_key_id,omitempty"`
+}
+
+// RecoveryEscrowRequest stores (or, for DELETE, removes) an escrowed copy of
+// the master key. WrappedKey is opaque to the server.
+type RecoveryEscrowRequest struct {
+	AuthHash   string `json:"auth_hash"`
+	Password   string `json:"password,omitempty"`
+	WrappedKey string `json:"wrapped_key,omitempty"`
+	// Code escrow: derived from the recovery code alongside the wrapping key
+	Verifier string `json:"verifier,omitempty"`
+	// Admin escrow: the admin key the master key was wrapped to
+	KeyID string `json:"key_id,omitempty"`
+}
+
+type RecoveryCodeRequest struct {
+	Username string `json:"username"`
+	Verifier string `json:"verifier"`
+}
+
+// RecoveryGrant lets a client unwrap its master key and, with RecoveryToken,
+// fetch the vault and set a new password.
+type RecoveryGrant struct {
+	RecoveryToken string `json:"recovery_token"`
+	WrappedKey    string `json:"wrapped_key"`
+	ExpiresIn     int64  `json:"expires_in"`
+}
+
+// CreateRecoveryRequest asks an admin for recovery. PublicKey is an
+// ephemeral key the admin re-wraps the master key to.
+type CreateRecoveryRequest struct {
+	Username  string `json:"username"`
+	PublicKey string `json:"public_key"`
+}
+
+type RecoveryRequestCreated struct {
+	RequestID    string `json:"request_id"`
+	RequestToken string `json:"request_token"`
+}
+
+type RecoveryRequestStatusRequest struct {
+	RequestToken string `json:"request_token"`
+}
+
+type RecoveryRequestStatus struct {
+	Status string `json:"status"` // PENDING, APPROVED, DENIED, COMPLETED, CANCELLED, EXPIRED
+	*RecoveryGrant
+}
+
+// AdminRecoveryRequest is a pending request together with the user's admin
+// escrow, which the admin unwraps and re-wraps to PublicKey client-side.
+type AdminRecoveryRequest struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	Kind       string    `json:"kind"`
+	Status     string    `json:"status"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	WrappedKey string    `json:"escrow_wrapped_key,omitempty"`
+	KeyID      string    `json:"escrow_key_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Where the request was filed from, to tell the user's own apart
+	CreatedIP        string     `json:"created_ip"`
+	CreatedUserAgent string     `json:"created_user_agent"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	DecidedBy        int        `json:"decided_by,omitempty"`
+	DecidedAt        *time.Time `json:"decided_at,omitempty"`
+}
+
+type ApproveRecoveryRequest struct {
+	WrappedKey string `json:"wrapped_key"`
+}
+
+type RecoveryTokenRequest struct {
+	RecoveryToken string `json:"recovery_token"`
+}
+
+// RecoveryVaultResponse is what a recovering client re-encrypts.
+type RecoveryVaultResponse struct {
+	Salt string `json:"salt"`
+	KDFParams
+	Cursor      int64             `json:"cursor"`
+	Items       []VaultRekeyItem  `json:"items"`
+	Trash       []VaultRekeyItem  `json:"trash"`
+	Attachments []AttachmentRekey `json:"attachments"`
+}
+
+type CompleteRecoveryRequest struct {
+	RecoveryToken string `json:"recovery_token"`
+	NewAuthHash   string `json:"new_auth_hash"`
+	Salt          string `json:"salt"`
+	KDFParams
+	Vault VaultRekey `json:"vault"`
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// --- Storage Quotas ---
+//
+// Limits come from server_settings (quota_*_default) and can be overridden per
+// user on the users row. A user value of 0 inherits the default, -1 means
+// unlimited. A default of 0 means unlimited.
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// getVaultQuota returns the effective limits for a user (0 = unlimited).
+func (s *Server) getVaultQuota(userID int) VaultQuota {
+	q := VaultQuota{
+		MaxItems:     s.getSettingInt64("quota_max_items_default"),
+		MaxBytes:     s.getSettingInt64("quota_max_bytes_default"),
+		MaxBlobBytes: s.getSettingInt64("quota_max_blob_bytes_default"),
+	}
+
+	var items, bytes, blob int64
+	err := s.systemDB.QueryRow("SELECT quota_max_items, quota_max_bytes, quota_max_blob_bytes FROM users WHERE id = ?", userID).
+		Scan(&items, &bytes, &blob)
+	if err != nil {
+		return q
+	}
+	q.MaxItems = applyQuotaOverride(q.MaxItems, items)
+	q.MaxBytes = applyQuotaOverride(q.MaxBytes, bytes)
+	q.MaxBlobBytes = applyQuotaOverride(q.MaxBlobBytes, blob)
+	return q
+}
+
+func applyQuotaOverride(def, override int64) int64 {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	default:
+		return def
+	}
+}
+
+// queryVaultUsage counts live items and the bytes stored for the vault: live
+// items, their history, the trash and attachments.
+func queryVaultUsage(q queryRower) (VaultUsage, error) {
+	var u VaultUsage
+	err := q.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM vault_items),
+			(SELECT COALESCE(SUM(LENGTH(encrypted_blob)), 0) FROM vault_items) +
+			(SELECT COALESCE(SUM(LENGTH(encrypted_blob)), 0) FROM vault_item_history) +
+			(SELECT COALESCE(SUM(LENGTH(encrypted_blob)), 0) FROM vault_trash) +
+			(SELECT COALESCE(SUM(size), 0) FROM vault_attachments)
+	`).Scan(&u.Items, &u.Bytes)
+	return u, err
+}
+
+// checkBlob rejects a single blob above the per-blob limit.
+func (q VaultQuota) checkBlob(size int64, usage VaultUsage) *QuotaError {
+	if q.MaxBlobBytes > 0 && size > q.MaxBlobBytes {
+		return &QuotaError{Error: "quota_exceeded", Quota: "max_blob_bytes", Limit: q.MaxBlobBytes, Usage: usage, Limits: q}
+	}
+	return nil
+}
+
+// checkUsage rejects a write that leaves the vault over a limit. Writes that
+// don't grow usage are allowed even when already over (e.g. after an admin
+// lowered the quota), so users can always delete their way back under it.
+func (q VaultQuota) checkUsage(before, after VaultUsage) *QuotaError {
+	if q.MaxItems > 0 && after.Items > q.MaxItems && after.Items > before.Items {
+		return &QuotaError{Error: "quota_exceeded", Quota: "max_items", Limit: q.MaxItems, Usage: before, Limits: q}
+	}
+	if q.MaxBytes > 0 && after.Bytes > q.MaxBytes && after.Bytes > before.Bytes {
+		return &QuotaError{Error: "quota_exceeded", Quota: "max_bytes", Limit: q.MaxBytes, Usage: before, Limits: q}
+	}
+	return nil
+}
+
+// writeQuotaError sends 413 for an oversized blob and 507 for exhausted storage.
+func writeQuotaError(w http.ResponseWriter, qe *QuotaError) {
+	status := http.StatusInsufficientStorage
+	if qe.Quota == "max_blob_bytes" {
+		status = http.StatusRequestEntityTooLarge
+	}
+	writeJSON(w, status, qe)
+}
+
+func (s *Server) handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	db, err := s.getUserDB(r.Context())
+	if err != nil {
+		http.Error(w, "Storage access failed", http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := queryVaultUsage(db)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, VaultUsageResponse{Usage: usage, Limits: s.getVaultQuota(userID)})
+}
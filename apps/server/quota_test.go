@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// quotaError checks the status of a rejected write and decodes its body.
+func quotaError(t *testing.T, w *httptest.ResponseRecorder, status int) QuotaError {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d %s, want %d", w.Code, w.Body, status)
+	}
+	var qe QuotaError
+	if err := json.Unmarshal(w.Body.Bytes(), &qe); err != nil {
+		t.Fatal(err)
+	}
+	if qe.Error != "quota_exceeded" {
+		t.Fatalf("error %q, want quota_exceeded", qe.Error)
+	}
+	return qe
+}
+
+// TestQuotaBlobSize checks that a blob above max_blob_bytes is refused with
+// 413 and a body naming the limit.
+func TestQuotaBlobSize(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "admin")
+	userID := addTestUser(t, s, "alice")
+	if w := updateUser(t, s, userID, map[string]any{"quota_max_blob_bytes": 8}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "12345678"}}))
+	qe := quotaError(t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "b", EncryptedBlob: "123456789"}}), http.StatusRequestEntityTooLarge)
+	if qe.Quota != "max_blob_bytes" || qe.Limit != 8 || qe.Limits.MaxBlobBytes != 8 || qe.Usage.Items != 1 {
+		t.Fatalf("quota error = %+v", qe)
+	}
+}
+
+// TestQuotaItems checks that the item limit stops new items but not edits or
+// deletes, and that -1 lifts the server default for one user.
+func TestQuotaItems(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "admin")
+	alice, bob := addTestUser(t, s, "alice"), addTestUser(t, s, "bob")
+	if _, err := s.systemDB.Exec("INSERT OR REPLACE INTO server_settings (key, value) VALUES ('quota_max_items_default', '2')"); err != nil {
+		t.Fatal(err)
+	}
+	if w := updateUser(t, s, bob, map[string]any{"quota_max_items": -1}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "a", EncryptedBlob: "a1"}, {ID: "b", EncryptedBlob: "b1"}}))
+	qe := quotaError(t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "c", EncryptedBlob: "c1"}}), http.StatusInsufficientStorage)
+	if qe.Quota != "max_items" || qe.Limit != 2 || qe.Usage.Items != 2 {
+		t.Fatalf("quota error = %+v", qe)
+	}
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "a", EncryptedBlob: "a2", Revision: 1}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "b", Revision: 1}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "c", EncryptedBlob: "c1"}}))
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, bob, []VaultItem{
+		{ID: "a", EncryptedBlob: "a1"}, {ID: "b", EncryptedBlob: "b1"}, {ID: "c", EncryptedBlob: "c1"},
+	}))
+	usage := decode[VaultUsageResponse](t, get(t, s.handleGetUsage, bob, "/vault/usage"))
+	if usage.Usage.Items != 3 || usage.Limits.MaxItems != 0 {
+		t.Fatalf("bob's usage = %+v, want 3 items and no limit", usage)
+	}
+}
+
+// TestQuotaBytesCountHistory checks that archived revisions count towards
+// max_bytes, so edits can't grow a vault past it through its history.
+func TestQuotaBytesCountHistory(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "admin")
+	userID := addTestUser(t, s, "alice")
+	if w := updateUser(t, s, userID, map[string]any{"quota_max_bytes": 25}); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "0123456789"}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "abcdefghij", Revision: 1}}))
+	qe := quotaError(t, call(t, s.handleUpsertItems, userID, []VaultItem{{ID: "a", EncryptedBlob: "ABCDEFGHIJ", Revision: 2}}), http.StatusInsufficientStorage)
+	if qe.Quota != "max_bytes" || qe.Usage.Bytes != 20 {
+		t.Fatalf("quota error = %+v, want max_bytes at 20 bytes used", qe)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Vault Reconciliation ---
+//
+// Every users row should have a vault file in DataDir, and every vault file
+// should belong to a user. reconcileVaults looks for exceptions. A missing
+// vault is moved back from quarantine if it is there. Otherwise it is only
+// reported, so a lost vault isn't papered over with an empty one; an admin
+// can have it recreated empty (to restore the user from a backup, say) by
+// asking for that explicitly. A vault that belongs to nobody, such as one left by a registration
+// that crashed before committing, is moved to DataDir/quarantine together
+// with its WAL and attachments. Nothing is deleted.
+
+const quarantineDirName = "quarantine"
+
+// vaultFiles lists a vault database and its WAL companions.
+func vaultFiles(path string) []string {
+	return []string{path, path + "-wal", path + "-shm"}
+}
+
+// removeVaultFiles deletes a vault that was never committed to a user.
+func removeVaultFiles(path string) {
+	for _, f := range vaultFiles(path) {
+		os.Remove(f)
+	}
+}
+
+// moveVault renames a vault, its WAL companions and its attachments directory
+// from srcDir/name to dstDir/dstName.
+func moveVault(srcDir, name, dstDir, dstName string) error {
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+	src, dst := vaultFiles(filepath.Join(srcDir, name)), vaultFiles(filepath.Join(dstDir, dstName))
+	for i := range src {
+		if err := os.Rename(src[i], dst[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Rename(attachmentDirFor(srcDir, name), attachmentDirFor(dstDir, dstName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// dropUserDB closes and forgets the cached connection for a vault file.
+func (s *Server) dropUserDB(fullPath string) {
+	if cached, ok := s.userDBs.LoadAndDelete(fullPath); ok {
+		cached.(*sql.DB).Close()
+	}
+}
+
+// reconcileVaults checks users against the vault files in DataDir. With
+// dryRun it only reports what it would do; recreateMissing creates empty
+// vaults for missing ones that aren't in quarantine.
+func (s *Server) reconcileVaults(trigger string, dryRun, recreateMissing bool) (*ReconcileReport, error) {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+
+	report := &ReconcileReport{RanAt: time.Now().UTC(), Trigger: trigger, DryRun: dryRun, Issues: []ReconcileIssue{}}
+
+	type userVault struct {
+		id       int
+		username string
+		path     string
+	}
+	rows, err := s.systemDB.Query("SELECT id, username, db_path FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var users []userVault
+	for rows.Next() {
+		var u userVault
+		if err := rows.Scan(&u.id, &u.username, &u.path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	report.UsersChecked = len(users)
+
+	dataDir := s.config.DataDir
+	quarantine := filepath.Join(dataDir, quarantineDirName)
+	owned := map[string]bool{"system.db": true}
+
+	for _, u := range users {
+		owned[u.path] = true
+		issue := ReconcileIssue{Kind: "missing_vault", File: u.path, UserID: u.id, Username: u.username}
+
+		if !isPlainFilename(u.path) || !strings.HasSuffix(u.path, ".db") {
+			issue.Kind, issue.Action = "invalid_path", "none"
+			report.Issues = append(report.Issues, issue)
+			continue
+		}
+		fullPath := filepath.Join(dataDir, u.path)
+		if _, err := os.Stat(fullPath); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			issue.Action, issue.Error = "none", err.Error()
+			report.Issues = append(report.Issues, issue)
+			continue
+		}
+
+		issue.Action = "reported"
+		if _, err := os.Stat(filepath.Join(quarantine, u.path)); err == nil {
+			issue.Action = "restored_from_quarantine"
+		} else if recreateMissing {
+			issue.Action = "recreated"
+		}
+		if !dryRun && issue.Action != "reported" {
+			// A connection cached before the file vanished points at a deleted inode
+			s.dropUserDB(fullPath)
+			if issue.Action == "restored_from_quarantine" {
+				err = moveVault(quarantine, u.path, dataDir, u.path)
+			} else {
+				err = initUserDB(fullPath)
+			}
+			if err != nil {
+				issue.Error = err.Error()
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasSuffix(name, ".db") || owned[name] {
+			continue
+		}
+
+		issue := ReconcileIssue{Kind: "stray_vault", File: name, Action: "quarantined"}
+		dstName := name
+		if _, err := os.Stat(filepath.Join(quarantine, name)); err == nil {
+			dstName = fmt.Sprintf("%s-%s.db", strings.TrimSuffix(name, ".db"), report.RanAt.Format("20060102T150405Z"))
+		}
+		issue.MovedTo = filepath.Join(quarantineDirName, dstName)
+		if !dryRun {
+			s.dropUserDB(filepath.Join(dataDir, name))
+			if err := moveVault(dataDir, name, quarantine, dstName); err != nil {
+				issue.Error = err.Error()
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for _, issue := range report.Issues {
+		msg := fmt.Sprintf("reconcileVaults: %s %s: %s", issue.Kind, issue.File, issue.Action)
+		if dryRun {
+			msg += " (dry run)"
+		}
+		if issue.Error != "" {
+			msg += " failed: " + issue.Error
+		}
+		s.logger.Println(msg)
+	}
+
+	if !dryRun {
+		s.lastReconcile.Store(report)
+	}
+	return report, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// issueFor returns the report's issue about file.
+func issueFor(t *testing.T, report *ReconcileReport, file string) ReconcileIssue {
+	t.Helper()
+	for _, issue := range report.Issues {
+		if issue.File == file {
+			return issue
+		}
+	}
+	t.Fatalf("no issue for %s in %+v", file, report.Issues)
+	return ReconcileIssue{}
+}
+
+// TestReconcileVaults checks that a missing vault is only reported, that a
+// stray one is quarantined with its attachments, and that a dry run changes
+// nothing.
+func TestReconcileVaults(t *testing.T) {
+	s := newTestServer(t)
+	alice := addTestUser(t, s, "alice")
+	addTestUser(t, s, "bob")
+	dataDir := s.config.DataDir
+	if err := os.Remove(filepath.Join(dataDir, "alice.db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := initUserDB(filepath.Join(dataDir, "orphan.db")); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(attachmentDirFor(dataDir, "orphan.db"), 0700)
+
+	report, err := s.reconcileVaults("manual", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UsersChecked != 2 || len(report.Issues) != 2 || s.lastReconcile.Load() != nil {
+		t.Fatalf("dry run report = %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "orphan.db")); err != nil {
+		t.Fatalf("dry run moved the stray vault: %v", err)
+	}
+
+	report, err = s.reconcileVaults("manual", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue := issueFor(t, report, "alice.db"); issue.Kind != "missing_vault" || issue.Action != "reported" || issue.UserID != alice {
+		t.Fatalf("alice = %+v", issue)
+	}
+	if issue := issueFor(t, report, "orphan.db"); issue.Kind != "stray_vault" || issue.Action != "quarantined" || issue.Error != "" {
+		t.Fatalf("orphan = %+v", issue)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "alice.db")); !os.IsNotExist(err) {
+		t.Fatalf("missing vault was created: %v", err)
+	}
+	if _, err := s.openUserDB("alice.db"); err != errVaultMissing {
+		t.Fatalf("open missing vault: %v, want errVaultMissing", err)
+	}
+	quarantine := filepath.Join(dataDir, quarantineDirName)
+	for _, p := range []string{filepath.Join(quarantine, "orphan.db"), attachmentDirFor(quarantine, "orphan.db")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("not quarantined: %v", err)
+		}
+	}
+	if s.lastReconcile.Load() != report {
+		t.Fatal("report not kept for GET /api/admin/reconcile")
+	}
+
+	// A quarantined vault of a user with a missing one is moved back
+	if err := os.Rename(filepath.Join(quarantine, "orphan.db"), filepath.Join(quarantine, "alice.db")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = s.reconcileVaults("manual", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue := issueFor(t, report, "alice.db"); issue.Action != "restored_from_quarantine" || issue.Error != "" {
+		t.Fatalf("alice = %+v", issue)
+	}
+	if _, err := s.openUserDB("alice.db"); err != nil {
+		t.Fatalf("open restored vault: %v", err)
+	}
+}
+
+// TestReconcileRecreateMissing checks that only an explicit admin request
+// recreates a missing vault, that it is audited, and that a connection cached
+// before the file vanished isn't reused.
+func TestReconcileRecreateMissing(t *testing.T) {
+	s := newTestServer(t)
+	admin := addTestUser(t, s, "admin")
+	alice := addTestUser(t, s, "alice")
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "a", EncryptedBlob: "blob"}}))
+	for _, f := range vaultFiles(filepath.Join(s.config.DataDir, "alice.db")) {
+		os.Remove(f)
+	}
+
+	reconcile := func(query string) *ReconcileReport {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/"+query, nil)
+		r = r.WithContext(context.WithValue(r.Context(), userIDKey, admin))
+		w := httptest.NewRecorder()
+		s.handleReconcile(w, r)
+		report := decode[ReconcileReport](t, w)
+		return &report
+	}
+
+	if issue := issueFor(t, reconcile(""), "alice.db"); issue.Action != "reported" {
+		t.Fatalf("without recreate_missing: %+v", issue)
+	}
+	if issue := issueFor(t, reconcile("?recreate_missing=true&dry_run=true"), "alice.db"); issue.Action != "recreated" {
+		t.Fatalf("dry run: %+v", issue)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.DataDir, "alice.db")); !os.IsNotExist(err) {
+		t.Fatalf("dry run created the vault: %v", err)
+	}
+	if issue := issueFor(t, reconcile("?recreate_missing=true"), "alice.db"); issue.Action != "recreated" || issue.Error != "" {
+		t.Fatalf("recreate: %+v", issue)
+	}
+
+	var audited int
+	s.systemDB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'vault.recreated' AND user_id = ?", alice).Scan(&audited)
+	if audited != 1 {
+		t.Fatalf("%d vault.recreated audit entries, want 1", audited)
+	}
+
+	resp := decode[VaultChangesResponse](t, get(t, s.handleListChanges, alice, "/vault/changes"))
+	if len(resp.Items) != 0 {
+		t.Fatalf("recreated vault has %d items", len(resp.Items))
+	}
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "b", EncryptedBlob: "blob"}}))
+	if n := countItems(t, filepath.Join(s.config.DataDir, "alice.db")); n != 1 {
+		t.Fatalf("write went to a stale connection: file has %d items, want 1", n)
+	}
+}
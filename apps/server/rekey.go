@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// --- Vault Re-keying ---
+//
+// Vault blobs are encrypted with the master key, so changing the password,
+// salt or KDF parameters means the client re-encrypts everything and uploads
+// it in one request. The server swaps it in atomically and only if nothing
+// changed since the client read the vault.
+
+var errVaultChanged = errors.New("vault changed since the re-key was prepared")
+
+// rekeyMismatchError is a re-key that doesn't cover the vault exactly.
+type rekeyMismatchError struct{ msg string }
+
+func (e rekeyMismatchError) Error() string { return e.msg }
+
+// rekeyVault writes a complete re-encryption of the vault and returns the new
+// cursor. Re-encrypted items get a new revision and seq so other devices pick
+// them up. History is dropped: old revisions stay under the old key.
+func rekeyVault(tx *sql.Tx, rk VaultRekey) (int64, error) {
+	var cursor int64
+	if err := tx.QueryRow("SELECT value FROM vault_meta WHERE key = 'last_seq'").Scan(&cursor); err != nil {
+		return 0, err
+	}
+	if cursor != rk.Cursor {
+		return 0, errVaultChanged
+	}
+
+	items := make(map[string]string, len(rk.Items))
+	for _, it := range rk.Items {
+		items[it.ID] = it.EncryptedBlob
+	}
+	trash := make(map[string]string, len(rk.Trash))
+	for _, it := range rk.Trash {
+		trash[it.ID] = it.EncryptedBlob
+	}
+	names := make(map[string]string, len(rk.Attachments))
+	for _, a := range rk.Attachments {
+		names[a.ID] = a.EncryptedName
+	}
+	if err := matchRekeySet(tx, "SELECT id FROM vault_items", "items", items, len(rk.Items), true); err != nil {
+		return 0, err
+	}
+	if err := matchRekeySet(tx, "SELECT id FROM vault_trash", "trash", trash, len(rk.Trash), true); err != nil {
+		return 0, err
+	}
+	if err := matchRekeySet(tx, "SELECT id FROM vault_attachments", "attachments", names, len(rk.Attachments), false); err != nil {
+		return 0, err
+	}
+
+	for id, blob := range items {
+		seq, err := nextVaultSeq(tx)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE vault_items SET encrypted_blob = ?, revision = revision + 1, updated_at = CURRENT_TIMESTAMP, seq = ? WHERE id = ?", blob, seq, id)
+		if err != nil {
+			return 0, err
+		}
+		cursor = seq
+	}
+	for id, blob := range trash {
+		if _, err := tx.Exec("UPDATE vault_trash SET encrypted_blob = ? WHERE id = ?", blob, id); err != nil {
+			return 0, err
+		}
+	}
+	for id, name := range names {
+		if _, err := tx.Exec("UPDATE vault_attachments SET encrypted_name = ? WHERE id = ?", name, id); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM vault_item_history"); err != nil {
+		return 0, err
+	}
+	return cursor, nil
+}
+
+// matchRekeySet checks that given (built from n entries) has exactly the ids
+// the query returns, with no duplicates and, if required, no empty values.
+func matchRekeySet(tx *sql.Tx, query, what string, given map[string]string, n int, required bool) error {
+	if len(given) != n {
+		return rekeyMismatchError{"duplicate id in " + what}
+	}
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	stored := 0
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		v, ok := given[id]
+		if !ok {
+			return errVaultChanged
+		}
+		if required && strings.TrimSpace(v) == "" {
+			return rekeyMismatchError{fmt.Sprintf("%s %s has no encrypted_blob", what, id)}
+		}
+		stored++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if stored != len(given) {
+		return errVaultChanged
+	}
+	return nil
+}
+
+// maxRekeyBodyBytes caps a request carrying a re-encrypted vault, the same as
+// an upsert batch.
+const maxRekeyBodyBytes = maxUpsertBodyBytes
+
+// decodeRekeyRequest decodes a request carrying a re-encrypted vault. It
+// writes a 413 or 400 and returns false when the body is too large or
+// malformed.
+func decodeRekeyRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRekeyBodyBytes)).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+	} else {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}
+	return false
+}
+
+// checkRekeyQuota applies the per-blob limit to re-encrypted items. Total
+// usage isn't checked: re-encryption doesn't meaningfully change it.
+func (s *Server) checkRekeyQuota(userID int, rk VaultRekey) *QuotaError {
+	quota := s.getVaultQuota(userID)
+	for _, it := range rk.Items {
+		if qe := quota.checkBlob(int64(len(it.EncryptedBlob)), VaultUsage{}); qe != nil {
+			return qe
+		}
+	}
+	return nil
+}
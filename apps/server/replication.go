@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- WAL Replication ---
+//
+// Every database is replicated as a series of generations. A generation is a
+// gzipped copy of the DB file taken right after a TRUNCATE checkpoint, followed
+// by segments of committed WAL frames shipped as they appear:
+//
+//	<db>/<generation>/generation.json
+//	<db>/<generation>/snapshot.db.gz
+//	<db>/<generation>/wal/<seq>-<unix ms>.frames
+//
+// Replaying a snapshot plus the segments shipped before a timestamp gives the
+// database as of that time. Segments are named by the time they were shipped,
+// not by when their transactions committed, so a restore point is accurate to
+// about replicaSyncInterval. While replication runs, SQLite's automatic
+// checkpoints are disabled and only the replicator resets the WAL, after it
+// has shipped everything, so no frame is lost between two syncs.
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagicLE         = 0x377f0682
+	walMagicBE         = 0x377f0683
+
+	replicaSyncInterval        = time.Second
+	replicaCheckpointInterval  = time.Minute
+	replicaCheckpointWALBytes  = 4 << 20
+	defaultReplicaSnapshotHrs  = 24
+	defaultReplicaRetentionHrs = 72
+)
+
+// ReplicaTarget stores replica files under slash-separated names.
+type ReplicaTarget interface {
+	Put(ctx context.Context, name string, r io.Reader) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the direct children of dir, sorted.
+	List(ctx context.Context, dir string) ([]string, error)
+	DeleteAll(ctx context.Context, dir string) error
+	String() string
+}
+
+type localReplicaTarget struct {
+	dir string
+}
+
+func (t localReplicaTarget) path(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+func (t localReplicaTarget) Put(ctx context.Context, name string, r io.Reader) error {
+	final := t.path(name)
+	if err := os.MkdirAll(filepath.Dir(final), 0700); err != nil {
+		return err
+	}
+	tmp := final + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, final)
+}
+
+func (t localReplicaTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(t.path(name))
+}
+
+func (t localReplicaTarget) List(ctx context.Context, dir string) ([]string, error) {
+	entries, err := os.ReadDir(t.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".tmp") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t localReplicaTarget) DeleteAll(ctx context.Context, dir string) error {
+	return os.RemoveAll(t.path(dir))
+}
+
+func (t localReplicaTarget) String() string {
+	return t.dir
+}
+
+// replicaGeneration is stored as generation.json.
+type replicaGeneration struct {
+	Database  string    `json:"database"`
+	CreatedAt time.Time `json:"created_at"`
+	PageSize  int       `json:"page_size"`
+}
+
+// replicaState tracks how much of one database's WAL has been shipped.
+// mu is held while the database is synced or checkpointed; db and progress
+// are guarded by Replicator.mu instead, so Status never waits for an upload.
+type replicaState struct {
+	mu sync.Mutex
+
+	name string // file name in the data dir, also the replica prefix
+	path string
+	db   *sql.DB
+
+	generation string
+	snapshotAt time.Time
+	pageSize   int
+	bigEndian  bool
+	salt       [2]uint32
+	cksum      [2]uint32
+	walOffset  int64 // bytes of the WAL already shipped; 0 = header not read yet
+	seq        uint64
+
+	lastSyncAt     time.Time
+	lastShippedAt  time.Time
+	lastCheckpoint time.Time
+	pendingBytes   int64
+	pendingSince   time.Time
+	lastErr        string
+
+	progress ReplicaStatus
+	lagSince time.Time // pendingSince as of the last publish
+}
+
+type Replicator struct {
+	server *Server
+	target ReplicaTarget
+
+	mu   sync.Mutex // guards dbs and each state's db and progress
+	dbs  map[string]*replicaState
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReplicator(s *Server, target ReplicaTarget) *Replicator {
+	return &Replicator{
+		server: s,
+		target: target,
+		dbs:    map[string]*replicaState{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Run ships WAL frames every replicaSyncInterval until Stop is called.
+func (r *Replicator) Run() {
+	defer close(r.done)
+
+	r.server.forEachUserVault(func(int, string, *sql.DB) {}) // open every vault so all get a generation
+	discover := time.NewTicker(time.Minute)
+	defer discover.Stop()
+	ticker := time.NewTicker(replicaSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		r.syncAll()
+		select {
+		case <-ticker.C:
+		case <-discover.C:
+			r.server.forEachUserVault(func(int, string, *sql.DB) {})
+		case <-r.stop:
+			r.syncAll()
+			return
+		}
+	}
+}
+
+// Stop ends Run after a final sync.
+func (r *Replicator) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// databases returns the state of system.db and every open user DB.
+func (r *Replicator) databases() []*replicaState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	add := func(name, fullPath string, db *sql.DB) {
+		if st, ok := r.dbs[name]; ok {
+			st.db = db
+			return
+		}
+		r.dbs[name] = &replicaState{name: name, path: fullPath, db: db}
+	}
+	add("system.db", filepath.Join(r.server.config.DataDir, "system.db"), r.server.systemDB)
+	r.server.userDBs.Range(func(key, value any) bool {
+		if db, ok := value.(*sql.DB); ok {
+			add(filepath.Base(key.(string)), key.(string), db)
+		}
+		return true
+	})
+
+	states := make([]*replicaState, 0, len(r.dbs))
+	for _, st := range r.dbs {
+		states = append(states, st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].name < states[j].name })
+	return states
+}
+
+func (r *Replicator) syncAll() {
+	snapshotEvery := time.Duration(r.server.getSettingInt("replica_snapshot_interval_hours", defaultReplicaSnapshotHrs)) * time.Hour
+
+	for _, st := range r.databases() {
+		st.mu.Lock()
+		err := r.syncDB(st, snapshotEvery)
+		if err != nil {
+			st.lastErr = err.Error()
+		} else {
+			st.lastErr = ""
+		}
+		r.publish(st)
+		st.mu.Unlock()
+		if err != nil {
+			r.server.logger.Printf("replication: %s: %v", st.name, err)
+		}
+	}
+}
+
+// publish copies the progress of a database for Status. Callers hold st.mu.
+func (r *Replicator) publish(st *replicaState) {
+	p := ReplicaStatus{
+		Database:     st.name,
+		Generation:   st.generation,
+		ShippedBytes: st.walOffset,
+		PendingBytes: st.pendingBytes,
+		Error:        st.lastErr,
+	}
+	if !st.snapshotAt.IsZero() {
+		t := st.snapshotAt
+		p.SnapshotAt = &t
+	}
+	if !st.lastSyncAt.IsZero() {
+		t := st.lastSyncAt.UTC()
+		p.LastSyncAt = &t
+	}
+	if !st.lastShippedAt.IsZero() {
+		t := st.lastShippedAt.UTC()
+		p.LastShippedAt = &t
+	}
+
+	r.mu.Lock()
+	st.progress = p
+	st.lagSince = st.pendingSince
+	r.mu.Unlock()
+}
+
+// conn takes the connection of a database; the DB can be swapped by
+// databases while a sync runs.
+func (r *Replicator) conn(ctx context.Context, st *replicaState) (*sql.Conn, error) {
+	r.mu.Lock()
+	db := st.db
+	r.mu.Unlock()
+	return db.Conn(ctx)
+}
+
+// syncDB ships new frames of one database, checkpoints a large or idle WAL
+// and rolls over to a new generation when due. Callers hold st.mu.
+func (r *Replicator) syncDB(st *replicaState, snapshotEvery time.Duration) error {
+	ctx := context.Background()
+
+	if st.generation == "" || time.Since(st.snapshotAt) > snapshotEvery {
+		if err := r.startGeneration(ctx, st); err != nil {
+			return err
+		}
+		r.applyRetention(ctx, st)
+	}
+
+	restarted, err := r.shipFrames(ctx, st)
+	if err != nil {
+		return err
+	}
+	if restarted {
+		// Someone else reset the WAL; frames may be missing from this generation.
+		st.generation = ""
+		return r.syncDB(st, snapshotEvery)
+	}
+
+	if st.walOffset >= replicaCheckpointWALBytes || (st.walOffset > 0 && time.Since(st.lastCheckpoint) > replicaCheckpointInterval) {
+		return r.checkpoint(ctx, st)
+	}
+	return nil
+}
+
+// checkpoint ships the remaining frames and truncates the WAL while holding
+// the database's only connection, so nothing commits in between.
+func (r *Replicator) checkpoint(ctx context.Context, st *replicaState) error {
+	conn, err := r.conn(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := r.shipFrames(ctx, st); err != nil {
+		return err
+	}
+
+	var busy, logFrames, checkpointed int
+	if err := conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	st.lastCheckpoint = time.Now()
+	if busy == 0 {
+		st.walOffset = 0 // the next write starts a fresh WAL with new salts
+	}
+	return nil
+}
+
+// startGeneration checkpoints the database and uploads a copy of the file as
+// the base of a new generation.
+func (r *Replicator) startGeneration(ctx context.Context, st *replicaState) error {
+	conn, err := r.conn(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var busy, logFrames, checkpointed int
+	if err := conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return errors.New("checkpoint busy, snapshot postponed")
+	}
+	var pageSize int
+	if err := conn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	gen := fmt.Sprintf("%016x", now.UnixNano())
+	prefix := path.Join(st.name, gen)
+
+	f, err := os.Open(st.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, f)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	if err := r.target.Put(ctx, path.Join(prefix, "snapshot.db.gz"), pr); err != nil {
+		return err
+	}
+
+	meta, _ := json.Marshal(replicaGeneration{Database: st.name, CreatedAt: now, PageSize: pageSize})
+	if err := r.target.Put(ctx, path.Join(prefix, "generation.json"), bytes.NewReader(meta)); err != nil {
+		return err
+	}
+
+	st.generation = gen
+	st.snapshotAt = now
+	st.pageSize = pageSize
+	st.walOffset = 0
+	st.seq = 0
+	st.lastCheckpoint = time.Now()
+	r.server.logger.Printf("replication: %s: started generation %s", st.name, gen)
+	return nil
+}
+
+// shipFrames uploads the committed frames appended to the WAL since the last
+// sync. It reports restarted=true if the WAL no longer matches what was
+// shipped (different salts), which means frames may have been lost.
+func (r *Replicator) shipFrames(ctx context.Context, st *replicaState) (restarted bool, err error) {
+	now := time.Now()
+	st.lastSyncAt = now
+
+	f, err := os.Open(st.path + "-wal")
+	if os.IsNotExist(err) {
+		st.pendingBytes = 0
+		return st.walOffset > 0, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() < walHeaderSize {
+		st.pendingBytes = 0
+		return st.walOffset > 0, nil
+	}
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, err
+	}
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic != walMagicLE && magic != walMagicBE {
+		return false, fmt.Errorf("bad WAL magic %#x", magic)
+	}
+	salt := [2]uint32{binary.BigEndian.Uint32(header[16:20]), binary.BigEndian.Uint32(header[20:24])}
+
+	if st.walOffset == 0 {
+		bigEndian := magic == walMagicBE
+		sum := walChecksum(bigEndian, [2]uint32{}, header[:24])
+		if sum != [2]uint32{binary.BigEndian.Uint32(header[24:28]), binary.BigEndian.Uint32(header[28:32])} {
+			st.pendingBytes = 0
+			return false, nil // header being written
+		}
+		if int(binary.BigEndian.Uint32(header[8:12])) != st.pageSize {
+			return false, fmt.Errorf("WAL page size %d differs from generation", binary.BigEndian.Uint32(header[8:12]))
+		}
+		st.bigEndian = bigEndian
+		st.salt = salt
+		st.cksum = sum
+		st.walOffset = walHeaderSize
+	} else if salt != st.salt {
+		return true, nil
+	}
+
+	frameSize := int64(walFrameHeaderSize + st.pageSize)
+	if _, err := f.Seek(st.walOffset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	// Walk the checksum chain; only ship up to the last valid commit frame.
+	var batch bytes.Buffer
+	frame := make([]byte, frameSize)
+	cksum := st.cksum
+	committedLen, committedCksum := 0, st.cksum
+	for offset := st.walOffset; offset+frameSize <= info.Size(); offset += frameSize {
+		if _, err := io.ReadFull(f, frame); err != nil {
+			break
+		}
+		if binary.BigEndian.Uint32(frame[8:12]) != st.salt[0] || binary.BigEndian.Uint32(frame[12:16]) != st.salt[1] {
+			break
+		}
+		cksum = walChecksum(st.bigEndian, cksum, frame[:8])
+		cksum = walChecksum(st.bigEndian, cksum, frame[walFrameHeaderSize:])
+		if cksum != [2]uint32{binary.BigEndian.Uint32(frame[16:20]), binary.BigEndian.Uint32(frame[20:24])} {
+			break
+		}
+		batch.Write(frame)
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			committedLen, committedCksum = batch.Len(), cksum
+		}
+	}
+
+	if committedLen > 0 {
+		name := path.Join(st.name, st.generation, "wal", fmt.Sprintf("%016x-%d.frames", st.seq, now.UnixMilli()))
+		if err := r.target.Put(ctx, name, bytes.NewReader(batch.Bytes()[:committedLen])); err != nil {
+			return false, err
+		}
+		st.walOffset += int64(committedLen)
+		st.cksum = committedCksum
+		st.seq++
+		st.lastShippedAt = now
+	}
+
+	pending := info.Size() - st.walOffset
+	if pending >= frameSize {
+		if st.pendingBytes == 0 {
+			st.pendingSince = now
+		}
+		st.pendingBytes = pending
+	} else {
+		st.pendingBytes = 0
+	}
+	return false, nil
+}
+
+// walChecksum continues SQLite's WAL checksum over b (a multiple of 8 bytes).
+func walChecksum(bigEndian bool, s [2]uint32, b []byte) [2]uint32 {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	s0, s1 := s[0], s[1]
+	for i := 0; i+8 <= len(b); i += 8 {
+		s0 += order.Uint32(b[i:]) + s1
+		s1 += order.Uint32(b[i+4:]) + s0
+	}
+	return [2]uint32{s0, s1}
+}
+
+// applyRetention drops generations that are no longer needed to restore any
+// point within replica_retention_hours.
+func (r *Replicator) applyRetention(ctx context.Context, st *replicaState) {
+	retention := time.Duration(r.server.getSettingInt("replica_retention_hours", defaultReplicaRetentionHrs)) * time.Hour
+	cutoff := time.Now().Add(-retention)
+
+	gens, err := r.target.List(ctx, st.name)
+	if err != nil {
+		return
+	}
+	// Keep the newest generation that started before the cutoff; it covers it.
+	keepFrom := -1
+	for i, g := range gens {
+		if ts, err := strconv.ParseInt(g, 16, 64); err == nil && time.Unix(0, ts).Before(cutoff) {
+			keepFrom = i
+		}
+	}
+	for _, g := range gens[:max(keepFrom, 0)] {
+		if err := r.target.DeleteAll(ctx, path.Join(st.name, g)); err != nil {
+			r.server.logger.Printf("replication: %s: drop generation %s failed: %v", st.name, g, err)
+		}
+	}
+}
+
+// checkpointAll checkpoints every replicated database after shipping its WAL.
+func (r *Replicator) checkpointAll() {
+	ctx := context.Background()
+	for _, st := range r.databases() {
+		st.mu.Lock()
+		if st.generation != "" {
+			if err := r.checkpoint(ctx, st); err != nil {
+				r.server.logger.Printf("replication: %s: checkpoint failed: %v", st.name, err)
+			}
+			r.publish(st)
+		}
+		st.mu.Unlock()
+	}
+}
+
+// Status reports replication progress and lag for every database, as of
+// its last sync.
+func (r *Replicator) Status() []ReplicaStatus {
+	states := r.databases()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	out := make([]ReplicaStatus, 0, len(states))
+	for _, st := range states {
+		s := st.progress
+		s.Database = st.name
+		if s.PendingBytes > 0 {
+			s.LagSeconds = now.Sub(st.lagSince).Seconds()
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// --- Point-in-time Restore ---
+
+// restoreReplicaDB rebuilds one database as of at into dst, replaying the
+// segments shipped at or before at. Frames don't carry a commit time, so a
+// transaction committed just before at but shipped after it is left out. It
+// returns the ship time of the last segment applied.
+func restoreReplicaDB(ctx context.Context, target ReplicaTarget, name, dst string, at time.Time) (time.Time, error) {
+	gens, err := target.List(ctx, name)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var gen replicaGeneration
+	var genName string
+	for _, g := range gens {
+		rc, err := target.Get(ctx, path.Join(name, g, "generation.json"))
+		if err != nil {
+			continue // incomplete generation
+		}
+		var meta replicaGeneration
+		err = json.NewDecoder(rc).Decode(&meta)
+		rc.Close()
+		if err == nil && !meta.CreatedAt.After(at) {
+			gen, genName = meta, g
+		}
+	}
+	if genName == "" {
+		return time.Time{}, fmt.Errorf("%s: no generation covers %s", name, at.Format(time.RFC3339))
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer out.Close()
+
+	rc, err := target.Get(ctx, path.Join(name, genName, "snapshot.db.gz"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	gz, err := gzip.NewReader(rc)
+	if err == nil {
+		_, err = io.Copy(out, gz)
+	}
+	rc.Close()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: read snapshot: %w", name, err)
+	}
+
+	restoredTo := gen.CreatedAt
+	segments, err := target.List(ctx, path.Join(name, genName, "wal"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, seg := range segments {
+		ms, err := strconv.ParseInt(strings.TrimSuffix(seg[strings.IndexByte(seg, '-')+1:], ".frames"), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: bad segment name %q", name, seg)
+		}
+		shippedAt := time.UnixMilli(ms)
+		if shippedAt.After(at) {
+			break
+		}
+		if err := applyWALSegment(ctx, target, path.Join(name, genName, "wal", seg), out, gen.PageSize); err != nil {
+			return time.Time{}, fmt.Errorf("%s: apply %s: %w", name, seg, err)
+		}
+		restoredTo = shippedAt
+	}
+
+	return restoredTo, out.Sync()
+}
+
+// applyWALSegment writes each frame's page into the DB file and resizes the
+// file at every commit frame, as a checkpoint would.
+func applyWALSegment(ctx context.Context, target ReplicaTarget, name string, db *os.File, pageSize int) error {
+	rc, err := target.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	frame := make([]byte, walFrameHeaderSize+pageSize)
+	for {
+		if _, err := io.ReadFull(rc, frame); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		pgno := int64(binary.BigEndian.Uint32(frame[0:4]))
+		if _, err := db.WriteAt(frame[walFrameHeaderSize:], (pgno-1)*int64(pageSize)); err != nil {
+			return err
+		}
+		if commit := int64(binary.BigEndian.Uint32(frame[4:8])); commit != 0 {
+			if err := db.Truncate(commit * int64(pageSize)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// restoreReplicaDataDir rebuilds a whole data directory as of at: system.db
+// first, then the vaults of the users it lists.
+func restoreReplicaDataDir(ctx context.Context, target ReplicaTarget, dir string, at time.Time) ([]string, error) {
+	var report []string
+
+	restoredTo, err := restoreReplicaDB(ctx, target, "system.db", filepath.Join(dir, "system.db"), at)
+	if err != nil {
+		return nil, err
+	}
+	report = append(report, fmt.Sprintf("system.db: restored to %s", restoredTo.UTC().Format(time.RFC3339)))
+
+	users, err := readSnapshotUsers(filepath.Join(dir, "system.db"))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		restoredTo, err := restoreReplicaDB(ctx, target, u.DBPath, filepath.Join(dir, u.DBPath), at)
+		if err != nil {
+			return nil, fmt.Errorf("user %d (%s): %w", u.ID, u.Username, err)
+		}
+		report = append(report, fmt.Sprintf("%s (%s): restored to %s", u.DBPath, u.Username, restoredTo.UTC().Format(time.RFC3339)))
+	}
+
+	for _, name := range append([]string{"system.db"}, userDBPaths(users)...) {
+		if err := checkDBIntegrity(filepath.Join(dir, name)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return report, nil
+}
+
+func userDBPaths(users []snapshotUser) []string {
+	paths := make([]string, len(users))
+	for i, u := range users {
+		paths[i] = u.DBPath
+	}
+	return paths
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPageSize = 512
+
+type testFrame struct {
+	pgno, commit uint32
+	fill         byte
+}
+
+// buildWAL encodes a little-endian WAL the way SQLite writes it.
+func buildWAL(salt [2]uint32, frames []testFrame) []byte {
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], walMagicLE)
+	binary.BigEndian.PutUint32(header[4:], 3007000)
+	binary.BigEndian.PutUint32(header[8:], testPageSize)
+	binary.BigEndian.PutUint32(header[16:], salt[0])
+	binary.BigEndian.PutUint32(header[20:], salt[1])
+	sum := walChecksum(false, [2]uint32{}, header[:24])
+	binary.BigEndian.PutUint32(header[24:], sum[0])
+	binary.BigEndian.PutUint32(header[28:], sum[1])
+
+	wal := bytes.NewBuffer(header)
+	for _, f := range frames {
+		frame := make([]byte, walFrameHeaderSize+testPageSize)
+		binary.BigEndian.PutUint32(frame[0:], f.pgno)
+		binary.BigEndian.PutUint32(frame[4:], f.commit)
+		binary.BigEndian.PutUint32(frame[8:], salt[0])
+		binary.BigEndian.PutUint32(frame[12:], salt[1])
+		for i := walFrameHeaderSize; i < len(frame); i++ {
+			frame[i] = f.fill
+		}
+		sum = walChecksum(false, sum, frame[:8])
+		sum = walChecksum(false, sum, frame[walFrameHeaderSize:])
+		binary.BigEndian.PutUint32(frame[16:], sum[0])
+		binary.BigEndian.PutUint32(frame[20:], sum[1])
+		wal.Write(frame)
+	}
+	return wal.Bytes()
+}
+
+func frameOffset(n int) int64 {
+	return walHeaderSize + int64(n)*(walFrameHeaderSize+testPageSize)
+}
+
+// shippedSegments returns the contents of the shipped segments, in order.
+func shippedSegments(t *testing.T, target localReplicaTarget, st *replicaState) [][]byte {
+	t.Helper()
+	dir := path.Join(st.name, st.generation, "wal")
+	names, err := target.List(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segs [][]byte
+	for _, name := range names {
+		b, err := os.ReadFile(target.path(path.Join(dir, name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs = append(segs, b)
+	}
+	return segs
+}
+
+func TestShipFramesChecksumChain(t *testing.T) {
+	dir := t.TempDir()
+	target := localReplicaTarget{dir: filepath.Join(dir, "replica")}
+	r := &Replicator{target: target}
+	st := &replicaState{name: "test.db", path: filepath.Join(dir, "test.db"), generation: "gen", pageSize: testPageSize}
+	ctx := context.Background()
+
+	salt := [2]uint32{0x1234, 0x5678}
+	wal := buildWAL(salt, []testFrame{
+		{1, 0, 'a'}, {2, 2, 'b'}, // transaction 1
+		{3, 0, 'c'}, {1, 3, 'd'}, // transaction 2
+		{2, 3, 'e'}, // transaction 3
+	})
+
+	// Only the committed transaction goes out; the open one waits.
+	if err := os.WriteFile(st.path+"-wal", wal[:frameOffset(3)], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if restarted, err := r.shipFrames(ctx, st); err != nil || restarted {
+		t.Fatalf("shipFrames = %v, %v", restarted, err)
+	}
+	if st.walOffset != frameOffset(2) {
+		t.Fatalf("walOffset = %d, want %d", st.walOffset, frameOffset(2))
+	}
+	if st.pendingBytes == 0 {
+		t.Fatal("uncommitted frame not reported as pending")
+	}
+
+	// The next sync continues the checksum chain where the last one stopped.
+	// Transaction 3 has a broken checksum and must not be shipped.
+	broken := bytes.Clone(wal)
+	broken[frameOffset(4)+walFrameHeaderSize] ^= 0xff
+	if err := os.WriteFile(st.path+"-wal", broken, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.shipFrames(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	if st.walOffset != frameOffset(4) {
+		t.Fatalf("walOffset = %d, want %d", st.walOffset, frameOffset(4))
+	}
+
+	segs := shippedSegments(t, target, st)
+	if len(segs) != 2 {
+		t.Fatalf("shipped %d segments, want 2", len(segs))
+	}
+	if !bytes.Equal(segs[0], wal[frameOffset(0):frameOffset(2)]) || !bytes.Equal(segs[1], wal[frameOffset(2):frameOffset(4)]) {
+		t.Fatal("shipped segments don't match the WAL frames")
+	}
+
+	// A WAL with new salts was reset behind the replicator's back.
+	if err := os.WriteFile(st.path+"-wal", buildWAL([2]uint32{1, 2}, []testFrame{{1, 1, 'x'}}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if restarted, err := r.shipFrames(ctx, st); err != nil || !restarted {
+		t.Fatalf("shipFrames after reset = %v, %v; want restarted", restarted, err)
+	}
+}
+
+// TestWALChecksumSQLite checks walChecksum against a WAL written by SQLite.
+func TestWALChecksumSQLite(t *testing.T) {
+	defer func(v bool) { walAutoCheckpoint = v }(walAutoCheckpoint)
+	walAutoCheckpoint = false
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, q := range []string{
+		"CREATE TABLE t (n INTEGER, s TEXT)",
+		"INSERT INTO t VALUES (1, 'one')",
+		"INSERT INTO t SELECT n + 1, s FROM t",
+		"INSERT INTO t SELECT n + 2, s FROM t",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wal, err := os.ReadFile(dbPath + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	magic := binary.BigEndian.Uint32(wal[0:4])
+	bigEndian := magic == walMagicBE
+	pageSize := int(binary.BigEndian.Uint32(wal[8:12]))
+	sum := walChecksum(bigEndian, [2]uint32{}, wal[:24])
+	if sum != [2]uint32{binary.BigEndian.Uint32(wal[24:]), binary.BigEndian.Uint32(wal[28:])} {
+		t.Fatal("header checksum mismatch")
+	}
+
+	commits := 0
+	frameSize := walFrameHeaderSize + pageSize
+	for off := walHeaderSize; off+frameSize <= len(wal); off += frameSize {
+		frame := wal[off : off+frameSize]
+		sum = walChecksum(bigEndian, sum, frame[:8])
+		sum = walChecksum(bigEndian, sum, frame[walFrameHeaderSize:])
+		if sum != [2]uint32{binary.BigEndian.Uint32(frame[16:]), binary.BigEndian.Uint32(frame[20:])} {
+			t.Fatalf("frame at %d: checksum mismatch", off)
+		}
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			commits++
+		}
+	}
+	if commits < 4 {
+		t.Fatalf("found %d commit frames, want at least 4", commits)
+	}
+}
+
+func TestReplicaPointInTimeRestore(t *testing.T) {
+	defer func(v bool) { walAutoCheckpoint = v }(walAutoCheckpoint)
+	walAutoCheckpoint = false
+
+	s := newTestServer(t)
+	target := localReplicaTarget{dir: filepath.Join(t.TempDir(), "replica")}
+	r := newReplicator(s, target)
+	exec := func(q string) {
+		t.Helper()
+		if _, err := s.systemDB.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func() {
+		t.Helper()
+		r.syncAll()
+		for _, st := range r.Status() {
+			if st.Error != "" {
+				t.Fatalf("%s: %s", st.Database, st.Error)
+			}
+		}
+	}
+	// Segment names have millisecond resolution
+	tick := func() { time.Sleep(10 * time.Millisecond) }
+
+	exec("CREATE TABLE pitr (n INTEGER)")
+	sync()
+	exec("INSERT INTO pitr VALUES (1)")
+	sync()
+	tick()
+	first := time.Now()
+	tick()
+	exec("INSERT INTO pitr VALUES (2)")
+	sync()
+	r.checkpointAll() // the next frames go to a fresh WAL
+	exec("INSERT INTO pitr VALUES (3)")
+	sync()
+
+	restore := func(at time.Time) int {
+		t.Helper()
+		dst := filepath.Join(t.TempDir(), "system.db")
+		if _, err := restoreReplicaDB(context.Background(), target, "system.db", dst, at); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkDBIntegrity(dst); err != nil {
+			t.Fatal(err)
+		}
+		db, err := openSQLite(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM pitr").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := restore(first); n != 1 {
+		t.Fatalf("restore to first insert: %d rows, want 1", n)
+	}
+	if n := restore(time.Now()); n != 3 {
+		t.Fatalf("restore to latest: %d rows, want 3", n)
+	}
+}
+
+// TestReplicaStatusDoesNotWaitForSync checks that Status answers while a
+// database is being synced.
+func TestReplicaStatusDoesNotWaitForSync(t *testing.T) {
+	s := newTestServer(t)
+	r := newReplicator(s, localReplicaTarget{dir: t.TempDir()})
+	st := r.databases()[0]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	done := make(chan []ReplicaStatus)
+	go func() { done <- r.Status() }()
+	select {
+	case status := <-done:
+		if len(status) != 1 || status[0].Database != "system.db" {
+			t.Fatalf("Status = %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status blocked on a database being synced")
+	}
+}
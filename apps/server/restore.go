@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// --- Backup Restore & Verify ---
+
+// openBackupArchive returns the (decrypted) tar.gz stream of an archive.
+// Copies shipped to destinations may be age-encrypted; they need identities.
+func openBackupArchive(f io.Reader, identities []age.Identity) (io.Reader, error) {
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(len(ageHeaderPrefix))
+	if string(header) != ageHeaderPrefix {
+		return br, nil
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("archive is age-encrypted; pass the identity file with --identity")
+	}
+	return age.Decrypt(br, identities...)
+}
+
+const ageHeaderPrefix = "age-encryption.org/"
+
+// extractBackupArchive unpacks a backup archive into dst and returns its
+// manifest. Only regular files with clean relative names are accepted.
+func extractBackupArchive(archivePath, dst string, identities []age.Identity) (BackupManifest, error) {
+	var manifest BackupManifest
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+
+	stream, err := openBackupArchive(f, identities)
+	if err != nil {
+		return manifest, err
+	}
+	gz, err := gzip.NewReader(stream)
+	if err != nil {
+		return manifest, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	haveManifest := false
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return manifest, fmt.Errorf("unexpected entry %q in archive", hdr.Name)
+		}
+		if !isSafeArchivePath(hdr.Name) {
+			return manifest, fmt.Errorf("unsafe path %q in archive", hdr.Name)
+		}
+
+		if hdr.Name == backupManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("invalid manifest: %w", err)
+			}
+			haveManifest = true
+			continue
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return manifest, err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return manifest, err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	if !haveManifest {
+		return manifest, fmt.Errorf("archive has no %s", backupManifestName)
+	}
+	if manifest.Format != backupManifestFormat {
+		return manifest, fmt.Errorf("unsupported manifest format %d", manifest.Format)
+	}
+	return manifest, nil
+}
+
+// isSafeArchivePath accepts at most two clean, relative path elements, which
+// is all a backup archive ever contains (<file> or <uuid>.attachments/<id>).
+func isSafeArchivePath(name string) bool {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || strings.Contains(name, `\`) {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, p := range parts {
+		if !isPlainFilename(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyExtractedBackup checks an unpacked archive against its manifest and
+// runs PRAGMA integrity_check on every database. It returns the problems found.
+func verifyExtractedBackup(dir string, manifest BackupManifest) []string {
+	var problems []string
+
+	listed := map[string]bool{}
+	for _, f := range manifest.Files {
+		listed[f.Path] = true
+		full := filepath.Join(dir, filepath.FromSlash(f.Path))
+
+		info, err := os.Stat(full)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: missing from archive", f.Path))
+			continue
+		}
+		if info.Size() != f.Size {
+			problems = append(problems, fmt.Sprintf("%s: size %d, manifest says %d", f.Path, info.Size(), f.Size))
+		}
+		if sum, err := fileSHA256(full); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.Path, err))
+		} else if sum != f.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", f.Path))
+		}
+
+		if f.Kind == "system" || f.Kind == "vault" {
+			if err := checkDBIntegrity(full); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", f.Path, err))
+			}
+		}
+	}
+
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if !listed[filepath.ToSlash(rel)] && !isSQLiteSidecar(rel) {
+			problems = append(problems, fmt.Sprintf("%s: not listed in manifest", rel))
+		}
+		return nil
+	})
+
+	if listed["system.db"] {
+		users, err := readSnapshotUsers(filepath.Join(dir, "system.db"))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("system.db: cannot read users: %v", err))
+		}
+		for _, u := range users {
+			if !listed[u.DBPath] {
+				problems = append(problems, fmt.Sprintf("user %d (%s): vault %s missing", u.ID, u.Username, u.DBPath))
+			}
+		}
+	} else {
+		problems = append(problems, "system.db: missing from manifest")
+	}
+
+	return problems
+}
+
+func isSQLiteSidecar(name string) bool {
+	return strings.HasSuffix(name, "-wal") || strings.HasSuffix(name, "-shm") || strings.HasSuffix(name, "-journal")
+}
+
+// checkDBIntegrity runs PRAGMA integrity_check and returns its findings as an error.
+func checkDBIntegrity(path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var findings []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			findings = append(findings, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("integrity_check: %s", strings.Join(findings, "; "))
+	}
+	return nil
+}
+
+// verifyBackupArchive restores an archive into a temporary directory, checks
+// it and removes the directory again.
+func verifyBackupArchive(archivePath string, identities []age.Identity) (BackupVerifyReport, error) {
+	report := BackupVerifyReport{Archive: filepath.Base(archivePath), Problems: []string{}}
+
+	tmp, err := os.MkdirTemp("", "guardian-verify-")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(tmp)
+
+	manifest, err := extractBackupArchive(archivePath, tmp, identities)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report, nil
+	}
+
+	report.CreatedAt = manifest.CreatedAt
+	for _, f := range manifest.Files {
+		switch f.Kind {
+		case "system", "vault":
+			report.Databases++
+		case "attachment":
+			report.Attachments++
+		}
+	}
+	report.Problems = append(report.Problems, verifyExtractedBackup(tmp, manifest)...)
+	report.OK = len(report.Problems) == 0
+	return report, nil
+}
+
+// extractVerified unpacks an archive next to dataDir and refuses to continue
+// if the contents don't match the manifest.
+func extractVerified(archivePath, dataDir string, identities []age.Identity) (string, BackupManifest, error) {
+	tmp, err := os.MkdirTemp(filepath.Dir(filepath.Clean(dataDir)), ".guardian-restore-")
+	if err != nil {
+		return "", BackupManifest{}, err
+	}
+
+	manifest, err := extractBackupArchive(archivePath, tmp, identities)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", manifest, err
+	}
+	if problems := verifyExtractedBackup(tmp, manifest); len(problems) > 0 {
+		os.RemoveAll(tmp)
+		return "", manifest, fmt.Errorf("archive failed verification:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return tmp, manifest, nil
+}
+
+// restoreWholeServer replaces dataDir with the archive contents. An existing
+// data directory is only touched with force, and is then moved aside rather
+// than deleted.
+func restoreWholeServer(archivePath, dataDir string, force bool, identities []age.Identity) (string, error) {
+	if err := checkRestoreTarget(dataDir, force); err != nil {
+		return "", err
+	}
+
+	tmp, _, err := extractVerified(archivePath, dataDir, identities)
+	if err != nil {
+		return "", err
+	}
+	return installDataDir(tmp, dataDir)
+}
+
+func checkRestoreTarget(dataDir string, force bool) error {
+	if _, err := os.Stat(filepath.Join(dataDir, "system.db")); err == nil && !force {
+		return fmt.Errorf("%s already contains system.db; use --force to replace it", dataDir)
+	}
+	return nil
+}
+
+// installDataDir moves a fully prepared directory into place as dataDir,
+// keeping any previous data directory under a .pre-restore-<timestamp> name.
+func installDataDir(tmp, dataDir string) (string, error) {
+	var movedAside string
+	if _, err := os.Stat(dataDir); err == nil {
+		movedAside = fmt.Sprintf("%s.pre-restore-%s", filepath.Clean(dataDir), time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(dataDir, movedAside); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dataDir); err != nil {
+		os.RemoveAll(tmp)
+		return movedAside, err
+	}
+	os.Chmod(dataDir, 0755)
+	return movedAside, nil
+}
+
+// restoreUser brings back one user's vault, attachments and users row from an
+// archive into an existing data directory. Replaced files are kept with a
+// .pre-restore-<timestamp> suffix.
+func restoreUser(archivePath, dataDir, who string, identities []age.Identity) (snapshotUser, error) {
+	var user snapshotUser
+
+	liveSystemPath := filepath.Join(dataDir, "system.db")
+	if _, err := os.Stat(liveSystemPath); err != nil {
+		return user, fmt.Errorf("%s has no system.db; restore the whole server instead", dataDir)
+	}
+
+	tmp, _, err := extractVerified(archivePath, dataDir, identities)
+	if err != nil {
+		return user, err
+	}
+	defer os.RemoveAll(tmp)
+
+	snapSystemPath := filepath.Join(tmp, "system.db")
+	users, err := readSnapshotUsers(snapSystemPath)
+	if err != nil {
+		return user, err
+	}
+	found := false
+	for _, u := range users {
+		if u.Username == who || strconv.Itoa(u.ID) == who {
+			user, found = u, true
+			break
+		}
+	}
+	if !found {
+		return user, fmt.Errorf("user %q not found in backup", who)
+	}
+
+	live, err := initSystemDB(liveSystemPath, "", nil)
+	if err != nil {
+		return user, err
+	}
+	defer live.Close()
+
+	var conflictID int
+	err = live.QueryRow("SELECT id FROM users WHERE username = ? AND id != ?", user.Username, user.ID).Scan(&conflictID)
+	if err == nil {
+		return user, fmt.Errorf("username %q now belongs to user %d", user.Username, conflictID)
+	} else if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	var liveDBPath string
+	live.QueryRow("SELECT db_path FROM users WHERE id = ?", user.ID).Scan(&liveDBPath)
+
+	suffix := ".pre-restore-" + time.Now().UTC().Format("20060102T150405Z")
+	for _, name := range []string{liveDBPath, user.DBPath} {
+		if !isPlainFilename(name) {
+			continue
+		}
+		base := filepath.Join(dataDir, name)
+		for _, p := range []string{base, base + "-wal", base + "-shm", attachmentDirFor(dataDir, name)} {
+			if _, err := os.Stat(p); err == nil {
+				if err := os.Rename(p, p+suffix); err != nil {
+					return user, err
+				}
+			}
+		}
+	}
+
+	if err := os.Rename(filepath.Join(tmp, user.DBPath), filepath.Join(dataDir, user.DBPath)); err != nil {
+		return user, err
+	}
+	snapAttachments := attachmentDirFor(tmp, user.DBPath)
+	if _, err := os.Stat(snapAttachments); err == nil {
+		if err := os.Rename(snapAttachments, attachmentDirFor(dataDir, user.DBPath)); err != nil {
+			return user, err
+		}
+	}
+
+	if err := copyUserRow(live, snapSystemPath, user.ID); err != nil {
+		return user, fmt.Errorf("restore users row: %w", err)
+	}
+	return user, nil
+}
+
+// copyUserRow replaces a users row with the one from a snapshot system.db.
+// Only columns both schemas share are copied, so older archives still restore.
+func copyUserRow(live *sql.DB, snapSystemPath string, userID int) error {
+	if _, err := live.Exec("ATTACH DATABASE ? AS snap", snapSystemPath); err != nil {
+		return err
+	}
+	defer live.Exec("DETACH DATABASE snap")
+
+	liveCols, err := tableColumns(live, "main", "users")
+	if err != nil {
+		return err
+	}
+	snapCols, err := tableColumns(live, "snap", "users")
+	if err != nil {
+		return err
+	}
+	var cols []string
+	for _, c := range sortedKeys(liveCols) {
+		if snapCols[c] {
+			cols = append(cols, `"`+c+`"`)
+		}
+	}
+	colList := strings.Join(cols, ", ")
+
+	tx, err := live.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM main.users WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO main.users ("+colList+") SELECT "+colList+" FROM snap.users WHERE id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableColumns returns the set of column names of schema.table.
+func tableColumns(db *sql.DB, schema, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s', '%s')", table, schema))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// sortedKeys keeps generated column lists deterministic.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
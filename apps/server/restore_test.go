@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestArchive backs up a server with alice (one item) and bob and returns
+// the archive path.
+func newTestArchive(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := newTestServer(t)
+	alice := addTestUser(t, s, "alice")
+	addTestUser(t, s, "bob")
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, alice, []VaultItem{{ID: "a", EncryptedBlob: "blob"}}))
+	b := runTestBackup(t, s)
+	if b.Status != "success" {
+		t.Fatalf("backup = %+v", b)
+	}
+	return s, filepath.Join(s.config.BackupDir, b.Filename)
+}
+
+// rewriteArchive writes a copy of a backup archive to dst, letting edit
+// rename or drop (nil data) entries on the way.
+func rewriteArchive(t *testing.T, src, dst string, edit func(name string, data []byte) (string, []byte)) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	gzw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gzw)
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, data := edit(hdr.Name, data)
+		if data == nil {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countItems opens a vault file directly and counts its items.
+func countItems(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM vault_items").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestVerifyBackupArchive checks that a clean archive passes the drill and
+// that changed, missing and unsafe entries are reported.
+func TestVerifyBackupArchive(t *testing.T) {
+	_, path := newTestArchive(t)
+
+	report, err := verifyBackupArchive(path, nil)
+	if err != nil || !report.OK || report.Databases != 3 || report.Attachments != 0 {
+		t.Fatalf("report = %+v, %v", report, err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		edit    func(name string, data []byte) (string, []byte)
+		problem string
+	}{
+		{"changed vault", func(name string, data []byte) (string, []byte) {
+			if name == "alice.db" {
+				data[len(data)-1] ^= 0xff
+			}
+			return name, data
+		}, "alice.db: checksum mismatch"},
+		{"missing vault", func(name string, data []byte) (string, []byte) {
+			if name == "bob.db" {
+				return name, nil
+			}
+			return name, data
+		}, "bob.db: missing from archive"},
+		{"unsafe path", func(name string, data []byte) (string, []byte) {
+			if name == "bob.db" {
+				return "../bob.db", data
+			}
+			return name, data
+		}, `unsafe path "../bob.db"`},
+	} {
+		tampered := filepath.Join(t.TempDir(), "tampered.tar.gz")
+		rewriteArchive(t, path, tampered, tc.edit)
+		report, err := verifyBackupArchive(tampered, nil)
+		if err != nil || report.OK || !strings.Contains(strings.Join(report.Problems, "\n"), tc.problem) {
+			t.Fatalf("%s: report = %+v, %v", tc.name, report, err)
+		}
+	}
+}
+
+// TestRestoreWholeServer checks that a restore only replaces an existing
+// data directory with force, and keeps the old one aside.
+func TestRestoreWholeServer(t *testing.T) {
+	_, path := newTestArchive(t)
+	dataDir := filepath.Join(t.TempDir(), "data")
+
+	if moved, err := restoreWholeServer(path, dataDir, false, nil); err != nil || moved != "" {
+		t.Fatalf("restore into empty dir: %q, %v", moved, err)
+	}
+	if n := countItems(t, filepath.Join(dataDir, "alice.db")); n != 1 {
+		t.Fatalf("restored alice has %d items, want 1", n)
+	}
+
+	if _, err := restoreWholeServer(path, dataDir, false, nil); err == nil {
+		t.Fatal("restore over a data dir without force succeeded")
+	}
+	moved, err := restoreWholeServer(path, dataDir, true, nil)
+	if err != nil || moved == "" {
+		t.Fatalf("forced restore: %q, %v", moved, err)
+	}
+	if _, err := os.Stat(filepath.Join(moved, "system.db")); err != nil {
+		t.Fatalf("previous data dir not kept: %v", err)
+	}
+
+	tampered := filepath.Join(t.TempDir(), "tampered.tar.gz")
+	rewriteArchive(t, path, tampered, func(name string, data []byte) (string, []byte) {
+		if name == "alice.db" {
+			data[len(data)-1] ^= 0xff
+		}
+		return name, data
+	})
+	other := filepath.Join(t.TempDir(), "other")
+	if _, err := restoreWholeServer(tampered, other, false, nil); err == nil {
+		t.Fatal("restore of a tampered archive succeeded")
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Fatalf("failed restore created %s: %v", other, err)
+	}
+}
+
+// TestRestoreUser checks that one user's vault and users row come back from
+// an archive while the replaced vault is kept and other users are untouched.
+func TestRestoreUser(t *testing.T) {
+	s, path := newTestArchive(t)
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, 1, []VaultItem{{ID: "b", EncryptedBlob: "blob"}}))
+	decode[UpsertItemsResponse](t, call(t, s.handleUpsertItems, 2, []VaultItem{{ID: "b", EncryptedBlob: "blob"}}))
+	if _, err := s.systemDB.Exec("UPDATE users SET status = 'DISABLED' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	// Restores run with the server stopped
+	s.userDBs.Range(func(_, v any) bool {
+		v.(interface{ Close() error }).Close()
+		return true
+	})
+	s.systemDB.Close()
+
+	if _, err := restoreUser(path, s.config.DataDir, "carol", nil); err == nil {
+		t.Fatal("restore of an unknown user succeeded")
+	}
+	u, err := restoreUser(path, s.config.DataDir, "alice", nil)
+	if err != nil || u.ID != 1 {
+		t.Fatalf("restore alice: %+v, %v", u, err)
+	}
+
+	if n := countItems(t, filepath.Join(s.config.DataDir, "alice.db")); n != 1 {
+		t.Fatalf("restored alice has %d items, want 1", n)
+	}
+	if n := countItems(t, filepath.Join(s.config.DataDir, "bob.db")); n != 1 {
+		t.Fatalf("bob has %d items, want his own 1", n)
+	}
+	if kept, _ := filepath.Glob(filepath.Join(s.config.DataDir, "alice.db.pre-restore-*")); len(kept) != 1 || countItems(t, kept[0]) != 2 {
+		t.Fatalf("replaced vault not kept: %v", kept)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(s.config.DataDir, "system.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var status string
+	if err := db.QueryRow("SELECT COALESCE(status, 'ACTIVE') FROM users WHERE id = 1").Scan(&status); err != nil || status != "ACTIVE" {
+		t.Fatalf("alice's status = %q, %v", status, err)
+	}
+}
+
+// TestBackupRestoreDrill checks the drill endpoint records the outcome on
+// the backup and that the scheduled drill picks the newest archive.
+func TestBackupRestoreDrill(t *testing.T) {
+	s, path := newTestArchive(t)
+	second := runTestBackup(t, s)
+
+	sched := BackupSchedule{VerifyIntervalHours: 24}
+	if id, _, due := s.verifyDue(sched); !due || id != second.ID {
+		t.Fatalf("verifyDue = %d %v, want backup %d", id, due, second.ID)
+	}
+
+	drill := func(id int64) BackupRecord {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.SetPathValue("id", strconv.FormatInt(id, 10))
+		w := httptest.NewRecorder()
+		s.handleVerifyBackup(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("verify %d: %d %s", id, w.Code, w.Body)
+		}
+		s.verifyMu.Lock()
+		s.verifyMu.Unlock()
+		b, err := scanBackupRecord(s.systemDB.QueryRow("SELECT "+backupColumns+" FROM backups WHERE id = ?", id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	if b := drill(second.ID); b.VerifyStatus != "ok" || b.VerifiedAt == nil {
+		t.Fatalf("drill of a clean archive = %+v", b)
+	}
+	if _, _, due := s.verifyDue(sched); due {
+		t.Fatal("drill due right after one finished")
+	}
+
+	rewriteArchive(t, path, path+".new", func(name string, data []byte) (string, []byte) {
+		if name == "bob.db" {
+			return name, nil
+		}
+		return name, data
+	})
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	if b := drill(1); b.VerifyStatus != "failed" || !strings.Contains(b.VerifyError, "bob.db") {
+		t.Fatalf("drill of a broken archive = %+v", b)
+	}
+}
@@ -15,27 +15,65 @@ type SSEEvent struct {
 // SSEHub manages all active WebSocket and any future event-stream connections.
 // Despite the name, it is no longer SSE-specific — it is used by WebSocket connections.
 type SSEHub struct {
-	clients    map[int]map[chan string]bool
+	clients    map[int]map[chan string]hubClient
 	mu         sync.RWMutex
 	shutdowned bool
 }
 
+// hubClient identifies a connection's session and carries the channel on
+// which the server tells it to close, and why.
+type hubClient struct {
+	sessionID string
+	kick      chan CloseReason
+}
+
+// CloseReason is sent to a client the server disconnects on purpose.
+type CloseReason struct {
+	Code int
+	Text string
+}
+
 // NewSSEHub creates a new SSEHub
 func NewSSEHub() *SSEHub {
 	return &SSEHub{
-		clients: make(map[int]map[chan string]bool),
+		clients: make(map[int]map[chan string]hubClient),
 	}
 }
 
-// AddClient registers a new client channel for a specific user ID
-func (h *SSEHub) AddClient(userID int, ch chan string) {
+// AddClient registers a new client channel for a specific user ID and session
+// and returns the channel on which a disconnect reason arrives.
+func (h *SSEHub) AddClient(userID int, sessionID string, ch chan string) <-chan CloseReason {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if h.clients[userID] == nil {
-		h.clients[userID] = make(map[chan string]bool)
+		h.clients[userID] = make(map[chan string]hubClient)
+	}
+	kick := make(chan CloseReason, 1)
+	h.clients[userID][ch] = hubClient{sessionID: sessionID, kick: kick}
+	return kick
+}
+
+// DisconnectUser asks every connection of a user to close with reason.
+func (h *SSEHub) DisconnectUser(userID int, reason CloseReason) {
+	h.DisconnectSession(userID, "", reason)
+}
+
+// DisconnectSession asks the connections of one session to close with
+// reason; an empty sessionID matches all of the user's connections.
+func (h *SSEHub) DisconnectSession(userID int, sessionID string, reason CloseReason) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, c := range h.clients[userID] {
+		if sessionID != "" && c.sessionID != sessionID {
+			continue
+		}
+		select {
+		case c.kick <- reason:
+		default: // already being closed
+		}
 	}
-	h.clients[userID][ch] = true
 }
 
 // RemoveClient unregisters a client channel
@@ -82,6 +120,17 @@ func (h *SSEHub) BroadcastToUser(userID int, eventType string) {
 	}
 }
 
+// ClientCount returns the number of connected clients and of distinct users.
+func (h *SSEHub) ClientCount() (clients, users int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userClients := range h.clients {
+		clients += len(userClients)
+	}
+	return clients, len(h.clients)
+}
+
 // shutdown closes all client channels to unblock connections
 func (h *SSEHub) shutdown() {
 	h.mu.Lock()
@@ -94,5 +143,5 @@ func (h *SSEHub) shutdown() {
 			close(ch)
 		}
 	}
-	h.clients = make(map[int]map[chan string]bool)
+	h.clients = make(map[int]map[chan string]hubClient)
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Login Throttling ---
+//
+// Failed logins, password re-checks, second factors, recovery codes and
+// invite checks are counted per username and per client IP in login_throttle,
+// so the limits survive a restart. Admin recovery requests are counted per
+// username in a scope of their own, so filing them can't lock the account.
+// Wrong invite tokens are limited per client IP; a much higher count across
+// all clients backs that up against guessing from many addresses, and an
+// admin can clear it. After the free attempts each further failure doubles
+// the wait before the next try, up to a cap. A username that keeps failing is
+// locked for a while; usernames are counted whether or not the account
+// exists, so neither the delay nor the lockout tells them apart. Counters
+// that see no failure for the window are forgotten.
+
+const (
+	throttleUser     = "user"
+	throttleIP       = "ip"
+	throttleRecovery = "recovery"
+	throttleInvite   = "invite"
+
+	defaultLoginFreeAttempts       = 3
+	defaultLoginIPFreeAttempts     = 20   // several users can share an address
+	defaultLoginInviteFreeAttempts = 1000 // shared by every client
+	defaultLoginBackoffBase        = 1    // seconds
+	defaultLoginBackoffMax         = 900
+	defaultLoginLockoutThreshold   = 10 // 0 disables lockout
+	defaultLoginLockoutMinutes     = 30
+	defaultLoginFailureWindow      = 60 // minutes
+)
+
+type throttleKey struct {
+	scope, key string
+}
+
+func userThrottle(username string) throttleKey { return throttleKey{throttleUser, username} }
+
+func ipThrottle(r *http.Request) throttleKey { return throttleKey{throttleIP, getClientIP(r)} }
+
+func recoveryThrottle(username string) throttleKey { return throttleKey{throttleRecovery, username} }
+
+// inviteThrottle is the backstop counter of wrong invite tokens and setup
+// codes from all clients.
+var inviteThrottle = throttleKey{throttleInvite, "*"}
+
+// loginThrottleConfig holds the login_* settings.
+type loginThrottleConfig struct {
+	freeAttempts, ipFreeAttempts int
+	inviteFreeAttempts           int
+	backoffBase, backoffMax      int64
+	lockoutThreshold             int
+	lockout, window              int64
+}
+
+func (s *Server) loginThrottleConfig() loginThrottleConfig {
+	return loginThrottleConfig{
+		freeAttempts:       s.getSettingInt("login_free_attempts", defaultLoginFreeAttempts),
+		ipFreeAttempts:     s.getSettingInt("login_ip_free_attempts", defaultLoginIPFreeAttempts),
+		inviteFreeAttempts: s.getSettingInt("login_invite_free_attempts", defaultLoginInviteFreeAttempts),
+		backoffBase:        int64(s.getSettingInt("login_backoff_base_seconds", defaultLoginBackoffBase)),
+		backoffMax:         int64(s.getSettingInt("login_backoff_max_seconds", defaultLoginBackoffMax)),
+		lockoutThreshold:   int(s.getSettingInt64("login_lockout_threshold")),
+		lockout:            int64(s.getSettingInt("login_lockout_minutes", defaultLoginLockoutMinutes)) * 60,
+		window:             int64(s.getSettingInt("login_failure_window_minutes", defaultLoginFailureWindow)) * 60,
+	}
+}
+
+// backoff is the wait after the given number of failures.
+func (c loginThrottleConfig) backoff(scope string, failures int) int64 {
+	free := c.freeAttempts
+	switch scope {
+	case throttleIP:
+		free = c.ipFreeAttempts
+	case throttleInvite:
+		free = c.inviteFreeAttempts
+	}
+	if failures <= free {
+		return 0
+	}
+	delay := c.backoffBase
+	for i := free + 1; i < failures && delay < c.backoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, c.backoffMax)
+}
+
+// validLoginThrottleSetting checks a login_* setting: a positive number, or
+// for the lockout threshold also 0.
+func validLoginThrottleSetting(key, value string) bool {
+	if !strings.HasPrefix(key, "login_") {
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return false
+	}
+	if key == "login_lockout_threshold" {
+		return n >= 0
+	}
+	return n > 0
+}
+
+// loginWait reports how long the caller has to wait before trying again
+// under any of the keys, and whether that is an account lockout.
+func (s *Server) loginWait(keys ...throttleKey) (wait time.Duration, locked bool) {
+	now := time.Now().Unix()
+	for _, k := range keys {
+		var blockedUntil, lockedUntil int64
+		err := s.systemDB.QueryRow("SELECT blocked_until, locked_until FROM login_throttle WHERE scope = ? AND key = ?",
+			k.scope, k.key).Scan(&blockedUntil, &lockedUntil)
+		if err != nil {
+			continue
+		}
+		if lockedUntil > now {
+			locked = true
+			wait = max(wait, time.Duration(lockedUntil-now)*time.Second)
+		}
+		if blockedUntil > now {
+			wait = max(wait, time.Duration(blockedUntil-now)*time.Second)
+		}
+	}
+	return wait, locked
+}
+
+// checkLoginThrottle writes a 429 and returns false while any of the keys is
+// waiting out a backoff or lockout.
+func (s *Server) checkLoginThrottle(w http.ResponseWriter, keys ...throttleKey) bool {
+	wait, locked := s.loginWait(keys...)
+	if wait <= 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+	if locked {
+		http.Error(w, "Account temporarily locked, try again later", http.StatusTooManyRequests)
+	} else {
+		http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+	}
+	return false
+}
+
+// recordLoginFailure counts a failure against each key and starts its
+// backoff, locking a username that reached the lockout threshold.
+func (s *Server) recordLoginFailure(r *http.Request, keys ...throttleKey) {
+	cfg := s.loginThrottleConfig()
+	now := time.Now().Unix()
+
+	tx, err := s.systemDB.Begin()
+	if err != nil {
+		s.logger.Println("recordLoginFailure:", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, k := range keys {
+		var failures int
+		var lastFailure, lockedUntil int64
+		err := tx.QueryRow("SELECT failures, last_failure, locked_until FROM login_throttle WHERE scope = ? AND key = ?",
+			k.scope, k.key).Scan(&failures, &lastFailure, &lockedUntil)
+		if err != nil && err != sql.ErrNoRows {
+			s.logger.Println("recordLoginFailure:", err)
+			return
+		}
+		// A quiet window or a served lockout starts the count over
+		if now-lastFailure > cfg.window || (lockedUntil != 0 && lockedUntil <= now) {
+			failures, lockedUntil = 0, 0
+		}
+		failures++
+
+		lockedNow := k.scope == throttleUser && cfg.lockoutThreshold > 0 && failures >= cfg.lockoutThreshold && lockedUntil == 0
+		if lockedNow {
+			lockedUntil = now + cfg.lockout
+		}
+		_, err = tx.Exec(`
+			INSERT INTO login_throttle (scope, key, failures, last_failure, blocked_until, locked_until) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(scope, key) DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure,
+				blocked_until = excluded.blocked_until, locked_until = excluded.locked_until
+		`, k.scope, k.key, failures, now, now+cfg.backoff(k.scope, failures), lockedUntil)
+		if err != nil {
+			s.logger.Println("recordLoginFailure:", err)
+			return
+		}
+		if lockedNow {
+			var userID int
+			tx.QueryRow("SELECT id FROM users WHERE username = ?", k.key).Scan(&userID)
+			s.auditTx(tx, r, 0, userID, "login.locked", k.key+" after "+strconv.Itoa(failures)+" failures")
+			s.logger.Printf("recordLoginFailure: locked %q for %ds after %d failures", k.key, cfg.lockout, failures)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		s.logger.Println("recordLoginFailure:", err)
+	}
+}
+
+// clearLoginFailures forgets the counter of a key, after a successful login
+// or an admin unlock. IP counters are left to expire: one working account
+// shouldn't reset the count for everyone guessing from that address.
+func (s *Server) clearLoginFailures(k throttleKey) (bool, error) {
+	res, err := s.systemDB.Exec("DELETE FROM login_throttle WHERE scope = ? AND key = ?", k.scope, k.key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// usernameThrottle is the username key of a user known by ID, for steps
+// after the password where only the ID is at hand.
+func (s *Server) usernameThrottle(userID int) throttleKey {
+	var username string
+	s.systemDB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	return userThrottle(username)
+}
+
+// pruneLoginThrottle deletes counters that are past their window and no
+// longer blocking anything.
+func (s *Server) pruneLoginThrottle() {
+	cfg := s.loginThrottleConfig()
+	now := time.Now().Unix()
+	res, err := s.systemDB.Exec("DELETE FROM login_throttle WHERE last_failure < ? AND blocked_until <= ? AND locked_until <= ?",
+		now-cfg.window, now, now)
+	if err != nil {
+		s.logger.Println("pruneLoginThrottle:", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.logger.Printf("pruneLoginThrottle: removed %d counters", n)
+	}
+}
+
+// handleListLoginThrottle lists the current failure counters, most recent
+// first.
+func (s *Server) handleListLoginThrottle(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.systemDB.Query(`
+		SELECT scope, key, failures, last_failure, blocked_until, locked_until FROM login_throttle
+		ORDER BY last_failure DESC LIMIT 500
+	`)
+	if err != nil {
+		s.logger.Println("handleListLoginThrottle:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now().Unix()
+	entries := []LoginThrottleEntry{}
+	for rows.Next() {
+		var e LoginThrottleEntry
+		var lastFailure, blockedUntil, lockedUntil int64
+		if err := rows.Scan(&e.Scope, &e.Key, &e.Failures, &lastFailure, &blockedUntil, &lockedUntil); err != nil {
+			continue
+		}
+		e.LastFailure = time.Unix(lastFailure, 0).UTC()
+		if blockedUntil > now {
+			t := time.Unix(blockedUntil, 0).UTC()
+			e.BlockedUntil = &t
+		}
+		if lockedUntil > now {
+			t := time.Unix(lockedUntil, 0).UTC()
+			e.LockedUntil = &t
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database iteration error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleAdminUnlockUser clears a user's failed login count and lockout.
+func (s *Server) handleAdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(userIDKey).(int)
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var username string
+	if err := s.systemDB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	cleared, err := s.clearLoginFailures(userThrottle(username))
+	if err != nil {
+		s.logger.Println("handleAdminUnlockUser:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if cleared {
+		s.audit(r, adminID, userID, "login.unlocked", "")
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "User unlocked"})
+}
+
+// handleAdminClearLoginThrottle clears a username, IP or invite counter, e.g.
+// an IP address a whole office logs in from, or the invite backstop (key "*").
+func (s *Server) handleAdminClearLoginThrottle(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(userIDKey).(int)
+	k := throttleKey{r.PathValue("scope"), r.PathValue("key")}
+	if k.scope != throttleUser && k.scope != throttleIP && k.scope != throttleInvite {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	cleared, err := s.clearLoginFailures(k)
+	if err != nil {
+		s.logger.Println("handleAdminClearLoginThrottle:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !cleared {
+		http.Error(w, "No failures recorded", http.StatusNotFound)
+		return
+	}
+	s.audit(r, adminID, 0, "login.unlocked", k.scope+" "+k.key)
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Failures cleared"})
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +22,13 @@ const (
 	wsWriteTimeout   = 10 * time.Second
 	wsNonceCleanup   = 15 * time.Second
 	wsDefaultMaxPerIP = 5
+
+	// Close codes for connections the server ends on purpose (4000-4999 are
+	// reserved for applications)
+	wsCloseAccountDisabled  = 4001
+	wsCloseAccountSuspended = 4002
+	wsCloseSessionRevoked   = 4003
+	wsClosePasswordChanged  = 4004
 )
 
 var wsUpgrader = websocket.Upgrader{
@@ -67,16 +76,74 @@ type wsMessage struct {
 	Timestamp int64  `json:"timestamp,omitempty"`
 }
 
+// trustedProxies are the TRUSTED_PROXIES addresses allowed to set
+// X-Forwarded-For. It is set once at startup.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of addresses and CIDR
+// ranges.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP is the address a request came from. X-Forwarded-For is only
+// believed when the peer is a trusted proxy, and is read from the right:
+// the first hop that isn't a trusted proxy is the client, anything left of
+// it was sent by the client itself.
 func getClientIP(r *http.Request) string {
-	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
-		parts := strings.Split(fwd, ",")
-		return strings.TrimSpace(parts[0])
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
 	}
-	idx := strings.LastIndex(r.RemoteAddr, ":")
-	if idx == -1 {
-		return r.RemoteAddr
+	if !isTrustedProxy(ip) {
+		return ip
 	}
-	return r.RemoteAddr[:idx]
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
 }
 
 func (s *Server) getMaxWsPerIP() int {
@@ -198,7 +265,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.Header.Set("Authorization", "Bearer "+auth.Token)
-	userID, err := s.validateToken(r)
+	session, err := s.validateToken(r)
 	if err != nil {
 		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
 		conn.WriteJSON(wsMessage{Type: "auth_error"})
@@ -207,6 +274,8 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID := session.userID
+
 	// Post-auth: check per-user override (if set, it always applies)
 	userMax := s.getUserMaxWsPerIP(userID)
 	if userMax > 0 {
@@ -227,7 +296,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// 3. Subscribe
 	eventCh := make(chan string, 10)
-	s.sseHub.AddClient(userID, eventCh)
+	kickCh := s.sseHub.AddClient(userID, session.sessionID, eventCh)
 
 	// Pong handler re-arms read deadline
 	conn.SetPongHandler(func(string) error {
@@ -267,6 +336,11 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		case <-readDone:
 			doCleanup()
 			return
+		case reason := <-kickCh:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(reason.Code, reason.Text), time.Now().Add(wsWriteTimeout))
+			doCleanup()
+			<-readDone
+			return
 		case msg, ok := <-eventCh:
 			if !ok {
 				doCleanup()
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1, 172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(p []netip.Prefix) { trustedProxies = p }(trustedProxies)
+	trustedProxies = proxies
+
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:4000", "", "203.0.113.5"},
+		// Only a trusted proxy can say who the client is
+		{"203.0.113.5:4000", "198.51.100.7", "203.0.113.5"},
+		{"10.0.0.1:4000", "198.51.100.7", "198.51.100.7"},
+		// Hops the client wrote itself are skipped
+		{"10.0.0.1:4000", "1.2.3.4, 198.51.100.7, 172.17.0.2", "198.51.100.7"},
+		{"10.0.0.1:4000", "", "10.0.0.1"},
+		{"[::1]:4000", "198.51.100.7", "::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := getClientIP(r); got != tc.want {
+			t.Errorf("getClientIP(%s, X-Forwarded-For %q) = %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies accepted an invalid range")
+	}
+}
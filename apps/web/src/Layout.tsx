@@ -367,6 +367,7 @@ export default function Layout({ children, currentPageName }: LayoutProps) {
                           to={createPageUrl('Login')}
                           onClick={() => {
                             localStorage.removeItem('guardian_token');
+                            localStorage.removeItem('guardian_refresh_token');
                             localStorage.removeItem('guardian_user');
                           }}
                           className={`
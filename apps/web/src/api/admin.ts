@@ -39,6 +39,7 @@ export interface AdminUser {
     last_login: string | null;
     used_space?: string;
     used_space_overhead?: string;
+    vault_missing?: boolean;
 }
 
 export interface UpdateUserRequest {
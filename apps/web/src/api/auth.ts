@@ -7,6 +7,7 @@ export interface LoginRequest {
 
 export interface AuthResponse {
     token: string;
+    refresh_token: string;
     username: string;
     is_admin: boolean;
 }
@@ -17,6 +18,7 @@ export const authApi = {
 
         // Store token and user info
         localStorage.setItem('guardian_token', response.data.token);
+        localStorage.setItem('guardian_refresh_token', response.data.refresh_token);
         localStorage.setItem('guardian_user', JSON.stringify({
             username: response.data.username,
             is_admin: response.data.is_admin,
@@ -27,6 +29,7 @@ export const authApi = {
 
     logout() {
         localStorage.removeItem('guardian_token');
+        localStorage.removeItem('guardian_refresh_token');
         localStorage.removeItem('guardian_user');
     },
 
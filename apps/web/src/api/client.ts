@@ -1,4 +1,4 @@
-import axios from 'axios';
+import axios, { type AxiosRequestConfig } from 'axios';
 
 const apiClient = axios.create({
     baseURL: import.meta.env.VITE_API_URL || '',
@@ -23,14 +23,46 @@ apiClient.interceptors.request.use(
     }
 );
 
+// Access tokens are short-lived; one refresh at a time renews them with the
+// stored refresh token, which the server replaces on every use.
+let refreshing: Promise<string | null> | null = null;
+
+async function refreshAccessToken(): Promise<string | null> {
+    const refreshToken = localStorage.getItem('guardian_refresh_token');
+    if (!refreshToken) return null;
+    try {
+        const response = await axios.post<{ token: string; refresh_token: string }>(
+            `${apiClient.defaults.baseURL}/auth/refresh`,
+            { refresh_token: refreshToken },
+            { timeout: 10000 },
+        );
+        localStorage.setItem('guardian_token', response.data.token);
+        localStorage.setItem('guardian_refresh_token', response.data.refresh_token);
+        return response.data.token;
+    } catch {
+        return null;
+    }
+}
+
 // Response interceptor for error handling
 apiClient.interceptors.response.use(
     (response) => response,
-    (error) => {
+    async (error) => {
         console.error('API Error:', error);
+        const config = error.config as (AxiosRequestConfig & { _retried?: boolean }) | undefined;
+        if (error.response?.status === 401 && config && !config._retried && !config.url?.startsWith('/auth/')) {
+            refreshing ??= refreshAccessToken().finally(() => { refreshing = null; });
+            const token = await refreshing;
+            if (token) {
+                // The request interceptor picks up the new token
+                config._retried = true;
+                return apiClient(config);
+            }
+        }
         if (error.response?.status === 401) {
             // Clear token and redirect to login
             localStorage.removeItem('guardian_token');
+            localStorage.removeItem('guardian_refresh_token');
             localStorage.removeItem('guardian_user');
             window.location.href = '/login';
         }
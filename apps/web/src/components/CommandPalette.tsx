@@ -122,6 +122,7 @@ export function CommandPalette({ open, onOpenChange }: CommandPaletteProps) {
       icon: LogOut,
       action: () => {
         localStorage.removeItem('guardian_token');
+        localStorage.removeItem('guardian_refresh_token');
         localStorage.removeItem('guardian_user');
         navigate(createPageUrl('Login'));
       },
@@ -115,7 +115,9 @@ export default function UserTable({ users, loading, onEditUser }: UserTableProps
                 <TableCell>
                   <div className={`flex items-center gap-2 ${themeClasses.text}`}>
                     <Key className={`w-4 h-4 ${themeClasses.textTertiary}`} />
-                    {user.vault_items}
+                    {user.vault_missing ? (
+                      <span className="text-red-400 text-xs">vault file missing</span>
+                    ) : user.vault_items}
                   </div>
                 </TableCell>
                 <TableCell>
@@ -199,10 +199,10 @@ async function loadArgon2Module(): Promise<WebAssembly.Instance> {
  * - PBKDF2: Secure, widely supported, but not memory-hard
  * 
  * PBKDF2 is safe for production use, but Argon2 offers better protection
- * against attacks with specialized hardware. The number of iterations (100000) was
+ * against attacks with specialized hardware. The default number of iterations (100000) was
  * calibrated for approximately 2 seconds of work, similar to Argon2.
  */
-async function deriveKeyFallback(password: string, salt: Uint8Array): Promise<Uint8Array> {
+async function deriveKeyFallback(password: string, salt: Uint8Array, iterations = 100000): Promise<Uint8Array> {
   const passwordBytes = new TextEncoder().encode(password);
 
   const keyMaterial = await crypto.subtle.importKey(
@@ -213,10 +213,6 @@ async function deriveKeyFallback(password: string, salt: Uint8Array): Promise<Ui
     ['deriveBits']
   );
 
-  // Iteration adjustment for approximately 2 seconds of work
-  // This value should be calibrated based on the execution environment
-  const iterations = 100000;
-
   // Creates a copy of the salt to ensure type compatibility
   const saltBuffer = new Uint8Array(salt).buffer;
 
@@ -246,12 +242,16 @@ async function deriveKeyFallback(password: string, salt: Uint8Array): Promise<Ui
  * @param password - The master password
  * @param salt - Random salt of 16 bytes
  * @param memoryCost - Memory cost in KiB (must match encryption parameters)
+ * @param timeCost - Iterations (must match encryption parameters)
+ * @param parallelism - Lanes, computed one after another since WASM has no threads
  * @returns Derived key of 32 bytes
  */
 async function deriveKeyWithParams(
   password: string,
   salt: Uint8Array,
-  memoryCost: number
+  memoryCost: number,
+  timeCost = 4,
+  parallelism = 1
 ): Promise<Uint8Array> {
   if (salt.length !== 16) {
     throw new Error('Salt must be exactly 16 bytes');
@@ -262,10 +262,7 @@ async function deriveKeyWithParams(
     const argon2 = await loadArgon2Module();
     const passwordBytes = new TextEncoder().encode(password);
 
-    // Fixed parameters - MUST match encryption parameters
-    // NOTE: WebAssembly does not support real threads, so parallelism must be 1
-    const timeCost = 4; // 4 iterations - FIXED
-    const parallelism = 1; // WASM does not support real threads - FIXED
+    // timeCost, memoryCost and parallelism MUST match encryption parameters
     const hashLength = 32; // 32 bytes output - FIXED
 
     // Gets exported functions from WASM
@@ -508,6 +505,52 @@ export async function deriveKeyLegacy(password: string, salt: Uint8Array): Promi
   }
 }
 
+/**
+ * Key derivation parameters as the server stores them per account
+ * (kdf_* fields of /auth/prelogin). Memory and parallelism are 0 for pbkdf2-sha256.
+ */
+export interface KdfParams {
+  kdf: 'argon2id' | 'pbkdf2-sha256';
+  kdf_memory: number;
+  kdf_iterations: number;
+  kdf_parallelism: number;
+}
+
+/**
+ * The parameters deriveKey uses
+ */
+export const DEFAULT_KDF_PARAMS: KdfParams = {
+  kdf: 'argon2id',
+  kdf_memory: 32 * 1024,
+  kdf_iterations: 4,
+  kdf_parallelism: 1,
+};
+
+/**
+ * Derives a key with an account's stored parameters
+ *
+ * Only pbkdf2-sha256 accounts use PBKDF2. Argon2id never falls back to it:
+ * the key would differ, so the login would fail and a new account would
+ * store a PBKDF2 key under Argon2id parameters.
+ *
+ * @param password - The master password
+ * @param salt - Random salt of 16 bytes
+ * @param params - KDF parameters from /auth/prelogin
+ * @returns Derived key of 32 bytes
+ * @throws If params ask for Argon2id and Argon2 is unavailable in this client
+ */
+export async function deriveKeyWithKdf(password: string, salt: Uint8Array, params: KdfParams): Promise<Uint8Array> {
+  if (params.kdf === 'pbkdf2-sha256') {
+    return deriveKeyFallback(password, salt, params.kdf_iterations);
+  }
+  try {
+    return await deriveKeyWithParams(password, salt, params.kdf_memory, params.kdf_iterations, params.kdf_parallelism);
+  } catch (error) {
+    const detail = error instanceof Error ? error.message : String(error);
+    throw new Error(`Argon2 is unavailable in this client, so the master key can't be derived: ${detail}`);
+  }
+}
+
 /**
  * Generates a random salt of 16 bytes
  */
@@ -0,0 +1,68 @@
+import { deriveHKDF } from './hkdf';
+import { DEFAULT_KDF_PARAMS, type KdfParams, deriveKeyWithKdf, generateSalt } from './argon2';
+
+/**
+ * Answer of /auth/prelogin: how to derive the master key and which secret the account logs in with
+ */
+export interface PreloginResponse extends KdfParams {
+  salt: string;
+  auth_scheme: 'password' | 'auth_hash';
+}
+
+function toBase64(bytes: Uint8Array): string {
+  let binary = '';
+  for (const byte of bytes) {
+    binary += String.fromCharCode(byte);
+  }
+  return btoa(binary);
+}
+
+/**
+ * Derives the secret sent to the server at login and registration
+ * The master password never leaves the client; the server only stores a hash of this value
+ *
+ * @param masterKey - 32-byte key from deriveKey(password, salt), the same one that encrypts the vault
+ * @returns Base64 auth hash for the auth_hash field of /auth/login and /auth/register
+ */
+export async function deriveAuthHash(masterKey: Uint8Array): Promise<string> {
+  return toBase64(await deriveHKDF(masterKey, 'guardian-auth-hash'));
+}
+
+/**
+ * Derives the master key and the /auth/login credentials from a prelogin answer
+ *
+ * Accounts still on the password scheme send the password once more along with
+ * the auth hash; the server then switches them to the auth hash.
+ *
+ * @param password - The master password
+ * @param prelogin - Answer of /auth/prelogin for the username
+ * @returns The vault key and the fields to send to /auth/login with the username
+ */
+export async function deriveLoginSecrets(
+  password: string,
+  prelogin: PreloginResponse
+): Promise<{ masterKey: Uint8Array; credentials: { auth_hash: string; password?: string } }> {
+  const salt = Uint8Array.from(atob(prelogin.salt), c => c.charCodeAt(0));
+  const masterKey = await deriveKeyWithKdf(password, salt, prelogin);
+  const authHash = await deriveAuthHash(masterKey);
+  const credentials: { auth_hash: string; password?: string } = { auth_hash: authHash };
+  if (prelogin.auth_scheme === 'password') {
+    credentials.password = password;
+  }
+  return { masterKey, credentials };
+}
+
+/**
+ * Derives the master key of a new account and the /auth/register fields for it
+ *
+ * @param password - The master password
+ * @returns The vault key and the auth_hash, salt and kdf_* fields to send to /auth/register
+ */
+export async function deriveRegistrationSecrets(
+  password: string
+): Promise<{ masterKey: Uint8Array; fields: KdfParams & { auth_hash: string; salt: string } }> {
+  const salt = generateSalt();
+  const masterKey = await deriveKeyWithKdf(password, salt, DEFAULT_KDF_PARAMS);
+  const authHash = await deriveAuthHash(masterKey);
+  return { masterKey, fields: { ...DEFAULT_KDF_PARAMS, auth_hash: authHash, salt: toBase64(salt) } };
+}
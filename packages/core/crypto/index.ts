@@ -12,6 +12,7 @@ export * from "./argon2";
 export * from "./chacha20";
 export * from "./vault";
 export * from "./generator";
+export * from "./auth";
 
 // Exports Argon2 diagnostic functions
 export { isArgon2Available, getArgon2Status } from "./argon2";